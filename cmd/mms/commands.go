@@ -20,12 +20,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/metno/go-mms/pkg/mms"
 	"github.com/nats-io/nats.go"
 	"github.com/urfave/cli/v2"
@@ -38,8 +43,34 @@ func listAllEventsCmd(ctx *cli.Context) error {
 	if ctx.String("production-hub") == "" {
 		return fmt.Errorf("No production-hub specified")
 	}
-	url := ctx.String("production-hub") + "/api/v1/events"
-	newEvents, err := mms.ListProductEvents(url)
+
+	// Parse the flags with the same rules as the events API.
+	query := url.Values{}
+	for flag, param := range map[string]string{
+		"product":       "product",
+		"hub":           "productionHub",
+		"jobname":       "jobName",
+		"since":         "since",
+		"until":         "until",
+		"reftime-since": "refTimeSince",
+		"reftime-until": "refTimeUntil",
+		"order":         "order",
+		"cursor":        "cursor",
+	} {
+		if ctx.String(flag) != "" {
+			query.Set(param, ctx.String(flag))
+		}
+	}
+	if ctx.Int("limit") > 0 {
+		query.Set("limit", strconv.Itoa(ctx.Int("limit")))
+	}
+	filter, err := mms.ParseEventFilter(query)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+
+	apiURL := ctx.String("production-hub") + "/api/v1/events"
+	newEvents, nextCursor, err := mms.ListProductEventsPage(apiURL, filter)
 	if err != nil {
 		return fmt.Errorf("failed to access events: %v", err)
 	}
@@ -47,10 +78,60 @@ func listAllEventsCmd(ctx *cli.Context) error {
 	for _, event := range events {
 		fmt.Printf("Event: %+v\n", event)
 	}
+	if nextCursor != "" {
+		fmt.Fprintf(os.Stderr, "More events available, continue with --cursor %s\n", nextCursor)
+	}
 	return nil
 }
 
+func statusCmd(ctx *cli.Context) error {
+	if ctx.String("production-hub") == "" {
+		return fmt.Errorf("No production-hub specified")
+	}
+	apiURL := ctx.String("production-hub") + "/api/v1/productstatus"
+
+	var statuses []mms.ProductStatus
+	if ctx.String("product") != "" {
+		status, err := mms.GetProductStatus(apiURL, ctx.String("hub"), ctx.String("product"))
+		if err != nil {
+			return fmt.Errorf("failed to get product status: %v", err)
+		}
+		statuses = append(statuses, *status)
+	} else {
+		var err error
+		statuses, err = mms.ListProductStatus(apiURL, mms.ProductState(ctx.String("state")))
+		if err != nil {
+			return fmt.Errorf("failed to get product status: %v", err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRODUCT\tHUB\tSTATE\tLAST EVENT\tNEXT EXPECTED\tDELAY")
+	for _, status := range statuses {
+		lastEvent := "-"
+		if status.LastEvent != nil {
+			lastEvent = time.Time(status.LastEvent.CreatedAt).UTC().Format(mms.DefaultTimeFormat)
+		}
+		nextExpected := "-"
+		delay := "-"
+		if status.NextInstanceExpected != nil {
+			nextExpected = status.NextInstanceExpected.UTC().Format(mms.DefaultTimeFormat)
+			delay = (time.Duration(status.DelaySeconds) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", status.Product, status.ProductionHub, status.State, lastEvent, nextExpected, delay)
+	}
+	return w.Flush()
+}
+
 func subscribeEventsCmd(ctx *cli.Context) error {
+	switch ctx.String("via") {
+	case "nats":
+	case "http":
+		return subscribeHTTPEventsCmd(ctx)
+	default:
+		return fmt.Errorf("unknown --via %q, use nats or http", ctx.String("via"))
+	}
+
 	var natsCreds nats.Option
 
 	if ctx.String("cred-file") == "" {
@@ -58,36 +139,87 @@ func subscribeEventsCmd(ctx *cli.Context) error {
 	} else {
 		natsCreds = nats.UserCredentials(ctx.String("cred-file"))
 	}
-	queueName := ctx.String("queue-name")
+	// The NATS server filters on the production hub and product where it can, the callbacks filter on the rest.
+	filter := mms.EventFilter{ProductionHub: ctx.String("hub"), Product: ctx.String("product")}
+	subject := mms.SubscriptionSubject(ctx.String("queue-name"), filter.ProductionHub, filter.Product)
 	natsLocal := ctx.Bool("nats-local")
-	mmsClient, err := mms.NewNatsConsumerClient(ctx.String("production-hub"), natsCreds, queueName, natsLocal)
+
+	// Consume from JetStream when asked for any of its features, even from a local production hub.
+	consumerConfig := mms.ConsumerConfig{
+		Durable:           ctx.String("durable"),
+		AckWait:           ctx.Duration("ack-wait"),
+		MaxDeliver:        ctx.Int("max-deliver"),
+		DeadLetterSubject: ctx.String("dead-letter-subject"),
+	}
+	if err := consumerConfig.SetStart(ctx.String("start")); err != nil {
+		return err
+	}
+	var consumerConfigs []mms.ConsumerConfig
+	if !natsLocal || ctx.IsSet("durable") || ctx.IsSet("start") || ctx.IsSet("ack-wait") ||
+		ctx.IsSet("max-deliver") || ctx.IsSet("dead-letter-subject") {
+		consumerConfigs = append(consumerConfigs, consumerConfig)
+	}
+
+	mmsClient, err := mms.NewNatsConsumerClient(ctx.String("production-hub"), natsCreds, subject, natsLocal, consumerConfigs...)
 	if err != nil {
 		return fmt.Errorf("one hub event subscription failed, ending: %v", err)
 	}
 
+	var callback mms.ProductEventCallback
 	if ctx.String("command") != "None" {
-		callback := createExecutableCallback(ctx.String("command"), ctx.Bool("args"), ctx.String("product"))
-		mmsClient.WatchProductEvents(callback)
+		callback = createExecutableCallback(ctx.String("command"), ctx.Bool("args"), filter)
 	} else {
 		// Same as Aviso-echo
-		mmsClient.WatchProductEvents(productReceiver(ctx.String("product")))
+		callback = productReceiver(filter)
+	}
+
+	// Stop receiving and close the NATS connection on interrupt.
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sub, err := mmsClient.Subscribe(sigCtx, callback)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to events: %v", err)
+	}
+	if err := sub.Wait(); err != nil {
+		return fmt.Errorf("subscription ended: %v", err)
 	}
 
 	return nil
 }
 
+// subscribeHTTPEventsCmd receives events from the event stream of mmsd, for clients that can not reach NATS.
+func subscribeHTTPEventsCmd(ctx *cli.Context) error {
+	if ctx.String("production-hub") == "" {
+		return fmt.Errorf("No production-hub specified")
+	}
+
+	// The stream is filtered by mmsd, so the callbacks do not filter again.
+	var callback mms.ProductEventCallback
+	if ctx.String("command") != "None" {
+		callback = createExecutableCallback(ctx.String("command"), ctx.Bool("args"), mms.EventFilter{})
+	} else {
+		callback = productReceiver(mms.EventFilter{})
+	}
+	filter := mms.EventFilter{ProductionHub: ctx.String("hub"), Product: ctx.String("product")}
+
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	streamURL := ctx.String("production-hub") + "/api/v1/events/stream"
+	return mms.StreamProductEvents(sigCtx, streamURL, filter, callback)
+}
+
 func postEventCmd(ctx *cli.Context) error {
-	var err error
-	refTime := time.Now()
-	if ctx.String("reftime") != "now" {
-		refTime, err = time.Parse(mms.DefaultTimeFormat, ctx.String("reftime"))
-		if err != nil {
-			log.Println("Could not parse reftime")
-			log.Println("Please use RFC 3339 format:")
-			log.Println("- '2006-01-02T15:04:05Z' for UTC")
-			log.Println("- '2006-01-02T15:04:05+01:00' for other time zones")
-			log.Fatalf("Parser error: %v", err)
-		}
+	if ctx.String("from-file") != "" {
+		return postEventsFromFileCmd(ctx)
+	}
+
+	// Whole seconds, as subscribers with older versions of mms only parse times without fractional seconds.
+	now := time.Now().Truncate(time.Second)
+	refTime, err := mms.ParseRelativeTime(ctx.String("reftime"), now)
+	if err != nil {
+		return fmt.Errorf("invalid --reftime: %v", err)
 	}
 	productEvent := mms.ProductEvent{
 		JobName:         ctx.String("jobname"),
@@ -97,11 +229,29 @@ func postEventCmd(ctx *cli.Context) error {
 		Counter:         ctx.Int("counter"),
 		TotalCount:      ctx.Int("ntotal"),
 		RefTime:         mms.PEventTime(refTime),
-		CreatedAt:       mms.PEventTime(time.Now()),
-		NextEventAt:     mms.PEventTime(time.Now().Add(time.Second * time.Duration(ctx.Int("event-interval")))),
+		CreatedAt:       mms.PEventTime(now),
+		NextEventAt:     mms.PEventTime(now.Add(time.Second * time.Duration(ctx.Int("event-interval")))),
 		MMD:             ctx.String("MMD"),
 	}
 
+	if err := setOptionalEventFields(ctx, &productEvent); err != nil {
+		return err
+	}
+
+	if ctx.Bool("deterministic-id") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(ctx.String("reftime"))), "now") {
+			return fmt.Errorf("--deterministic-id needs an explicit --reftime, the time now differs when the job is retried")
+		}
+		productEvent.EventID = productEvent.DeterministicID()
+	}
+	if ctx.String("idempotency-key") != "" {
+		productEvent.EventID = ctx.String("idempotency-key")
+	}
+	// With an id, retried and spooled posts are only published once.
+	if productEvent.EventID == "" {
+		productEvent.EventID = uuid.New().String()
+	}
+
 	if ctx.String("production-hub") == "" {
 		return fmt.Errorf("No production-hub specified")
 	}
@@ -111,17 +261,180 @@ func postEventCmd(ctx *cli.Context) error {
 		queueName = "mms"
 	}
 
-	err = mms.PostProductEvent(ctx.String("production-hub"), ctx.String("api-key"), queueName, &productEvent, ctx.Bool("insecure"))
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.String("spool-dir") == "" {
+		if _, err := client.PostProductEvent(ctx.Context, queueName, &productEvent); err != nil {
+			return fmt.Errorf("Posting ProductEvent failed: %v", err)
+		}
+		return nil
+	}
+
+	spool, err := openSpool(ctx)
+	if err != nil {
+		return err
+	}
+	spooled, err := spool.Post(ctx.Context, client, queueName, &productEvent)
 	if err != nil {
 		return fmt.Errorf("Posting ProductEvent failed: %v", err)
 	}
+	if spooled {
+		log.Printf("production hub not reachable, event %s is spooled in %s, post it with mms spool flush", productEvent.EventID, spool.Dir())
+	}
+	return nil
+}
+
+// postEventsFromFileCmd posts the events in a file, or on stdin, in batches.
+func postEventsFromFileCmd(ctx *cli.Context) error {
+	input := os.Stdin
+	if ctx.String("from-file") != "-" {
+		file, err := os.Open(ctx.String("from-file"))
+		if err != nil {
+			return fmt.Errorf("failed to open events file: %v", err)
+		}
+		defer file.Close()
+		input = file
+	}
+	events, err := mms.ReadProductEvents(input)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("no events in %s", ctx.String("from-file"))
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for _, pEvent := range events {
+		if pEvent.ProductionHub == "" {
+			pEvent.ProductionHub = ctx.String("production-hub")
+		}
+		if time.Time(pEvent.CreatedAt).IsZero() {
+			pEvent.CreatedAt = mms.PEventTime(now)
+		}
+		if pEvent.EventID == "" && ctx.Bool("deterministic-id") {
+			pEvent.EventID = pEvent.DeterministicID()
+		}
+	}
+
+	queueName := ctx.String("queue-name")
+	if queueName == "" {
+		queueName = mms.DefaultSubjectPrefix
+	}
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.String("spool-dir") == "" {
+		return postEventBatches(ctx, client, queueName, events)
+	}
+
+	spool, err := openSpool(ctx)
+	if err != nil {
+		return err
+	}
+	spooled, err := spool.PostBatch(ctx.Context, client, queueName, events)
+	if err != nil {
+		return fmt.Errorf("Posting ProductEvents failed: %v", err)
+	}
+	if spooled > 0 {
+		log.Printf("production hub not reachable, %d of %d events are spooled in %s, post them with mms spool flush", spooled, len(events), spool.Dir())
+	}
+	fmt.Printf("Posted %d events\n", len(events)-spooled)
+	return nil
+}
+
+// postEventBatches posts events in batches of at most mms.MaxBatchEvents, and tells which events the production hub rejects.
+func postEventBatches(ctx *cli.Context, client *mms.Client, queueName string, events []*mms.ProductEvent) error {
+	posted := 0
+	for start := 0; start < len(events); start += mms.MaxBatchEvents {
+		end := start + mms.MaxBatchEvents
+		if end > len(events) {
+			end = len(events)
+		}
+		for _, pEvent := range events[start:end] {
+			if pEvent.EventID == "" {
+				pEvent.EventID = uuid.New().String()
+			}
+		}
+
+		results, err := client.PostProductEvents(ctx.Context, queueName, events[start:end])
+		for i, result := range results {
+			if result.Error != "" {
+				log.Printf("event %d is rejected: %s", start+i+1, result.Error)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Posting ProductEvents failed after posting %d of %d events: %v", posted, len(events), err)
+		}
+		posted += end - start
+	}
+	fmt.Printf("Posted %d events\n", posted)
+	return nil
+}
+
+// newHubClient creates a client of the production hub REST API from the post and spool flags.
+func newHubClient(ctx *cli.Context) (*mms.Client, error) {
+	if ctx.String("production-hub") == "" {
+		return nil, fmt.Errorf("No production-hub specified")
+	}
+	return mms.NewClient(ctx.String("production-hub"), mms.ClientConfig{
+		APIKey:    ctx.String("api-key"),
+		Insecure:  ctx.Bool("insecure"),
+		Retries:   ctx.Int("retries"),
+		RetryWait: ctx.Duration("retry-wait"),
+	})
+}
 
+// setOptionalEventFields sets the optional fields of productEvent from the post flags.
+func setOptionalEventFields(ctx *cli.Context, productEvent *mms.ProductEvent) error {
+	productEvent.Checksum = ctx.String("checksum")
+	productEvent.Size = ctx.Int64("size")
+	productEvent.MediaType = ctx.String("media-type")
+
+	coverage := mms.Coverage{}
+	if ctx.String("bbox") != "" {
+		bbox, err := mms.ParseBoundingBox(ctx.String("bbox"))
+		if err != nil {
+			return err
+		}
+		coverage.BoundingBox = bbox
+	}
+	for flag, dst := range map[string]**mms.PEventTime{
+		"coverage-start": &coverage.Start,
+		"coverage-end":   &coverage.End,
+	} {
+		if ctx.String(flag) == "" {
+			continue
+		}
+		t, err := mms.ParseRelativeTime(ctx.String(flag), time.Now().Truncate(time.Second))
+		if err != nil {
+			return fmt.Errorf("invalid --%s: %v", flag, err)
+		}
+		pt := mms.PEventTime(t)
+		*dst = &pt
+	}
+	if coverage != (mms.Coverage{}) {
+		productEvent.Coverage = &coverage
+	}
+
+	for _, attribute := range ctx.StringSlice("attribute") {
+		key, value, found := strings.Cut(attribute, "=")
+		if !found || key == "" {
+			return fmt.Errorf("invalid --attribute %q, use key=value", attribute)
+		}
+		if productEvent.Attributes == nil {
+			productEvent.Attributes = map[string]string{}
+		}
+		productEvent.Attributes[key] = value
+	}
 	return nil
 }
 
-func productReceiver(product string) func(event *mms.ProductEvent) error {
+func productReceiver(filter mms.EventFilter) func(event *mms.ProductEvent) error {
 	return func(event *mms.ProductEvent) error {
-		if product != "" && event.Product != product {
+		if !filter.Matches(event) {
 			return nil
 		}
 
@@ -136,9 +449,9 @@ func productReceiver(product string) func(event *mms.ProductEvent) error {
 	}
 }
 
-// createExecutableCallback generate a callback that filter on product and call the command at filepath.
+// createExecutableCallback generate a callback that filter the events, and call the command at filepath.
 // The command gets the product-location as first argument and the complete serialized event as the env variable MMS_EVENT.
-func createExecutableCallback(filepath string, args bool, product string) func(event *mms.ProductEvent) error {
+func createExecutableCallback(filepath string, args bool, filter mms.EventFilter) func(event *mms.ProductEvent) error {
 	_, err := exec.LookPath(filepath)
 
 	if err != nil {
@@ -148,8 +461,8 @@ func createExecutableCallback(filepath string, args bool, product string) func(e
 	return func(event *mms.ProductEvent) error {
 		var productLocation string
 
-		// Ignore events not matching product filter, if set.
-		if product != "" && event.Product != product {
+		// Ignore events not matching the filter.
+		if !filter.Matches(event) {
 			return nil
 		}
 
@@ -185,9 +498,312 @@ func eventAsEnvVariables(event *mms.ProductEvent) ([]string, error) {
 	if err != nil {
 		return []string{}, fmt.Errorf("failed to serialie product event to env vars: %s", err)
 	}
+	if event.Coverage != nil {
+		coverageEnvSet, err := env.Marshal(event.Coverage)
+		if err != nil {
+			return []string{}, fmt.Errorf("failed to serialie product event coverage to env vars: %s", err)
+		}
+		for name, value := range coverageEnvSet {
+			envSet[name] = value
+		}
+	}
+	if len(event.Attributes) > 0 {
+		attributes, err := json.Marshal(event.Attributes)
+		if err != nil {
+			return []string{}, fmt.Errorf("failed to serialie product event attributes: %s", err)
+		}
+		envSet["MMS_PRODUCT_EVENT_ATTRIBUTES"] = string(attributes)
+		for key, value := range event.Attributes {
+			envSet["MMS_PRODUCT_EVENT_ATTRIBUTE_"+envName(key)] = value
+		}
+	}
+
 	var envVars []string
 	for name, value := range envSet {
 		envVars = append(envVars, fmt.Sprintf("%s=%s", name, value))
 	}
 	return envVars, nil
 }
+
+// envName makes an attribute key usable in an environment variable name: upper case, with other characters than letters and digits as _.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+func dlqCredentials(ctx *cli.Context) nats.Option {
+	if ctx.String("cred-file") == "" {
+		return nil
+	}
+	return nats.UserCredentials(ctx.String("cred-file"))
+}
+
+func listDeadLettersCmd(ctx *cli.Context) error {
+	if ctx.String("production-hub") == "" {
+		return fmt.Errorf("No production-hub specified")
+	}
+
+	deadLetters, err := mms.ListDeadLetters(ctx.String("production-hub"), dlqCredentials(ctx), ctx.String("dead-letter-subject"))
+	if err != nil {
+		return fmt.Errorf("failed to list dead letters: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tSUBJECT\tPRODUCT\tDELIVERIES\tERROR")
+	for _, dl := range deadLetters {
+		product := "-"
+		if dl.Event != nil {
+			product = dl.Event.Product
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", dl.Sequence, dl.Time.UTC().Format(mms.DefaultTimeFormat), dl.Subject, product, dl.Deliveries, dl.Error)
+	}
+	return w.Flush()
+}
+
+func replayDeadLettersCmd(ctx *cli.Context) error {
+	if ctx.String("production-hub") == "" {
+		return fmt.Errorf("No production-hub specified")
+	}
+
+	var sequences []uint64
+	for _, seq := range ctx.Int64Slice("seq") {
+		if seq <= 0 {
+			return fmt.Errorf("invalid sequence number %d", seq)
+		}
+		sequences = append(sequences, uint64(seq))
+	}
+	if len(sequences) == 0 && !ctx.Bool("all") {
+		return fmt.Errorf("specify the dead letters to replay with --seq, or use --all")
+	}
+
+	replayed, err := mms.ReplayDeadLetters(ctx.String("production-hub"), dlqCredentials(ctx), ctx.String("dead-letter-subject"), sequences)
+	for _, dl := range replayed {
+		fmt.Printf("Replayed %d to %s\n", dl.Sequence, dl.Subject)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replay dead letters: %v", err)
+	}
+	return nil
+}
+
+// openSpool opens the spool given by the spool-dir flag.
+func openSpool(ctx *cli.Context) (*mms.Spool, error) {
+	if ctx.String("spool-dir") == "" {
+		return nil, fmt.Errorf("No spool-dir specified")
+	}
+	return mms.NewSpool(ctx.String("spool-dir"))
+}
+
+func listSpoolCmd(ctx *cli.Context) error {
+	spool, err := openSpool(ctx)
+	if err != nil {
+		return err
+	}
+	spooled, err := spool.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SPOOLED\tQUEUE\tPRODUCT\tEVENT ID\tERROR")
+	for _, spooledEvent := range spooled {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", spooledEvent.SpooledAt.Format(mms.DefaultTimeFormat), spooledEvent.QueueName,
+			spooledEvent.Event.Product, spooledEvent.Event.EventID, spooledEvent.Error)
+	}
+	return w.Flush()
+}
+
+func flushSpoolCmd(ctx *cli.Context) error {
+	spool, err := openSpool(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	posted, err := spool.Flush(ctx.Context, client)
+	fmt.Printf("Posted %d spooled events\n", posted)
+	return err
+}
+
+func spoolDaemonCmd(ctx *cli.Context) error {
+	spool, err := openSpool(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.Duration("interval") <= 0 {
+		return fmt.Errorf("invalid --interval %s", ctx.Duration("interval"))
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("flushing %s every %s", spool.Dir(), ctx.Duration("interval"))
+	spool.Run(sigCtx, client, ctx.Duration("interval"))
+	return nil
+}
+
+func listKeysCmd(ctx *cli.Context) error {
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := client.ListAPIKeys(ctx.Context)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY ID\tCREATED\tLAST USED\tEXPIRES\tMESSAGE\tSCOPE")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.CreatedDate, orDefault(key.LastUsed, "never"), orDefault(key.Expires, "never"),
+			key.Message, formatScope(key.Scope))
+	}
+	return w.Flush()
+}
+
+func generateKeyCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 0 {
+		return fmt.Errorf("a generated key takes no arguments, use keys add to add a given key")
+	}
+	return createKey(ctx, "")
+}
+
+func addKeyCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("give the key to add")
+	}
+	return createKey(ctx, ctx.Args().First())
+}
+
+// createKey adds apiKey to the production hub, or a generated key if apiKey is empty.
+func createKey(ctx *cli.Context, apiKey string) error {
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	newKey := mms.NewAPIKey{Key: apiKey, Message: ctx.String("message"), Expires: ctx.String("expires")}
+	if ctx.IsSet("scope") {
+		if newKey.Scope, err = parseScopeFlags(ctx.StringSlice("scope")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("rate-limit") {
+		newKey.RateLimit = &mms.APIKeyRateLimit{Rate: ctx.Float64("rate-limit"), Burst: ctx.Int("rate-burst")}
+	}
+
+	key, err := client.AddAPIKey(ctx.Context, newKey)
+	if err != nil {
+		return err
+	}
+	printKey(key)
+	return nil
+}
+
+func revokeKeyCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("give the id of the key to revoke")
+	}
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.RevokeAPIKey(ctx.Context, ctx.Args().First()); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked key %s\n", ctx.Args().First())
+	return nil
+}
+
+func rotateKeyCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("give the id of the key to rotate")
+	}
+	client, err := newHubClient(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := client.RotateAPIKey(ctx.Context, ctx.Args().First(), ctx.Duration("grace"))
+	if err != nil {
+		return err
+	}
+	printKey(key)
+	fmt.Printf("Key %s stops working within %s\n", ctx.Args().First(), ctx.Duration("grace"))
+	return nil
+}
+
+func printKey(key *mms.APIKey) {
+	if key.Key != "" {
+		fmt.Printf("Key:     %s\n", key.Key)
+	}
+	fmt.Printf("Key ID:  %s\n", key.ID)
+	fmt.Printf("Message: %s\n", key.Message)
+	fmt.Printf("Scope:   %s\n", formatScope(key.Scope))
+	fmt.Printf("Expires: %s\n", orDefault(key.Expires, "never"))
+	if key.RateLimit != nil {
+		if key.RateLimit.Rate == 0 {
+			fmt.Printf("Rate:    unlimited\n")
+		} else {
+			fmt.Printf("Rate:    %g/s, burst %d\n", key.RateLimit.Rate, key.RateLimit.Burst)
+		}
+	}
+}
+
+// parseScopeFlags parses scopes given as kind=pattern, where kind is role, queue, hub or product.
+func parseScopeFlags(scopes []string) (*mms.APIKeyScope, error) {
+	scope := mms.APIKeyScope{}
+	for _, s := range scopes {
+		kind, value, found := strings.Cut(s, "=")
+		if !found || value == "" {
+			return nil, fmt.Errorf("invalid --scope %q, use role=, queue=, hub= or product=", s)
+		}
+		switch kind {
+		case "role":
+			scope.Roles = append(scope.Roles, value)
+		case "queue":
+			scope.QueueNames = append(scope.QueueNames, value)
+		case "hub":
+			scope.Hubs = append(scope.Hubs, value)
+		case "product":
+			scope.Products = append(scope.Products, value)
+		default:
+			return nil, fmt.Errorf("invalid --scope %q, use role=, queue=, hub= or product=", s)
+		}
+	}
+	return &scope, nil
+}
+
+// formatScope gives the scope in the form of the --scope flags.
+func formatScope(scope mms.APIKeyScope) string {
+	var parts []string
+	for _, p := range []struct {
+		kind   string
+		values []string
+	}{{"role", scope.Roles}, {"queue", scope.QueueNames}, {"hub", scope.Hubs}, {"product", scope.Products}} {
+		for _, value := range p.values {
+			parts = append(parts, p.kind+"="+value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func orDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
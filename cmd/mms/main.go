@@ -19,7 +19,9 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
+	"github.com/metno/go-mms/pkg/mms"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
 )
@@ -34,12 +36,78 @@ func run(args []string) error {
 			Name:  "production-hub", // HTTP
 			Usage: "The production hub URL.",
 		},
+		&cli.StringFlag{
+			Name:  "product",
+			Usage: "Only list events for this product. '*' matches any characters.",
+		},
+		&cli.StringFlag{
+			Name:  "hub",
+			Usage: "Only list events from this production hub name. '*' matches any characters.",
+		},
+		&cli.StringFlag{
+			Name:  "jobname",
+			Usage: "Only list events from this job. '*' matches any characters.",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only list events created at or after this time (RFC3339, or relative such as today-1d).",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Only list events created before this time (RFC3339, or relative such as today-1d).",
+		},
+		&cli.StringFlag{
+			Name:  "reftime-since",
+			Usage: "Only list events with a reference time at or after this time (RFC3339, or relative such as today-1d).",
+		},
+		&cli.StringFlag{
+			Name:  "reftime-until",
+			Usage: "Only list events with a reference time before this time (RFC3339, or relative such as today-1d).",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of events to list. 0 lists all matching events.",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "order",
+			Usage: "Sort order by creation time, asc or desc.",
+			Value: "asc",
+		},
+		&cli.StringFlag{
+			Name:  "cursor",
+			Usage: "Continue listing from the cursor printed by a previous, limited listing.",
+		},
+	}
+
+	statusFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "production-hub", // HTTP
+			Usage: "The production hub URL.",
+		},
+		&cli.StringFlag{
+			Name:  "product",
+			Usage: "Only show the status of this product.",
+		},
+		&cli.StringFlag{
+			Name:  "hub",
+			Usage: "Production hub of the product given with --product, needed if the product comes from several production hubs.",
+		},
+		&cli.StringFlag{
+			Name:  "state",
+			Usage: "Only show products in this state: on-time, late, overdue or unknown.",
+		},
 	}
 
 	subscriptionFlags := []cli.Flag{
 		&cli.StringFlag{
-			Name:  "production-hub", // NATS
-			Usage: "The production hub NATS URL.",
+			Name:  "production-hub", // NATS or HTTP
+			Usage: "The production hub NATS URL, or the HTTP URL when subscribing via http.",
+		},
+		&cli.StringFlag{
+			Name:  "via",
+			Usage: "How to receive events: nats, or http for the Server-Sent Events stream of mmsd.",
+			Value: "nats",
 		},
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    "command",
@@ -53,9 +121,14 @@ func run(args []string) error {
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    "product",
-			Usage:   "Name of the product.",
+			Usage:   "Name of the product, or a pattern such as 'arome_*'.",
 			EnvVars: []string{"MMS_PRODUCT"},
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "hub",
+			Usage:   "Name of the production hub the events come from, or a pattern such as 'ppi-*'.",
+			EnvVars: []string{"MMS_HUB"},
+		}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{
 			Name:  "args",
 			Usage: "Toggles sending of productLocation as arg[1] in executable",
@@ -63,7 +136,8 @@ func run(args []string) error {
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    "queue-name",
-			Usage:   "Name of NATS subject (queue) to subscribe to",
+			Usage:   "Prefix of the NATS subjects (queue) to subscribe to. Events are received on <queue-name>.<hub>.<product>.",
+			Value:   mms.DefaultSubjectPrefix,
 			EnvVars: []string{"MMS_QUEUE"},
 		}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{
@@ -71,6 +145,72 @@ func run(args []string) error {
 			Usage: "Specify wether this MMS instance will connect to NATS-server (True) or connect to an existing NATS stream",
 			Value: true,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "durable",
+			Usage:   "Name of a durable JetStream consumer. After a restart, events are received from where the previous run stopped.",
+			EnvVars: []string{"MMS_DURABLE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "start",
+			Usage: "Where a new JetStream consumer starts: all, new, last-per-subject, a stream sequence number, an RFC3339 time or a duration back in time. Default is 12h.",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "ack-wait",
+			Usage: "How long JetStream waits for the command to finish before delivering the event again.",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "max-deliver",
+			Usage: "How many times an event is delivered to a failing command before it is moved to the dead-letter subject. Default is 5, -1 retries forever.",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "dead-letter-subject",
+			Usage: "Subject for events the command failed to handle.",
+			Value: mms.DefaultDeadLetterSubject,
+		}),
+	}
+
+	dlqFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "production-hub", // NATS
+			Usage: "The production hub NATS URL.",
+		},
+		&cli.StringFlag{
+			Name:  "cred-file",
+			Usage: "File-path to credfile for NATS",
+		},
+		&cli.StringFlag{
+			Name:  "dead-letter-subject",
+			Usage: "Subject of the dead letters.",
+			Value: mms.DefaultDeadLetterSubject,
+		},
+	}
+
+	// Flags of the commands posting to the production hub REST API.
+	hubClientFlags := []cli.Flag{
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    "retries",
+			Usage:   "Number of times a post is retried when the production hub can not be reached or is temporarily failing.",
+			EnvVars: []string{"MMS_RETRIES"},
+			Value:   mms.DefaultPostRetries,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    "retry-wait",
+			Usage:   "Wait before the first retry, doubled for each retry, with random jitter.",
+			EnvVars: []string{"MMS_RETRY_WAIT"},
+			Value:   mms.DefaultClientRetryWait,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "spool-dir",
+			Usage:   "Directory keeping events that could not be posted after the retries, e.g. ~/.cache/mms/spool, until mms spool flush posts them. mms post then succeeds. Events are not spooled if not set.",
+			EnvVars: []string{"MMS_SPOOL_DIR"},
+		}),
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Usage:   "Load configuration from file.",
+			EnvVars: []string{"MMS_CONFIG"},
+			Value:   confFile,
+		},
 	}
 
 	postFlags := []cli.Flag{
@@ -86,7 +226,7 @@ func run(args []string) error {
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    "queue-name",
-			Usage:   "Nats queue (Subject) to post to.",
+			Usage:   "Prefix of the NATS subject (queue) to post to. The event is published on <queue-name>.<production-hub>.<product>.",
 			EnvVars: []string{"MMS_QUEUE"},
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
@@ -111,7 +251,7 @@ func run(args []string) error {
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "reftime",
-			Usage: "The event reference time in RFC3339 format ('2006-01-02T15:04:05Z' or '2006-01-02T15:04:05+01:00').",
+			Usage: "The event reference time in RFC3339 or ISO 8601 format ('2006-01-02T15:04:05Z', '2006-01-02T15:04:05+01:00' or '2006-01-02'), or relative to now such as 'today+06h' or 'now-1h'.",
 			Value: "now",
 		}),
 		altsrc.NewIntFlag(&cli.IntFlag{
@@ -132,6 +272,93 @@ func run(args []string) error {
 			Usage:   "The total number of events to expect for this series of connected events.",
 			Value:   1,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "checksum",
+			Usage:   "Checksum of the product as <algorithm>:<hex digest>, e.g. sha256:9f86d0...",
+			EnvVars: []string{"MMS_CHECKSUM"},
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    "size",
+			Usage:   "Size of the product in bytes.",
+			EnvVars: []string{"MMS_SIZE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "media-type",
+			Usage:   "Media type of the product, e.g. application/x-netcdf.",
+			EnvVars: []string{"MMS_MEDIA_TYPE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "bbox",
+			Usage:   "Geographic coverage of the product in degrees, as west,south,east,north.",
+			EnvVars: []string{"MMS_BBOX"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "coverage-start",
+			Usage:   "Start of the time coverage of the product, in the same formats as --reftime.",
+			EnvVars: []string{"MMS_COVERAGE_START"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "coverage-end",
+			Usage:   "End of the time coverage of the product, in the same formats as --reftime.",
+			EnvVars: []string{"MMS_COVERAGE_END"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    "attribute",
+			Aliases: []string{"a"},
+			Usage:   "Custom attribute of the event as key=value. Can be repeated.",
+			EnvVars: []string{"MMS_ATTRIBUTES"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "idempotency-key",
+			Usage:   "Unique id of the event. The production hub only stores and publishes the first event posted with an id.",
+			EnvVars: []string{"MMS_IDEMPOTENCY_KEY"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    "deterministic-id",
+			Usage:   "Derive the event id from production hub, product, reftime, counter and product location, so a retried job does not post the event twice. Needs an explicit reftime.",
+			EnvVars: []string{"MMS_DETERMINISTIC_ID"},
+		}),
+		&cli.StringFlag{
+			Name:  "from-file",
+			Usage: "Post the events in this file, as a JSON array or one JSON event per line, in batches. Use - to read them from stdin. The flags describing a single event are not used.",
+		},
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "Accept invalid certificates, useful for testing with self-signed ones.",
+			Value: false,
+		}),
+	}
+	postFlags = append(postFlags, hubClientFlags...)
+
+	spoolFlags := append([]cli.Flag{
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "api-key",
+			Usage:   "The authorized API key.",
+			EnvVars: []string{"MMS_API_KEY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "production-hub", // HTTP
+			Usage:   "The production hub URL.",
+			EnvVars: []string{"MMS_PRODUCTION_HUB"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "Accept invalid certificates, useful for testing with self-signed ones.",
+			Value: false,
+		}),
+	}, hubClientFlags...)
+
+	keysFlags := []cli.Flag{
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "api-key",
+			Usage:   "An API key with the admin role.",
+			EnvVars: []string{"MMS_API_KEY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "production-hub", // HTTP
+			Usage:   "The production hub URL.",
+			EnvVars: []string{"MMS_PRODUCTION_HUB"},
+		}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{
 			Name:  "insecure",
 			Usage: "Accept invalid certificates, useful for testing with self-signed ones.",
@@ -145,6 +372,30 @@ func run(args []string) error {
 			Value:   confFile,
 		},
 	}
+	addKeyFlags := append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "A descriptive message for the key.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "scope",
+			Usage: "Restrict the key to `KIND=PATTERN`, where KIND is role (write or admin), queue, hub or product. Patterns may contain '*'. May be repeated.",
+		},
+		&cli.StringFlag{
+			Name:  "expires",
+			Usage: "Make the key stop working at `TIME`, e.g. 2022-01-01 or now+90d.",
+		},
+		&cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "Events per second that may be posted with the key, instead of the default of the production hub. 0 for no limit.",
+		},
+		&cli.IntFlag{
+			Name:  "rate-burst",
+			Usage: "Events that may be posted at once with the key, above --rate-limit.",
+			Value: 1,
+		},
+	}, keysFlags...)
 
 	app := &cli.App{
 		Name:  "mms",
@@ -157,6 +408,12 @@ func run(args []string) error {
 				Flags:   listFlags,
 				Action:  listAllEventsCmd,
 			},
+			{
+				Name:   "status",
+				Usage:  "Show whether products arrived when expected.",
+				Flags:  statusFlags,
+				Action: statusCmd,
+			},
 			{
 				Name:    "subscribe",
 				Aliases: []string{"s"},
@@ -164,21 +421,123 @@ func run(args []string) error {
 				Flags:   subscriptionFlags,
 				Action:  subscribeEventsCmd,
 			},
+			{
+				Name:  "dlq",
+				Usage: "Inspect and replay events that subscribers failed to handle.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the dead letters.",
+						Flags:  dlqFlags,
+						Action: listDeadLettersCmd,
+					},
+					{
+						Name:  "replay",
+						Usage: "Publish dead letters again on their original subject.",
+						Flags: append([]cli.Flag{
+							&cli.Int64SliceFlag{
+								Name:  "seq",
+								Usage: "Sequence number of a dead letter to replay, as shown by dlq list. Can be repeated.",
+							},
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "Replay all dead letters.",
+							},
+						}, dlqFlags...),
+						Action: replayDeadLettersCmd,
+					},
+				},
+			},
+			{
+				Name:  "spool",
+				Usage: "Post the events that mms post could not deliver to the production hub.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the spooled events, oldest first.",
+						Before: loadConfig(spoolFlags),
+						Flags:  spoolFlags,
+						Action: listSpoolCmd,
+					},
+					{
+						Name:   "flush",
+						Usage:  "Post the spooled events in order, stopping at the first one that still can not be posted.",
+						Before: loadConfig(spoolFlags),
+						Flags:  spoolFlags,
+						Action: flushSpoolCmd,
+					},
+					{
+						Name:   "daemon",
+						Usage:  "Flush the spool regularly until stopped.",
+						Before: loadConfig(spoolFlags),
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "interval",
+								Usage: "Time between flushes.",
+								Value: time.Minute,
+							},
+						}, spoolFlags...),
+						Action: spoolDaemonCmd,
+					},
+				},
+			},
+			{
+				Name:  "keys",
+				Usage: "Manage the API keys of a production hub, using an API key with the admin role.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the API keys, without the keys themselves.",
+						Before: loadConfig(keysFlags),
+						Flags:  keysFlags,
+						Action: listKeysCmd,
+					},
+					{
+						Name:   "gen",
+						Usage:  "Generate a new API key.",
+						Before: loadConfig(addKeyFlags),
+						Flags:  addKeyFlags,
+						Action: generateKeyCmd,
+					},
+					{
+						Name:      "add",
+						Usage:     "Add an API key.",
+						ArgsUsage: "KEY",
+						Before:    loadConfig(addKeyFlags),
+						Flags:     addKeyFlags,
+						Action:    addKeyCmd,
+					},
+					{
+						Name:      "revoke",
+						Usage:     "Remove an API key.",
+						ArgsUsage: "KEY-ID",
+						Before:    loadConfig(keysFlags),
+						Flags:     keysFlags,
+						Action:    revokeKeyCmd,
+					},
+					{
+						Name:      "rotate",
+						Usage:     "Generate a new API key with the message and scope of a key, and make the old key stop working after a grace period.",
+						ArgsUsage: "KEY-ID",
+						Before:    loadConfig(keysFlags),
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "grace",
+								Usage: "How long the old key keeps working.",
+								Value: 24 * time.Hour,
+							},
+						}, keysFlags...),
+						Action: rotateKeyCmd,
+					},
+				},
+			},
 			{
 				Name:    "post",
 				Aliases: []string{"p"},
 				Usage:   "Post a message about a product update.",
-				Before: func(ctx *cli.Context) error {
-					inputSource, err := altsrc.NewYamlSourceFromFile(ctx.String("config"))
-					if err != nil {
-						// If there is no file, just return without error
-						return nil
-					}
-
-					return altsrc.ApplyInputSourceValues(ctx, inputSource, postFlags)
-				},
-				Flags:  postFlags,
-				Action: postEventCmd,
+				Before:  loadConfig(postFlags),
+				Flags:   postFlags,
+				Action:  postEventCmd,
 			},
 		},
 	}
@@ -192,3 +551,16 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// loadConfig sets the flags not given on the command line from the YAML file given by the config flag.
+func loadConfig(flags []cli.Flag) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		inputSource, err := altsrc.NewYamlSourceFromFile(ctx.String("config"))
+		if err != nil {
+			// If there is no file, just return without error
+			return nil
+		}
+
+		return altsrc.ApplyInputSourceValues(ctx, inputSource, flags)
+	}
+}
@@ -19,13 +19,12 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/metno/go-mms/internal/server"
@@ -52,6 +51,7 @@ const confFile = "mmsd_config.yml"
 const dbEventsFile = "events.db"
 const dbStateFile = "state.db"
 const dbJWTFile = "jwt.db"
+const jetStreamDir = "jetstream"
 
 func main() {
 
@@ -139,11 +139,98 @@ func main() {
 			Usage: "Specify the interval for sending heartbeats. Turn off with 0 or negative value",
 			Value: 10,
 		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "stream-subjects",
+			Usage: "Subjects stored in the JetStream stream of the local NATS server. Events can only be posted with a Queue-Name matching one of them. Keep the dead-letter subject of subscribers in the list.",
+			Value: cli.NewStringSlice("mms", "mms.>", mms.DefaultDeadLetterSubject),
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "legacy-subjects",
+			Usage: "Also publish events on the Queue-Name itself, besides <queue-name>.<production-hub>.<product>, for subscribers of earlier versions. Turn off once they are upgraded.",
+			Value: true,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "public-subjects",
+			Usage: "Subject trees anonymous users of the local NATS server may receive events from, e.g. mms.*.arome_arctic. Default is the stream subjects.",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "stream-max-age",
+			Usage: "How long the local NATS server keeps events for replay. 0 keeps them until stream-max-bytes is reached.",
+			Value: 24 * time.Hour,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "stream-duplicate-window",
+			Usage: "How long the local NATS server remembers event ids, to drop events that are posted again. Must not be longer than stream-max-age.",
+			Value: 2 * time.Hour,
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "stream-max-bytes",
+			Usage: "Maximum size in bytes of the events kept by the local NATS server. The oldest events are removed first. -1 for no limit.",
+			Value: 1 << 30,
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:  "key-rate-limit",
+			Usage: "Events per second that may be posted with each API key, unless the key has its own limit. 0 for no limit.",
+			Value: 100,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "key-rate-burst",
+			Usage: "Events that may be posted at once with each API key, above key-rate-limit.",
+			Value: mms.MaxBatchEvents,
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:  "ip-rate-limit",
+			Usage: "Posts per second from each client address. 0 for no limit.",
+			Value: 20,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "ip-rate-burst",
+			Usage: "Posts that may be sent at once from each client address, above ip-rate-limit.",
+			Value: 50,
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:  "admin-rate-limit",
+			Usage: "Admin requests per second from each client address. 0 for no limit.",
+			Value: 1,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "admin-rate-burst",
+			Usage: "Admin requests that may be sent at once from each client address, above admin-rate-limit.",
+			Value: 10,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "trusted-proxies",
+			Usage: "Addresses or CIDRs of the proxies in front of mmsd, whose X-Forwarded-For and X-Real-IP headers give the client address.",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "max-post-bytes",
+			Usage: "Largest body of a post or admin request. 0 for no limit.",
+			Value: 4 << 20,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "event-store",
+			Usage: "Where to keep the posted events: sqlite, in events.db in the work-dir, or memory, losing them on restart.",
+			Value: "sqlite",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "memory-store-events",
+			Usage: "Events kept by the memory event store. The oldest events are dropped first.",
+			Value: server.DefaultMemoryStoreEvents,
+		}),
 		altsrc.NewUintFlag(&cli.UintFlag{
 			Name:  "del-events-interval",
-			Usage: "Specify the interval(hours) for deleting events. Default is 12 hours (deletes 12 hours old events)",
+			Usage: "Hours to keep events that match no retention rule. Default is 12 hours (deletes events received more than 12 hours ago). 0 keeps them.",
 			Value: 12,
 		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "retention",
+			Usage: "Retention rules, such as 'product=nowcast_* max-age=2h keep-reftimes=1', with product=, hub=, max-age=, max-count= (per product) and keep-reftimes=. The first rule matching the product and hub of an event applies.",
+		}),
+		altsrc.NewUintFlag(&cli.UintFlag{
+			Name:  "audit-days",
+			Usage: "Days to keep the audit trail of posts. 0 keeps it forever.",
+			Value: 90,
+		}),
 	}
 
 	certFlags := []cli.Flag{
@@ -189,8 +276,9 @@ func main() {
 			var natsPassword string
 			var natsCredentials natscli.Option
 
-			var eventsDB *sql.DB
+			var events server.EventStore
 			var stateDB *sql.DB
+			var natsServer *nats.Server
 
 			natsLocal := ctx.Bool("nats-local")
 
@@ -202,29 +290,28 @@ func main() {
 				if err != nil {
 					log.Fatal(err)
 				}
+				streamSubjects := ctx.StringSlice("stream-subjects")
 				privateNatsUser := &nats.User{
 					Username: natsUser,
 					Password: natsPassword,
 					Permissions: &nats.Permissions{
 						Publish: &nats.SubjectPermission{
-							Allow: []string{"mms"},
+							Allow: append([]string{"$JS.API.>"}, streamSubjects...),
 						},
 						Subscribe: &nats.SubjectPermission{
-							Allow: []string{"mms"},
+							Allow: append([]string{"_INBOX.>"}, streamSubjects...),
 						},
 					},
 				}
 
+				publicSubjects := ctx.StringSlice("public-subjects")
+				shareAll := len(publicSubjects) == 0
+				if shareAll {
+					publicSubjects = streamSubjects
+				}
 				publicNatsUser := &nats.User{
-					Username: "publicUser",
-					Permissions: &nats.Permissions{
-						Publish: &nats.SubjectPermission{
-							Deny: []string{"*"},
-						},
-						Subscribe: &nats.SubjectPermission{
-							Allow: []string{"mms"},
-						},
-					},
+					Username:    "publicUser",
+					Permissions: publicUserPermissions(publicSubjects, shareAll),
 				}
 
 				users := []*nats.User{privateNatsUser, publicNatsUser}
@@ -235,15 +322,31 @@ func main() {
 					Port:       ctx.Int("nats-port"),
 					Users:      users,
 					NoAuthUser: "publicUser",
+					JetStream:  true,
+					StoreDir:   filepath.Join(ctx.String("work-dir"), jetStreamDir),
 				}
 
-				natsServer, err := nats.NewServer(opts)
+				natsServer, err = nats.NewServer(opts)
 				if err != nil {
 					nats.PrintAndDie(fmt.Sprintf("nats server failed: %s for server: mmsd-nats-server-%s", err, productionHubName))
 				}
 
 				startNATSServer(natsServer, natsURL)
 				natsCredentials = natscli.UserInfo("privateUser", natsPassword)
+
+				if !natsServer.ReadyForConnections(10 * time.Second) {
+					log.Fatalf("nats server not ready for connections on %s", natsURL)
+				}
+				streamInfo, err := server.EnsureProductStream(natsURL, natsCredentials, server.StreamConfig{
+					Subjects:   streamSubjects,
+					MaxAge:     ctx.Duration("stream-max-age"),
+					MaxBytes:   ctx.Int64("stream-max-bytes"),
+					Duplicates: ctx.Duration("stream-duplicate-window"),
+				})
+				if err != nil {
+					log.Fatalf("could not set up JetStream stream: %s", err)
+				}
+				log.Printf("JetStream stream %s keeps %d events on %v", streamInfo.Config.Name, streamInfo.State.Msgs, streamInfo.Config.Subjects)
 			} else {
 				natsURL = ctx.String("nats-url")
 				if natsURL == "" {
@@ -263,10 +366,21 @@ func main() {
 
 			apiURL := fmt.Sprintf("%s:%d", ctx.String("hostname"), ctx.Int("api-port"))
 
-			eventsPath := fmt.Sprint(filepath.Join(ctx.String("work-dir"), dbEventsFile))
-			eventsDB, err = server.NewEventsDB(eventsPath)
-			if err != nil {
-				log.Fatalf("could not open events db: %s", err)
+			switch ctx.String("event-store") {
+			case "sqlite":
+				eventsPath := fmt.Sprint(filepath.Join(ctx.String("work-dir"), dbEventsFile))
+				eventsDB, err := server.NewEventsDB(eventsPath)
+				if err != nil {
+					log.Fatalf("could not open events db: %s", err)
+				}
+				events = server.NewSQLiteEventStore(eventsDB)
+			case "memory":
+				events, err = server.NewMemoryEventStore(ctx.Int("memory-store-events"))
+				if err != nil {
+					log.Fatal(err)
+				}
+			default:
+				return fmt.Errorf("unknown event-store %q, expected sqlite or memory", ctx.String("event-store"))
 			}
 			if natsLocal {
 				statePath := fmt.Sprint(filepath.Join(ctx.String("work-dir"), dbStateFile))
@@ -285,24 +399,44 @@ func main() {
 
 			templates := server.CreateTemplates()
 
-			webService := server.NewService(templates, eventsDB, stateDB, natsURL, natsCredentials, server.Version{Version: version, Commit: commit, Date: date}, natsLocal)
+			webService := server.NewService(templates, events, stateDB, natsURL, natsCredentials, server.Version{Version: version, Commit: commit, Date: date}, natsLocal)
+			webService.NatsServer = natsServer
+			retention, err := retentionRules(ctx.StringSlice("retention"), ctx.Uint("del-events-interval"))
+			if err != nil {
+				return err
+			}
+			webService.SetRetention(retention)
+			webService.SetLimits(server.Limits{
+				KeyRate:      ctx.Float64("key-rate-limit"),
+				KeyBurst:     ctx.Int("key-rate-burst"),
+				IPRate:       ctx.Float64("ip-rate-limit"),
+				IPBurst:      ctx.Int("ip-rate-burst"),
+				AdminRate:    ctx.Float64("admin-rate-limit"),
+				AdminBurst:   ctx.Int("admin-rate-burst"),
+				MaxBodyBytes: ctx.Int64("max-post-bytes"),
+			})
+			if err := webService.SetTrustedProxies(ctx.StringSlice("trusted-proxies")); err != nil {
+				return err
+			}
+			webService.SetLegacySubjects(ctx.Bool("legacy-subjects"))
 
 			log.Println("Populating productstatus from the local events database ...")
-			events, err := webService.GetAllEvents(context.Background())
+			storedEvents, err := webService.GetAllEvents(context.Background())
 			if err != nil {
 				log.Fatalf("could not read all events %s", err)
 			}
-			webService.Productstatus.Populate(events)
+			webService.Productstatus.Populate(storedEvents)
 
 			if natsLocal {
 
 				heartBeatInterval := ctx.Int("heartbeat-interval")
 
 				if heartBeatInterval > 0 {
-					startHeartBeat(heartBeatInterval, natsURL, natsCredentials, natsLocal)
+					startHeartBeat(heartBeatInterval, webService)
 				}
 			}
-			startEventLoop(webService, ctx.Int(("del-events-interval")))
+			webService.StartOutboxDispatcher(context.Background())
+			startEventLoop(webService, ctx.Int("audit-days"))
 			startWebServer(webService, apiURL, ctx.Bool("tls"), ctx.String("certificate"), ctx.String("key"))
 
 			return nil
@@ -331,7 +465,7 @@ func main() {
 					altsrc.NewStringFlag(&cli.StringFlag{
 						Name:    "remove",
 						Aliases: []string{"r"},
-						Usage:   "Remove an API key from autorized keys.",
+						Usage:   "Remove an API key, given by the key or its id, from autorized keys.",
 						Value:   "None",
 					}),
 					altsrc.NewStringFlag(&cli.StringFlag{
@@ -340,6 +474,44 @@ func main() {
 						Usage:   "A descriptive message for the generated or added key.",
 						Value:   "Unnamed key",
 					}),
+					&cli.StringSliceFlag{
+						Name:  "scope",
+						Usage: "Restrict the generated or added key, or the key given to --set-scope, to `KIND=PATTERN`, where KIND is role (write or admin), queue, hub or product. Patterns may contain '*'. May be repeated; without a role the key gets the write role.",
+					},
+					&cli.StringFlag{
+						Name:  "set-scope",
+						Usage: "Replace the scope of an API key, given by the key or its id, with the scopes given by --scope.",
+					},
+					&cli.StringFlag{
+						Name:  "expires",
+						Usage: "Make the generated or added key, or the key given to --set-expiry, stop working at `TIME`, e.g. 2022-01-01 or now+90d. Keys without an expiry work until they are removed.",
+					},
+					&cli.StringFlag{
+						Name:  "set-expiry",
+						Usage: "Replace the expiry of an API key, given by the key or its id, with the time given by --expires.",
+					},
+					&cli.StringFlag{
+						Name:  "rotate",
+						Usage: "Generate a new API key with the message and scope of an API key, given by the key or its id, and make the old key expire after --grace.",
+					},
+					&cli.Float64Flag{
+						Name:  "rate-limit",
+						Usage: "Events per second that may be posted with the generated or added key, or the key given to --set-rate-limit, instead of key-rate-limit. 0 for no limit.",
+					},
+					&cli.IntFlag{
+						Name:  "rate-burst",
+						Usage: "Events that may be posted at once with the key, above --rate-limit.",
+						Value: 1,
+					},
+					&cli.StringFlag{
+						Name:  "set-rate-limit",
+						Usage: "Replace the rate limit of an API key, given by the key or its id, with --rate-limit and --rate-burst. Without --rate-limit, the key gets key-rate-limit.",
+					},
+					&cli.DurationFlag{
+						Name:  "grace",
+						Usage: "How long a rotated key keeps working.",
+						Value: server.DefaultRotateGrace,
+					},
 				},
 				Action: func(ctx *cli.Context) error {
 					// Open the database
@@ -349,8 +521,24 @@ func main() {
 						log.Fatalf("could not open state db: %s", err)
 					}
 
+					scope, err := server.ParseKeyScope(ctx.StringSlice("scope"))
+					if err != nil {
+						log.Fatalf("invalid --scope: %s", err)
+					}
+					var rateLimit *server.RateLimit
+					if ctx.IsSet("rate-limit") {
+						rateLimit = &server.RateLimit{Rate: ctx.Float64("rate-limit"), Burst: ctx.Int("rate-burst")}
+					}
+					var expires time.Time
+					if ctx.String("expires") != "" {
+						expires, err = mms.ParseRelativeTime(ctx.String("expires"), time.Now())
+						if err != nil {
+							log.Fatalf("invalid --expires: %s", err)
+						}
+					}
+
 					if ctx.Bool("gen") {
-						err := generateAPIKey(stateDB, ctx.String("message"))
+						err := generateAPIKey(stateDB, ctx.String("message"), scope, expires, rateLimit)
 						if err != nil {
 							log.Fatalf("failed to generate key: %s", err)
 						}
@@ -360,12 +548,55 @@ func main() {
 							log.Fatalf("failed to list keys: %s", err)
 						}
 					} else if ctx.String("add") != "None" {
-						err := server.AddNewApiKey(stateDB, ctx.String("add"), ctx.String("message"))
+						err := server.AddScopedApiKey(stateDB, ctx.String("add"), ctx.String("message"), scope, expires, rateLimit)
 						if err != nil {
 							log.Fatalf("failed to add key: %s", err)
 						}
-						fmt.Printf("Added Key:   %s\n", ctx.String("add"))
+						fmt.Printf("Added Key:   %s\n", server.ApiKeyID(ctx.String("add")))
 						fmt.Printf("Key Message: %s\n", ctx.String("message"))
+						fmt.Printf("Key Scope:   %s\n", scope)
+						fmt.Printf("Key Expires: %s\n", formatExpiry(expires))
+					} else if ctx.String("set-scope") != "" {
+						isOk, err := server.SetApiKeyScope(stateDB, ctx.String("set-scope"), scope)
+						if err != nil {
+							log.Fatalf("failed to set key scope: %s", err)
+						}
+						if isOk {
+							fmt.Printf("Updated Key: %s\n", ctx.String("set-scope"))
+							fmt.Printf("Key Scope:   %s\n", scope)
+						} else {
+							fmt.Printf("Key Not Found: %s\n", ctx.String("set-scope"))
+						}
+					} else if ctx.String("set-expiry") != "" {
+						isOk, err := server.SetApiKeyExpiry(stateDB, ctx.String("set-expiry"), expires)
+						if err != nil {
+							log.Fatalf("failed to set key expiry: %s", err)
+						}
+						if isOk {
+							fmt.Printf("Updated Key: %s\n", ctx.String("set-expiry"))
+							fmt.Printf("Key Expires: %s\n", formatExpiry(expires))
+						} else {
+							fmt.Printf("Key Not Found: %s\n", ctx.String("set-expiry"))
+						}
+					} else if ctx.String("set-rate-limit") != "" {
+						isOk, err := server.SetApiKeyRateLimit(stateDB, ctx.String("set-rate-limit"), rateLimit)
+						if err != nil {
+							log.Fatalf("failed to set key rate limit: %s", err)
+						}
+						if isOk {
+							fmt.Printf("Updated Key:     %s\n", ctx.String("set-rate-limit"))
+							fmt.Printf("Key Rate Limit:  %s\n", formatRateLimit(rateLimit))
+						} else {
+							fmt.Printf("Key Not Found: %s\n", ctx.String("set-rate-limit"))
+						}
+					} else if ctx.String("rotate") != "" {
+						apiKey, err := server.RotateApiKey(stateDB, ctx.String("rotate"), ctx.Duration("grace"))
+						if err != nil {
+							log.Fatalf("failed to rotate key: %s", err)
+						}
+						fmt.Printf("Generated Key: %s\n", apiKey)
+						fmt.Printf("Key ID:        %s\n", server.ApiKeyID(apiKey))
+						fmt.Printf("Rotated Key:   %s, stops working within %s\n", ctx.String("rotate"), ctx.Duration("grace"))
 					} else if ctx.String("remove") != "None" {
 						isOk, err := server.RemoveApiKey(stateDB, ctx.String("remove"))
 						if err != nil {
@@ -383,6 +614,68 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "audit",
+				Usage: "Show who posted which events, or with --admin who changed which API keys, newest first, including rejected requests.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "key-id", Usage: "Only posts with the API key with this id."},
+					&cli.StringFlag{Name: "client", Usage: "Only posts from this client address."},
+					&cli.StringFlag{Name: "event-id", Usage: "Only posts of the event with this id."},
+					&cli.StringFlag{Name: "product", Usage: "Only posts of events about this product."},
+					&cli.StringFlag{Name: "production-hub", Usage: "Only posts of events from this production hub."},
+					&cli.StringFlag{Name: "queue-name", Usage: "Only posts to this queue."},
+					&cli.StringFlag{Name: "outcome", Usage: "Only posts that were accepted, duplicate or rejected."},
+					&cli.StringFlag{Name: "since", Usage: "Only posts at or after `TIME`, e.g. 2021-03-01T06:00:00Z or now-1d."},
+					&cli.StringFlag{Name: "until", Usage: "Only posts before `TIME`."},
+					&cli.IntFlag{Name: "limit", Usage: "Show at most this many posts.", Value: server.DefaultAuditLimit},
+					&cli.BoolFlag{Name: "admin", Usage: "Show the API keys created, revoked and rotated through the admin API instead, selected by key-id, client, since, until and limit."},
+				},
+				Action: func(ctx *cli.Context) error {
+					statePath := fmt.Sprint(filepath.Join(ctx.String("work-dir"), dbStateFile))
+					stateDB, err := server.NewStateDB(statePath)
+					if err != nil {
+						log.Fatalf("could not open state db: %s", err)
+					}
+
+					params := map[string]string{
+						"keyId":         ctx.String("key-id"),
+						"clientAddress": ctx.String("client"),
+						"eventId":       ctx.String("event-id"),
+						"product":       ctx.String("product"),
+						"productionHub": ctx.String("production-hub"),
+						"queueName":     ctx.String("queue-name"),
+						"outcome":       ctx.String("outcome"),
+						"since":         ctx.String("since"),
+						"until":         ctx.String("until"),
+						"limit":         strconv.Itoa(ctx.Int("limit")),
+					}
+					filter, err := server.ParseAuditFilter(func(name string) string { return params[name] }, time.Now())
+					if err != nil {
+						return err
+					}
+					if ctx.Bool("admin") {
+						return server.ListAdminAudit(stateDB, filter)
+					}
+					return server.ListAudit(stateDB, filter)
+				},
+			},
+			{
+				Name:  "db",
+				Usage: "Manage the events and state databases.",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "migrate",
+						Usage: "Upgrade the databases in the work dir to the latest schema, which mmsd also does when it starts.",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "Show the migrations that would be applied, without changing the databases.",
+							},
+						},
+						Action: migrateDBsCmd,
+					},
+				},
+			},
 			{
 				Name:    "generate-certificate",
 				Aliases: []string{"gencert"},
@@ -415,6 +708,46 @@ func main() {
 	}
 }
 
+// publicUserPermissions lets anyone read the events on subjects from the stream and keep their own consumers,
+// but not change the stream or publish events. Consumers must filter on one of the subjects,
+// so a subject tree like mms.ppi.> only shares the events of that production hub.
+// With shareAll, when all the stream subjects are shared, the requests of older NATS clients are also allowed:
+// creating durable consumers with the filter subject only in the request, and getting single messages from the stream.
+// They can not be limited to subjects, so they are left out when only some subjects are shared.
+func publicUserPermissions(subjects []string, shareAll bool) *nats.Permissions {
+	publish := []string{
+		"$JS.API.INFO",
+		"$JS.API.STREAM.INFO." + mms.ProductStream,
+		"$JS.API.CONSUMER.INFO." + mms.ProductStream + ".*",
+		"$JS.API.CONSUMER.MSG.NEXT." + mms.ProductStream + ".*",
+		"$JS.API.CONSUMER.DELETE." + mms.ProductStream + ".*",
+		"$JS.ACK." + mms.ProductStream + ".>",
+		// Subscribers move the events they fail to handle to the dead-letter subject.
+		mms.DefaultDeadLetterSubject,
+	}
+	for _, subject := range subjects {
+		// The filter subject of a new consumer is the end of the subject of the request creating it.
+		publish = append(publish, "$JS.API.CONSUMER.CREATE."+mms.ProductStream+".*."+subject)
+	}
+	if shareAll {
+		publish = append(publish,
+			"$JS.API.STREAM.MSG.GET."+mms.ProductStream,
+			"$JS.API.CONSUMER.CREATE."+mms.ProductStream,
+			"$JS.API.CONSUMER.CREATE."+mms.ProductStream+".>",
+			"$JS.API.CONSUMER.DURABLE.CREATE."+mms.ProductStream+".*",
+		)
+	}
+
+	return &nats.Permissions{
+		Publish: &nats.SubjectPermission{
+			Allow: publish,
+		},
+		Subscribe: &nats.SubjectPermission{
+			Allow: append([]string{"_INBOX.>"}, subjects...),
+		},
+	}
+}
+
 func startNATSServer(natsServer *nats.Server, natsURL string) {
 	go func() {
 		log.Printf("Starting NATS server on %s ...", natsURL)
@@ -425,7 +758,7 @@ func startNATSServer(natsServer *nats.Server, natsURL string) {
 	}()
 }
 
-func startHeartBeat(heartBeatInterval int, natsURL string, natsCredentials natscli.Option, natsLocal bool) {
+func startHeartBeat(heartBeatInterval int, webService *server.Service) {
 
 	var pEvent mms.HeartBeatEvent
 	log.Printf("Starting heartbeat sender with interval: %d s", heartBeatInterval)
@@ -441,15 +774,20 @@ func startHeartBeat(heartBeatInterval int, natsURL string, natsCredentials natsc
 		for range ticker.C {
 			pEvent.CreatedAt = time.Now()
 			pEvent.NextEventAt = time.Now().Add(interval)
-			if err := mms.MakeHeartBeatEvent(natsURL, natsCredentials, &pEvent, natsLocal); err != nil {
+			publisher, err := webService.Publisher()
+			if err == nil {
+				// Maybe queueName for HeartBeatEvent should be heartbeat? Hardcoded to mms for now
+				err = publisher.PublishHeartBeatEvent(context.Background(), &pEvent, "mms")
+			}
+			if err != nil {
 				log.Printf("failed to send HeartBeat message: %s", err.Error())
 			}
 		}
 	}()
 }
 
-func startEventLoop(webService *server.Service, eventDeletionInterval int) {
-	log.Printf("Starting event loop with %v hours of event deletion Interval ...", eventDeletionInterval)
+func startEventLoop(webService *server.Service, auditDays int) {
+	log.Printf("Starting event loop, pruning events every hour ...")
 	// Start a separate go routine serving as an event loop for maintenance tasks.
 
 	uptimeCounter := prometheus.NewCounter(prometheus.CounterOpts{
@@ -469,18 +807,96 @@ func startEventLoop(webService *server.Service, eventDeletionInterval int) {
 		}
 	}()
 
+	minuteTicker := time.NewTicker(1 * time.Minute)
+	go func() {
+		for range minuteTicker.C {
+			if err := webService.FlushThrottledAudit(time.Now()); err != nil {
+				log.Printf("failed to audit throttled posts: %s", err)
+			}
+		}
+	}()
+
 	hourTicker := time.NewTicker(1 * time.Hour)
 	go func() {
 		for range hourTicker.C {
-			if err := webService.DeleteOldEvents(time.Now().Add(-time.Hour * time.Duration(eventDeletionInterval))); err != nil {
-				log.Printf("failed to delete old events from events db: %s", err)
-			} else {
-				log.Printf("Deleted old events")
+			if _, err := webService.PruneEvents(context.Background(), time.Now()); err != nil {
+				log.Printf("failed to prune events: %s", err)
+			}
+			if auditDays > 0 {
+				if n, err := webService.DeleteOldAudit(time.Now().AddDate(0, 0, -auditDays)); err != nil {
+					log.Printf("failed to delete old audit entries from state db: %s", err)
+				} else if n > 0 {
+					log.Printf("Deleted %d old audit entries", n)
+				}
 			}
 		}
 	}()
 }
 
+// retentionRules parses the retention rules, and adds a last rule keeping the events matched by no rule for
+// eventDeletionInterval hours, unless it is 0.
+func retentionRules(rules []string, eventDeletionInterval uint) ([]server.RetentionRule, error) {
+	var retention []server.RetentionRule
+	for _, s := range rules {
+		rule, err := server.ParseRetentionRule(s)
+		if err != nil {
+			return nil, err
+		}
+		retention = append(retention, rule)
+	}
+	if eventDeletionInterval > 0 {
+		retention = append(retention, server.RetentionRule{MaxAge: time.Duration(eventDeletionInterval) * time.Hour})
+	}
+	return retention, nil
+}
+
+// migrateDBsCmd upgrades the events and state databases of the work dir, and shows the migrations.
+func migrateDBsCmd(ctx *cli.Context) error {
+	dryRun := ctx.Bool("dry-run")
+	for _, db := range []struct {
+		file    string
+		migrate func(db *sql.DB, dryRun bool) ([]server.Migration, error)
+	}{
+		{dbEventsFile, server.MigrateEventsDB},
+		{dbStateFile, server.MigrateStateDB},
+	} {
+		dbPath := filepath.Join(ctx.String("work-dir"), db.file)
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			fmt.Printf("%s does not exist, and is created with the latest schema when mmsd starts\n", dbPath)
+			continue
+		}
+
+		sqlDB, err := server.OpenDB(dbPath)
+		if err != nil {
+			return err
+		}
+		version, err := server.SchemaVersion(sqlDB)
+		if err != nil {
+			sqlDB.Close()
+			return fmt.Errorf("%s: %v", dbPath, err)
+		}
+		migrations, err := db.migrate(sqlDB, dryRun)
+		sqlDB.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", dbPath, err)
+		}
+
+		if len(migrations) == 0 {
+			fmt.Printf("%s has the latest schema version %d\n", dbPath, version)
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%s would be migrated from schema version %d:\n", dbPath, version)
+		} else {
+			fmt.Printf("%s is migrated from schema version %d:\n", dbPath, version)
+		}
+		for _, m := range migrations {
+			fmt.Printf("  %d: %s\n", m.Version, m.Description)
+		}
+	}
+	return nil
+}
+
 func startWebServer(webService *server.Service, apiURL string, tlsEnabled bool, certificatePath string, keyPath string) {
 	server := &http.Server{
 		Addr:         apiURL,
@@ -496,28 +912,32 @@ func startWebServer(webService *server.Service, apiURL string, tlsEnabled bool,
 	}
 }
 
-func generateAPIKey(stateDB *sql.DB, keyMsg string) error {
-	// Seeding the random generator for each call may be risky since it may produce the same
-	// seed twice if the time resolution is low and the function is called often. However, the
-	// function is only called once in a single instance of mmsd, and the database should error
-	// on a duplicate key entry.
-	rand.Seed(time.Now().UnixNano())
-
-	// Generate the key
-	byteKey := make([]byte, 32)
-	for i := range byteKey {
-		byteKey[i] = byte(rand.Intn(255))
-	}
-	apiKey := base64.StdEncoding.EncodeToString([]byte(byteKey))
-
-	// Save the new key entry
-	err := server.AddNewApiKey(stateDB, apiKey, keyMsg)
+func generateAPIKey(stateDB *sql.DB, keyMsg string, scope server.KeyScope, expires time.Time, rateLimit *server.RateLimit) error {
+	apiKey, err := server.GenerateScopedApiKey(stateDB, keyMsg, scope, expires, rateLimit)
 	if err != nil {
 		log.Fatalf("error in state db: %s", err)
 	}
 
+	// Only the id and a hash of the key are stored, so it can not be shown again.
 	fmt.Printf("Generated Key: %s\n", apiKey)
+	fmt.Printf("Key ID:        %s\n", server.ApiKeyID(apiKey))
 	fmt.Printf("Key Message:   %s\n", keyMsg)
+	fmt.Printf("Key Scope:     %s\n", scope)
+	fmt.Printf("Key Expires:   %s\n", formatExpiry(expires))
 
 	return nil
 }
+
+func formatRateLimit(rateLimit *server.RateLimit) string {
+	if rateLimit == nil {
+		return "Default"
+	}
+	return rateLimit.String()
+}
+
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return "Never"
+	}
+	return expires.UTC().Format(time.RFC3339)
+}
@@ -21,7 +21,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/metno/go-mms/pkg/mms"
 	nats "github.com/nats-io/nats-server/v2/server"
+	natscli "github.com/nats-io/nats.go"
 )
 
 func createNats() (*nats.Server, error) {
@@ -88,3 +90,54 @@ func TestStartWebServer(t *testing.T) {
 func TestGenerateAPIKey(t *testing.T) {
 
 }
+
+func TestPublicUserPermissions(t *testing.T) {
+	natsServer, err := nats.NewServer(&nats.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Users: []*nats.User{
+			{Username: "privateUser", Password: "secret"},
+			{Username: "publicUser", Permissions: publicUserPermissions([]string{"mms.ppi.>"}, false)},
+		},
+		NoAuthUser: "publicUser",
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %s", err)
+	}
+	go natsServer.Start()
+	defer natsServer.Shutdown()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+
+	private, err := natscli.Connect(natsServer.ClientURL(), natscli.UserInfo("privateUser", "secret"))
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer private.Close()
+	js, _ := private.JetStream()
+	if _, err := js.AddStream(&natscli.StreamConfig{Name: mms.ProductStream, Subjects: []string{"mms.>"}}); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	public, err := natscli.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer public.Close()
+	publicJS, _ := public.JetStream(natscli.MaxWait(time.Second))
+
+	if _, err := publicJS.PullSubscribe(mms.SubscriptionSubject("mms", "ppi", "arome_*"), "", natscli.BindStream(mms.ProductStream)); err != nil {
+		t.Errorf("Expected to consume events from ppi; Got %s", err)
+	}
+	for _, subject := range []string{mms.SubscriptionSubject("mms", "", "arome_arctic"), "mms.>"} {
+		if _, err := publicJS.PullSubscribe(subject, "", natscli.BindStream(mms.ProductStream)); err == nil {
+			t.Errorf("Expected consuming %s outside of mms.ppi.> to be denied", subject)
+		}
+	}
+	if _, err := publicJS.Publish("mms.ppi.arome_arctic", []byte("{}")); err == nil {
+		t.Errorf("Expected publishing events to be denied")
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// DefaultRotateGrace is how long a rotated API key keeps working by default.
+const DefaultRotateGrace = 24 * time.Hour
+
+// apiKeyRequest is the body of a request generating or adding an API key.
+type apiKeyRequest struct {
+	Key     string    `json:"key,omitempty"` // The key to add. A key is generated if not given.
+	Message string    `json:"message"`
+	Scope   *KeyScope `json:"scope,omitempty"`
+	Expires string    `json:"expires,omitempty"` // When the key stops working, as an RFC 3339 time, a date or a relative time.
+	// Rate limit of the key instead of the default of the production hub.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+}
+
+// apiKeyResponse describes an API key. The key itself is only given when it is generated.
+type apiKeyResponse struct {
+	ApiKeyInfo
+	Key string `json:"key,omitempty"`
+}
+
+// authorizeAdmin checks that a request has an API key with the admin role, and answers the request if it has not.
+// It returns the id of the key.
+func (service *Service) authorizeAdmin(httpRespW http.ResponseWriter, httpReq *http.Request) (string, bool) {
+	if !service.NatsLocal {
+		errorResponse(fmt.Errorf("API keys are only managed by mmsd with nats-local"), http.StatusNotImplemented, httpRespW, httpReq)
+		return "", false
+	}
+
+	apiKey := httpReq.Header.Get("Api-Key")
+	validKey, err := ValidateApiKey(service.stateDB, apiKey)
+	if err != nil {
+		log.Printf("Failed to validate key: %s", err)
+	}
+	if apiKey == "" || !validKey {
+		errorResponse(fmt.Errorf("API key invalid or missing"), http.StatusUnauthorized, httpRespW, httpReq)
+		log.Printf("unauthorized: admin API key from %s not accepted", service.clientAddress(httpReq))
+		return "", false
+	}
+
+	keyID := ApiKeyID(apiKey)
+	adminAuditOf(httpReq).authorize(keyID)
+	scope, err := ApiKeyScope(service.stateDB, keyID)
+	if err != nil {
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		log.Printf("failed to read scope of key %s: %v", keyID, err)
+		return "", false
+	}
+	if !scope.HasRole(KeyRoleAdmin) {
+		errorResponse(fmt.Errorf("API key does not have the admin role"), http.StatusForbidden, httpRespW, httpReq)
+		log.Printf("forbidden: key %s from %s does not have the admin role", keyID, service.clientAddress(httpReq))
+		return "", false
+	}
+	return keyID, true
+}
+
+// listKeysHandler lists the API keys, without the keys themselves.
+func (service *Service) listKeysHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	if _, ok := service.authorizeAdmin(httpRespW, httpReq); !ok {
+		return
+	}
+
+	keys, err := ReadApiKeys(service.stateDB)
+	if err != nil {
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		log.Print(err)
+		return
+	}
+	jsonResponse(keys, http.StatusOK, httpRespW, httpReq)
+}
+
+// getKeyHandler describes one API key.
+func (service *Service) getKeyHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	if _, ok := service.authorizeAdmin(httpRespW, httpReq); !ok {
+		return
+	}
+
+	key, err := ReadApiKey(service.stateDB, mux.Vars(httpReq)["id"])
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if key == nil {
+		errorResponse(fmt.Errorf("API key %s not found", mux.Vars(httpReq)["id"]), http.StatusNotFound, httpRespW, httpReq)
+		return
+	}
+	jsonResponse(key, http.StatusOK, httpRespW, httpReq)
+}
+
+// createKeyHandler generates a new API key, or adds the key given in the request.
+func (service *Service) createKeyHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	adminKeyID, ok := service.authorizeAdmin(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	request := apiKeyRequest{}
+	if err := json.NewDecoder(httpReq.Body).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			service.bodyTooLarge(httpRespW, httpReq)
+			return
+		}
+		errorResponse(fmt.Errorf("invalid API key request: %v", err), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	scope := DefaultKeyScope
+	if request.Scope != nil {
+		var err error
+		if scope, err = request.Scope.withDefaults(); err != nil {
+			errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+			return
+		}
+	}
+	var expires time.Time
+	if request.Expires != "" {
+		var err error
+		if expires, err = mms.ParseRelativeTime(request.Expires, time.Now()); err != nil {
+			errorResponse(fmt.Errorf("invalid expires: %v", err), http.StatusBadRequest, httpRespW, httpReq)
+			return
+		}
+	}
+	if request.RateLimit != nil && (request.RateLimit.Rate < 0 || request.RateLimit.Burst < 0) {
+		errorResponse(fmt.Errorf("invalid rateLimit: negative rate or burst"), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if request.Message == "" {
+		request.Message = "Unnamed key"
+	}
+
+	apiKey := request.Key
+	if apiKey == "" {
+		var err error
+		if apiKey, err = GenerateScopedApiKey(service.stateDB, request.Message, scope, expires, request.RateLimit); err != nil {
+			errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+			log.Print(err)
+			return
+		}
+		adminAuditOf(httpReq).target(ApiKeyID(apiKey))
+	} else {
+		if err := checkKeyFormat(apiKey); err != nil {
+			errorResponse(fmt.Errorf("api key rejected: %v", err), http.StatusBadRequest, httpRespW, httpReq)
+			return
+		}
+		adminAuditOf(httpReq).target(ApiKeyID(apiKey))
+		if existing, err := ReadApiKey(service.stateDB, apiKey); err != nil || existing != nil {
+			errorResponse(fmt.Errorf("an API key with id %s already exists", ApiKeyID(apiKey)), http.StatusConflict, httpRespW, httpReq)
+			return
+		}
+		if err := AddScopedApiKey(service.stateDB, apiKey, request.Message, scope, expires, request.RateLimit); err != nil {
+			errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+			log.Print(err)
+			return
+		}
+	}
+	log.Printf("admin key %s added key %s with scope %s", adminKeyID, ApiKeyID(apiKey), scope)
+
+	response := apiKeyResponse{}
+	if request.Key == "" {
+		response.Key = apiKey
+	}
+	service.keyResponse(response, apiKey, http.StatusCreated, httpRespW, httpReq)
+}
+
+// revokeKeyHandler removes an API key.
+func (service *Service) revokeKeyHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	adminKeyID, ok := service.authorizeAdmin(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	keyID := mux.Vars(httpReq)["id"]
+	removed, err := RemoveApiKey(service.stateDB, keyID)
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if !removed {
+		errorResponse(fmt.Errorf("API key %s not found", keyID), http.StatusNotFound, httpRespW, httpReq)
+		return
+	}
+	log.Printf("admin key %s revoked key %s", adminKeyID, keyID)
+	httpRespW.WriteHeader(http.StatusNoContent)
+}
+
+// rotateKeyHandler generates a new API key replacing a key, which keeps working for the grace period given by the grace parameter.
+func (service *Service) rotateKeyHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	adminKeyID, ok := service.authorizeAdmin(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	grace := DefaultRotateGrace
+	if value := httpReq.URL.Query().Get("grace"); value != "" {
+		var err error
+		if grace, err = time.ParseDuration(value); err != nil || grace < 0 {
+			errorResponse(fmt.Errorf("invalid grace %q", value), http.StatusBadRequest, httpRespW, httpReq)
+			return
+		}
+	}
+
+	keyID := mux.Vars(httpReq)["id"]
+	if existing, err := ReadApiKey(service.stateDB, keyID); err != nil || existing == nil {
+		errorResponse(fmt.Errorf("API key %s not found", keyID), http.StatusNotFound, httpRespW, httpReq)
+		return
+	}
+	apiKey, err := RotateApiKey(service.stateDB, keyID, grace)
+	if err != nil {
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		log.Print(err)
+		return
+	}
+	log.Printf("admin key %s rotated key %s to %s with a grace period of %s", adminKeyID, keyID, ApiKeyID(apiKey), grace)
+
+	service.keyResponse(apiKeyResponse{Key: apiKey}, apiKey, http.StatusCreated, httpRespW, httpReq)
+}
+
+// keyResponse answers with response, described by what is stored about apiKey.
+func (service *Service) keyResponse(response apiKeyResponse, apiKey string, statusCode int, httpRespW http.ResponseWriter, httpReq *http.Request) {
+	key, err := ReadApiKey(service.stateDB, apiKey)
+	if err != nil || key == nil {
+		errorResponse(fmt.Errorf("failed to read API key %s: %v", ApiKeyID(apiKey), err), http.StatusInternalServerError, httpRespW, httpReq)
+		return
+	}
+	response.ApiKeyInfo = *key
+	jsonResponse(response, statusCode, httpRespW, httpReq)
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// newAdminTestClient gives a client of a nats-local service, using a key with the admin role.
+func newAdminTestClient(t *testing.T) (*Service, *mms.Client) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	adminKey, err := GenerateApiKey(service.stateDB, "admin")
+	if err != nil {
+		t.Fatalf("failed to generate admin key: %s", err)
+	}
+	SetApiKeyScope(service.stateDB, adminKey, KeyScope{Roles: []KeyRole{KeyRoleAdmin}})
+
+	ts := httptest.NewServer(service.Router)
+	t.Cleanup(ts.Close)
+	client, _ := mms.NewClient(ts.URL, mms.ClientConfig{APIKey: adminKey})
+	return service, client
+}
+
+func expectStatus(t *testing.T, err error, statusCode int) {
+	t.Helper()
+	var apiErr *mms.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != statusCode {
+		t.Errorf("Expected %d; Got %v", statusCode, err)
+	}
+}
+
+func TestAdminKeys(t *testing.T) {
+	service, client := newAdminTestClient(t)
+	ctx := context.Background()
+
+	generated, err := client.AddAPIKey(ctx, mms.NewAPIKey{Message: "generated", Expires: "now+1d",
+		Scope: &mms.APIKeyScope{Products: []string{"arome_*"}}, RateLimit: &mms.APIKeyRateLimit{Rate: 5, Burst: 10}})
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	if generated.Key == "" || generated.ID != ApiKeyID(generated.Key) || generated.Expires == "" ||
+		len(generated.Scope.Roles) != 1 || generated.Scope.Roles[0] != "write" || generated.Scope.Products[0] != "arome_*" ||
+		generated.RateLimit == nil || generated.RateLimit.Burst != 10 {
+		t.Errorf("Expected a generated write key for arome_* with an expiry and a rate limit; Got %+v", generated)
+	}
+	if ok, err := ValidateApiKey(service.stateDB, generated.Key); !ok || err != nil {
+		t.Errorf("Expected the generated key to be valid; Got %v, %v", ok, err)
+	}
+
+	added, err := client.AddAPIKey(ctx, mms.NewAPIKey{Key: testScopedAPIKey, Message: "added"})
+	if err != nil || added.Key != "" || added.ID != ApiKeyID(testScopedAPIKey) {
+		t.Errorf("Expected the key to be added, and not given back; Got %+v, %v", added, err)
+	}
+	_, err = client.AddAPIKey(ctx, mms.NewAPIKey{Key: testScopedAPIKey})
+	expectStatus(t, err, http.StatusConflict)
+	_, err = client.AddAPIKey(ctx, mms.NewAPIKey{Scope: &mms.APIKeyScope{Roles: []string{"owner"}}})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = client.AddAPIKey(ctx, mms.NewAPIKey{RateLimit: &mms.APIKeyRateLimit{Rate: -1}})
+	expectStatus(t, err, http.StatusBadRequest)
+
+	keys, err := client.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 4 {
+		t.Fatalf("Expected 4 keys; Got %+v, %v", keys, err)
+	}
+	for _, key := range keys {
+		if key.Key != "" {
+			t.Errorf("Expected listed keys not to be given; Got %+v", key)
+		}
+	}
+
+	rotated, err := client.RotateAPIKey(ctx, generated.ID, time.Hour)
+	if err != nil || rotated.Key == "" || rotated.Message != "generated" || rotated.Scope.Products[0] != "arome_*" ||
+		rotated.RateLimit == nil || rotated.RateLimit.Rate != 5 {
+		t.Errorf("Expected a new key with the message, scope and rate limit of the rotated key; Got %+v, %v", rotated, err)
+	}
+
+	if err := client.RevokeAPIKey(ctx, generated.ID); err != nil {
+		t.Errorf("failed to revoke key: %s", err)
+	}
+	if ok, _ := ValidateApiKey(service.stateDB, generated.Key); ok {
+		t.Errorf("Expected the revoked key to be invalid")
+	}
+	expectStatus(t, client.RevokeAPIKey(ctx, generated.ID), http.StatusNotFound)
+	_, err = client.RotateAPIKey(ctx, generated.ID, time.Hour)
+	expectStatus(t, err, http.StatusNotFound)
+}
+
+func TestAdminKeysAuthorization(t *testing.T) {
+	service, _ := newAdminTestClient(t)
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	// The key of newOutboxTestService may only post events.
+	for apiKey, statusCode := range map[string]int{"": http.StatusUnauthorized, testScopedAPIKey: http.StatusUnauthorized, testAPIKey: http.StatusForbidden} {
+		client, _ := mms.NewClient(ts.URL, mms.ClientConfig{APIKey: apiKey})
+		_, err := client.ListAPIKeys(context.Background())
+		expectStatus(t, err, statusCode)
+	}
+
+	service.NatsLocal = false
+	client, _ := mms.NewClient(ts.URL, mms.ClientConfig{APIKey: testAPIKey})
+	_, err := client.ListAPIKeys(context.Background())
+	expectStatus(t, err, http.StatusNotImplemented)
+}
+
+func TestAdminAudit(t *testing.T) {
+	service, client := newAdminTestClient(t)
+	ctx := context.Background()
+
+	generated, err := client.AddAPIKey(ctx, mms.NewAPIKey{Message: "audited"})
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	if _, err := client.RotateAPIKey(ctx, generated.ID, time.Hour); err != nil {
+		t.Fatalf("failed to rotate key: %s", err)
+	}
+	if err := client.RevokeAPIKey(ctx, generated.ID); err != nil {
+		t.Fatalf("failed to revoke key: %s", err)
+	}
+	httpReq := httptest.NewRequest("DELETE", "/api/v1/admin/keys/"+generated.ID, nil)
+	httpReq.Header.Set("Api-Key", "not-a-key")
+	httpReq.RemoteAddr = "192.0.2.1:1234"
+	service.Router.ServeHTTP(httptest.NewRecorder(), httpReq)
+	if _, err := client.ListAPIKeys(ctx); err != nil {
+		t.Fatalf("failed to list keys: %s", err)
+	}
+
+	entries, err := ReadAdminAudit(service.stateDB, AuditFilter{})
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("Expected the 4 changes of keys, and not the listing, in the admin audit trail; Got %+v, %v", entries, err)
+	}
+	adminKeyID := entries[3].KeyID
+	for i, expected := range []AdminAuditEntry{
+		{Action: AdminRevokeKey, Status: http.StatusUnauthorized, ClientAddress: "192.0.2.1"},
+		{Action: AdminRevokeKey, Status: http.StatusNoContent, KeyID: adminKeyID},
+		{Action: AdminRotateKey, Status: http.StatusCreated, KeyID: adminKeyID},
+		{Action: AdminCreateKey, Status: http.StatusCreated, KeyID: adminKeyID},
+	} {
+		entry := entries[i]
+		if entry.Action != expected.Action || entry.Status != expected.Status || entry.KeyID != expected.KeyID ||
+			entry.TargetKeyID != generated.ID || (expected.ClientAddress != "" && entry.ClientAddress != expected.ClientAddress) {
+			t.Errorf("Expected %s of %s with status %d by %q; Got %+v", expected.Action, generated.ID, expected.Status, expected.KeyID, entry)
+		}
+	}
+	if adminKeyID == "" || entries[0].Error == "" {
+		t.Errorf("Expected the admin key of the accepted requests, and the error of the rejected one; Got %+v", entries)
+	}
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	service, _ := newAdminTestClient(t)
+	service.SetLimits(Limits{AdminRate: 0.001, AdminBurst: 2, MaxBodyBytes: 64})
+	get := func(remoteAddr string) int {
+		httpReq := httptest.NewRequest("GET", "/api/v1/admin/keys", nil)
+		httpReq.Header.Set("Api-Key", "not-a-key")
+		httpReq.RemoteAddr = remoteAddr
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+		return httpRespW.Code
+	}
+
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if code := get("192.0.2.1:1234"); code != expected {
+			t.Errorf("Expected %d for admin request %d; Got %d", expected, i+1, code)
+		}
+	}
+	if code := get("192.0.2.2:1234"); code != http.StatusUnauthorized {
+		t.Errorf("Expected another address to have its own limit; Got %d", code)
+	}
+
+	httpReq := httptest.NewRequest("POST", "/api/v1/admin/keys", strings.NewReader(`{"message": "`+strings.Repeat("a", 64)+`"}`))
+	httpReq.RemoteAddr = "192.0.2.3:1234"
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+	if httpRespW.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 Request Entity Too Large; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+}
@@ -24,14 +24,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	gorilla "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rakyll/statik/fs"
 
 	"github.com/metno/go-mms/pkg/mms"
@@ -47,17 +51,30 @@ type Version struct {
 
 // Service is a struct that wires up all data that is needed for this service to run.
 type Service struct {
-	eventsDB        *sql.DB
-	stateDB         *sql.DB
-	about           *About
-	htmlTemplates   *template.Template
-	Router          *mux.Router
-	NatsURL         string
-	NatsCredentials nats.Option
-	NatsLocal       bool
-	Metrics         *metrics
-	Productstatus   *Productstatus
-	Version         Version
+	events           EventStore
+	stateDB          *sql.DB
+	about            *About
+	htmlTemplates    *template.Template
+	Router           *mux.Router
+	NatsURL          string
+	NatsCredentials  nats.Option
+	NatsLocal        bool
+	NatsServer       *natsserver.Server // Embedded NATS server in nats-local mode, checked by healthz.
+	Metrics          *metrics
+	Productstatus    *Productstatus
+	Version          Version
+	publishers       *publisherPool
+	streams          *eventBroker
+	outbox           *outboxDispatcher
+	limits           Limits
+	keyLimiters      *rateLimiters
+	ipLimiters       *rateLimiters
+	adminLimiters    *rateLimiters
+	trustedProxies   []*net.IPNet
+	throttled        *prometheus.CounterVec
+	throttledAudit   *throttledAudit
+	retention        []RetentionRule
+	retentionDeleted *prometheus.CounterVec
 }
 
 // HTTPServerError is used when the server fails to return a correct response to the user.
@@ -66,11 +83,13 @@ type HTTPServerError struct {
 }
 
 // NewService creates a service struct, containing all that is needed for a mmsd server to run.
-func NewService(templates *template.Template, eventsDB *sql.DB, stateDB *sql.DB, natsURL string, natsCredentials nats.Option, version Version, natsLocal bool) *Service {
+func NewService(templates *template.Template, events EventStore, stateDB *sql.DB, natsURL string, natsCredentials nats.Option, version Version, natsLocal bool) *Service {
 	m := NewServiceMetrics(MetricsOpts{})
+	publisherMetrics := mms.NewPublisherMetrics()
+	m.MustRegister(publisherMetrics)
 
 	service := Service{
-		eventsDB:        eventsDB,
+		events:          events,
 		stateDB:         stateDB,
 		about:           aboutMMSd(version),
 		htmlTemplates:   templates,
@@ -81,7 +100,25 @@ func NewService(templates *template.Template, eventsDB *sql.DB, stateDB *sql.DB,
 		Metrics:         m,
 		Productstatus:   NewProductstatus(m),
 		Version:         version,
+		publishers:      newPublisherPool(natsURL, mms.ProductStream, publisherMetrics),
+		streams:         newEventBroker(m),
+		keyLimiters:     newRateLimiters(),
+		ipLimiters:      newRateLimiters(),
+		adminLimiters:   newRateLimiters(),
+		throttledAudit:  newThrottledAudit(),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "mmsd",
+			Name:      "throttled_requests_total",
+			Help:      "The total number of requests rejected for exceeding a rate limit (key, ip or admin) or the size limit (size).",
+		}, []string{"limit"}),
+		retentionDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "mmsd",
+			Name:      "retention_deleted_events_total",
+			Help:      "The total number of events deleted by each retention rule.",
+		}, []string{"rule"}),
 	}
+	m.MustRegister(service.throttled, service.retentionDeleted)
+	service.outbox = newOutboxDispatcher(events, service.publisherFor, m)
 	service.setRoutes()
 
 	return &service
@@ -95,10 +132,26 @@ func (service *Service) setRoutes() {
 	}
 	// Events
 	service.Router.HandleFunc("/api/v1/events", service.Metrics.Endpoint("/v1/events", service.eventsHandler)).Methods("GET")
-	service.Router.Handle("/api/v1/events", proxyHeaders(service.postEventHandler)).Methods("POST")
+	service.Router.Handle("/api/v1/events", proxyHeaders(service.auditPosts(service.limitPosts(service.postEventHandler)))).Methods("POST")
+	service.Router.Handle("/api/v1/events:batch", proxyHeaders(service.auditPosts(service.limitPosts(service.postEventsBatchHandler)))).Methods("POST")
+	service.Router.HandleFunc("/api/v1/events/stream", service.streamEventsHandler).Methods("GET")
+
+	// Product status
+	service.Router.HandleFunc("/api/v1/productstatus", service.Metrics.Endpoint("/v1/productstatus", service.productstatusHandler)).Methods("GET")
+	service.Router.HandleFunc("/api/v1/productstatus/{product:.+}", service.Metrics.Endpoint("/v1/productstatus/product", service.productHandler)).Methods("GET")
+
+	// Administration of the API keys
+	service.Router.Handle("/api/v1/admin/keys", proxyHeaders(service.limitAdmin(service.listKeysHandler))).Methods("GET")
+	service.Router.Handle("/api/v1/admin/keys", proxyHeaders(service.limitAdmin(service.auditAdmin(AdminCreateKey, service.createKeyHandler)))).Methods("POST")
+	service.Router.Handle("/api/v1/admin/keys/{id:[0-9a-f]+}", proxyHeaders(service.limitAdmin(service.getKeyHandler))).Methods("GET")
+	service.Router.Handle("/api/v1/admin/keys/{id:[0-9a-f]+}", proxyHeaders(service.limitAdmin(service.auditAdmin(AdminRevokeKey, service.revokeKeyHandler)))).Methods("DELETE")
+	service.Router.Handle("/api/v1/admin/keys/{id:[0-9a-f]+}:rotate", proxyHeaders(service.limitAdmin(service.auditAdmin(AdminRotateKey, service.rotateKeyHandler)))).Methods("POST")
+	service.Router.Handle("/api/v1/admin/audit", proxyHeaders(service.limitAdmin(service.auditHandler))).Methods("GET")
 
 	// Health of the service
 	service.Router.HandleFunc("/api/v1/healthz", HealthzHandler(service.checkHealthz))
+	service.Router.HandleFunc("/api/v1/livez", service.livezHandler)
+	service.Router.HandleFunc("/api/v1/readyz", service.readyzHandler)
 
 	// Service discovery metadata for the world
 	service.Router.Handle("/api/v1/about", proxyHeaders(AboutHandler(service.about)))
@@ -121,14 +174,20 @@ func (service *Service) setRoutes() {
 
 // proxyHeaders is a http handler function for setting scheme and host correctly when behind a proxy.
 // Usually needed when the response consists of urls to the service.
+// The remote address is left as the address of the peer, since the forwarded address is only trusted from known proxies,
+// see clientAddress.
 func proxyHeaders(next func(httpRespW http.ResponseWriter, httpReq *http.Request)) http.Handler {
-	setSchemeIfEmpty := func(httpRespW http.ResponseWriter, httpReq *http.Request) {
-		if httpReq.URL.Scheme == "" {
-			httpReq.URL.Scheme = "http"
+	return http.HandlerFunc(func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+		peerAddress := httpReq.RemoteAddr
+		setSchemeIfEmpty := func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+			httpReq.RemoteAddr = peerAddress
+			if httpReq.URL.Scheme == "" {
+				httpReq.URL.Scheme = "http"
+			}
+			next(httpRespW, httpReq)
 		}
-		next(httpRespW, httpReq)
-	}
-	return gorilla.ProxyHeaders(http.HandlerFunc(setSchemeIfEmpty))
+		gorilla.ProxyHeaders(http.HandlerFunc(setSchemeIfEmpty)).ServeHTTP(httpRespW, httpReq)
+	})
 }
 
 const eventsApiResponseTimeoutSecs = 15
@@ -137,7 +196,13 @@ func (service *Service) eventsHandler(httpRespW http.ResponseWriter, httpReq *ht
 	dbCtx, cancel := context.WithTimeout(httpReq.Context(), time.Duration(eventsApiResponseTimeoutSecs)*time.Second)
 	defer cancel()
 
-	events, err := service.GetAllEvents(dbCtx)
+	filter, err := mms.ParseEventFilter(httpReq.URL.Query())
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+
+	events, nextCursor, err := service.QueryEvents(dbCtx, filter)
 	if err != nil {
 		serverErrorResponse(err, httpRespW, httpReq)
 		return
@@ -148,6 +213,71 @@ func (service *Service) eventsHandler(httpRespW http.ResponseWriter, httpReq *ht
 		http.Error(httpRespW, "Failed to serialize data.", http.StatusInternalServerError)
 		return
 	}
+	if nextCursor != "" {
+		httpRespW.Header().Set("Next-Cursor", nextCursor)
+	}
+	okResponse(payload, httpRespW, httpReq)
+}
+
+// productstatusHandler lists the status of all known products, optionally only those in a given state.
+func (service *Service) productstatusHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	state := mms.ProductState(httpReq.URL.Query().Get("state"))
+	switch state {
+	case "", mms.ProductStateOnTime, mms.ProductStateLate, mms.ProductStateOverdue, mms.ProductStateUnknown:
+	default:
+		errorResponse(fmt.Errorf("unknown state: %s", state), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+
+	statuses := []mms.ProductStatus{}
+	for _, status := range service.Productstatus.Statuses(time.Now()) {
+		if state == "" || status.State == state {
+			statuses = append(statuses, status)
+		}
+	}
+
+	payload, err := json.Marshal(statuses)
+	if err != nil {
+		http.Error(httpRespW, "Failed to serialize data.", http.StatusInternalServerError)
+		return
+	}
+	okResponse(payload, httpRespW, httpReq)
+}
+
+// productHandler gives the status of one product, from the production hub given by the productionHub parameter.
+// The parameter may be left out for a product that only comes from one production hub.
+// The product may contain '/', so it is the rest of the path.
+func (service *Service) productHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	product := mux.Vars(httpReq)["product"]
+	productionHub := httpReq.URL.Query().Get("productionHub")
+
+	var matches []mms.ProductStatus
+	if productionHub != "" {
+		if status, ok := service.Productstatus.Status(productionHub, product, time.Now()); ok {
+			matches = append(matches, status)
+		}
+	} else {
+		for _, status := range service.Productstatus.Statuses(time.Now()) {
+			if status.Product == product {
+				matches = append(matches, status)
+			}
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		errorResponse(fmt.Errorf("no events known for product: %s", product), http.StatusNotFound, httpRespW, httpReq)
+		return
+	case len(matches) > 1:
+		errorResponse(fmt.Errorf("product %s comes from several production hubs, give productionHub", product), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	status := matches[0]
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		http.Error(httpRespW, "Failed to serialize data.", http.StatusInternalServerError)
+		return
+	}
 	okResponse(payload, httpRespW, httpReq)
 }
 
@@ -167,6 +297,16 @@ func (service *Service) docsHandler(httpRespW http.ResponseWriter, httpReq *http
 	}
 }
 
+// postEventResponse is the answer to a posted event that has been stored and will be published.
+type postEventResponse struct {
+	ID        int64  `json:"id"`
+	EventID   string `json:"eventId"`
+	Duplicate bool   `json:"duplicate,omitempty"` // The event was already stored, and is not published again.
+}
+
+// maxIdempotencyKeyLength limits the size of the event ids given by clients.
+const maxIdempotencyKeyLength = 255
+
 // Post an event to the API
 func (service *Service) postEventHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
 
@@ -174,86 +314,160 @@ func (service *Service) postEventHandler(httpRespW http.ResponseWriter, httpReq
 		httpRespW.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	log.Print("Post started")
+	var pEvent mms.ProductEvent
+	auth, ok := service.authorizePost(httpRespW, httpReq)
+	if !ok || !service.allowEvents(httpRespW, httpReq, auth, 1) {
+		return
+	}
+
+	payLoad, ok := service.readBody(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	err := json.Unmarshal(payLoad, &pEvent)
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		log.Printf("failed to unmarshal request body: %v", err)
+		return
+	}
+
+	// A retried post with the same Idempotency-Key gets the same event id, and is only stored and published once.
+	if idempotencyKey := httpReq.Header.Get("Idempotency-Key"); idempotencyKey != "" {
+		pEvent.EventID = idempotencyKey
+	}
+	audited := postAuditOf(httpReq).addEvent(&pEvent, nil)
+	if err := validatePostedEvent(&pEvent); err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		log.Print(err)
+		return
+	}
+	if err := auth.scope.AllowsEvent(&pEvent); err != nil {
+		errorResponse(err, http.StatusForbidden, httpRespW, httpReq)
+		log.Printf("forbidden: %v", err)
+		return
+	}
+
+	// The event is published by the outbox dispatcher, so a NATS outage does not lose events that are already stored.
+	eventIDs, duplicates, err := service.events.SaveEvents(httpReq.Context(), []*mms.ProductEvent{&pEvent}, auth.queueName, auth.natsUser)
+	if err != nil {
+		log.Printf("could not save to database: %v", err)
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		return
+	}
+	eventID := eventIDs[0]
+	if duplicates[0] {
+		audited.duplicate = true
+		log.Printf("event %s is already stored as %d", pEvent.EventID, eventID)
+		payLoad, _ = json.Marshal(postEventResponse{ID: eventID, EventID: pEvent.EventID, Duplicate: true})
+		httpRespW.Header().Set("Content-Type", "application/json")
+		httpRespW.WriteHeader(http.StatusOK)
+		httpRespW.Write(payLoad)
+		return
+	}
+	service.outbox.notify()
+
+	payLoad, err = json.Marshal(postEventResponse{ID: eventID, EventID: pEvent.EventID})
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+	}
+	httpRespW.Header().Set("Content-Type", "application/json")
+	httpRespW.WriteHeader(http.StatusAccepted)
+	httpRespW.Write(payLoad)
+
+	service.eventAccepted(eventID, &pEvent)
+}
+
+// postAuthorization is what the API key of a request posting events allows.
+type postAuthorization struct {
+	keyID     string     // Identifies the API key in rate limits.
+	natsUser  string     // The NATS user publishing the events, if not nats-local.
+	queueName string     // The subjects of the events are below the queue name.
+	scope     KeyScope   // The events must be within the scope.
+	rateLimit *RateLimit // Overrides the rate limit of the API keys.
+}
+
+// authorizePost checks the API key and Queue-Name of a request posting events, and answers the request if they are not accepted.
+func (service *Service) authorizePost(httpRespW http.ResponseWriter, httpReq *http.Request) (*postAuthorization, bool) {
 	var err error
 	var validKey bool
-	var natsUser string
-	var pEvent mms.ProductEvent
-	var payLoad []byte
-	var postCredentials nats.Option
+	auth := postAuthorization{scope: DefaultKeyScope}
 	apiKey := httpReq.Header.Get("Api-Key")
 	if apiKey == "" {
-		http.Error(httpRespW, "API key invalid or missing", http.StatusUnauthorized)
+		errorResponse(fmt.Errorf("API key invalid or missing"), http.StatusUnauthorized, httpRespW, httpReq)
 		log.Print("unauthorized: API key invalid or missing")
-		return
+		return nil, false
 	}
 	if service.NatsLocal {
 		validKey, err = ValidateApiKey(service.stateDB, apiKey)
-		postCredentials = service.NatsCredentials
+		if validKey {
+			var key *ApiKeyInfo
+			key, err = ReadApiKey(service.stateDB, apiKey)
+			validKey = err == nil && key != nil
+			if validKey {
+				auth.keyID, auth.scope, auth.rateLimit = key.ID, key.Scope, key.RateLimit
+			}
+		}
 	} else {
-		validKey, natsUser, err = ValidateJWTKey(service.stateDB, apiKey)
-		postCredentials = nats.UserCredentials(natsUser)
+		validKey, auth.natsUser, err = ValidateJWTKey(service.stateDB, apiKey)
+		if validKey {
+			auth.keyID = "nats:" + auth.natsUser
+		}
 	}
 	if err != nil {
 		log.Printf("Failed to validate key: %s", err)
 	}
-	queueName := httpReq.Header.Get("Queue-Name")
-	if queueName == "" {
-		queueName = "mms"
+	auth.queueName = httpReq.Header.Get("Queue-Name")
+	if auth.queueName == "" {
+		auth.queueName = mms.DefaultSubjectPrefix
 	}
 
+	postAuditOf(httpReq).authorize(auth.keyID, auth.queueName)
+
 	if !validKey {
-		http.Error(httpRespW, "Unauthorized API key submitted", http.StatusUnauthorized)
+		errorResponse(fmt.Errorf("Unauthorized API key submitted"), http.StatusUnauthorized, httpRespW, httpReq)
 		log.Print("unauthorized: API key not accepted")
-		return
+		return nil, false
 	}
 
-	payLoad, err = ioutil.ReadAll(httpReq.Body)
-	if err != nil {
-		http.Error(httpRespW, fmt.Sprintf("%v", err), http.StatusInternalServerError)
-		log.Printf("failed reading request body: %v", err)
-		return
+	if !validQueueName(auth.queueName) {
+		errorResponse(fmt.Errorf("Queue-Name %q is not a valid NATS subject", auth.queueName), http.StatusBadRequest, httpRespW, httpReq)
+		log.Printf("invalid Queue-Name %q", auth.queueName)
+		return nil, false
 	}
 
-	err = json.Unmarshal(payLoad, &pEvent)
-	if err != nil {
-		http.Error(httpRespW, fmt.Sprintf("%v", err), http.StatusBadRequest)
-		log.Printf("failed to unmarshal request body: %v", err)
-		return
+	if !auth.scope.HasRole(KeyRoleWrite) {
+		errorResponse(fmt.Errorf("API key may not post events"), http.StatusForbidden, httpRespW, httpReq)
+		log.Print("forbidden: API key does not have the write role")
+		return nil, false
 	}
+	if !auth.scope.AllowsQueueName(auth.queueName) {
+		errorResponse(fmt.Errorf("API key may not post to Queue-Name %q", auth.queueName), http.StatusForbidden, httpRespW, httpReq)
+		log.Printf("forbidden: API key may not post to Queue-Name %q", auth.queueName)
+		return nil, false
+	}
+
+	return &auth, true
+}
 
+// validatePostedEvent checks that a posted event can be stored and published, and gives it a random id if it has none.
+func validatePostedEvent(pEvent *mms.ProductEvent) error {
 	if pEvent.ProductionHub == "" {
-		http.Error(httpRespW, "ProductionHub must be given", http.StatusBadRequest)
-		log.Print("ProductionHub must be given")
-		return
+		return fmt.Errorf("ProductionHub must be given")
 	}
-
-	err = saveProductEvent(service.eventsDB, &pEvent)
-	if err != nil {
-		log.Printf("could not save to database: %v", err)
-		http.Error(httpRespW, fmt.Sprintf("%v", err), http.StatusInternalServerError)
-		return
+	if len(pEvent.EventID) > maxIdempotencyKeyLength {
+		return fmt.Errorf("Idempotency-Key is longer than %d characters", maxIdempotencyKeyLength)
 	}
-
-	err = mms.MakeProductEvent(service.NatsURL, postCredentials, &pEvent, queueName, service.NatsLocal)
-	if err != nil {
-		http.Error(httpRespW, fmt.Sprintf("%v", err), http.StatusBadRequest)
-		log.Printf("failed to create ProductEvent: %v", err)
-		return
+	if pEvent.EventID == "" {
+		pEvent.EventID = uuid.New().String()
 	}
-
-	httpRespW.WriteHeader(http.StatusCreated)
-	service.Productstatus.PushEvent(pEvent)
-	log.Print("Post ended")
-
+	return nil
 }
 
-// checkHealthz is supplied to HealthzHandler as a callback function.
-func (service *Service) checkHealthz() (*Healthz, error) {
-	return &Healthz{
-		Status:      HealthzStatusHealthy,
-		Description: "No deps, so everything is ok all the time.",
-	}, nil
+// eventAccepted updates the product status and the event streams with a newly stored event.
+func (service *Service) eventAccepted(eventID int64, pEvent *mms.ProductEvent) {
+	service.Productstatus.PushEvent(*pEvent)
+	service.streams.publish(StoredEvent{ID: eventID, Event: pEvent})
 }
 
 func okResponse(payload []byte, httpRespW http.ResponseWriter, httpReq *http.Request) {
@@ -266,6 +480,29 @@ func okResponse(payload []byte, httpRespW http.ResponseWriter, httpReq *http.Req
 }
 
 func serverErrorResponse(errMsg error, httpRespW http.ResponseWriter, httpReq *http.Request) {
+	errorResponse(errMsg, http.StatusServiceUnavailable, httpRespW, httpReq)
+}
+
+// jsonResponse answers with response as JSON.
+func jsonResponse(response interface{}, statusCode int, httpRespW http.ResponseWriter, httpReq *http.Request) {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		http.Error(httpRespW, "Failed to serialize data.", http.StatusInternalServerError)
+		return
+	}
+	httpRespW.Header().Set("Content-Type", "application/json")
+	httpRespW.WriteHeader(statusCode)
+	if _, err := httpRespW.Write(payload); err != nil {
+		log.Printf("failed to send response to req %q: %s", httpReq.URL, err)
+	}
+}
+
+// errorResponse sends errMsg as a HTTPServerError with the given status code.
+// The error is recorded in the audit trail if the request posts events or changes API keys.
+func errorResponse(errMsg error, statusCode int, httpRespW http.ResponseWriter, httpReq *http.Request) {
+	postAuditOf(httpReq).reject(errMsg)
+	adminAuditOf(httpReq).reject(errMsg)
+
 	errResponse := HTTPServerError{
 		ErrMsg: errMsg.Error(),
 	}
@@ -275,11 +512,21 @@ func serverErrorResponse(errMsg error, httpRespW http.ResponseWriter, httpReq *h
 		http.Error(httpRespW, "failed to serialize data", http.StatusInternalServerError)
 		return
 	}
-	httpRespW.WriteHeader(http.StatusServiceUnavailable)
-
 	httpRespW.Header().Set("Content-Type", "application/json")
+	httpRespW.WriteHeader(statusCode)
+
 	_, err = httpRespW.Write(payload)
 	if err != nil {
 		log.Printf("failed to send response to req %q: %s", httpReq.URL, err)
 	}
 }
+
+// validQueueName reports whether queueName can be the beginning of the subjects events are published on.
+func validQueueName(queueName string) bool {
+	for _, token := range strings.Split(queueName, ".") {
+		if token == "" || strings.ContainsAny(token, "*> \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+func TestClientPostEvent(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	client, _ := mms.NewClient(ts.URL, mms.ClientConfig{APIKey: testAPIKey})
+	result, err := client.PostProductEvent(context.Background(), "mms", &mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+	if err != nil || result.ID == 0 || result.EventID == "" {
+		t.Errorf("Expected the event to be accepted; Got %+v, %v", result, err)
+	}
+
+	client, _ = mms.NewClient(ts.URL, mms.ClientConfig{APIKey: "not-a-key"})
+	_, err = client.PostProductEvent(context.Background(), "mms", &mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+	var apiErr *mms.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "Unauthorized API key submitted" {
+		t.Errorf("Expected 401 with the error of the server; Got %v", err)
+	}
+}
@@ -0,0 +1,674 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// Outcomes of posted events in the audit trail.
+const (
+	AuditAccepted  = "accepted"  // The event is stored and will be published.
+	AuditDuplicate = "duplicate" // An event with the same id was already stored.
+	AuditRejected  = "rejected"  // The post was not accepted.
+)
+
+const (
+	// DefaultAuditLimit is the number of audit entries given when no limit is asked for.
+	DefaultAuditLimit = 100
+	// MaxAuditLimit is the largest number of audit entries given at once.
+	MaxAuditLimit = 10000
+)
+
+// auditTimeFormat has a fixed number of decimals, so the times of the audit trail sort as text.
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+const createAuditTable = `CREATE TABLE IF NOT EXISTS "post_audit" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"time" TEXT NOT NULL,
+	"keyId" TEXT,
+	"clientAddress" TEXT,
+	"userAgent" TEXT,
+	"eventId" TEXT,
+	"product" TEXT,
+	"productionHub" TEXT,
+	"queueName" TEXT,
+	"status" INTEGER,
+	"outcome" TEXT,
+	"error" TEXT
+);
+CREATE INDEX IF NOT EXISTS "post_audit_time_idx" ON "post_audit" ("time");
+CREATE INDEX IF NOT EXISTS "post_audit_event_idx" ON "post_audit" ("eventId");`
+
+const createAdminAuditTable = `CREATE TABLE IF NOT EXISTS "admin_audit" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"time" TEXT NOT NULL,
+	"keyId" TEXT,
+	"clientAddress" TEXT,
+	"userAgent" TEXT,
+	"action" TEXT NOT NULL,
+	"targetKeyId" TEXT,
+	"status" INTEGER,
+	"error" TEXT
+);
+CREATE INDEX IF NOT EXISTS "admin_audit_time_idx" ON "admin_audit" ("time");`
+
+// Actions of the admin audit trail.
+const (
+	AdminCreateKey = "create" // An API key was generated or added.
+	AdminRevokeKey = "revoke"
+	AdminRotateKey = "rotate"
+)
+
+// throttledAuditWindow is how long the throttled posts of an API key from a client address are counted in one audit entry.
+const throttledAuditWindow = time.Minute
+
+// AuditEntry records an attempt to post an event. Posts of batches get an entry for each event, and posts rejected
+// before the events are read get one entry without an event. Posts throttled by the limits get one entry for each
+// API key, client address and status each minute, counting the throttled posts.
+type AuditEntry struct {
+	ID            int64     `json:"id"`
+	Time          time.Time `json:"time"`
+	KeyID         string    `json:"keyId,omitempty"` // Not set when the API key is not accepted.
+	ClientAddress string    `json:"clientAddress"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+	EventID       string    `json:"eventId,omitempty"`
+	Product       string    `json:"product,omitempty"`
+	ProductionHub string    `json:"productionHub,omitempty"`
+	QueueName     string    `json:"queueName,omitempty"`
+	Status        int       `json:"status"` // HTTP status of the answer to the post.
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"` // Why the post was rejected.
+	Count         int       `json:"count"`           // Number of posts recorded by the entry, more than 1 for throttled posts.
+}
+
+// AdminAuditEntry records an attempt to change the API keys through the admin API.
+type AdminAuditEntry struct {
+	ID            int64     `json:"id"`
+	Time          time.Time `json:"time"`
+	KeyID         string    `json:"keyId,omitempty"` // Id of the admin key. Not set when the key is not accepted.
+	ClientAddress string    `json:"clientAddress"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+	Action        string    `json:"action"`
+	TargetKeyID   string    `json:"targetKeyId,omitempty"` // Id of the key created, revoked or rotated.
+	Status        int       `json:"status"`                // HTTP status of the answer to the request.
+	Error         string    `json:"error,omitempty"`       // Why the request was rejected.
+}
+
+// AuditFilter selects entries of the audit trail. Empty fields select all entries.
+type AuditFilter struct {
+	KeyID         string
+	ClientAddress string
+	EventID       string
+	Product       string
+	ProductionHub string
+	QueueName     string
+	Outcome       string
+	Since         time.Time
+	Until         time.Time
+	Limit         int // The number of newest entries to give, DefaultAuditLimit if 0.
+}
+
+// ReadAudit gives the entries of the audit trail selected by filter, newest first.
+func ReadAudit(db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	for _, f := range []struct {
+		column, value string
+	}{
+		{"keyId", filter.KeyID},
+		{"clientAddress", filter.ClientAddress},
+		{"eventId", filter.EventID},
+		{"product", filter.Product},
+		{"productionHub", filter.ProductionHub},
+		{"queueName", filter.QueueName},
+		{"outcome", filter.Outcome},
+	} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.Since.UTC().Format(auditTimeFormat))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, filter.Until.UTC().Format(auditTimeFormat))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditLimit
+	}
+
+	query := `SELECT id, time, keyId, clientAddress, userAgent, eventId, product, productionHub, queueName, status, outcome, error, count FROM post_audit`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	rows, err := db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit trail from db: %s", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var entryTime string
+		var keyID, clientAddress, userAgent, eventID, product, productionHub, queueName, outcome, errMsg sql.NullString
+		if err := rows.Scan(&entry.ID, &entryTime, &keyID, &clientAddress, &userAgent, &eventID, &product, &productionHub,
+			&queueName, &entry.Status, &outcome, &errMsg, &entry.Count); err != nil {
+			return nil, fmt.Errorf("failed to read audit trail from db: %s", err)
+		}
+		entry.Time, _ = time.Parse(auditTimeFormat, entryTime)
+		entry.KeyID, entry.ClientAddress, entry.UserAgent = keyID.String, clientAddress.String, userAgent.String
+		entry.EventID, entry.Product, entry.ProductionHub = eventID.String, product.String, productionHub.String
+		entry.QueueName, entry.Outcome, entry.Error = queueName.String, outcome.String, errMsg.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ListAudit prints the entries of the audit trail selected by filter, newest first.
+func ListAudit(db *sql.DB, filter AuditFilter) error {
+	entries, err := ReadAudit(db, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-27s  %-9s  %-15s  %-36s  %-20s  %-15s  %-10s  %-4s  %-9s  %-5s  %s\n",
+		"Time", "Key ID", "Client", "Event ID", "Product", "Production Hub", "Queue", "Code", "Outcome", "Posts", "Error")
+	for _, e := range entries {
+		fmt.Printf("%-27s  %-9s  %-15s  %-36s  %-20s  %-15s  %-10s  %-4d  %-9s  %-5d  %s\n", e.Time.Format(auditTimeFormat), orNone(e.KeyID),
+			e.ClientAddress, orNone(e.EventID), orNone(e.Product), orNone(e.ProductionHub), orNone(e.QueueName), e.Status, e.Outcome, e.Count, e.Error)
+	}
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// ReadAdminAudit gives the entries of the admin audit trail selected by the key id, client address, times and limit
+// of filter, newest first.
+func ReadAdminAudit(db *sql.DB, filter AuditFilter) ([]AdminAuditEntry, error) {
+	var where []string
+	var args []interface{}
+	for _, f := range []struct {
+		column, value string
+	}{
+		{"keyId", filter.KeyID},
+		{"clientAddress", filter.ClientAddress},
+	} {
+		if f.value != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.Since.UTC().Format(auditTimeFormat))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, filter.Until.UTC().Format(auditTimeFormat))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditLimit
+	}
+
+	query := `SELECT id, time, keyId, clientAddress, userAgent, action, targetKeyId, status, error FROM admin_audit`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	rows, err := db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin audit trail from db: %s", err)
+	}
+	defer rows.Close()
+
+	entries := []AdminAuditEntry{}
+	for rows.Next() {
+		var entry AdminAuditEntry
+		var entryTime string
+		var keyID, clientAddress, userAgent, targetKeyID, errMsg sql.NullString
+		if err := rows.Scan(&entry.ID, &entryTime, &keyID, &clientAddress, &userAgent, &entry.Action, &targetKeyID,
+			&entry.Status, &errMsg); err != nil {
+			return nil, fmt.Errorf("failed to read admin audit trail from db: %s", err)
+		}
+		entry.Time, _ = time.Parse(auditTimeFormat, entryTime)
+		entry.KeyID, entry.ClientAddress, entry.UserAgent = keyID.String, clientAddress.String, userAgent.String
+		entry.TargetKeyID, entry.Error = targetKeyID.String, errMsg.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ListAdminAudit prints the entries of the admin audit trail selected by filter, newest first.
+func ListAdminAudit(db *sql.DB, filter AuditFilter) error {
+	entries, err := ReadAdminAudit(db, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-27s  %-9s  %-15s  %-6s  %-10s  %-4s  %s\n", "Time", "Key ID", "Client", "Action", "Target Key", "Code", "Error")
+	for _, e := range entries {
+		fmt.Printf("%-27s  %-9s  %-15s  %-6s  %-10s  %-4d  %s\n", e.Time.Format(auditTimeFormat), orNone(e.KeyID), e.ClientAddress,
+			e.Action, orNone(e.TargetKeyID), e.Status, e.Error)
+	}
+	return nil
+}
+
+// DeleteOldAudit removes the entries of the audit trails older than before, and gives the number of removed entries.
+func (service *Service) DeleteOldAudit(before time.Time) (int64, error) {
+	var deleted int64
+	for _, table := range []string{"post_audit", "admin_audit"} {
+		result, err := service.stateDB.Exec(`DELETE FROM `+table+` WHERE time < ?`, before.UTC().Format(auditTimeFormat))
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete old audit entries from db: %s", err)
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+	}
+	return deleted, nil
+}
+
+const insertAuditEntry = `INSERT INTO post_audit (time, keyId, clientAddress, userAgent, eventId, product, productionHub, queueName, status, outcome, error, count)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// auditValues gives the values of e for insertAuditEntry. Entries without a count record one post.
+func auditValues(e AuditEntry) []interface{} {
+	count := e.Count
+	if count == 0 {
+		count = 1
+	}
+	return []interface{}{e.Time.UTC().Format(auditTimeFormat), e.KeyID, e.ClientAddress, e.UserAgent, e.EventID, e.Product,
+		e.ProductionHub, e.QueueName, e.Status, e.Outcome, e.Error, count}
+}
+
+// writeAudit adds entries to the audit trail in one transaction.
+func writeAudit(db *sql.DB, entries []AuditEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(insertAuditEntry)
+	if err != nil {
+		return fmt.Errorf("failed to prepare audit statement: %s", err)
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if _, err := stmt.Exec(auditValues(e)...); err != nil {
+			return fmt.Errorf("failed to add audit entry to db: %s", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// throttledAudit counts the posts throttled by the limits in one audit entry for each API key, client address and
+// status each throttledAuditWindow, so a client flooding the service leaves a trace without also flooding the state db.
+type throttledAudit struct {
+	mu      sync.Mutex
+	entries map[throttledAuditKey]*throttledAuditEntry
+}
+
+type throttledAuditKey struct {
+	keyID         string
+	clientAddress string
+	status        int
+}
+
+type throttledAuditEntry struct {
+	id      int64 // Id of the entry in the audit trail.
+	start   time.Time
+	count   int // Throttled posts since start.
+	written int // Throttled posts counted in the audit trail.
+}
+
+func newThrottledAudit() *throttledAudit {
+	return &throttledAudit{entries: map[throttledAuditKey]*throttledAuditEntry{}}
+}
+
+// add records a throttled post. The first post of its key, client address and status in a window is written to the
+// audit trail at once, and the others are counted by flush.
+func (audit *throttledAudit) add(db *sql.DB, entry AuditEntry) error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	key := throttledAuditKey{keyID: entry.KeyID, clientAddress: entry.ClientAddress, status: entry.Status}
+	throttled := audit.entries[key]
+	if throttled != nil && entry.Time.Sub(throttled.start) < throttledAuditWindow {
+		throttled.count++
+		return nil
+	}
+	if throttled != nil {
+		if err := throttled.write(db); err != nil {
+			return err
+		}
+	}
+
+	entry.Count = 1
+	result, err := db.Exec(insertAuditEntry, auditValues(entry)...)
+	if err != nil {
+		return fmt.Errorf("failed to add audit entry to db: %s", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to add audit entry to db: %s", err)
+	}
+	audit.entries[key] = &throttledAuditEntry{id: id, start: entry.Time, count: 1, written: 1}
+	return nil
+}
+
+// flush writes the counts of throttled posts to the audit trail, and forgets the entries whose window has ended at now.
+func (audit *throttledAudit) flush(db *sql.DB, now time.Time) error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	for key, throttled := range audit.entries {
+		if err := throttled.write(db); err != nil {
+			return err
+		}
+		if now.Sub(throttled.start) >= throttledAuditWindow {
+			delete(audit.entries, key)
+		}
+	}
+	return nil
+}
+
+// write updates the count of the entry in the audit trail, if it has changed.
+func (throttled *throttledAuditEntry) write(db *sql.DB) error {
+	if throttled.count == throttled.written {
+		return nil
+	}
+	if _, err := db.Exec(`UPDATE post_audit SET count = ? WHERE id = ?`, throttled.count, throttled.id); err != nil {
+		return fmt.Errorf("failed to count throttled posts in audit entry: %s", err)
+	}
+	throttled.written = throttled.count
+	return nil
+}
+
+// FlushThrottledAudit writes the counts of throttled posts to the audit trail. It should be called every minute or so.
+func (service *Service) FlushThrottledAudit(now time.Time) error {
+	return service.throttledAudit.flush(service.stateDB, now)
+}
+
+// postAudit gathers what is known about a post while it is handled, and is written to the audit trail when it is answered.
+type postAudit struct {
+	keyID     string
+	queueName string
+	err       string // Why the post was rejected.
+	events    []*auditedEvent
+}
+
+type auditedEvent struct {
+	event     *mms.ProductEvent // Read when the post is answered, so the event id given while handling the post is recorded.
+	err       string            // Why the event was rejected.
+	duplicate bool
+}
+
+type auditContextKey struct{}
+
+// postAuditOf gives the audit of a request posting events, or nil for other requests.
+func postAuditOf(httpReq *http.Request) *postAudit {
+	audit, _ := httpReq.Context().Value(auditContextKey{}).(*postAudit)
+	return audit
+}
+
+// authorize records the API key and Queue-Name of the post.
+func (audit *postAudit) authorize(keyID string, queueName string) {
+	if audit == nil {
+		return
+	}
+	audit.keyID, audit.queueName = keyID, queueName
+}
+
+// reject records why the post was rejected. Only the first error is kept.
+func (audit *postAudit) reject(err error) {
+	if audit == nil || audit.err != "" {
+		return
+	}
+	audit.err = err.Error()
+}
+
+// addEvent records an event of the post, and why it is rejected if err is not nil.
+func (audit *postAudit) addEvent(pEvent *mms.ProductEvent, err error) *auditedEvent {
+	audited := &auditedEvent{event: pEvent}
+	if err != nil {
+		audited.err = err.Error()
+	}
+	if audit != nil {
+		audit.events = append(audit.events, audited)
+	}
+	return audited
+}
+
+// entry gives the audit trail entry of a post from clientAddress answered with statusCode, without its events.
+func (audit *postAudit) entry(httpReq *http.Request, clientAddress string, statusCode int, now time.Time) AuditEntry {
+	entry := AuditEntry{
+		Time:          now,
+		KeyID:         audit.keyID,
+		ClientAddress: clientAddress,
+		UserAgent:     httpReq.UserAgent(),
+		QueueName:     audit.queueName,
+		Status:        statusCode,
+		Outcome:       AuditAccepted,
+	}
+	if statusCode >= http.StatusBadRequest {
+		entry.Outcome = AuditRejected
+		entry.Error = audit.err
+	}
+	return entry
+}
+
+// entries gives the audit trail entries of a post from clientAddress answered with statusCode, one for each event.
+func (audit *postAudit) entries(httpReq *http.Request, clientAddress string, statusCode int, now time.Time) []AuditEntry {
+	entry := audit.entry(httpReq, clientAddress, statusCode, now)
+	if len(audit.events) == 0 {
+		return []AuditEntry{entry}
+	}
+
+	entries := make([]AuditEntry, len(audit.events))
+	for i, audited := range audit.events {
+		entries[i] = entry
+		entries[i].EventID = audited.event.EventID
+		entries[i].Product = audited.event.Product
+		entries[i].ProductionHub = audited.event.ProductionHub
+		if audited.err != "" {
+			entries[i].Error = audited.err
+		}
+		if entry.Outcome == AuditAccepted && audited.duplicate {
+			entries[i].Outcome = AuditDuplicate
+		}
+	}
+	return entries
+}
+
+// statusRecorder remembers the status code a request is answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+// auditPosts records every post in the audit trail, also when the post is rejected. Posts throttled by the limits
+// are counted in one entry for each API key, client address and status each minute, see throttledAudit.
+func (service *Service) auditPosts(next func(httpRespW http.ResponseWriter, httpReq *http.Request)) func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	return func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+		audit := &postAudit{}
+		recorder := &statusRecorder{ResponseWriter: httpRespW, statusCode: http.StatusOK}
+		next(recorder, httpReq.WithContext(context.WithValue(httpReq.Context(), auditContextKey{}, audit)))
+
+		address := service.clientAddress(httpReq)
+		var err error
+		if recorder.statusCode == http.StatusTooManyRequests || recorder.statusCode == http.StatusRequestEntityTooLarge {
+			err = service.throttledAudit.add(service.stateDB, audit.entry(httpReq, address, recorder.statusCode, time.Now()))
+		} else {
+			err = writeAudit(service.stateDB, audit.entries(httpReq, address, recorder.statusCode, time.Now()))
+		}
+		if err != nil {
+			log.Printf("failed to audit post from %s: %v", address, err)
+		}
+	}
+}
+
+// adminAudit gathers what is known about a request changing API keys while it is handled, and is written to the
+// admin audit trail when it is answered.
+type adminAudit struct {
+	keyID       string
+	targetKeyID string
+	err         string // Why the request was rejected.
+}
+
+type adminAuditContextKey struct{}
+
+// adminAuditOf gives the audit of a request changing API keys, or nil for other requests.
+func adminAuditOf(httpReq *http.Request) *adminAudit {
+	audit, _ := httpReq.Context().Value(adminAuditContextKey{}).(*adminAudit)
+	return audit
+}
+
+// authorize records the id of the admin key of the request.
+func (audit *adminAudit) authorize(keyID string) {
+	if audit != nil {
+		audit.keyID = keyID
+	}
+}
+
+// target records the id of the key the request changes.
+func (audit *adminAudit) target(keyID string) {
+	if audit != nil {
+		audit.targetKeyID = keyID
+	}
+}
+
+// reject records why the request was rejected. Only the first error is kept.
+func (audit *adminAudit) reject(err error) {
+	if audit == nil || audit.err != "" {
+		return
+	}
+	audit.err = err.Error()
+}
+
+// auditAdmin records every request changing API keys with action in the admin audit trail, also when it is rejected.
+// The changed key is the one of the route, or the one recorded by the handler when a key is created.
+func (service *Service) auditAdmin(action string, next func(httpRespW http.ResponseWriter, httpReq *http.Request)) func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	return func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+		audit := &adminAudit{targetKeyID: mux.Vars(httpReq)["id"]}
+		recorder := &statusRecorder{ResponseWriter: httpRespW, statusCode: http.StatusOK}
+		next(recorder, httpReq.WithContext(context.WithValue(httpReq.Context(), adminAuditContextKey{}, audit)))
+
+		entry := AdminAuditEntry{
+			Time:          time.Now(),
+			KeyID:         audit.keyID,
+			ClientAddress: service.clientAddress(httpReq),
+			UserAgent:     httpReq.UserAgent(),
+			Action:        action,
+			TargetKeyID:   audit.targetKeyID,
+			Status:        recorder.statusCode,
+			Error:         audit.err,
+		}
+		_, err := service.stateDB.Exec(`INSERT INTO admin_audit (time, keyId, clientAddress, userAgent, action, targetKeyId, status, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, entry.Time.UTC().Format(auditTimeFormat), entry.KeyID, entry.ClientAddress, entry.UserAgent,
+			entry.Action, entry.TargetKeyID, entry.Status, entry.Error)
+		if err != nil {
+			log.Printf("failed to audit admin request from %s: %v", entry.ClientAddress, err)
+		}
+	}
+}
+
+// auditHandler gives the entries of the audit trail selected by the query parameters, newest first.
+func (service *Service) auditHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	if _, ok := service.authorizeAdmin(httpRespW, httpReq); !ok {
+		return
+	}
+
+	filter, err := ParseAuditFilter(httpReq.URL.Query().Get, time.Now())
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	entries, err := ReadAudit(service.stateDB, filter)
+	if err != nil {
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		log.Print(err)
+		return
+	}
+	jsonResponse(entries, http.StatusOK, httpRespW, httpReq)
+}
+
+// ParseAuditFilter reads a filter of the audit trail from the parameters keyId, clientAddress, eventId, product,
+// productionHub, queueName, outcome, since, until and limit.
+// The times since and until may be relative to now, such as now-1d.
+func ParseAuditFilter(param func(name string) string, now time.Time) (AuditFilter, error) {
+	filter := AuditFilter{
+		KeyID:         param("keyId"),
+		ClientAddress: param("clientAddress"),
+		EventID:       param("eventId"),
+		Product:       param("product"),
+		ProductionHub: param("productionHub"),
+		QueueName:     param("queueName"),
+		Outcome:       param("outcome"),
+	}
+	switch filter.Outcome {
+	case "", AuditAccepted, AuditDuplicate, AuditRejected:
+	default:
+		return AuditFilter{}, fmt.Errorf("unknown outcome %q, use %s, %s or %s", filter.Outcome, AuditAccepted, AuditDuplicate, AuditRejected)
+	}
+
+	var err error
+	if since := param("since"); since != "" {
+		if filter.Since, err = mms.ParseRelativeTime(since, now); err != nil {
+			return AuditFilter{}, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if until := param("until"); until != "" {
+		if filter.Until, err = mms.ParseRelativeTime(until, now); err != nil {
+			return AuditFilter{}, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if limit := param("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > MaxAuditLimit {
+			return AuditFilter{}, fmt.Errorf("limit must be a number from 1 to %d", MaxAuditLimit)
+		}
+	}
+	return filter, nil
+}
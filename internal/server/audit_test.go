@@ -0,0 +1,169 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditPosts(t *testing.T) {
+	service := newScopedTestService(t, "product=a*")
+	event := `{"Product": "arome", "ProductionHub": "` + productionHubName + `"}`
+
+	post := func(path, apiKey, idempotencyKey, body string) {
+		httpReq := httptest.NewRequest("POST", path, strings.NewReader(body))
+		httpReq.Header.Set("Api-Key", apiKey)
+		httpReq.Header.Set("User-Agent", "audit-test")
+		if idempotencyKey != "" {
+			httpReq.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		httpReq.RemoteAddr = "192.0.2.1:1234"
+		service.Router.ServeHTTP(httptest.NewRecorder(), httpReq)
+	}
+	post("/api/v1/events", testAPIKey, "audited-1", event)
+	post("/api/v1/events", testAPIKey, "audited-1", event)
+	post("/api/v1/events", "not-a-key", "", event)
+	post("/api/v1/events:batch", testScopedAPIKey, "", event+"\n"+`{"Product": "meps", "ProductionHub": "`+productionHubName+`"}`)
+
+	entries, err := ReadAudit(service.stateDB, AuditFilter{})
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("Expected 5 audit entries; Got %+v, %v", entries, err)
+	}
+	keyID, scopedKeyID := ApiKeyID(testAPIKey), ApiKeyID(testScopedAPIKey)
+	for i, expected := range []struct {
+		keyID, product, outcome string
+		status                  int
+		hasError                bool
+	}{
+		{scopedKeyID, "meps", AuditRejected, http.StatusForbidden, true},
+		{scopedKeyID, "arome", AuditRejected, http.StatusForbidden, true},
+		{"", "", AuditRejected, http.StatusUnauthorized, true},
+		{keyID, "arome", AuditDuplicate, http.StatusOK, false},
+		{keyID, "arome", AuditAccepted, http.StatusAccepted, false},
+	} {
+		entry := entries[i]
+		if entry.KeyID != expected.keyID || entry.Product != expected.product || entry.Outcome != expected.outcome ||
+			entry.Status != expected.status || (entry.Error != "") != expected.hasError {
+			t.Errorf("Expected entry %d to be %+v; Got %+v", i, expected, entry)
+		}
+		if entry.ClientAddress != "192.0.2.1" || entry.UserAgent != "audit-test" || entry.QueueName != "mms" {
+			t.Errorf("Expected the client, user agent and queue of the post; Got %+v", entry)
+		}
+	}
+	if entries[4].EventID != "audited-1" || entries[1].EventID == "" {
+		t.Errorf("Expected the event ids to be recorded; Got %q and %q", entries[4].EventID, entries[1].EventID)
+	}
+
+	entries, _ = ReadAudit(service.stateDB, AuditFilter{KeyID: keyID, Outcome: AuditAccepted})
+	if len(entries) != 1 || entries[0].EventID != "audited-1" {
+		t.Errorf("Expected the accepted post of the key; Got %+v", entries)
+	}
+	entries, _ = ReadAudit(service.stateDB, AuditFilter{Since: time.Now().Add(time.Hour)})
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries from the future; Got %+v", entries)
+	}
+
+	if n, err := service.DeleteOldAudit(time.Now().Add(time.Minute)); err != nil || n != 5 {
+		t.Errorf("Expected 5 entries deleted; Got %d, %v", n, err)
+	}
+}
+
+func TestThrottledAudit(t *testing.T) {
+	service := newScopedTestService(t)
+	keyID := ApiKeyID(testAPIKey)
+	start := time.Now()
+	throttled := func(keyID string, status int, at time.Duration) {
+		entry := AuditEntry{Time: start.Add(at), KeyID: keyID, ClientAddress: "192.0.2.1", Status: status, Outcome: AuditRejected, Error: "throttled"}
+		if err := service.throttledAudit.add(service.stateDB, entry); err != nil {
+			t.Fatalf("failed to audit throttled post: %s", err)
+		}
+	}
+	counts := func() []int {
+		entries, err := ReadAudit(service.stateDB, AuditFilter{})
+		if err != nil {
+			t.Fatalf("failed to read audit trail: %s", err)
+		}
+		var counts []int
+		for i := len(entries) - 1; i >= 0; i-- {
+			counts = append(counts, entries[i].Count)
+		}
+		return counts
+	}
+
+	// The first throttled post of a key and status is written at once, and the others are counted when flushed.
+	for i := 0; i < 3; i++ {
+		throttled(keyID, http.StatusTooManyRequests, time.Duration(i)*time.Second)
+	}
+	throttled(keyID, http.StatusRequestEntityTooLarge, 0)
+	throttled("", http.StatusTooManyRequests, 0)
+	if got := counts(); !reflect.DeepEqual(got, []int{1, 1, 1}) {
+		t.Errorf("Expected an entry for each key and status; Got counts %v", got)
+	}
+	if err := service.FlushThrottledAudit(start.Add(time.Second)); err != nil {
+		t.Fatalf("failed to flush throttled posts: %s", err)
+	}
+	if got := counts(); !reflect.DeepEqual(got, []int{3, 1, 1}) {
+		t.Errorf("Expected the throttled posts to be counted; Got counts %v", got)
+	}
+
+	// After a window, throttled posts get a new entry, and the count of the old one is written.
+	throttled(keyID, http.StatusTooManyRequests, 10*time.Second)
+	throttled(keyID, http.StatusTooManyRequests, throttledAuditWindow+time.Second)
+	if got := counts(); !reflect.DeepEqual(got, []int{4, 1, 1, 1}) {
+		t.Errorf("Expected a new entry after the window; Got counts %v", got)
+	}
+	if err := service.FlushThrottledAudit(start.Add(3 * throttledAuditWindow)); err != nil || len(service.throttledAudit.entries) != 0 {
+		t.Errorf("Expected the ended windows to be forgotten; Got %d, %v", len(service.throttledAudit.entries), err)
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	service := newScopedTestService(t)
+	adminKey, _ := GenerateApiKey(service.stateDB, "admin")
+	SetApiKeyScope(service.stateDB, adminKey, KeyScope{Roles: []KeyRole{KeyRoleAdmin}})
+	postTestBody(service, "/api/v1/events", testAPIKey, "", `{"Product": "arome", "ProductionHub": "`+productionHubName+`"}`)
+	postTestBody(service, "/api/v1/events", testAPIKey, "", `{"Product": "meps", "ProductionHub": "`+productionHubName+`"}`)
+
+	get := func(apiKey, query string) *httptest.ResponseRecorder {
+		httpReq := httptest.NewRequest("GET", "/api/v1/admin/audit"+query, nil)
+		httpReq.Header.Set("Api-Key", apiKey)
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+		return httpRespW
+	}
+
+	resp := get(adminKey, "?product=meps&since=now-1h")
+	var entries []AuditEntry
+	json.Unmarshal(resp.Body.Bytes(), &entries)
+	if resp.Code != http.StatusOK || len(entries) != 1 || entries[0].Product != "meps" {
+		t.Errorf("Expected the post of meps; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	for _, query := range []string{"?outcome=maybe", "?since=yesterday-", "?limit=0"} {
+		if resp := get(adminKey, query); resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 Bad Request for %s; Got %d: %s", query, resp.Code, resp.Body.String())
+		}
+	}
+	if resp := get(testAPIKey, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden without the admin role; Got %d", resp.Code)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// maxBatchErrors is the number of invalid events described in the error of a rejected batch.
+const maxBatchErrors = 5
+
+// postBatchItem is the result of one event of a posted batch.
+type postBatchItem struct {
+	ID        int64  `json:"id,omitempty"`
+	EventID   string `json:"eventId,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"` // Why the event is not valid.
+}
+
+// postBatchResponse is the answer to a posted batch of events. Error is only set when the batch is rejected.
+type postBatchResponse struct {
+	Error   string          `json:"error,omitempty"`
+	Results []postBatchItem `json:"results"`
+}
+
+// postEventsBatchHandler stores a batch of events, given as a JSON array or as newline delimited JSON, in one transaction.
+// If any of the events is invalid, or outside the scope of the API key, none are stored, and the response tells which ones are rejected.
+func (service *Service) postEventsBatchHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	auth, ok := service.authorizePost(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	payload, ok := service.readBody(httpRespW, httpReq)
+	if !ok {
+		return
+	}
+
+	items, err := splitEventsBatch(payload)
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if len(items) == 0 {
+		errorResponse(fmt.Errorf("no events in batch"), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if len(items) > mms.MaxBatchEvents {
+		errorResponse(fmt.Errorf("batch has %d events, at most %d are allowed", len(items), mms.MaxBatchEvents), http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+	if !service.allowEvents(httpRespW, httpReq, auth, len(items)) {
+		return
+	}
+
+	audit := postAuditOf(httpReq)
+	events := make([]*mms.ProductEvent, len(items))
+	audited := make([]*auditedEvent, len(items))
+	results := make([]postBatchItem, len(items))
+	var invalid []string
+	statusCode := http.StatusForbidden
+	for i, item := range items {
+		pEvent := mms.ProductEvent{}
+		err := json.Unmarshal(item, &pEvent)
+		if err == nil {
+			err = validatePostedEvent(&pEvent)
+		}
+		if err != nil {
+			// Invalid events make the whole batch a bad request, even if other events are forbidden.
+			statusCode = http.StatusBadRequest
+		} else {
+			err = auth.scope.AllowsEvent(&pEvent)
+		}
+		audited[i] = audit.addEvent(&pEvent, err)
+		if err != nil {
+			results[i].Error = err.Error()
+			invalid = append(invalid, fmt.Sprintf("event %d: %v", i, err))
+			continue
+		}
+		events[i] = &pEvent
+	}
+	if len(invalid) > 0 {
+		msg := strings.Join(invalid, "; ")
+		if len(invalid) > maxBatchErrors {
+			msg = fmt.Sprintf("%s; and %d more", strings.Join(invalid[:maxBatchErrors], "; "), len(invalid)-maxBatchErrors)
+		}
+		log.Printf("rejected batch of %d events with %d rejected events", len(items), len(invalid))
+		audit.reject(fmt.Errorf("batch rejected, %d of %d events are rejected", len(invalid), len(items)))
+		jsonResponse(postBatchResponse{Error: fmt.Sprintf("%d of %d events are rejected: %s", len(invalid), len(items), msg), Results: results},
+			statusCode, httpRespW, httpReq)
+		return
+	}
+
+	eventIDs, duplicates, err := service.events.SaveEvents(httpReq.Context(), events, auth.queueName, auth.natsUser)
+	if err != nil {
+		log.Printf("could not save to database: %v", err)
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		return
+	}
+	service.outbox.notify()
+
+	accepted := 0
+	for i, pEvent := range events {
+		results[i] = postBatchItem{ID: eventIDs[i], EventID: pEvent.EventID, Duplicate: duplicates[i]}
+		audited[i].duplicate = duplicates[i]
+		if !duplicates[i] {
+			accepted++
+			service.eventAccepted(eventIDs[i], pEvent)
+		}
+	}
+	log.Printf("stored %d of %d events posted in batch", accepted, len(events))
+
+	jsonResponse(postBatchResponse{Results: results}, http.StatusAccepted, httpRespW, httpReq)
+}
+
+// splitEventsBatch splits a JSON array, or newline delimited JSON, into the JSON of each event.
+func splitEventsBatch(payload []byte) ([]json.RawMessage, error) {
+	payload = bytes.TrimSpace(payload)
+	if bytes.HasPrefix(payload, []byte("[")) {
+		var items []json.RawMessage
+		if err := json.Unmarshal(payload, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array of events: %v", err)
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(line))
+	}
+	return items, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+func postTestBatch(t *testing.T, service *Service, payload string) (int, postBatchResponse) {
+	httpReq := httptest.NewRequest("POST", "/api/v1/events:batch", strings.NewReader(payload))
+	httpReq.Header.Set("Api-Key", testAPIKey)
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+
+	var resp postBatchResponse
+	if err := json.Unmarshal(httpRespW.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected a batch response; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+	return httpRespW.Code, resp
+}
+
+func TestPostEventsBatch(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	postTestEvent(t, service, mms.ProductEvent{Product: "a", ProductionHub: productionHubName, EventID: "a"})
+
+	// Newline delimited JSON, with an event that is already stored.
+	code, resp := postTestBatch(t, service, `{"Product": "a", "ProductionHub": "`+productionHubName+`", "EventID": "a"}
+
+{"Product": "b", "ProductionHub": "`+productionHubName+`"}
+{"Product": "c", "ProductionHub": "`+productionHubName+`", "EventID": "c"}
+`)
+	if code != http.StatusAccepted || len(resp.Results) != 3 {
+		t.Fatalf("Expected 202 with 3 results; Got %d: %+v", code, resp)
+	}
+	if !resp.Results[0].Duplicate || resp.Results[1].Duplicate || resp.Results[1].EventID == "" || resp.Results[2].EventID != "c" {
+		t.Errorf("Expected a to be a duplicate, and b and c to be stored; Got %+v", resp.Results)
+	}
+
+	// A JSON array.
+	code, resp = postTestBatch(t, service, `[{"Product": "d", "ProductionHub": "`+productionHubName+`"}]`)
+	if code != http.StatusAccepted || len(resp.Results) != 1 || resp.Results[0].ID == 0 {
+		t.Errorf("Expected 202 with 1 result; Got %d: %+v", code, resp)
+	}
+
+	events, _, err := service.QueryEvents(context.Background(), mms.EventFilter{})
+	if err != nil || len(events) != 4 {
+		t.Errorf("Expected 4 stored events; Got %v, %v", events, err)
+	}
+	entries, err := service.events.PendingOutbox(context.Background(), time.Now(), outboxBatchSize)
+	if err != nil || len(entries) != 4 {
+		t.Errorf("Expected 4 events in the outbox; Got %v, %v", entries, err)
+	}
+}
+
+func TestPostEventsBatchInvalid(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+
+	code, resp := postTestBatch(t, service, `{"Product": "a", "ProductionHub": "`+productionHubName+`"}
+{"Product": "b"}
+not json
+`)
+	if code != http.StatusBadRequest || len(resp.Results) != 3 || resp.Error == "" {
+		t.Fatalf("Expected 400 with 3 results; Got %d: %+v", code, resp)
+	}
+	if resp.Results[0].Error != "" || resp.Results[1].Error == "" || resp.Results[2].Error == "" {
+		t.Errorf("Expected the second and third events to be invalid; Got %+v", resp.Results)
+	}
+
+	events, _, err := service.QueryEvents(context.Background(), mms.EventFilter{})
+	if err != nil || len(events) != 0 {
+		t.Errorf("Expected no stored events; Got %v, %v", events, err)
+	}
+}
+
+func TestClientPostEventsBatch(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+	client, _ := mms.NewClient(ts.URL, mms.ClientConfig{APIKey: testAPIKey})
+
+	results, err := client.PostProductEvents(context.Background(), "mms", []*mms.ProductEvent{
+		{Product: "a", ProductionHub: productionHubName},
+		{Product: "b", ProductionHub: productionHubName},
+	})
+	if err != nil || len(results) != 2 || results[0].ID == 0 || results[1].ID == 0 {
+		t.Errorf("Expected both events to be stored; Got %+v, %v", results, err)
+	}
+
+	results, err = client.PostProductEvents(context.Background(), "mms", []*mms.ProductEvent{
+		{Product: "c", ProductionHub: productionHubName},
+		{Product: "d"},
+	})
+	var apiErr *mms.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400; Got %v", err)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != "ProductionHub must be given" {
+		t.Errorf("Expected the second event to be invalid; Got %+v", results)
+	}
+}
@@ -18,12 +18,16 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/metno/go-mms/pkg/mms"
 )
 
 const productionHubName = "default"
@@ -68,6 +72,104 @@ func TestNewEventsDB(t *testing.T) {
 	os.Remove(dbTestFile)
 }
 
+func TestQueryEvents(t *testing.T) {
+	dbTestFile := fmt.Sprintf("/tmp/mmsdtestsqlite%d.db", rand.Int())
+	defer os.Remove(dbTestFile)
+	eventsDB, err := NewEventsDB(dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to create db: %s", err)
+	}
+	service := NewService(CreateTemplates(), NewSQLiteEventStore(eventsDB), nil, "", nil, Version{}, true)
+
+	start := time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		product := "arome_arctic"
+		if i%2 == 1 {
+			product = "meps"
+		}
+		_, err := insertProductEvent(eventsDB, &mms.ProductEvent{
+			Product:       product,
+			ProductionHub: productionHubName,
+			JobName:       fmt.Sprintf("job%d", i),
+			RefTime:       mms.PEventTime(start),
+			CreatedAt:     mms.PEventTime(start.Add(time.Duration(i) * time.Hour)),
+		})
+		if err != nil {
+			t.Fatalf("failed to save event: %s", err)
+		}
+	}
+
+	events, _, err := service.QueryEvents(context.Background(), mms.EventFilter{Product: "arome*"})
+	if err != nil {
+		t.Fatalf("failed to query events: %s", err)
+	}
+	if len(events) != 3 {
+		t.Errorf("Expected 3 arome events; Got %d events", len(events))
+	}
+
+	events, _, err = service.QueryEvents(context.Background(), mms.EventFilter{
+		Since: start.Add(time.Hour),
+		Until: start.Add(3 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("failed to query events: %s", err)
+	}
+	if len(events) != 2 || events[0].JobName != "job1" {
+		t.Errorf("Expected job1 and job2; Got %d events", len(events))
+	}
+
+	// Page through all events, newest first.
+	var jobNames []string
+	filter := mms.EventFilter{Limit: 2, Descending: true}
+	for {
+		events, cursor, err := service.QueryEvents(context.Background(), filter)
+		if err != nil {
+			t.Fatalf("failed to query events: %s", err)
+		}
+		for _, event := range events {
+			jobNames = append(jobNames, event.JobName)
+		}
+		if cursor == "" {
+			break
+		}
+		filter.Cursor = cursor
+	}
+	if strings.Join(jobNames, ",") != "job4,job3,job2,job1,job0" {
+		t.Errorf("Expected all jobs newest first; Got %v", jobNames)
+	}
+
+	if _, _, err := service.QueryEvents(context.Background(), mms.EventFilter{Cursor: "bogus"}); err == nil {
+		t.Errorf("Expected an error for an invalid cursor")
+	}
+}
+
+func TestEventsDBAddsQueryColumns(t *testing.T) {
+	dbTestFile := fmt.Sprintf("/tmp/mmsdtestsqlite%d.db", rand.Int())
+	defer os.Remove(dbTestFile)
+
+	// Create a db with the original events table and one event in it.
+	db, err := sql.Open("sqlite3", dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to create db: %s", err)
+	}
+	_, err = db.Exec(`CREATE TABLE events ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "createdAt" string, "event" BLOB);
+		INSERT INTO events(createdAt, event) VALUES ("2022-07-05T08:51:19Z", '{"Product": "arome_arctic", "ProductionHub": "default"}');`)
+	if err != nil {
+		t.Fatalf("failed to create old events table: %s", err)
+	}
+	db.Close()
+
+	db, err = NewEventsDB(dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	var product string
+	err = db.QueryRow("SELECT product FROM events").Scan(&product)
+	if err != nil || product != "arome_arctic" {
+		t.Errorf("Expected product column filled with arome_arctic; Got %q (%v)", product, err)
+	}
+}
+
 func NewMockService() (*Service, sqlmock.Sqlmock, error) {
 	eventsDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -75,7 +177,7 @@ func NewMockService() (*Service, sqlmock.Sqlmock, error) {
 	}
 
 	templates := CreateTemplates()
-	webService := NewService(templates, eventsDB, nil, "", nil, Version{}, true)
+	webService := NewService(templates, NewSQLiteEventStore(eventsDB), nil, "", nil, Version{}, true)
 
 	return webService, mock, nil
 }
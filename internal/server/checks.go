@@ -0,0 +1,153 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const healthzCheckTimeout = 2 * time.Second
+
+// checkHealthz is supplied to HealthzHandler as a callback function.
+func (service *Service) checkHealthz() (*Healthz, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthzCheckTimeout)
+	defer cancel()
+
+	components := []HealthzComponent{
+		checkEventStore(ctx, "events-db", service.events),
+	}
+	if service.stateDB != nil {
+		stateTable := "api_keys"
+		if !service.NatsLocal {
+			stateTable = "jwt_keys"
+		}
+		components = append(components, checkDB(ctx, "state-db", service.stateDB, fmt.Sprintf("SELECT 1 FROM %s LIMIT 1", stateTable)))
+	}
+	components = append(components, service.checkNatsPublish())
+	if service.NatsLocal {
+		components = append(components, service.checkEmbeddedNats())
+	}
+
+	return RollUpHealthz(components), nil
+}
+
+// checkDB pings the database and runs a small query, which also fails if the database is locked.
+func checkDB(ctx context.Context, name string, db *sql.DB, query string) HealthzComponent {
+	if db == nil {
+		return HealthzComponent{Name: name, Status: HealthzStatusCritical, Description: "Database is not open."}
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return HealthzComponent{Name: name, Status: HealthzStatusCritical, Description: fmt.Sprintf("Ping failed: %s", err)}
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return HealthzComponent{Name: name, Status: HealthzStatusCritical, Description: fmt.Sprintf("Query failed: %s", err)}
+	}
+	rows.Close()
+
+	return HealthzComponent{Name: name, Status: HealthzStatusHealthy, Description: "Database is ok."}
+}
+
+// checkEventStore checks that the event store answers, which also fails if a database behind it is locked.
+func checkEventStore(ctx context.Context, name string, events EventStore) HealthzComponent {
+	if events == nil {
+		return HealthzComponent{Name: name, Status: HealthzStatusCritical, Description: "Event store is not open."}
+	}
+	stats, err := events.Stats(ctx)
+	if err != nil {
+		return HealthzComponent{Name: name, Status: HealthzStatusCritical, Description: fmt.Sprintf("Query failed: %s", err)}
+	}
+
+	return HealthzComponent{Name: name, Status: HealthzStatusHealthy, Description: fmt.Sprintf("Event store is ok, with %d events.", stats.Events)}
+}
+
+// checkNatsPublish checks that the publish connection to NatsURL is up and answers a round trip.
+func (service *Service) checkNatsPublish() HealthzComponent {
+	component := HealthzComponent{Name: "nats-publish"}
+
+	publisher, err := service.Publisher()
+	if err != nil {
+		component.Status = HealthzStatusCritical
+		component.Description = fmt.Sprintf("No publish connection: %s", err)
+		return component
+	}
+	conn := publisher.Conn()
+	if !conn.IsConnected() {
+		component.Status = HealthzStatusCritical
+		component.Description = fmt.Sprintf("Not connected to %s, connection is %s.", service.NatsURL, conn.Status())
+		return component
+	}
+	if err := conn.FlushTimeout(healthzCheckTimeout); err != nil {
+		component.Status = HealthzStatusUnhealthy
+		component.Description = fmt.Sprintf("Connected to %s, but no answer from the server: %s", conn.ConnectedUrlRedacted(), err)
+		return component
+	}
+
+	component.Status = HealthzStatusHealthy
+	component.Description = fmt.Sprintf("Connected to %s.", conn.ConnectedUrlRedacted())
+	return component
+}
+
+// checkEmbeddedNats checks the NATS server started by mmsd in nats-local mode.
+func (service *Service) checkEmbeddedNats() HealthzComponent {
+	component := HealthzComponent{Name: "nats-server"}
+
+	switch {
+	case service.NatsServer == nil:
+		component.Status = HealthzStatusCritical
+		component.Description = "Embedded NATS server is not set up."
+	case !service.NatsServer.Running():
+		component.Status = HealthzStatusCritical
+		component.Description = "Embedded NATS server is not running."
+	case !service.NatsServer.ReadyForConnections(100 * time.Millisecond):
+		component.Status = HealthzStatusUnhealthy
+		component.Description = "Embedded NATS server is not ready for connections."
+	case !service.NatsServer.JetStreamEnabled():
+		component.Status = HealthzStatusCritical
+		component.Description = "JetStream is not enabled on the embedded NATS server, so events can not be stored for replay."
+	default:
+		component.Status = HealthzStatusHealthy
+		component.Description = fmt.Sprintf("Embedded NATS server is running with %d client connections.", service.NatsServer.NumClients())
+	}
+
+	return component
+}
+
+// livezHandler tells Kubernetes that the process is alive and serving http requests.
+func (service *Service) livezHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	httpRespW.Header().Set("Cache-Control", "no-cache")
+	httpRespW.Header().Set("Content-Type", "text/plain")
+	httpRespW.Write([]byte("ok"))
+}
+
+// readyzHandler tells Kubernetes whether the service can accept events, i.e. no component is critical.
+func (service *Service) readyzHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	healthz, _ := service.checkHealthz()
+
+	httpRespW.Header().Set("Cache-Control", "no-cache")
+	httpRespW.Header().Set("Content-Type", "text/plain")
+	if healthz.Status == HealthzStatusCritical {
+		httpRespW.WriteHeader(http.StatusServiceUnavailable)
+		httpRespW.Write([]byte(healthz.Description))
+		return
+	}
+	httpRespW.Write([]byte("ok"))
+}
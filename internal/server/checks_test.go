@@ -0,0 +1,123 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newHealthzTestService(t *testing.T, natsURL string) *Service {
+	dbTestFile := fmt.Sprintf("/tmp/mmsdtestsqlite%d.db", rand.Int())
+	t.Cleanup(func() { os.Remove(dbTestFile) })
+	eventsDB, err := NewEventsDB(dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to create db: %s", err)
+	}
+	return NewService(CreateTemplates(), NewSQLiteEventStore(eventsDB), nil, natsURL, nil, Version{}, true)
+}
+
+func TestRollUpHealthz(t *testing.T) {
+	healthz := RollUpHealthz([]HealthzComponent{
+		{Name: "a", Status: HealthzStatusHealthy},
+		{Name: "b", Status: HealthzStatusUnhealthy},
+		{Name: "c", Status: HealthzStatusHealthy},
+	})
+	if healthz.Status != HealthzStatusUnhealthy || healthz.Description != "Components not ok: b." {
+		t.Errorf("Expected unhealthy because of b; Got %s: %s", healthz.Status, healthz.Description)
+	}
+
+	healthz = RollUpHealthz([]HealthzComponent{
+		{Name: "a", Status: HealthzStatusCritical},
+		{Name: "b", Status: HealthzStatusUnhealthy},
+	})
+	if healthz.Status != HealthzStatusCritical || healthz.Description != "Components not ok: a, b." {
+		t.Errorf("Expected critical because of a and b; Got %s: %s", healthz.Status, healthz.Description)
+	}
+
+	healthz = RollUpHealthz(nil)
+	if healthz.Status != HealthzStatusHealthy {
+		t.Errorf("Expected healthy without components; Got %s", healthz.Status)
+	}
+}
+
+func TestHealthzWithNats(t *testing.T) {
+	natsServer := runTestJetStreamServer(t)
+
+	service := newHealthzTestService(t, natsServer.ClientURL())
+	service.NatsServer = natsServer
+	defer service.Close()
+
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/healthz", nil))
+	if httpRespW.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+
+	var healthz healthzJSONLD
+	if err := json.Unmarshal(httpRespW.Body.Bytes(), &healthz); err != nil {
+		t.Fatalf("failed to decode healthz: %s", err)
+	}
+	if healthz.Status != "healthy" || len(healthz.Components) != 3 {
+		t.Errorf("Expected healthy events-db, nats-publish and nats-server; Got %+v", healthz)
+	}
+
+	httpRespW = httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/readyz", nil))
+	if httpRespW.Code != http.StatusOK {
+		t.Errorf("Expected ready; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+}
+
+func TestHealthzNatsDown(t *testing.T) {
+	service := newHealthzTestService(t, "nats://127.0.0.1:1")
+	defer service.Close()
+
+	healthz, err := service.checkHealthz()
+	if err != nil {
+		t.Fatalf("failed to check healthz: %s", err)
+	}
+	if healthz.Status != HealthzStatusCritical {
+		t.Errorf("Expected critical; Got %s: %s", healthz.Status, healthz.Description)
+	}
+	for _, component := range healthz.Components {
+		var expected HealthzStatus = HealthzStatusCritical
+		if component.Name == "events-db" {
+			expected = HealthzStatusHealthy
+		}
+		if component.Status != expected {
+			t.Errorf("Expected %s to be %s; Got %s: %s", component.Name, expected, component.Status, component.Description)
+		}
+	}
+
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/readyz", nil))
+	if httpRespW.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from readyz; Got %d", httpRespW.Code)
+	}
+
+	httpRespW = httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/livez", nil))
+	if httpRespW.Code != http.StatusOK {
+		t.Errorf("Expected 200 from livez; Got %d", httpRespW.Code)
+	}
+}
@@ -19,15 +19,16 @@ package server
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3" // Import sqlite3 driver for database/sql library
+	"github.com/mattn/go-sqlite3" // Import sqlite3 driver for database/sql library
 	"github.com/metno/go-mms/pkg/mms"
 )
 
@@ -39,20 +40,105 @@ func NewEventsDB(filePath string) (*sql.DB, error) {
 	return createEventsDB(filePath)
 }
 
-// GetAllEvents returns all product events in the events database.
+// SQLiteEventStore keeps events in a sqlite database made by NewEventsDB.
+type SQLiteEventStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteEventStore gives an event store keeping the events in db.
+func NewSQLiteEventStore(db *sql.DB) *SQLiteEventStore {
+	return &SQLiteEventStore{db: db}
+}
+
+// GetAllEvents returns all product events in the event store.
 func (service *Service) GetAllEvents(ctx context.Context) ([]*mms.ProductEvent, error) {
-	rows, err := service.eventsDB.QueryContext(ctx, "SELECT * FROM events")
+	events, _, err := service.events.QueryEvents(ctx, mms.EventFilter{})
+	return events, err
+}
+
+// QueryEvents returns the product events matching filter, ordered by creation time.
+// If filter.Limit is set and there may be more events, the cursor for the next page is returned as well.
+func (service *Service) QueryEvents(ctx context.Context, filter mms.EventFilter) ([]*mms.ProductEvent, string, error) {
+	return service.events.QueryEvents(ctx, filter)
+}
+
+// DeleteOldEvents removes the events received before maxAge, together with their outbox entries, but keeps events not yet published.
+func (service *Service) DeleteOldEvents(maxAge time.Time) error {
+	_, err := service.events.DeleteBefore(context.Background(), maxAge)
+	return err
+}
+
+// SaveEvents stores events and adds them to the outbox in one transaction, so either all or none are stored.
+func (store *SQLiteEventStore) SaveEvents(ctx context.Context, events []*mms.ProductEvent, queueName string, natsUser string) ([]int64, []bool, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("could not access db to get events: %s", err)
+		return nil, nil, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	eventIDs := make([]int64, len(events))
+	duplicates := make([]bool, len(events))
+	for i, event := range events {
+		eventIDs[i], err = insertProductEventToOutbox(tx, event, queueName, natsUser)
+		if err == errDuplicateEvent {
+			duplicates[i] = true
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to store event %d: %s", i, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit events: %s", err)
+	}
+	return eventIDs, duplicates, nil
+}
+
+// QueryEvents gives the events matching filter, ordered by creation time.
+func (store *SQLiteEventStore) QueryEvents(ctx context.Context, filter mms.EventFilter) ([]*mms.ProductEvent, string, error) {
+	conditions, args := eventFilterConditions(filter)
+
+	order := "ASC"
+	cursorCond := "(createdAt, id) > (?, ?)"
+	if filter.Descending {
+		order = "DESC"
+		cursorCond = "(createdAt, id) < (?, ?)"
+	}
+
+	if filter.Cursor != "" {
+		createdAt, id, err := decodeEventsCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		conditions = append(conditions, cursorCond)
+		args = append(args, createdAt, id)
+	}
+
+	query := "SELECT id, createdAt, event FROM events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY createdAt %s, id %s", order, order)
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not access db to get events: %s", err)
 	}
 	defer rows.Close()
 
-	var events []*mms.ProductEvent
+	events := []*mms.ProductEvent{}
+	var lastID int
+	var lastCreatedAt string
+	var nRows int
 	for rows.Next() {
-		var id int
-		var createdAt string
 		var payload []byte
-		rows.Scan(&id, &createdAt, &payload)
+		if err := rows.Scan(&lastID, &lastCreatedAt, &payload); err != nil {
+			return nil, "", fmt.Errorf("could not read event from db: %s", err)
+		}
+		nRows++
 
 		var event mms.ProductEvent
 		if err := json.Unmarshal(payload, &event); err != nil {
@@ -61,63 +147,463 @@ func (service *Service) GetAllEvents(ctx context.Context) ([]*mms.ProductEvent,
 			events = append(events, &event)
 		}
 	}
-	return events, nil
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("could not read events from db: %s", err)
+	}
+
+	var nextCursor string
+	if filter.Limit > 0 && nRows == filter.Limit {
+		nextCursor = encodeEventsCursor(lastCreatedAt, lastID)
+	}
+
+	return events, nextCursor, nil
 }
 
-// DeleteOldEvents removes events older than a specified datetime.
-func (service *Service) DeleteOldEvents(maxAge time.Time) error {
-	deleteOldEvents := `DELETE FROM events WHERE createdAt < "` + maxAge.Format(time.RFC3339) + `";`
-	_, err := service.eventsDB.Exec(deleteOldEvents)
-	return err
+// EventsAfter gives at most limit events matching filter that were stored after the event with the given id.
+func (store *SQLiteEventStore) EventsAfter(ctx context.Context, id int64, filter mms.EventFilter, limit int) ([]StoredEvent, error) {
+	conditions, args := eventFilterConditions(filter)
+	conditions = append(conditions, "id > ?")
+	args = append(args, id, limit)
+
+	query := "SELECT id, event FROM events WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id ASC LIMIT ?"
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not access db to get events: %s", err)
+	}
+	defer rows.Close()
+
+	var events []StoredEvent
+	for rows.Next() {
+		var se StoredEvent
+		var payload []byte
+		if err := rows.Scan(&se.ID, &payload); err != nil {
+			return nil, fmt.Errorf("could not read event from db: %s", err)
+		}
+		se.Event = &mms.ProductEvent{}
+		if err := json.Unmarshal(payload, se.Event); err != nil {
+			log.Printf("failed to unmarshal an event from db: %s", err)
+			continue
+		}
+		events = append(events, se)
+	}
+
+	return events, rows.Err()
+}
+
+// outboxDone selects the outbox entries of events that are published or can never be published.
+const outboxDone = `(deliveredAt IS NOT NULL OR failedAt IS NOT NULL)`
+
+// noPendingOutbox selects the events without an outbox entry, once the entries of the published events are deleted.
+const noPendingOutbox = `NOT EXISTS (SELECT 1 FROM outbox WHERE outbox.eventId = events.id)`
+
+// DeleteBefore removes the events received before t, together with their outbox entries, but keeps events not yet published.
+func (store *SQLiteEventStore) DeleteBefore(ctx context.Context, t time.Time) (int64, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE eventId IN (SELECT id FROM events WHERE receivedAt < ?) AND `+outboxDone, formatDBTime(t)); err != nil {
+		return 0, fmt.Errorf("failed to delete outbox entries of old events: %s", err)
+	}
+	result, err := tx.Exec(`DELETE FROM events WHERE receivedAt < ? AND `+noPendingOutbox, formatDBTime(t))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old events: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete old events: %s", err)
+	}
+	return result.RowsAffected()
+}
+
+// EventProducts gives the production hub and product of each group of stored events.
+func (store *SQLiteEventStore) EventProducts(ctx context.Context) ([]ProductKey, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT DISTINCT productionHub, product FROM events`)
+	if err != nil {
+		return nil, fmt.Errorf("could not access db to get event products: %s", err)
+	}
+	defer rows.Close()
+
+	var keys []ProductKey
+	for rows.Next() {
+		var productionHub, product sql.NullString
+		if err := rows.Scan(&productionHub, &product); err != nil {
+			return nil, fmt.Errorf("could not read event product from db: %s", err)
+		}
+		keys = append(keys, ProductKey{ProductionHub: productionHub.String, Product: product.String})
+	}
+
+	return keys, rows.Err()
 }
 
-func saveProductEvent(db *sql.DB, event *mms.ProductEvent) error {
+// EventSummaries gives the id, reference time and time of receipt of each stored event of product from productionHub,
+// in the order they were stored.
+func (store *SQLiteEventStore) EventSummaries(ctx context.Context, key ProductKey) ([]EventSummary, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT id, refTime, receivedAt FROM events
+		WHERE productionHub = ? AND product = ? ORDER BY id`, key.ProductionHub, key.Product)
+	if err != nil {
+		return nil, fmt.Errorf("could not access db to get events: %s", err)
+	}
+	defer rows.Close()
+
+	var summaries []EventSummary
+	for rows.Next() {
+		summary := EventSummary{Product: key.Product, ProductionHub: key.ProductionHub}
+		var refTime, receivedAt sql.NullString
+		if err := rows.Scan(&summary.ID, &refTime, &receivedAt); err != nil {
+			return nil, fmt.Errorf("could not read event from db: %s", err)
+		}
+		summary.RefTime, _ = time.Parse(time.RFC3339, refTime.String)
+		summary.ReceivedAt, _ = time.Parse(time.RFC3339, receivedAt.String)
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+// DeleteEvents removes the events with the given ids, together with their outbox entries, in one transaction,
+// but keeps events not yet published.
+func (store *SQLiteEventStore) DeleteEvents(ctx context.Context, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE eventId IN (`+placeholders+`) AND `+outboxDone, args...); err != nil {
+		return 0, fmt.Errorf("failed to delete outbox entries of events: %s", err)
+	}
+	result, err := tx.Exec(`DELETE FROM events WHERE id IN (`+placeholders+`) AND `+noPendingOutbox, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete events: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete events: %s", err)
+	}
+	return result.RowsAffected()
+}
+
+// Stats counts the stored events and the outbox backlog.
+func (store *SQLiteEventStore) Stats(ctx context.Context) (EventStoreStats, error) {
+	var stats EventStoreStats
+	var oldest, newest sql.NullString
+	var lastID sql.NullInt64
+	err := store.db.QueryRowContext(ctx, `SELECT count(*), min(receivedAt), max(receivedAt), max(id) FROM events`).Scan(&stats.Events, &oldest, &newest, &lastID)
+	if err != nil {
+		return stats, fmt.Errorf("could not count events: %s", err)
+	}
+	stats.OldestReceived, _ = time.Parse(time.RFC3339, oldest.String)
+	stats.NewestReceived, _ = time.Parse(time.RFC3339, newest.String)
+	stats.LastID = lastID.Int64
+
+	if err := store.db.QueryRowContext(ctx, `SELECT count(*) FROM outbox WHERE deliveredAt IS NULL AND failedAt IS NULL`).Scan(&stats.OutboxBacklog); err != nil {
+		return stats, fmt.Errorf("could not count outbox backlog: %s", err)
+	}
+	return stats, nil
+}
+
+// PendingOutbox gives the outbox entries that are due, in the order the events were stored.
+func (store *SQLiteEventStore) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT outbox.eventId, outbox.queueName, outbox.natsUser, outbox.attempts, events.event
+		FROM outbox JOIN events ON events.id = outbox.eventId
+		WHERE outbox.deliveredAt IS NULL AND outbox.failedAt IS NULL AND outbox.nextAttemptAt <= ?
+		AND NOT EXISTS (SELECT 1 FROM outbox AS earlier WHERE earlier.natsUser = outbox.natsUser AND earlier.eventId < outbox.eventId
+			AND earlier.deliveredAt IS NULL AND earlier.failedAt IS NULL AND earlier.nextAttemptAt > ?)
+		ORDER BY outbox.eventId LIMIT ?`, formatDBTime(now), formatDBTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not access db to get outbox: %s", err)
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var entry OutboxEntry
+		var payload []byte
+		if err := rows.Scan(&entry.ID, &entry.QueueName, &entry.NatsUser, &entry.Attempts, &payload); err != nil {
+			return nil, fmt.Errorf("could not read outbox entry from db: %s", err)
+		}
+		entry.Event = &mms.ProductEvent{}
+		if err := json.Unmarshal(payload, entry.Event); err != nil {
+			log.Printf("failed to unmarshal event %d in outbox: %s", entry.ID, err)
+			entry.Event = nil
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// MarkDelivered records that the event with the given id is published.
+func (store *SQLiteEventStore) MarkDelivered(ctx context.Context, id int64, deliveredAt time.Time) error {
+	_, err := store.db.ExecContext(ctx, `UPDATE outbox SET deliveredAt = ?, attempts = attempts + 1, lastError = NULL WHERE eventId = ?`,
+		formatDBTime(deliveredAt), id)
+	if err != nil {
+		return fmt.Errorf("failed to mark event %d as delivered: %s", id, err)
+	}
+	return nil
+}
+
+// MarkFailed records a failed attempt to publish the event with the given id.
+func (store *SQLiteEventStore) MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, publishErr error) error {
+	_, err := store.db.ExecContext(ctx, `UPDATE outbox SET attempts = attempts + 1, nextAttemptAt = ?, lastError = ? WHERE eventId = ?`,
+		formatDBTime(nextAttemptAt), publishErr.Error(), id)
+	if err != nil {
+		return fmt.Errorf("failed to record failed publish of event %d: %s", id, err)
+	}
+	return nil
+}
+
+// MarkUndeliverable records that the event with the given id can never be published.
+func (store *SQLiteEventStore) MarkUndeliverable(ctx context.Context, id int64, publishErr error) error {
+	_, err := store.db.ExecContext(ctx, `UPDATE outbox SET attempts = attempts + 1, failedAt = ?, lastError = ? WHERE eventId = ?`,
+		formatDBTime(time.Now()), publishErr.Error(), id)
+	if err != nil {
+		return fmt.Errorf("failed to mark event %d as undeliverable: %s", id, err)
+	}
+	return nil
+}
+
+// eventFilterConditions translates the selecting parts of filter into SQL conditions and their arguments.
+func eventFilterConditions(filter mms.EventFilter) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	for _, globCond := range []struct {
+		column  string
+		pattern string
+	}{
+		{"product", filter.Product},
+		{"productionHub", filter.ProductionHub},
+		{"jobName", filter.JobName},
+	} {
+		if globCond.pattern != "" {
+			conditions = append(conditions, globCond.column+" GLOB ?")
+			args = append(args, globCond.pattern)
+		}
+	}
+
+	for _, timeCond := range []struct {
+		cond string
+		t    time.Time
+	}{
+		{"createdAt >= ?", filter.Since},
+		{"createdAt < ?", filter.Until},
+		{"refTime >= ?", filter.RefTimeSince},
+		{"refTime < ?", filter.RefTimeUntil},
+	} {
+		if !timeCond.t.IsZero() {
+			conditions = append(conditions, timeCond.cond)
+			args = append(args, formatDBTime(timeCond.t))
+		}
+	}
+
+	return conditions, args
+}
+
+// encodeEventsCursor creates an opaque pagination cursor pointing after the given row.
+func encodeEventsCursor(createdAt string, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d", createdAt, id)))
+}
+
+func decodeEventsCursor(cursor string) (string, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor")
+	}
+	return parts[0], id, nil
+}
+
+// errDuplicateEvent is returned when an event with the same EventID is already stored.
+var errDuplicateEvent = errors.New("event already stored")
+
+// insertProductEventToOutbox stores event and adds it to the outbox. If an event with the same EventID is already stored,
+// it returns the id of that event and errDuplicateEvent.
+func insertProductEventToOutbox(tx *sql.Tx, event *mms.ProductEvent, queueName string, natsUser string) (int64, error) {
+	eventID, err := insertProductEvent(tx, event)
+	if err == errDuplicateEvent {
+		var storedID int64
+		if err := tx.QueryRow(`SELECT id FROM events WHERE eventId = ?`, event.EventID).Scan(&storedID); err != nil {
+			return 0, fmt.Errorf("failed to find stored event %s: %s", event.EventID, err)
+		}
+		return storedID, errDuplicateEvent
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	insertOutboxSQL := `INSERT INTO outbox(eventId, queueName, natsUser, nextAttemptAt) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(insertOutboxSQL, eventID, queueName, natsUser, formatDBTime(time.Now())); err != nil {
+		return 0, fmt.Errorf("failed to add event to outbox: %s", err)
+	}
+	return eventID, nil
+}
+
+// dbPreparer is implemented by both *sql.DB and *sql.Tx.
+type dbPreparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+func insertProductEvent(db dbPreparer, event *mms.ProductEvent) (int64, error) {
 
 	payload, err := json.Marshal(event)
 	if err != nil {
-		return fmt.Errorf("failed to create json blob for storage: %s", err)
+		return 0, fmt.Errorf("failed to create json blob for storage: %s", err)
 	}
 
 	str, err := strconv.Unquote(strings.Replace(strconv.Quote(string(payload)), `\\u`, `\u`, -1))
 	if err != nil {
-		return fmt.Errorf("failed to unescape html characters for storage: %s", err)
+		return 0, fmt.Errorf("failed to unescape html characters for storage: %s", err)
 	}
 
-	insertEventSQL := `INSERT INTO events(createdAt,event) VALUES (?, ?)`
+	insertEventSQL := `INSERT INTO events(createdAt, event, product, productionHub, jobName, refTime, eventId, receivedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 	statement, err := db.Prepare(insertEventSQL)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %s", err)
+		return 0, fmt.Errorf("failed to prepare statement: %s", err)
+	}
+	defer statement.Close()
+
+	result, err := statement.Exec(formatDBTime(time.Time(event.CreatedAt)), str,
+		event.Product, event.ProductionHub, event.JobName, formatDBTime(time.Time(event.RefTime)),
+		sql.NullString{String: event.EventID, Valid: event.EventID != ""}, formatDBTime(time.Now()))
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return 0, errDuplicateEvent
 	}
-	_, err = statement.Exec(time.Time(event.CreatedAt).Format(time.RFC3339), str)
 	if err != nil {
 
-		return fmt.Errorf("failed to store event in db: %s", err)
+		return 0, fmt.Errorf("failed to store event in db: %s", err)
 	}
 
-	_ = statement.Close()
-	return nil
+	return result.LastInsertId()
 }
 
 func createEventsDB(dbFilePath string) (*sql.DB, error) {
-	// Create file if it does not exist.
-	file, err := os.OpenFile(dbFilePath, os.O_CREATE, 0660)
+	db, err := OpenDB(dbFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create db file: %s", err)
+		return nil, err
+	}
+	if _, err := MigrateEventsDB(db, false); err != nil {
+		db.Close()
+		return nil, err
 	}
-	file.Close()
+	return db, nil
+}
+
+// eventsMigrations upgrade events databases. Version 0 is a database from before the schema had a version.
+var eventsMigrations = []migration{
+	{1, "create the events and outbox tables", func(tx *sql.Tx) error {
+		createTables := `CREATE TABLE IF NOT EXISTS events (
+			"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"createdAt" string,
+			"event" BLOB
+		);
+		CREATE TABLE IF NOT EXISTS outbox (
+			"eventId" integer NOT NULL PRIMARY KEY,
+			"queueName" TEXT NOT NULL,
+			"natsUser" TEXT NOT NULL DEFAULT '',
+			"attempts" integer NOT NULL DEFAULT 0,
+			"nextAttemptAt" TEXT NOT NULL,
+			"lastError" TEXT,
+			"deliveredAt" TEXT
+		);
+		CREATE INDEX IF NOT EXISTS "outbox_pending_idx" ON "outbox" ("nextAttemptAt") WHERE "deliveredAt" IS NULL;`
+		if _, err := tx.Exec(createTables); err != nil {
+			return fmt.Errorf("failed to create tables: %s", err)
+		}
+		return nil
+	}},
+	{2, "add indexed product, productionHub, jobName, refTime and eventId columns to events", addEventsQueryColumns},
+	{3, "add the indexed receivedAt column to events", addEventsReceivedAtColumn},
+	{4, "add the failedAt column to the outbox, for events that can never be published", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`ALTER TABLE outbox ADD COLUMN "failedAt" TEXT`); err != nil {
+			return fmt.Errorf("failed to add column failedAt to outbox table: %s", err)
+		}
+		return nil
+	}},
+	{5, "index the events of each product of a production hub, for retention rules", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS "events_retention_idx" ON "events" ("productionHub", "product", "id")`); err != nil {
+			return fmt.Errorf("failed to create events index: %s", err)
+		}
+		return nil
+	}},
+}
 
-	// Create db with necessary tables if it does not exist.
-	db, err := sql.Open("sqlite3", dbFilePath)
+// MigrateEventsDB upgrades an events database to the latest schema, and gives the migrations that were applied.
+// With dryRun, nothing is changed, and it gives the migrations that would be applied.
+func MigrateEventsDB(db *sql.DB, dryRun bool) ([]Migration, error) {
+	return runMigrations(db, eventsMigrations, dryRun)
+}
+
+// addEventsQueryColumns adds the columns used for filtering events, filling them from the stored event for older dbs.
+func addEventsQueryColumns(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "events")
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to sqlite database: %s", err)
+		return err
+	}
+
+	for _, c := range []struct{ column, field string }{
+		{"product", "Product"},
+		{"productionHub", "ProductionHub"},
+		{"jobName", "JobName"},
+		{"refTime", "RefTime"},
+		{"eventId", "EventID"},
+	} {
+		if columns[c.column] {
+			continue
+		}
+		alterSQL := fmt.Sprintf(`ALTER TABLE events ADD COLUMN "%s" TEXT;
+			UPDATE events SET "%s" = json_extract(event, '$.%s');`, c.column, c.column, c.field)
+		if _, err := tx.Exec(alterSQL); err != nil {
+			return fmt.Errorf("failed to add column %s to events table: %s", c.column, err)
+		}
+	}
+
+	createIndexes := `CREATE INDEX IF NOT EXISTS "events_createdAt_idx" ON "events" ("createdAt", "id");
+	CREATE INDEX IF NOT EXISTS "events_product_idx" ON "events" ("product", "createdAt");
+	CREATE INDEX IF NOT EXISTS "events_productionHub_idx" ON "events" ("productionHub", "createdAt");
+	CREATE INDEX IF NOT EXISTS "events_jobName_idx" ON "events" ("jobName");
+	CREATE INDEX IF NOT EXISTS "events_refTime_idx" ON "events" ("refTime");
+	CREATE UNIQUE INDEX IF NOT EXISTS "events_eventId_idx" ON "events" ("eventId");`
+	if _, err := tx.Exec(createIndexes); err != nil {
+		return fmt.Errorf("failed to create events indexes: %s", err)
 	}
-	createEventTable := `CREATE TABLE IF NOT EXISTS events (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		"createdAt" string,
-		"event" BLOB
-	);`
 
-	_, err = db.Exec(createEventTable)
+	return nil
+}
 
-	return db, err
+// addEventsReceivedAtColumn adds the time events were received by the production hub. Events received before the column
+// existed get the time they were created.
+func addEventsReceivedAtColumn(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "events")
+	if err != nil {
+		return err
+	}
+	if !columns["receivedAt"] {
+		alterSQL := `ALTER TABLE events ADD COLUMN "receivedAt" TEXT;
+			UPDATE events SET "receivedAt" = "createdAt";`
+		if _, err := tx.Exec(alterSQL); err != nil {
+			return fmt.Errorf("failed to add column receivedAt to events table: %s", err)
+		}
+	}
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS "events_receivedAt_idx" ON "events" ("receivedAt")`); err != nil {
+		return fmt.Errorf("failed to create events index: %s", err)
+	}
+	return nil
 }
@@ -0,0 +1,112 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// EventStore keeps the events posted to the production hub, and the outbox of events waiting to be published to NATS.
+// Events are put in the outbox when they are stored, so every stored event is eventually published.
+type EventStore interface {
+	// SaveEvents stores events, all or none, and adds them to the outbox to be published to queueName with the credentials
+	// of natsUser. It gives the id of each event, and whether an event with the same EventID was already stored,
+	// in which case the id is that of the stored event, and the event is not stored or added to the outbox again.
+	SaveEvents(ctx context.Context, events []*mms.ProductEvent, queueName string, natsUser string) ([]int64, []bool, error)
+
+	// QueryEvents gives the events matching filter, ordered by creation time. If filter.Limit is set and there may be more
+	// events, it also gives the cursor of the next page.
+	QueryEvents(ctx context.Context, filter mms.EventFilter) ([]*mms.ProductEvent, string, error)
+
+	// EventsAfter gives at most limit events matching filter that were stored after the event with the given id,
+	// in the order they were stored.
+	EventsAfter(ctx context.Context, id int64, filter mms.EventFilter, limit int) ([]StoredEvent, error)
+
+	// DeleteBefore removes the events received before t, together with their outbox entries,
+	// and gives the number of removed events. Events not yet published are kept, so they are not lost while NATS is down.
+	DeleteBefore(ctx context.Context, t time.Time) (int64, error)
+
+	// EventProducts gives the production hub and product of each group of stored events.
+	EventProducts(ctx context.Context) ([]ProductKey, error)
+
+	// EventSummaries gives what retention rules need to know about each stored event of product from productionHub,
+	// in the order they were stored.
+	EventSummaries(ctx context.Context, key ProductKey) ([]EventSummary, error)
+
+	// DeleteEvents removes the events with the given ids, together with their outbox entries,
+	// and gives the number of removed events. Events not yet published are kept, as with DeleteBefore.
+	DeleteEvents(ctx context.Context, ids []int64) (int64, error)
+
+	// Stats describes the stored events and the outbox.
+	Stats(ctx context.Context) (EventStoreStats, error)
+
+	// PendingOutbox gives at most limit outbox entries that are not delivered and are due at now, in the order they were stored.
+	// The entries of a NATS user stored after one of its entries that is not due yet are left out, so the events of each user
+	// are published in order.
+	PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error)
+
+	// MarkDelivered records that the event with the given id is published.
+	MarkDelivered(ctx context.Context, id int64, deliveredAt time.Time) error
+
+	// MarkFailed records a failed attempt to publish the event with the given id, which is tried again at nextAttemptAt.
+	MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, publishErr error) error
+
+	// MarkUndeliverable records that the event with the given id can never be published, e.g. because it can not be read.
+	// It is not tried again, does not hold back the later events of its NATS user, and is not counted in the backlog.
+	MarkUndeliverable(ctx context.Context, id int64, publishErr error) error
+}
+
+// StoredEvent is a product event together with its id in the event store, which is also used as the SSE event id.
+type StoredEvent struct {
+	ID    int64             `json:"id"`
+	Event *mms.ProductEvent `json:"event"`
+}
+
+// OutboxEntry is a stored event waiting to be published.
+type OutboxEntry struct {
+	ID        int64             // Id of the event in the event store.
+	QueueName string            // The event is published below the queue name.
+	NatsUser  string            // The event is published with the credentials of the NATS user, or of mmsd if empty.
+	Attempts  int               // Earlier attempts to publish the event.
+	Event     *mms.ProductEvent // Nil if the stored event can not be read.
+}
+
+// EventSummary is what retention rules need to know about a stored event.
+type EventSummary struct {
+	ID            int64
+	Product       string
+	ProductionHub string
+	RefTime       time.Time
+	ReceivedAt    time.Time
+}
+
+// EventStoreStats describes what an event store holds.
+type EventStoreStats struct {
+	Events         int64     // Stored events.
+	OldestReceived time.Time // When the oldest stored event was received, zero if there are none.
+	NewestReceived time.Time // When the newest stored event was received, zero if there are none.
+	OutboxBacklog  int64     // Stored events that are not published yet.
+	LastID         int64     // Id of the newest stored event, 0 if there are none. Events stored later get higher ids.
+}
+
+// formatDBTime formats times the way event stores compare them, as strings in UTC with whole seconds.
+func formatDBTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
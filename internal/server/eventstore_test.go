@@ -0,0 +1,429 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+func TestSQLiteEventStore(t *testing.T) {
+	testEventStore(t, func(t *testing.T) EventStore {
+		dbTestFile := fmt.Sprintf("/tmp/mmsdtesteventstore%d.db", rand.Int())
+		t.Cleanup(func() { os.Remove(dbTestFile) })
+		eventsDB, err := NewEventsDB(dbTestFile)
+		if err != nil {
+			t.Fatalf("failed to create db: %s", err)
+		}
+		t.Cleanup(func() { eventsDB.Close() })
+		return NewSQLiteEventStore(eventsDB)
+	})
+}
+
+func TestMemoryEventStore(t *testing.T) {
+	testEventStore(t, func(t *testing.T) EventStore {
+		store, err := NewMemoryEventStore(100)
+		if err != nil {
+			t.Fatalf("failed to create memory event store: %s", err)
+		}
+		return store
+	})
+}
+
+func TestMemoryEventStoreFull(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewMemoryEventStore(3)
+
+	var firstID int64
+	for i := 0; i < 5; i++ {
+		event := &mms.ProductEvent{Product: fmt.Sprintf("p%d", i), EventID: fmt.Sprintf("e%d", i)}
+		ids, _, err := store.SaveEvents(ctx, []*mms.ProductEvent{event}, "mms", "")
+		if err != nil {
+			t.Fatalf("failed to save event: %s", err)
+		}
+		if i == 0 {
+			firstID = ids[0]
+		}
+	}
+
+	events, _, _ := store.QueryEvents(ctx, mms.EventFilter{})
+	if len(events) != 3 || events[0].Product != "p2" || events[2].Product != "p4" {
+		t.Errorf("Expected the 3 newest events to be kept; Got %+v", events)
+	}
+	// A dropped event is no longer known, so it is stored again.
+	ids, dups, _ := store.SaveEvents(ctx, []*mms.ProductEvent{{Product: "p0", EventID: "e0"}}, "mms", "")
+	if dups[0] || ids[0] != firstID+5 {
+		t.Errorf("Expected a dropped event to be stored again as %d; Got %d, duplicate %v", firstID+5, ids[0], dups[0])
+	}
+	if stats, _ := store.Stats(ctx); stats.Events != 3 || stats.OutboxBacklog != 3 {
+		t.Errorf("Expected 3 events in the outbox; Got %+v", stats)
+	}
+
+	// The ids of a store created later, as after a restart, follow the ids of this one, so stream clients can resume.
+	restarted, _ := NewMemoryEventStore(3)
+	if ids, _, _ := restarted.SaveEvents(ctx, []*mms.ProductEvent{{Product: "p5"}}, "mms", ""); ids[0] <= firstID+5 {
+		t.Errorf("Expected the ids after a restart to be higher than %d; Got %d", firstID+5, ids[0])
+	}
+}
+
+// testEventStore checks that an event store behaves like the other event stores.
+func testEventStore(t *testing.T, newStore func(t *testing.T) EventStore) {
+	t.Run("Save", func(t *testing.T) { testEventStoreSave(t, newStore(t)) })
+	t.Run("Query", func(t *testing.T) { testEventStoreQuery(t, newStore(t)) })
+	t.Run("EventsAfter", func(t *testing.T) { testEventStoreEventsAfter(t, newStore(t)) })
+	t.Run("DeleteBefore", func(t *testing.T) { testEventStoreDeleteBefore(t, newStore(t)) })
+	t.Run("DeleteEvents", func(t *testing.T) { testEventStoreDeleteEvents(t, newStore(t)) })
+	t.Run("Outbox", func(t *testing.T) { testEventStoreOutbox(t, newStore(t)) })
+}
+
+// testEvents are 6 events, created an hour apart, alternately of arome_arctic and meps.
+func testEvents() []*mms.ProductEvent {
+	start := time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC)
+	var events []*mms.ProductEvent
+	for i := 0; i < 6; i++ {
+		product := "arome_arctic"
+		if i%2 == 1 {
+			product = "meps"
+		}
+		events = append(events, &mms.ProductEvent{
+			Product:       product,
+			ProductionHub: productionHubName,
+			JobName:       fmt.Sprintf("job%d", i),
+			RefTime:       mms.PEventTime(start.Add(time.Duration(i/2) * 6 * time.Hour)),
+			CreatedAt:     mms.PEventTime(start.Add(time.Duration(i) * time.Hour)),
+			EventID:       fmt.Sprintf("event%d", i),
+			Attributes:    map[string]string{"i": fmt.Sprint(i)},
+		})
+	}
+	return events
+}
+
+func testEventStoreSave(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	events := testEvents()
+
+	ids, dups, err := store.SaveEvents(ctx, events[:2], "mms", "")
+	if err != nil || len(ids) != 2 || ids[0] == ids[1] || dups[0] || dups[1] {
+		t.Fatalf("Expected 2 new events; Got %v, %v, %v", ids, dups, err)
+	}
+
+	// An event posted again, or twice in the same batch, is only stored once.
+	again := *events[1]
+	noID := *events[2]
+	noID.EventID = ""
+	ids2, dups2, err := store.SaveEvents(ctx, []*mms.ProductEvent{&again, events[3], events[3], &noID, &noID}, "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	if !dups2[0] || ids2[0] != ids[1] || dups2[1] || !dups2[2] || ids2[2] != ids2[1] || dups2[3] || dups2[4] || ids2[3] == ids2[4] {
+		t.Errorf("Expected duplicates of the stored events, and events without an EventID to be stored; Got %v, %v", ids2, dups2)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.Events != 5 || stats.OutboxBacklog != 5 {
+		t.Errorf("Expected 5 stored events waiting to be published; Got %+v, %v", stats, err)
+	}
+	if stats.OldestReceived.IsZero() || time.Since(stats.NewestReceived) > time.Minute {
+		t.Errorf("Expected the events to be received now; Got %+v", stats)
+	}
+	if stats.LastID != ids2[4] {
+		t.Errorf("Expected the last id to be %d; Got %+v", ids2[4], stats)
+	}
+
+	// Changing a saved or returned event does not change the stored event.
+	events[0].Attributes["i"] = "changed"
+	stored, _, _ := store.QueryEvents(ctx, mms.EventFilter{JobName: "job0"})
+	if len(stored) != 1 || stored[0].Attributes["i"] != "0" {
+		t.Fatalf("Expected the stored event to be unchanged; Got %+v", stored)
+	}
+	stored[0].Attributes["i"] = "changed"
+	stored, _, _ = store.QueryEvents(ctx, mms.EventFilter{JobName: "job0"})
+	if stored[0].Attributes["i"] != "0" {
+		t.Errorf("Expected the stored event to be unchanged; Got %+v", stored[0])
+	}
+}
+
+// jobNames gives the job names of events, which identify the test events.
+func jobNames(events []*mms.ProductEvent) string {
+	names := ""
+	for _, event := range events {
+		names += event.JobName + " "
+	}
+	return names
+}
+
+func testEventStoreQuery(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	events := testEvents()
+	// Stored out of order, so the events must be ordered by creation time.
+	if _, _, err := store.SaveEvents(ctx, append(events[3:], events[:3]...), "mms", ""); err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	start := time.Time(events[0].CreatedAt)
+
+	tests := []struct {
+		filter   mms.EventFilter
+		expected string
+	}{
+		{mms.EventFilter{}, "job0 job1 job2 job3 job4 job5 "},
+		{mms.EventFilter{Product: "meps"}, "job1 job3 job5 "},
+		{mms.EventFilter{Product: "arome*"}, "job0 job2 job4 "},
+		{mms.EventFilter{ProductionHub: "other"}, ""},
+		{mms.EventFilter{JobName: "job[12]"}, "job1 job2 "},
+		{mms.EventFilter{Since: start.Add(2 * time.Hour), Until: start.Add(4 * time.Hour)}, "job2 job3 "},
+		// Times are compared in UTC.
+		{mms.EventFilter{Since: start.Add(4 * time.Hour).In(time.FixedZone("UTC+2", 2*3600))}, "job4 job5 "},
+		{mms.EventFilter{RefTimeSince: start.Add(6 * time.Hour), RefTimeUntil: start.Add(12 * time.Hour)}, "job2 job3 "},
+		{mms.EventFilter{Product: "arome_arctic", Descending: true}, "job4 job2 job0 "},
+	}
+	for _, test := range tests {
+		got, _, err := store.QueryEvents(ctx, test.filter)
+		if err != nil || jobNames(got) != test.expected {
+			t.Errorf("Expected %q for %+v; Got %q, %v", test.expected, test.filter, jobNames(got), err)
+		}
+	}
+
+	for _, descending := range []bool{false, true} {
+		filter := mms.EventFilter{Limit: 4, Descending: descending}
+		page1, cursor, err := store.QueryEvents(ctx, filter)
+		if err != nil || len(page1) != 4 || cursor == "" {
+			t.Fatalf("Expected a page of 4 events and a cursor; Got %q, %q, %v", jobNames(page1), cursor, err)
+		}
+		filter.Cursor = cursor
+		page2, cursor, err := store.QueryEvents(ctx, filter)
+		expected := "job4 job5 "
+		if descending {
+			expected = "job1 job0 "
+		}
+		if err != nil || jobNames(page2) != expected || cursor != "" {
+			t.Errorf("Expected the last page %q; Got %q, %q, %v", expected, jobNames(page2), cursor, err)
+		}
+	}
+
+	if _, _, err := store.QueryEvents(ctx, mms.EventFilter{Cursor: "not a cursor"}); err == nil {
+		t.Errorf("Expected an invalid cursor to fail")
+	}
+
+	// '*' matches '/' in every store, as it does in EventFilter.Matches.
+	slashed := *events[0]
+	slashed.JobName = "runs/7"
+	slashed.EventID = "slashed"
+	if _, _, err := store.SaveEvents(ctx, []*mms.ProductEvent{&slashed}, "mms", ""); err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	filter := mms.EventFilter{JobName: "runs*"}
+	if got, _, err := store.QueryEvents(ctx, filter); err != nil || jobNames(got) != "runs/7 " || !filter.Matches(&slashed) {
+		t.Errorf("Expected runs* to match runs/7; Got %q, %v", jobNames(got), err)
+	}
+}
+
+func testEventStoreEventsAfter(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	events := testEvents()
+	ids, _, err := store.SaveEvents(ctx, events, "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+
+	got, err := store.EventsAfter(ctx, 0, mms.EventFilter{Product: "meps"}, 2)
+	if err != nil || len(got) != 2 || got[0].ID != ids[1] || got[1].ID != ids[3] || got[1].Event.JobName != "job3" {
+		t.Errorf("Expected the first 2 meps events; Got %+v, %v", got, err)
+	}
+	got, err = store.EventsAfter(ctx, ids[3], mms.EventFilter{}, 10)
+	if err != nil || len(got) != 2 || got[0].ID != ids[4] || got[1].ID != ids[5] {
+		t.Errorf("Expected the events after %d; Got %+v, %v", ids[3], got, err)
+	}
+	if got, err = store.EventsAfter(ctx, ids[5], mms.EventFilter{}, 10); err != nil || len(got) != 0 {
+		t.Errorf("Expected no events after the last; Got %+v, %v", got, err)
+	}
+}
+
+func testEventStoreDeleteBefore(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	ids, _, err := store.SaveEvents(ctx, testEvents(), "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+
+	// Events are deleted by when they were received, not when they were created,
+	// and events not yet published are kept.
+	if deleted, err := store.DeleteBefore(ctx, time.Now().Add(-time.Hour)); err != nil || deleted != 0 {
+		t.Errorf("Expected no events received an hour ago; Got %d, %v", deleted, err)
+	}
+	if deleted, err := store.DeleteBefore(ctx, time.Now().Add(time.Second)); err != nil || deleted != 0 {
+		t.Errorf("Expected events not yet published to be kept; Got %d deleted, %v", deleted, err)
+	}
+	for _, id := range ids[:4] {
+		if err := store.MarkDelivered(ctx, id, time.Now()); err != nil {
+			t.Fatalf("failed to mark event delivered: %s", err)
+		}
+	}
+	if err := store.MarkUndeliverable(ctx, ids[4], errors.New("unreadable")); err != nil {
+		t.Fatalf("failed to mark event undeliverable: %s", err)
+	}
+	if deleted, err := store.DeleteBefore(ctx, time.Now().Add(time.Second)); err != nil || deleted != 5 {
+		t.Errorf("Expected the 5 published and undeliverable events to be deleted; Got %d, %v", deleted, err)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.Events != 1 || stats.OutboxBacklog != 1 {
+		t.Errorf("Expected the pending event to be kept; Got %+v, %v", stats, err)
+	}
+	if entries, err := store.PendingOutbox(ctx, time.Now(), 10); err != nil || len(entries) != 1 || entries[0].ID != ids[5] {
+		t.Errorf("Expected only the outbox entry of the pending event to be kept; Got %+v, %v", entries, err)
+	}
+	// An event posted again after it is deleted is stored again.
+	if _, dups, err := store.SaveEvents(ctx, testEvents()[:1], "mms", ""); err != nil || dups[0] {
+		t.Errorf("Expected a deleted event to be stored again; Got %v, %v", dups, err)
+	}
+}
+
+func testEventStoreDeleteEvents(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	events := testEvents()
+	ids, _, err := store.SaveEvents(ctx, events, "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+
+	keys, err := store.EventProducts(ctx)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Product < keys[j].Product })
+	arome := ProductKey{ProductionHub: productionHubName, Product: "arome_arctic"}
+	meps := ProductKey{ProductionHub: productionHubName, Product: "meps"}
+	if err != nil || !reflect.DeepEqual(keys, []ProductKey{arome, meps}) {
+		t.Fatalf("Expected the arome_arctic and meps products; Got %+v, %v", keys, err)
+	}
+	summaries, err := store.EventSummaries(ctx, meps)
+	if err != nil || len(summaries) != 3 {
+		t.Fatalf("Expected 3 meps summaries; Got %+v, %v", summaries, err)
+	}
+	expected := EventSummary{ID: ids[3], Product: "meps", ProductionHub: productionHubName, RefTime: time.Time(events[3].RefTime)}
+	if got := summaries[1]; got.ID != expected.ID || got.Product != expected.Product || got.ProductionHub != expected.ProductionHub ||
+		!got.RefTime.Equal(expected.RefTime) || time.Since(got.ReceivedAt) > time.Minute {
+		t.Errorf("Expected %+v received now; Got %+v", expected, got)
+	}
+
+	// Events not yet published are kept, and deleted events, and no events, are not counted.
+	if deleted, err := store.DeleteEvents(ctx, []int64{ids[0], ids[4]}); err != nil || deleted != 0 {
+		t.Errorf("Expected events not yet published to be kept; Got %d deleted, %v", deleted, err)
+	}
+	if err := store.MarkDelivered(ctx, ids[0], time.Now()); err != nil {
+		t.Fatalf("failed to mark event delivered: %s", err)
+	}
+	if err := store.MarkUndeliverable(ctx, ids[4], errors.New("unreadable")); err != nil {
+		t.Fatalf("failed to mark event undeliverable: %s", err)
+	}
+	if deleted, err := store.DeleteEvents(ctx, []int64{ids[0], ids[4]}); err != nil || deleted != 2 {
+		t.Errorf("Expected 2 deleted events; Got %d, %v", deleted, err)
+	}
+	if deleted, err := store.DeleteEvents(ctx, []int64{ids[4]}); err != nil || deleted != 0 {
+		t.Errorf("Expected no deleted events; Got %d, %v", deleted, err)
+	}
+	if deleted, err := store.DeleteEvents(ctx, nil); err != nil || deleted != 0 {
+		t.Errorf("Expected no deleted events; Got %d, %v", deleted, err)
+	}
+
+	stored, _, _ := store.QueryEvents(ctx, mms.EventFilter{})
+	if jobNames(stored) != "job1 job2 job3 job5 " {
+		t.Errorf("Expected the other events to be kept; Got %q", jobNames(stored))
+	}
+	if entries, _ := store.PendingOutbox(ctx, time.Now(), 10); len(entries) != 4 || entries[0].ID != ids[1] {
+		t.Errorf("Expected the outbox entries of the deleted events to be deleted; Got %+v", entries)
+	}
+	if summaries, _ := store.EventSummaries(ctx, arome); len(summaries) != 1 || summaries[0].ID != ids[2] {
+		t.Errorf("Expected summaries of the kept events; Got %+v", summaries)
+	}
+}
+
+func testEventStoreOutbox(t *testing.T, store EventStore) {
+	ctx := context.Background()
+	events := testEvents()
+	ids, _, err := store.SaveEvents(ctx, events[:2], "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	userIDs, _, err := store.SaveEvents(ctx, events[2:3], "other", "user")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+
+	now := time.Now()
+	entries, err := store.PendingOutbox(ctx, now, 10)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 pending entries; Got %+v, %v", entries, err)
+	}
+	if entries[0].ID != ids[0] || entries[1].ID != ids[1] || entries[2].ID != userIDs[0] {
+		t.Errorf("Expected the entries in the order they were stored; Got %+v", entries)
+	}
+	if entries[2].QueueName != "other" || entries[2].NatsUser != "user" || entries[2].Attempts != 0 || entries[2].Event.JobName != "job2" {
+		t.Errorf("Expected the queue, user and event of the entry; Got %+v", entries[2])
+	}
+	if limited, _ := store.PendingOutbox(ctx, now, 1); len(limited) != 1 || limited[0].ID != ids[0] {
+		t.Errorf("Expected only the first entry; Got %+v", limited)
+	}
+
+	if err := store.MarkDelivered(ctx, ids[0], now); err != nil {
+		t.Fatalf("failed to mark delivered: %s", err)
+	}
+	if err := store.MarkFailed(ctx, ids[1], now.Add(time.Minute), errors.New("no nats")); err != nil {
+		t.Fatalf("failed to mark failed: %s", err)
+	}
+
+	entries, err = store.PendingOutbox(ctx, now, 10)
+	if err != nil || len(entries) != 1 || entries[0].ID != userIDs[0] {
+		t.Errorf("Expected only the entry that is not delivered or waiting; Got %+v, %v", entries, err)
+	}
+	entries, err = store.PendingOutbox(ctx, now.Add(2*time.Minute), 10)
+	if err != nil || len(entries) != 2 || entries[0].ID != ids[1] || entries[0].Attempts != 1 {
+		t.Errorf("Expected the failed entry to be retried later; Got %+v, %v", entries, err)
+	}
+
+	if stats, err := store.Stats(ctx); err != nil || stats.Events != 3 || stats.OutboxBacklog != 2 {
+		t.Errorf("Expected 3 events with 2 not published; Got %+v, %v", stats, err)
+	}
+
+	// A later event of the same NATS user waits for the failed one, to be published in order.
+	laterIDs, _, err := store.SaveEvents(ctx, events[3:4], "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	entries, err = store.PendingOutbox(ctx, now, 10)
+	if err != nil || len(entries) != 1 || entries[0].ID != userIDs[0] {
+		t.Errorf("Expected the later event to wait for the failed one; Got %+v, %v", entries, err)
+	}
+
+	// An event that can never be published no longer holds back the later ones.
+	if err := store.MarkUndeliverable(ctx, ids[1], errors.New("unreadable")); err != nil {
+		t.Fatalf("failed to mark undeliverable: %s", err)
+	}
+	entries, err = store.PendingOutbox(ctx, now.Add(2*time.Minute), 10)
+	if err != nil || len(entries) != 2 || entries[0].ID != userIDs[0] || entries[1].ID != laterIDs[0] {
+		t.Errorf("Expected the undeliverable event to be left out; Got %+v, %v", entries, err)
+	}
+	if stats, err := store.Stats(ctx); err != nil || stats.Events != 4 || stats.OutboxBacklog != 2 {
+		t.Errorf("Expected 4 events with 2 to be published; Got %+v, %v", stats, err)
+	}
+}
@@ -18,12 +18,22 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 )
 
 type Healthz struct {
 	Status      HealthzStatus
 	Description string
+	Components  []HealthzComponent
+}
+
+// HealthzComponent is the health of one dependency of the service.
+type HealthzComponent struct {
+	Name        string
+	Status      HealthzStatus
+	Description string
 }
 
 type HealthzStatus int
@@ -35,16 +45,49 @@ const (
 )
 
 type healthzJSONLD struct {
+	Status      string                   `json:"status"`
+	Description string                   `json:"description"`
+	Components  []healthzComponentJSONLD `json:"components,omitempty"`
+}
+
+type healthzComponentJSONLD struct {
+	Name        string `json:"name"`
 	Status      string `json:"status"`
 	Description string `json:"description"`
 }
 
+// RollUpHealthz combines the health of the components into the health of the service.
+// The service is as unhealthy as its least healthy component.
+func RollUpHealthz(components []HealthzComponent) *Healthz {
+	healthz := &Healthz{
+		Status:      HealthzStatusHealthy,
+		Description: "All components are ok.",
+		Components:  components,
+	}
+
+	var failing []string
+	for _, component := range components {
+		if component.Status != HealthzStatusHealthy {
+			failing = append(failing, component.Name)
+		}
+		if component.Status > healthz.Status {
+			healthz.Status = component.Status
+		}
+	}
+	if len(failing) > 0 {
+		healthz.Description = fmt.Sprintf("Components not ok: %s.", strings.Join(failing, ", "))
+	}
+
+	return healthz
+}
+
 // HealthzHandler runs the callback function check and serializes and sends the result of that check.
 func HealthzHandler(check func() (*Healthz, error)) http.HandlerFunc {
 	return func(httpRespW http.ResponseWriter, httpReq *http.Request) {
 		healthz, err := check()
 		if err != nil {
 			http.Error(httpRespW, "Could not check the health of the service.", http.StatusInternalServerError)
+			return
 		}
 		healthz.respond(httpRespW, httpReq)
 	}
@@ -71,6 +114,13 @@ func (healthz *Healthz) encodeJSONLD() ([]byte, error) {
 		Status:      healthz.Status.String(),
 		Description: healthz.Description,
 	}
+	for _, component := range healthz.Components {
+		ld.Components = append(ld.Components, healthzComponentJSONLD{
+			Name:        component.Name,
+			Status:      component.Status.String(),
+			Description: component.Description,
+		})
+	}
 
 	payload, err := json.Marshal(ld)
 	if err != nil {
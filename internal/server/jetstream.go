@@ -0,0 +1,82 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/nats-io/nats.go"
+)
+
+// StreamConfig is the configurable part of the JetStream stream storing the events of a local production hub.
+type StreamConfig struct {
+	Subjects []string      // Subjects stored in the stream. Events posted with other queue names can not be published.
+	MaxAge   time.Duration // Events older than this are removed from the stream. Zero keeps them forever.
+	MaxBytes int64         // The oldest events are removed when the stream grows beyond this size. -1 for no limit.
+	// Duplicates is how long the stream remembers event ids, to drop events published again. Zero uses the server default of 2 minutes.
+	Duplicates time.Duration
+}
+
+// EnsureProductStream creates the mms.ProductStream stream on the NATS server at natsURL, or updates it to match config.
+func EnsureProductStream(natsURL string, natsCredentials nats.Option, config StreamConfig) (*nats.StreamInfo, error) {
+	if len(config.Subjects) == 0 {
+		return nil, fmt.Errorf("stream %s needs at least one subject", mms.ProductStream)
+	}
+
+	conn, err := nats.Connect(natsURL, natsCredentials, nats.Name("mmsd-stream-setup"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %v", err)
+	}
+
+	streamConfig := &nats.StreamConfig{
+		Name:       mms.ProductStream,
+		Subjects:   config.Subjects,
+		MaxAge:     config.MaxAge,
+		MaxBytes:   config.MaxBytes,
+		Duplicates: config.Duplicates,
+		Storage:    nats.FileStorage,
+		Retention:  nats.LimitsPolicy,
+		Discard:    nats.DiscardOld,
+	}
+
+	_, err = js.StreamInfo(mms.ProductStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		info, err := js.AddStream(streamConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream %s: %v", mms.ProductStream, err)
+		}
+		return info, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream %s: %v", mms.ProductStream, err)
+	}
+
+	info, err := js.UpdateStream(streamConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update stream %s: %v", mms.ProductStream, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+var testStreamConfig = StreamConfig{Subjects: []string{"mms", "mms.>"}, MaxAge: time.Hour, MaxBytes: -1, Duplicates: 10 * time.Minute}
+
+// runTestJetStreamServer starts a NATS server with JetStream and the product stream, like the one of a local mmsd.
+func runTestJetStreamServer(t *testing.T) *natsserver.Server {
+	natsServer, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %s", err)
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready for connections")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	if _, err := EnsureProductStream(natsServer.ClientURL(), nil, testStreamConfig); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	return natsServer
+}
+
+func TestEnsureProductStream(t *testing.T) {
+	natsServer := runTestJetStreamServer(t)
+
+	// Running it again updates the existing stream.
+	info, err := EnsureProductStream(natsServer.ClientURL(), nil, StreamConfig{Subjects: []string{"mms.>"}, MaxAge: 2 * time.Hour, MaxBytes: 1 << 20, Duplicates: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to update stream: %s", err)
+	}
+	if info.Config.Name != mms.ProductStream || info.Config.MaxAge != 2*time.Hour || info.Config.MaxBytes != 1<<20 || info.Config.Duplicates != time.Hour || len(info.Config.Subjects) != 1 {
+		t.Errorf("Expected the updated stream config; Got %+v", info.Config)
+	}
+
+	if _, err := EnsureProductStream(natsServer.ClientURL(), nil, StreamConfig{}); err == nil {
+		t.Error("Expected an error for a stream without subjects")
+	}
+}
@@ -58,6 +58,9 @@ func createJWTDB(dbFilePath string, NSC_creds_location string) (*sql.DB, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create table: %s", err)
 	}
+	if _, err = db.Exec(createAuditTable); err != nil {
+		return nil, fmt.Errorf("failed to create audit table: %s", err)
+	}
 	err = InitializeJWTDB(db, NSC_creds_location)
 	return db, err
 }
@@ -0,0 +1,479 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// DefaultMemoryStoreEvents is how many events the in-memory event store keeps by default.
+const DefaultMemoryStoreEvents = 100000
+
+// MemoryEventStore keeps the latest events in a ring buffer in memory, for production hubs that do not need the events
+// to survive a restart. When the buffer is full, the oldest event is dropped to make room for a new one, also if it is
+// not published yet.
+type MemoryEventStore struct {
+	mu          sync.Mutex
+	slots       []*memoryEvent   // Event with id n is in slot (n-1) % len(slots), nil if it is deleted.
+	first       int64            // Id of the oldest event in the buffer.
+	next        int64            // Id of the next stored event.
+	undelivered int64            // Id of the oldest event that may not be published yet.
+	byEventID   map[string]int64 // Ids of the stored events by their EventID.
+	events      int64            // Number of stored events.
+	backlog     int64            // Number of stored events that are not published yet.
+}
+
+// memoryEvent is a stored event with the fields it is filtered by, formatted like in the events db so they compare the same.
+type memoryEvent struct {
+	id            int64
+	payload       []byte
+	eventID       string
+	product       string
+	productionHub string
+	jobName       string
+	createdAt     string
+	refTime       string
+	receivedAt    string
+	outbox        memoryOutboxEntry
+}
+
+type memoryOutboxEntry struct {
+	queueName     string
+	natsUser      string
+	attempts      int
+	nextAttemptAt string
+	delivered     bool
+	undeliverable bool
+}
+
+// NewMemoryEventStore gives an event store keeping at most capacity events in memory.
+// The ids start at the time in microseconds, so they keep growing across restarts, and clients resuming an event stream
+// with the id of an event from before a restart do not skip the new events. Microseconds keep the ids exact as
+// JavaScript numbers.
+func NewMemoryEventStore(capacity int) (*MemoryEventStore, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %d of memory event store", capacity)
+	}
+	firstID := time.Now().UnixMicro()
+	return &MemoryEventStore{
+		slots:       make([]*memoryEvent, capacity),
+		first:       firstID,
+		next:        firstID,
+		undelivered: firstID,
+		byEventID:   map[string]int64{},
+	}, nil
+}
+
+func (store *MemoryEventStore) slot(id int64) **memoryEvent {
+	return &store.slots[(id-1)%int64(len(store.slots))]
+}
+
+// get gives the stored event with the given id, or nil if there is none.
+func (store *MemoryEventStore) get(id int64) *memoryEvent {
+	if id < store.first || id >= store.next {
+		return nil
+	}
+	return *store.slot(id)
+}
+
+// remove deletes the event with the given id, and moves the start of the buffer past deleted events.
+func (store *MemoryEventStore) remove(id int64) {
+	stored := store.get(id)
+	if stored == nil {
+		return
+	}
+	if stored.eventID != "" {
+		delete(store.byEventID, stored.eventID)
+	}
+	store.events--
+	if stored.outbox.pending() {
+		store.backlog--
+	}
+	*store.slot(id) = nil
+	for store.first < store.next && *store.slot(store.first) == nil {
+		store.first++
+	}
+	store.advanceUndelivered()
+}
+
+// advanceUndelivered moves the oldest event that may not be published past the events that are no longer pending.
+func (store *MemoryEventStore) advanceUndelivered() {
+	if store.undelivered < store.first {
+		store.undelivered = store.first
+	}
+	for store.undelivered < store.next {
+		if event := store.get(store.undelivered); event != nil && event.outbox.pending() {
+			return
+		}
+		store.undelivered++
+	}
+}
+
+// SaveEvents stores events and adds them to the outbox, so either all or none are stored.
+func (store *MemoryEventStore) SaveEvents(ctx context.Context, events []*mms.ProductEvent, queueName string, natsUser string) ([]int64, []bool, error) {
+	stored := make([]*memoryEvent, len(events))
+	now := formatDBTime(time.Now())
+	for i, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to store event %d: %s", i, err)
+		}
+		stored[i] = &memoryEvent{
+			payload:       payload,
+			eventID:       event.EventID,
+			product:       event.Product,
+			productionHub: event.ProductionHub,
+			jobName:       event.JobName,
+			createdAt:     formatDBTime(time.Time(event.CreatedAt)),
+			refTime:       formatDBTime(time.Time(event.RefTime)),
+			receivedAt:    now,
+			outbox:        memoryOutboxEntry{queueName: queueName, natsUser: natsUser, nextAttemptAt: now},
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	eventIDs := make([]int64, len(events))
+	duplicates := make([]bool, len(events))
+	for i, event := range stored {
+		if id, ok := store.byEventID[event.eventID]; ok && event.eventID != "" {
+			eventIDs[i] = id
+			duplicates[i] = true
+			continue
+		}
+
+		if store.next-store.first == int64(len(store.slots)) {
+			if oldest := store.get(store.first); oldest != nil && oldest.outbox.pending() {
+				log.Printf("memory event store is full, dropping event %d before it is published", oldest.id)
+			}
+			store.remove(store.first)
+		}
+		event.id = store.next
+		store.next++
+		*store.slot(event.id) = event
+		store.events++
+		store.backlog++
+		if event.eventID != "" {
+			store.byEventID[event.eventID] = event.id
+		}
+		eventIDs[i] = event.id
+	}
+	return eventIDs, duplicates, nil
+}
+
+// matches tells whether the event is selected by filter.
+func (event *memoryEvent) matches(filter mms.EventFilter) bool {
+	for _, globCond := range []struct {
+		value   string
+		pattern string
+	}{
+		{event.product, filter.Product},
+		{event.productionHub, filter.ProductionHub},
+		{event.jobName, filter.JobName},
+	} {
+		if globCond.pattern == "" {
+			continue
+		}
+		if ok, err := mms.MatchGlob(globCond.pattern, globCond.value); err != nil || !ok {
+			return false
+		}
+	}
+
+	for _, timeCond := range []struct {
+		value string
+		t     time.Time
+		since bool
+	}{
+		{event.createdAt, filter.Since, true},
+		{event.createdAt, filter.Until, false},
+		{event.refTime, filter.RefTimeSince, true},
+		{event.refTime, filter.RefTimeUntil, false},
+	} {
+		if timeCond.t.IsZero() {
+			continue
+		}
+		if timeCond.since && timeCond.value < formatDBTime(timeCond.t) || !timeCond.since && timeCond.value >= formatDBTime(timeCond.t) {
+			return false
+		}
+	}
+	return true
+}
+
+// productEvent gives a copy of the stored event.
+func (event *memoryEvent) productEvent() (*mms.ProductEvent, error) {
+	var pEvent mms.ProductEvent
+	if err := json.Unmarshal(event.payload, &pEvent); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event %d: %s", event.id, err)
+	}
+	return &pEvent, nil
+}
+
+// QueryEvents gives the events matching filter, ordered by creation time.
+func (store *MemoryEventStore) QueryEvents(ctx context.Context, filter mms.EventFilter) ([]*mms.ProductEvent, string, error) {
+	var cursorCreatedAt string
+	var cursorID int
+	if filter.Cursor != "" {
+		var err error
+		if cursorCreatedAt, cursorID, err = decodeEventsCursor(filter.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	// before tells whether event a comes before event b in the order of the query.
+	before := func(aCreatedAt string, aID int64, bCreatedAt string, bID int64) bool {
+		if aCreatedAt != bCreatedAt {
+			return aCreatedAt < bCreatedAt != filter.Descending
+		}
+		return aID != bID && aID < bID != filter.Descending
+	}
+
+	store.mu.Lock()
+	var selected []*memoryEvent
+	for id := store.first; id < store.next; id++ {
+		event := store.get(id)
+		if event == nil || !event.matches(filter) {
+			continue
+		}
+		if filter.Cursor != "" && !before(cursorCreatedAt, int64(cursorID), event.createdAt, event.id) {
+			continue
+		}
+		selected = append(selected, event)
+	}
+	store.mu.Unlock()
+
+	sort.Slice(selected, func(i, j int) bool {
+		return before(selected[i].createdAt, selected[i].id, selected[j].createdAt, selected[j].id)
+	})
+	if filter.Limit > 0 && len(selected) > filter.Limit {
+		selected = selected[:filter.Limit]
+	}
+
+	events := []*mms.ProductEvent{}
+	for _, stored := range selected {
+		event, err := stored.productEvent()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		events = append(events, event)
+	}
+
+	var nextCursor string
+	if filter.Limit > 0 && len(selected) == filter.Limit {
+		last := selected[len(selected)-1]
+		nextCursor = encodeEventsCursor(last.createdAt, int(last.id))
+	}
+	return events, nextCursor, nil
+}
+
+// EventsAfter gives at most limit events matching filter that were stored after the event with the given id.
+func (store *MemoryEventStore) EventsAfter(ctx context.Context, id int64, filter mms.EventFilter, limit int) ([]StoredEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if id < store.first-1 {
+		id = store.first - 1
+	}
+	var events []StoredEvent
+	for next := id + 1; next < store.next && len(events) < limit; next++ {
+		stored := store.get(next)
+		if stored == nil || !stored.matches(filter) {
+			continue
+		}
+		event, err := stored.productEvent()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		events = append(events, StoredEvent{ID: stored.id, Event: event})
+	}
+	return events, nil
+}
+
+// DeleteBefore removes the events received before t, together with their outbox entries, but keeps events not yet published.
+func (store *MemoryEventStore) DeleteBefore(ctx context.Context, t time.Time) (int64, error) {
+	before := formatDBTime(t)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var deleted int64
+	for id := store.first; id < store.next; id++ {
+		if event := store.get(id); event != nil && event.receivedAt < before && !event.outbox.pending() {
+			store.remove(id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// EventProducts gives the production hub and product of each group of stored events, in the order they were first stored.
+func (store *MemoryEventStore) EventProducts(ctx context.Context) ([]ProductKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	seen := map[ProductKey]bool{}
+	var keys []ProductKey
+	for id := store.first; id < store.next; id++ {
+		event := store.get(id)
+		if event == nil {
+			continue
+		}
+		key := ProductKey{ProductionHub: event.productionHub, Product: event.product}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// EventSummaries gives the id, reference time and time of receipt of each stored event of product from productionHub,
+// in the order they were stored.
+func (store *MemoryEventStore) EventSummaries(ctx context.Context, key ProductKey) ([]EventSummary, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var summaries []EventSummary
+	for id := store.first; id < store.next; id++ {
+		event := store.get(id)
+		if event == nil || event.productionHub != key.ProductionHub || event.product != key.Product {
+			continue
+		}
+		summary := EventSummary{ID: id, Product: event.product, ProductionHub: event.productionHub}
+		summary.RefTime, _ = time.Parse(time.RFC3339, event.refTime)
+		summary.ReceivedAt, _ = time.Parse(time.RFC3339, event.receivedAt)
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// DeleteEvents removes the events with the given ids, together with their outbox entries, but keeps events not yet published.
+func (store *MemoryEventStore) DeleteEvents(ctx context.Context, ids []int64) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var deleted int64
+	for _, id := range ids {
+		if event := store.get(id); event != nil && !event.outbox.pending() {
+			store.remove(id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Stats counts the stored events and the outbox backlog. The events are received in the order they are stored,
+// so the oldest and newest are those stored first and last.
+func (store *MemoryEventStore) Stats(ctx context.Context) (EventStoreStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stats := EventStoreStats{Events: store.events, OutboxBacklog: store.backlog, LastID: store.next - 1}
+	if oldest := store.get(store.first); oldest != nil {
+		stats.OldestReceived, _ = time.Parse(time.RFC3339, oldest.receivedAt)
+	}
+	for id := store.next - 1; id >= store.first; id-- {
+		if newest := store.get(id); newest != nil {
+			stats.NewestReceived, _ = time.Parse(time.RFC3339, newest.receivedAt)
+			break
+		}
+	}
+	return stats, nil
+}
+
+// PendingOutbox gives the outbox entries that are due, in the order the events were stored.
+func (store *MemoryEventStore) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error) {
+	due := formatDBTime(now)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var entries []OutboxEntry
+	held := map[string]bool{} // NATS users with an entry that is not due, whose later entries wait to keep them in order.
+	for id := store.undelivered; id < store.next && len(entries) < limit; id++ {
+		event := store.get(id)
+		if event == nil || !event.outbox.pending() || held[event.outbox.natsUser] {
+			continue
+		}
+		if event.outbox.nextAttemptAt > due {
+			held[event.outbox.natsUser] = true
+			continue
+		}
+		entry := OutboxEntry{ID: id, QueueName: event.outbox.queueName, NatsUser: event.outbox.natsUser, Attempts: event.outbox.attempts}
+		var err error
+		if entry.Event, err = event.productEvent(); err != nil {
+			log.Printf("failed to read event %d in outbox: %s", id, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// MarkDelivered records that the event with the given id is published.
+func (store *MemoryEventStore) MarkDelivered(ctx context.Context, id int64, deliveredAt time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// The event may have been dropped while it was published.
+	if event := store.get(id); event != nil && event.outbox.pending() {
+		event.outbox.attempts++
+		event.outbox.delivered = true
+		store.backlog--
+		store.advanceUndelivered()
+	}
+	return nil
+}
+
+// MarkUndeliverable records that the event with the given id can never be published.
+func (store *MemoryEventStore) MarkUndeliverable(ctx context.Context, id int64, publishErr error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if event := store.get(id); event != nil && event.outbox.pending() {
+		event.outbox.attempts++
+		event.outbox.undeliverable = true
+		store.backlog--
+		store.advanceUndelivered()
+	}
+	return nil
+}
+
+// pending reports whether the event is still to be published.
+func (entry memoryOutboxEntry) pending() bool {
+	return !entry.delivered && !entry.undeliverable
+}
+
+// MarkFailed records a failed attempt to publish the event with the given id.
+func (store *MemoryEventStore) MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, publishErr error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if event := store.get(id); event != nil {
+		event.outbox.attempts++
+		event.outbox.nextAttemptAt = formatDBTime(nextAttemptAt)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// migration upgrades a database to version. The schema version of a database is kept in its user_version.
+// Databases from before the schema had a version have version 0, and may already have some of the changes of
+// the first migrations, so those migrations must only make the changes that are missing.
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx *sql.Tx) error
+}
+
+// Migration describes a migration of a database to a schema version.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// OpenDB opens a sqlite database, creating the file if it does not exist, without migrating it.
+func OpenDB(dbFilePath string) (*sql.DB, error) {
+	// Create file if it does not exist.
+	file, err := os.OpenFile(dbFilePath, os.O_CREATE, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create db file: %s", err)
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite3", dbFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to sqlite database: %s", err)
+	}
+	return db, nil
+}
+
+// SchemaVersion gives the schema version of a database, which is 0 for databases from before the schema had a version.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	return version, nil
+}
+
+// runMigrations applies the migrations to versions above the version of db, each in its own transaction,
+// and gives the applied migrations. With dryRun, it only gives the migrations that would be applied.
+func runMigrations(db *sql.DB, migrations []migration, dryRun bool) ([]Migration, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return nil, fmt.Errorf("db has schema version %d, which is newer than version %d known by this mmsd", version, latest)
+	}
+
+	applied := []Migration{}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if !dryRun {
+			if err := applyMigration(db, m); err != nil {
+				return applied, err
+			}
+			log.Printf("migrated db to schema version %d: %s", m.version, m.description)
+		}
+		applied = append(applied, Migration{Version: m.version, Description: m.description})
+	}
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := m.migrate(tx); err != nil {
+		return fmt.Errorf("failed to migrate db to schema version %d: %s", m.version, err)
+	}
+	// PRAGMA does not take parameters, and the version is always a number.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+		return fmt.Errorf("failed to set schema version %d: %s", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate db to schema version %d: %s", m.version, err)
+	}
+	return nil
+}
+
+// tableColumns gives the names of the columns of table, which has none if it does not exist.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s table columns: %s", table, err)
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read %s table columns: %s", table, err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
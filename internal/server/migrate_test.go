@@ -0,0 +1,113 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+func TestMigrateEventsDB(t *testing.T) {
+	dbTestFile := fmt.Sprintf("/tmp/mmsdtestmigrate%d.db", rand.Int())
+	defer os.Remove(dbTestFile)
+	latest := eventsMigrations[len(eventsMigrations)-1].version
+
+	db, err := OpenDB(dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE events ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "createdAt" string, "event" BLOB);
+		INSERT INTO events(createdAt, event) VALUES ("2022-07-05T08:51:19Z", '{"Product": "arome_arctic", "ProductionHub": "default"}');`)
+	if err != nil {
+		t.Fatalf("failed to create old events table: %s", err)
+	}
+
+	migrations, err := MigrateEventsDB(db, true)
+	if err != nil || len(migrations) != latest {
+		t.Fatalf("Expected %d migrations to be shown; Got %+v, %v", latest, migrations, err)
+	}
+	if version, _ := SchemaVersion(db); version != 0 {
+		t.Errorf("Expected a dry run to leave the db at version 0; Got %d", version)
+	}
+
+	if _, err := MigrateEventsDB(db, false); err != nil {
+		t.Fatalf("failed to migrate db: %s", err)
+	}
+	if version, _ := SchemaVersion(db); version != latest {
+		t.Errorf("Expected schema version %d; Got %d", latest, version)
+	}
+	var product, receivedAt string
+	err = db.QueryRow(`SELECT product, receivedAt FROM events`).Scan(&product, &receivedAt)
+	if err != nil || product != "arome_arctic" || receivedAt != "2022-07-05T08:51:19Z" {
+		t.Errorf("Expected the columns filled from the old event; Got %q, %q (%v)", product, receivedAt, err)
+	}
+
+	if migrations, err := MigrateEventsDB(db, false); err != nil || len(migrations) != 0 {
+		t.Errorf("Expected no migrations of a migrated db; Got %+v, %v", migrations, err)
+	}
+
+	db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, latest+1))
+	if _, err := MigrateEventsDB(db, false); err == nil {
+		t.Errorf("Expected an error for a db from a newer mmsd")
+	}
+}
+
+func TestMigrateStateDB(t *testing.T) {
+	db := newTestStateDB(t)
+	latest := stateMigrations[len(stateMigrations)-1].version
+
+	if version, _ := SchemaVersion(db); version != latest {
+		t.Errorf("Expected a new state db to have schema version %d; Got %d", latest, version)
+	}
+	if migrations, err := MigrateStateDB(db, true); err != nil || len(migrations) != 0 {
+		t.Errorf("Expected no migrations of a new state db; Got %+v, %v", migrations, err)
+	}
+}
+
+func TestDeleteOldEvents(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	oldID := postTestEvent(t, service, mms.ProductEvent{Product: "old", ProductionHub: productionHubName})
+	newID := postTestEvent(t, service, mms.ProductEvent{Product: "new", ProductionHub: productionHubName})
+	testEventsDB(service).Exec(`UPDATE events SET receivedAt = ? WHERE id = ?`, formatDBTime(time.Now().Add(-2*time.Hour)), oldID)
+	if err := service.events.MarkDelivered(context.Background(), oldID, time.Now()); err != nil {
+		t.Fatalf("failed to mark event delivered: %s", err)
+	}
+
+	// The age is compared in UTC, whatever the time zone of maxAge.
+	maxAge := time.Now().Add(-time.Hour).In(time.FixedZone("UTC-10", -10*3600))
+	if err := service.DeleteOldEvents(maxAge); err != nil {
+		t.Fatalf("failed to delete old events: %s", err)
+	}
+
+	var nEvents, nOutbox int
+	testEventsDB(service).QueryRow(`SELECT count(*) FROM events WHERE id = ?`, oldID).Scan(&nEvents)
+	testEventsDB(service).QueryRow(`SELECT count(*) FROM outbox WHERE eventId = ?`, oldID).Scan(&nOutbox)
+	if nEvents != 0 || nOutbox != 0 {
+		t.Errorf("Expected the old event and its outbox entry to be deleted; Got %d events and %d outbox entries", nEvents, nOutbox)
+	}
+	testEventsDB(service).QueryRow(`SELECT count(*) FROM events WHERE id = ?`, newID).Scan(&nEvents)
+	if nEvents != 1 {
+		t.Errorf("Expected the new event to be kept")
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	outboxPollInterval   = 1 * time.Second
+	outboxBatchSize      = 100
+	outboxPublishTimeout = 10 * time.Second
+	outboxMinBackoff     = 1 * time.Second
+	outboxMaxBackoff     = 5 * time.Minute
+)
+
+// outboxDispatcher publishes the events in the outbox of the event store to NATS, retrying with backoff until they are delivered.
+type outboxDispatcher struct {
+	events       EventStore
+	publisherFor func(natsUser string) (*mms.Publisher, error)
+	wake         chan struct{}
+
+	backlog  prometheus.Gauge
+	failures prometheus.Counter
+}
+
+func newOutboxDispatcher(events EventStore, publisherFor func(natsUser string) (*mms.Publisher, error), m *metrics) *outboxDispatcher {
+	dispatcher := &outboxDispatcher{
+		events:       events,
+		publisherFor: publisherFor,
+		wake:         make(chan struct{}, 1),
+		backlog: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "mmsd",
+			Name:      "outbox_backlog",
+			Help:      "The number of stored events not yet published to NATS.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "mmsd",
+			Name:      "outbox_publish_failures_total",
+			Help:      "The total number of failed attempts to publish events from the outbox.",
+		}),
+	}
+	m.MustRegister(dispatcher.backlog, dispatcher.failures)
+
+	return dispatcher
+}
+
+// notify wakes up the dispatcher without waiting for the next poll.
+func (d *outboxDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run dispatches the outbox until ctx is cancelled.
+func (d *outboxDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.dispatch(ctx); err != nil {
+			log.Printf("failed to dispatch outbox: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// dispatch tries to publish all pending events that are due, in the order they were stored.
+func (d *outboxDispatcher) dispatch(ctx context.Context) error {
+	for {
+		entries, err := d.events.PendingOutbox(ctx, time.Now(), outboxBatchSize)
+		if err != nil {
+			return err
+		}
+
+		// Once publishing for a NATS user fails, its later events are skipped, and the event store holds them back
+		// until the failed event is published, to keep them in order.
+		failedUsers := map[string]bool{}
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if failedUsers[entry.NatsUser] {
+				continue
+			}
+			if entry.Event == nil {
+				d.failures.Inc()
+				log.Printf("event %d in outbox can not be read, it will not be published", entry.ID)
+				if err := d.events.MarkUndeliverable(ctx, entry.ID, fmt.Errorf("failed to read stored event")); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.publish(ctx, entry); err != nil {
+				failedUsers[entry.NatsUser] = true
+				d.failures.Inc()
+				log.Printf("failed to publish event %d from outbox, attempt %d: %s", entry.ID, entry.Attempts+1, err)
+				if err := d.markFailed(ctx, entry, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.markDelivered(ctx, entry); err != nil {
+				return err
+			}
+		}
+
+		if err := d.updateBacklog(ctx); err != nil {
+			return err
+		}
+		if len(entries) < outboxBatchSize || len(failedUsers) > 0 {
+			return nil
+		}
+	}
+}
+
+func (d *outboxDispatcher) publish(ctx context.Context, entry OutboxEntry) error {
+	publisher, err := d.publisherFor(entry.NatsUser)
+	if err != nil {
+		return err
+	}
+
+	// While reconnecting, core NATS publishes only go to a client side buffer, so they would not count as delivered.
+	conn := publisher.Conn()
+	if !conn.IsConnected() {
+		return fmt.Errorf("not connected to nats, connection is %s", conn.Status())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+
+	if err := publisher.PublishProductEvent(ctx, entry.Event, entry.QueueName); err != nil {
+		return err
+	}
+	if err := conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("failed to flush to nats: %v", err)
+	}
+	return nil
+}
+
+func (d *outboxDispatcher) markDelivered(ctx context.Context, entry OutboxEntry) error {
+	return d.events.MarkDelivered(ctx, entry.ID, time.Now())
+}
+
+func (d *outboxDispatcher) markFailed(ctx context.Context, entry OutboxEntry, publishErr error) error {
+	return d.events.MarkFailed(ctx, entry.ID, time.Now().Add(outboxBackoff(entry.Attempts+1)), publishErr)
+}
+
+func (d *outboxDispatcher) updateBacklog(ctx context.Context) error {
+	stats, err := d.events.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	d.backlog.Set(float64(stats.OutboxBacklog))
+
+	return nil
+}
+
+// outboxBackoff gives the time to wait after the given number of failed attempts, doubling up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// StartOutboxDispatcher starts publishing stored events to NATS in the background until ctx is cancelled.
+func (service *Service) StartOutboxDispatcher(ctx context.Context) {
+	go service.outbox.run(ctx)
+}
+
+// publisherFor returns the publisher for the NATS user an event was posted by, or the service's own if there is none.
+func (service *Service) publisherFor(natsUser string) (*mms.Publisher, error) {
+	if natsUser == "" {
+		return service.Publisher()
+	}
+	return service.userPublisher(natsUser)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testAPIKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// newOutboxTestService creates a nats-local service with an API key for posting events.
+func newOutboxTestService(t *testing.T, natsURL string) *Service {
+	service := newHealthzTestService(t, natsURL)
+
+	stateTestFile := fmt.Sprintf("/tmp/mmsdteststate%d.db", rand.Int())
+	t.Cleanup(func() { os.Remove(stateTestFile) })
+	stateDB, err := NewStateDB(stateTestFile)
+	if err != nil {
+		t.Fatalf("failed to create state db: %s", err)
+	}
+	if err := AddNewApiKey(stateDB, testAPIKey, "test"); err != nil {
+		t.Fatalf("failed to add api key: %s", err)
+	}
+	service.stateDB = stateDB
+	t.Cleanup(service.Close)
+
+	return service
+}
+
+func postTestEvent(t *testing.T, service *Service, pEvent mms.ProductEvent) int64 {
+	payload, _ := json.Marshal(pEvent)
+	httpReq := httptest.NewRequest("POST", "/api/v1/events", bytes.NewReader(payload))
+	httpReq.Header.Set("Api-Key", testAPIKey)
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+
+	if httpRespW.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 Accepted; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+	var resp postEventResponse
+	if err := json.Unmarshal(httpRespW.Body.Bytes(), &resp); err != nil || resp.ID == 0 {
+		t.Fatalf("Expected the event id in the response; Got %s", httpRespW.Body.String())
+	}
+	return resp.ID
+}
+
+// testEventsDB gives the database of a service keeping its events in sqlite.
+func testEventsDB(service *Service) *sql.DB {
+	return service.events.(*SQLiteEventStore).db
+}
+
+func outboxState(t *testing.T, db *sql.DB, eventID int64) (attempts int, lastError sql.NullString, deliveredAt sql.NullString) {
+	err := db.QueryRow(`SELECT attempts, lastError, deliveredAt FROM outbox WHERE eventId = ?`, eventID).Scan(&attempts, &lastError, &deliveredAt)
+	if err != nil {
+		t.Fatalf("failed to read outbox: %s", err)
+	}
+	return attempts, lastError, deliveredAt
+}
+
+func TestOutboxDelivers(t *testing.T) {
+	natsServer := runTestJetStreamServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	defer conn.Close()
+	sub, err := conn.SubscribeSync("mms.*.arome_arctic")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	service := newOutboxTestService(t, natsServer.ClientURL())
+	eventID := postTestEvent(t, service, mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+
+	if backlog := testutil.ToFloat64(service.outbox.backlog); backlog != 0 {
+		t.Errorf("Expected no backlog before dispatching; Got %v", backlog)
+	}
+	if err := service.outbox.dispatch(context.Background()); err != nil {
+		t.Fatalf("failed to dispatch: %s", err)
+	}
+
+	if _, err := sub.NextMsg(2 * time.Second); err != nil {
+		t.Errorf("Expected the event on NATS; Got %s", err)
+	}
+	js, _ := conn.JetStream()
+	if info, err := js.StreamInfo(mms.ProductStream); err != nil || info.State.Msgs != 1 {
+		t.Errorf("Expected the event to be kept in the stream; Got %v, %v", info, err)
+	}
+	attempts, _, deliveredAt := outboxState(t, testEventsDB(service), eventID)
+	if attempts != 1 || !deliveredAt.Valid {
+		t.Errorf("Expected the event to be delivered in one attempt; Got %d attempts, delivered at %v", attempts, deliveredAt)
+	}
+	if backlog := testutil.ToFloat64(service.outbox.backlog); backlog != 0 {
+		t.Errorf("Expected no backlog; Got %v", backlog)
+	}
+}
+
+func TestOutboxRetriesWhenNatsIsDown(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	eventID := postTestEvent(t, service, mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+
+	// The event is stored and listed even though it can not be published yet.
+	events, _, err := service.QueryEvents(context.Background(), mms.EventFilter{})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected the stored event; Got %v, %v", events, err)
+	}
+
+	if err := service.outbox.dispatch(context.Background()); err != nil {
+		t.Fatalf("failed to dispatch: %s", err)
+	}
+	attempts, lastError, deliveredAt := outboxState(t, testEventsDB(service), eventID)
+	if attempts != 1 || !lastError.Valid || deliveredAt.Valid {
+		t.Errorf("Expected one failed attempt; Got %d attempts, error %v, delivered at %v", attempts, lastError, deliveredAt)
+	}
+	if backlog := testutil.ToFloat64(service.outbox.backlog); backlog != 1 {
+		t.Errorf("Expected a backlog of 1; Got %v", backlog)
+	}
+	if failures := testutil.ToFloat64(service.outbox.failures); failures != 1 {
+		t.Errorf("Expected 1 failure; Got %v", failures)
+	}
+
+	// The next attempt waits for the backoff.
+	if err := service.outbox.dispatch(context.Background()); err != nil {
+		t.Fatalf("failed to dispatch: %s", err)
+	}
+	if attempts, _, _ := outboxState(t, testEventsDB(service), eventID); attempts != 1 {
+		t.Errorf("Expected no new attempt before the backoff has passed; Got %d attempts", attempts)
+	}
+}
+
+func TestOutboxUnreadableEvent(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	eventID := postTestEvent(t, service, mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+	if _, err := testEventsDB(service).Exec(`UPDATE events SET event = 'not json' WHERE id = ?`, eventID); err != nil {
+		t.Fatalf("failed to break event: %s", err)
+	}
+
+	// The event is given up on at once, instead of being retried forever.
+	if err := service.outbox.dispatch(context.Background()); err != nil {
+		t.Fatalf("failed to dispatch: %s", err)
+	}
+	attempts, lastError, deliveredAt := outboxState(t, testEventsDB(service), eventID)
+	if attempts != 1 || !lastError.Valid || deliveredAt.Valid {
+		t.Errorf("Expected one failed attempt; Got %d attempts, error %v, delivered at %v", attempts, lastError, deliveredAt)
+	}
+	if entries, err := service.events.PendingOutbox(context.Background(), time.Now().Add(outboxMaxBackoff), 10); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the event not to be tried again; Got %+v, %v", entries, err)
+	}
+	if backlog := testutil.ToFloat64(service.outbox.backlog); backlog != 0 {
+		t.Errorf("Expected no backlog; Got %v", backlog)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		20: outboxMaxBackoff,
+	} {
+		if backoff := outboxBackoff(attempts); backoff != expected {
+			t.Errorf("Expected backoff %s after %d attempts; Got %s", expected, attempts, backoff)
+		}
+	}
+}
+
+func TestPostEventInvalidQueueName(t *testing.T) {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+
+	for _, queueName := range []string{"mms.>", "mms.*", "mms..test", "mms test"} {
+		payload, _ := json.Marshal(mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+		httpReq := httptest.NewRequest("POST", "/api/v1/events", bytes.NewReader(payload))
+		httpReq.Header.Set("Api-Key", testAPIKey)
+		httpReq.Header.Set("Queue-Name", queueName)
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+
+		if httpRespW.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 Bad Request for Queue-Name %q; Got %d", queueName, httpRespW.Code)
+		}
+	}
+}
+
+func TestPostEventIdempotencyKey(t *testing.T) {
+	natsServer := runTestJetStreamServer(t)
+	service := newOutboxTestService(t, natsServer.ClientURL())
+
+	var responses []postEventResponse
+	for i := 0; i < 2; i++ {
+		payload, _ := json.Marshal(mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+		httpReq := httptest.NewRequest("POST", "/api/v1/events", bytes.NewReader(payload))
+		httpReq.Header.Set("Api-Key", testAPIKey)
+		httpReq.Header.Set("Idempotency-Key", "arome_arctic-2021030106")
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+
+		var resp postEventResponse
+		json.Unmarshal(httpRespW.Body.Bytes(), &resp)
+		expectedCode := http.StatusAccepted
+		if i > 0 {
+			expectedCode = http.StatusOK
+		}
+		if httpRespW.Code != expectedCode || resp.EventID != "arome_arctic-2021030106" || resp.Duplicate != (i > 0) {
+			t.Errorf("Expected %d for post %d; Got %d: %s", expectedCode, i+1, httpRespW.Code, httpRespW.Body.String())
+		}
+		responses = append(responses, resp)
+	}
+	if responses[0].ID != responses[1].ID {
+		t.Errorf("Expected the id of the stored event for the duplicate; Got %d and %d", responses[0].ID, responses[1].ID)
+	}
+
+	events, _, err := service.QueryEvents(context.Background(), mms.EventFilter{})
+	if err != nil || len(events) != 1 {
+		t.Errorf("Expected 1 stored event; Got %v, %v", events, err)
+	}
+
+	// Publishing the event again, e.g. when the outbox did not see the acknowledgement, is dropped by the stream.
+	entries, err := service.events.PendingOutbox(context.Background(), time.Now(), outboxBatchSize)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 outbox entry; Got %v, %v", entries, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := service.outbox.publish(context.Background(), entries[0]); err != nil {
+			t.Fatalf("failed to publish: %s", err)
+		}
+	}
+	conn, _ := nats.Connect(natsServer.ClientURL())
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	if info, err := js.StreamInfo(mms.ProductStream); err != nil || info.State.Msgs != 1 {
+		t.Errorf("Expected 1 event in the stream; Got %v, %v", info, err)
+	}
+}
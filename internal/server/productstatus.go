@@ -1,7 +1,7 @@
 package server
 
 import (
-	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,18 +11,26 @@ import (
 
 type Product struct {
 	Name                 string
+	ProductionHub        string
 	NextInstanceExpected time.Time
+	LastEvent            mms.ProductEvent
+}
+
+// ProductKey identifies a product. Production hubs may have products with the same name, so products are told apart by hub.
+type ProductKey struct {
+	ProductionHub string
+	Product       string
 }
 
 type Productstatus struct {
-	Products map[string]Product
+	Products map[ProductKey]Product
 	GaugeVec *prometheus.GaugeVec
 	mu       sync.RWMutex
 }
 
 func NewProductstatus(m *metrics) *Productstatus {
 	productstatus := Productstatus{
-		Products: make(map[string]Product),
+		Products: make(map[ProductKey]Product),
 		GaugeVec: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Subsystem: "mmsd",
@@ -30,7 +38,8 @@ func NewProductstatus(m *metrics) *Productstatus {
 				Help:      "Delay of a product in seconds.",
 			},
 			[]string{
-				// The product represented as a label
+				// The production hub and product represented as labels
+				"production_hub",
 				"product",
 			},
 		),
@@ -41,36 +50,114 @@ func NewProductstatus(m *metrics) *Productstatus {
 	return &productstatus
 }
 
+// PushEvent records the event as the last one for its product from its production hub.
+// The next instance is only expected if the event says when the next event is due.
 func (p *Productstatus) PushEvent(pe mms.ProductEvent) error {
-	if time.Time(pe.NextEventAt).Equal(time.Time(pe.CreatedAt)) {
-		return nil
-	}
-
 	p.mu.Lock() // Used Lock() (not RLock()) because we're writing to the map
 	defer p.mu.Unlock()
 
-	p.Products[pe.Product] = Product{
-		Name:                 pe.Product,
-		NextInstanceExpected: time.Time(pe.NextEventAt),
+	product := Product{
+		Name:          pe.Product,
+		ProductionHub: pe.ProductionHub,
+		LastEvent:     pe,
 	}
+	if !time.Time(pe.NextEventAt).Equal(time.Time(pe.CreatedAt)) {
+		product.NextInstanceExpected = time.Time(pe.NextEventAt)
+	}
+	p.Products[ProductKey{ProductionHub: pe.ProductionHub, Product: pe.Product}] = product
+
 	return nil
 }
 
-func (p *Productstatus) GetProductDelays(t time.Time) {
+// GetProductDelays returns how long each product with an expected next instance is overdue at time t.
+// Negative delays mean that the next instance is not yet due.
+func (p *Productstatus) GetProductDelays(t time.Time) map[ProductKey]time.Duration {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+
+	delays := make(map[ProductKey]time.Duration)
 	for k, v := range p.Products {
-		diff := t.Sub(v.NextInstanceExpected)
-		fmt.Printf("%s: %v\n", k, diff.Seconds())
+		if v.NextInstanceExpected.IsZero() {
+			continue
+		}
+		delays[k] = t.Sub(v.NextInstanceExpected)
+	}
+	return delays
+}
+
+// Status returns the status of a product from a production hub at time t, and false if no events are known for it.
+func (p *Productstatus) Status(productionHub string, product string, t time.Time) (mms.ProductStatus, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	v, ok := p.Products[ProductKey{ProductionHub: productionHub, Product: product}]
+	if !ok {
+		return mms.ProductStatus{}, false
+	}
+	return v.status(t), true
+}
+
+// Statuses returns the status of all known products at time t, sorted by product name and production hub.
+func (p *Productstatus) Statuses(t time.Time) []mms.ProductStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := make([]mms.ProductStatus, 0, len(p.Products))
+	for _, v := range p.Products {
+		statuses = append(statuses, v.status(t))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Product != statuses[j].Product {
+			return statuses[i].Product < statuses[j].Product
+		}
+		return statuses[i].ProductionHub < statuses[j].ProductionHub
+	})
+
+	return statuses
+}
+
+// status classifies the product at time t. A product is overdue when it is late by more than
+// its own event interval, i.e. at least one whole event is missing.
+func (v Product) status(t time.Time) mms.ProductStatus {
+	lastEvent := v.LastEvent
+	status := mms.ProductStatus{
+		Product:       v.Name,
+		ProductionHub: v.ProductionHub,
+		State:         mms.ProductStateUnknown,
+		LastEvent:     &lastEvent,
 	}
+	if v.NextInstanceExpected.IsZero() {
+		return status
+	}
+
+	expected := v.NextInstanceExpected
+	delay := t.Sub(expected)
+	interval := expected.Sub(time.Time(v.LastEvent.CreatedAt))
+
+	status.NextInstanceExpected = &expected
+	status.DelaySeconds = delay.Seconds()
+	switch {
+	case delay <= 0:
+		status.State = mms.ProductStateOnTime
+	case interval > 0 && delay > interval:
+		status.State = mms.ProductStateOverdue
+	default:
+		status.State = mms.ProductStateLate
+	}
+
+	return status
 }
 
 func (p *Productstatus) UpdateMetrics() {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	for k, v := range p.Products {
+		if v.NextInstanceExpected.IsZero() {
+			p.GaugeVec.DeleteLabelValues(k.ProductionHub, k.Product)
+			continue
+		}
 		diff := time.Now().Sub(v.NextInstanceExpected)
-		p.GaugeVec.WithLabelValues(k).Set(diff.Seconds())
+		p.GaugeVec.WithLabelValues(k.ProductionHub, k.Product).Set(diff.Seconds())
 	}
 }
 
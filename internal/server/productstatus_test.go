@@ -1,6 +1,10 @@
 package server
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -51,3 +55,121 @@ func TestPushEvent(t *testing.T) {
 	ps.GetProductDelays(ts)
 
 }
+
+func TestProductStatus(t *testing.T) {
+	ps := NewProductstatus(NewServiceMetrics(MetricsOpts{}))
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ps.PushEvent(mms.ProductEvent{
+		Product:     "hourly",
+		CreatedAt:   mms.PEventTime(created),
+		NextEventAt: mms.PEventTime(created.Add(time.Hour)),
+	})
+	ps.PushEvent(mms.ProductEvent{
+		Product:     "once",
+		CreatedAt:   mms.PEventTime(created),
+		NextEventAt: mms.PEventTime(created),
+	})
+
+	for _, tc := range []struct {
+		at    time.Time
+		state mms.ProductState
+	}{
+		{created.Add(30 * time.Minute), mms.ProductStateOnTime},
+		{created.Add(90 * time.Minute), mms.ProductStateLate},
+		{created.Add(150 * time.Minute), mms.ProductStateOverdue},
+	} {
+		status, ok := ps.Status("", "hourly", tc.at)
+		if !ok {
+			t.Fatalf("Expected status for product hourly")
+		}
+		if status.State != tc.state {
+			t.Errorf("Expected %s at %s; Got %s", tc.state, tc.at, status.State)
+		}
+	}
+
+	status, _ := ps.Status("", "once", created.Add(time.Hour))
+	if status.State != mms.ProductStateUnknown || status.NextInstanceExpected != nil {
+		t.Errorf("Expected unknown state without expected time; Got %+v", status)
+	}
+
+	if _, ok := ps.Status("", "missing", created); ok {
+		t.Errorf("Expected no status for an unknown product")
+	}
+
+	statuses := ps.Statuses(created)
+	if len(statuses) != 2 || statuses[0].Product != "hourly" || statuses[1].Product != "once" {
+		t.Errorf("Expected statuses for hourly and once; Got %+v", statuses)
+	}
+
+	// Products with the same name from different production hubs have their own status.
+	ps.PushEvent(mms.ProductEvent{
+		Product:       "hourly",
+		ProductionHub: "other",
+		CreatedAt:     mms.PEventTime(created),
+		NextEventAt:   mms.PEventTime(created),
+	})
+	if status, ok := ps.Status("", "hourly", created); !ok || status.State != mms.ProductStateOnTime {
+		t.Errorf("Expected hourly to stay on time; Got %+v", status)
+	}
+	if status, ok := ps.Status("other", "hourly", created); !ok || status.State != mms.ProductStateUnknown || status.ProductionHub != "other" {
+		t.Errorf("Expected hourly from other to be unknown; Got %+v", status)
+	}
+	if delays := ps.GetProductDelays(created); len(delays) != 1 {
+		t.Errorf("Expected a delay for hourly only; Got %v", delays)
+	}
+}
+
+func TestProductstatusHandler(t *testing.T) {
+	service, _, err := NewMockService()
+	if err != nil {
+		t.Fatalf("failed to setup mock service: %s", err)
+	}
+	service.Productstatus.PushEvent(mms.ProductEvent{
+		Product:     "late_product",
+		CreatedAt:   mms.PEventTime(time.Now().Add(-90 * time.Minute)),
+		NextEventAt: mms.PEventTime(time.Now().Add(-30 * time.Minute)),
+	})
+
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/productstatus?state=late", nil))
+	var statuses []mms.ProductStatus
+	if err := json.Unmarshal(httpRespW.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(statuses) != 1 || statuses[0].Product != "late_product" {
+		t.Errorf("Expected late_product to be late; Got %+v", statuses)
+	}
+
+	httpRespW = httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/productstatus/missing", nil))
+	if httpRespW.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown product; Got %d", httpRespW.Code)
+	}
+
+	// Products may contain '/', and come from several production hubs.
+	for _, hub := range []string{"hub-a", "hub-b"} {
+		service.Productstatus.PushEvent(mms.ProductEvent{Product: "radar/composite", ProductionHub: hub})
+	}
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/api/v1/productstatus/" + url.PathEscape("radar/composite") + "?productionHub=hub-b", http.StatusOK},
+		{"/api/v1/productstatus/radar/composite?productionHub=hub-a", http.StatusOK},
+		{"/api/v1/productstatus/radar/composite", http.StatusBadRequest},
+		{"/api/v1/productstatus/radar/composite?productionHub=hub-c", http.StatusNotFound},
+	} {
+		httpRespW = httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", tc.path, nil))
+		if httpRespW.Code != tc.code {
+			t.Errorf("Expected %d for %s; Got %d: %s", tc.code, tc.path, httpRespW.Code, httpRespW.Body.String())
+		}
+	}
+	httpRespW = httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httptest.NewRequest("GET", "/api/v1/productstatus/radar%2Fcomposite?productionHub=hub-b", nil))
+	var status mms.ProductStatus
+	if err := json.Unmarshal(httpRespW.Body.Bytes(), &status); err != nil || status.Product != "radar/composite" || status.ProductionHub != "hub-b" {
+		t.Errorf("Expected the status of radar/composite from hub-b; Got %+v, %v", status, err)
+	}
+}
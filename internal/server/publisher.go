@@ -0,0 +1,108 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/nats-io/nats.go"
+)
+
+// publisherPool keeps one long-lived publisher per set of NATS credentials.
+// Publishers are created on first use, so mmsd can start before NATS is reachable.
+type publisherPool struct {
+	natsURL string
+	stream  string
+	metrics *mms.PublisherMetrics
+
+	mu             sync.Mutex
+	publishers     map[string]*mms.Publisher
+	legacySubjects bool
+}
+
+func newPublisherPool(natsURL string, stream string, metrics *mms.PublisherMetrics) *publisherPool {
+	return &publisherPool{
+		natsURL:    natsURL,
+		stream:     stream,
+		metrics:    metrics,
+		publishers: make(map[string]*mms.Publisher),
+	}
+}
+
+// get returns the publisher for the credentials identified by credsKey.
+func (pool *publisherPool) get(credsKey string, natsCredentials nats.Option) (*mms.Publisher, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if publisher, ok := pool.publishers[credsKey]; ok {
+		return publisher, nil
+	}
+
+	publisher, err := mms.NewPublisher(pool.natsURL, natsCredentials, pool.stream, pool.metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publisher: %v", err)
+	}
+	publisher.SetLegacySubjects(pool.legacySubjects)
+	pool.publishers[credsKey] = publisher
+
+	return publisher, nil
+}
+
+// setLegacySubjects sets whether the publishers also send product events on the queue name itself.
+func (pool *publisherPool) setLegacySubjects(legacySubjects bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.legacySubjects = legacySubjects
+	for _, publisher := range pool.publishers {
+		publisher.SetLegacySubjects(legacySubjects)
+	}
+}
+
+// close closes all publishers in the pool.
+func (pool *publisherPool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for credsKey, publisher := range pool.publishers {
+		publisher.Close()
+		delete(pool.publishers, credsKey)
+	}
+}
+
+// Publisher returns the publisher using the service's own NATS credentials.
+func (service *Service) Publisher() (*mms.Publisher, error) {
+	return service.publishers.get("", service.NatsCredentials)
+}
+
+// userPublisher returns the publisher using the credentials file of a NATS user.
+func (service *Service) userPublisher(natsUser string) (*mms.Publisher, error) {
+	return service.publishers.get(natsUser, nats.UserCredentials(natsUser))
+}
+
+// SetLegacySubjects makes the service also publish product events on the Queue-Name itself, as before they were
+// published on <queue-name>.<production-hub>.<product>, see mms.Publisher.SetLegacySubjects.
+func (service *Service) SetLegacySubjects(legacySubjects bool) {
+	service.publishers.setLegacySubjects(legacySubjects)
+}
+
+// Close releases the NATS connections held by the service.
+func (service *Service) Close() {
+	service.publishers.close()
+}
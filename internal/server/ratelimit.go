@@ -0,0 +1,295 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdle is how long the bucket of an API key or client address is kept after it was last used.
+const rateLimiterIdle = 10 * time.Minute
+
+// Limits protect the production hub from clients posting too much. Zero rates and sizes are unlimited.
+type Limits struct {
+	KeyRate      float64 // Events per second that may be posted with each API key.
+	KeyBurst     int     // Events that may be posted at once with each API key.
+	IPRate       float64 // Posts per second from each client address.
+	IPBurst      int     // Posts that may be sent at once from each client address.
+	AdminRate    float64 // Admin requests per second from each client address, so admin keys can not be guessed at full speed.
+	AdminBurst   int     // Admin requests that may be sent at once from each client address.
+	MaxBodyBytes int64   // Largest body of a post or admin request.
+}
+
+// RateLimit is a token bucket rate limit. A zero Rate is unlimited.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // Tokens added to the bucket per second.
+	Burst int     `json:"burst"` // Size of the bucket.
+}
+
+func (limit RateLimit) String() string {
+	if limit.Rate == 0 {
+		return "Unlimited"
+	}
+	return fmt.Sprintf("%g/s, burst %d", limit.Rate, limit.Burst)
+}
+
+// rateLimiters keeps a token bucket for each API key or client address.
+type rateLimiters struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{buckets: map[string]*bucket{}}
+}
+
+// take takes n tokens from the bucket of name, which is limited by limit. If there are not enough tokens, none are taken,
+// and it returns how long to wait before there are. Requests for more tokens than the bucket holds can never be allowed,
+// and fail with an error.
+func (limiters *rateLimiters) take(name string, limit RateLimit, n int, now time.Time) (time.Duration, error) {
+	if limit.Rate <= 0 {
+		return 0, nil
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	if n > burst {
+		return 0, fmt.Errorf("%d is more than the burst of %d", n, burst)
+	}
+
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	if now.Sub(limiters.lastSweep) > rateLimiterIdle {
+		for key, b := range limiters.buckets {
+			if now.Sub(b.lastSeen) > rateLimiterIdle {
+				delete(limiters.buckets, key)
+			}
+		}
+		limiters.lastSweep = now
+	}
+
+	b, ok := limiters.buckets[name]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), burst)}
+		limiters.buckets[name] = b
+	}
+	// The limit of a key may have changed since the bucket was made.
+	if b.limiter.Limit() != rate.Limit(limit.Rate) {
+		b.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+	}
+	if b.limiter.Burst() != burst {
+		b.limiter.SetBurstAt(now, burst)
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, n)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, nil
+	}
+	return 0, nil
+}
+
+// SetLimits sets the limits of posts to the service.
+func (service *Service) SetLimits(limits Limits) {
+	service.limits = limits
+}
+
+// limitPosts answers posts from client addresses over their rate limit with 429 Too Many Requests,
+// and posts with a body larger than the limit with 413 Request Entity Too Large.
+func (service *Service) limitPosts(next func(httpRespW http.ResponseWriter, httpReq *http.Request)) func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	return func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+		if maxBytes := service.limits.MaxBodyBytes; maxBytes > 0 {
+			if httpReq.ContentLength > maxBytes {
+				service.bodyTooLarge(httpRespW, httpReq)
+				return
+			}
+			httpReq.Body = http.MaxBytesReader(httpRespW, httpReq.Body, maxBytes)
+		}
+
+		address := service.clientAddress(httpReq)
+		limit := RateLimit{Rate: service.limits.IPRate, Burst: service.limits.IPBurst}
+		if wait, _ := service.ipLimiters.take(address, limit, 1, time.Now()); wait > 0 {
+			service.tooManyRequests(httpRespW, httpReq, "ip", wait, fmt.Errorf("too many posts from %s", address))
+			return
+		}
+
+		next(httpRespW, httpReq)
+	}
+}
+
+// limitAdmin answers admin requests from client addresses over their rate limit with 429 Too Many Requests,
+// and admin requests with a body larger than the limit with 413 Request Entity Too Large.
+func (service *Service) limitAdmin(next func(httpRespW http.ResponseWriter, httpReq *http.Request)) func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	return func(httpRespW http.ResponseWriter, httpReq *http.Request) {
+		if maxBytes := service.limits.MaxBodyBytes; maxBytes > 0 {
+			if httpReq.ContentLength > maxBytes {
+				service.bodyTooLarge(httpRespW, httpReq)
+				return
+			}
+			httpReq.Body = http.MaxBytesReader(httpRespW, httpReq.Body, maxBytes)
+		}
+
+		address := service.clientAddress(httpReq)
+		limit := RateLimit{Rate: service.limits.AdminRate, Burst: service.limits.AdminBurst}
+		if wait, _ := service.adminLimiters.take(address, limit, 1, time.Now()); wait > 0 {
+			service.tooManyRequests(httpRespW, httpReq, "admin", wait, fmt.Errorf("too many admin requests from %s", address))
+			return
+		}
+
+		next(httpRespW, httpReq)
+	}
+}
+
+// allowEvents takes n events from the rate limit of the API key of a post, and answers the post with 429 Too Many Requests
+// if the key is over its limit, or with 413 Request Entity Too Large if the key may never post n events at once.
+func (service *Service) allowEvents(httpRespW http.ResponseWriter, httpReq *http.Request, auth *postAuthorization, n int) bool {
+	limit := RateLimit{Rate: service.limits.KeyRate, Burst: service.limits.KeyBurst}
+	if auth.rateLimit != nil {
+		limit = *auth.rateLimit
+	}
+	wait, err := service.keyLimiters.take(auth.keyID, limit, n, time.Now())
+	if err != nil {
+		service.throttled.With(prometheus.Labels{"limit": "key"}).Inc()
+		errorResponse(fmt.Errorf("too many events at once for API key %s, post them in smaller batches: %v", auth.keyID, err),
+			http.StatusRequestEntityTooLarge, httpRespW, httpReq)
+		log.Printf("throttled: batch of %d events with API key %s: %v", n, auth.keyID, err)
+		return false
+	}
+	if wait > 0 {
+		service.tooManyRequests(httpRespW, httpReq, "key", wait, fmt.Errorf("too many events posted with API key %s", auth.keyID))
+		return false
+	}
+	return true
+}
+
+// readBody reads the body of a post, and answers the post if the body can not be read or is too large.
+func (service *Service) readBody(httpRespW http.ResponseWriter, httpReq *http.Request) ([]byte, bool) {
+	payload, err := ioutil.ReadAll(httpReq.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		service.bodyTooLarge(httpRespW, httpReq)
+		return nil, false
+	}
+	if err != nil {
+		errorResponse(err, http.StatusInternalServerError, httpRespW, httpReq)
+		log.Printf("failed reading request body: %v", err)
+		return nil, false
+	}
+	return payload, true
+}
+
+func (service *Service) bodyTooLarge(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	service.throttled.With(prometheus.Labels{"limit": "size"}).Inc()
+	errorResponse(fmt.Errorf("request body is larger than %d bytes", service.limits.MaxBodyBytes), http.StatusRequestEntityTooLarge, httpRespW, httpReq)
+	log.Printf("rejected request from %s larger than %d bytes", service.clientAddress(httpReq), service.limits.MaxBodyBytes)
+}
+
+func (service *Service) tooManyRequests(httpRespW http.ResponseWriter, httpReq *http.Request, limit string, wait time.Duration, err error) {
+	service.throttled.With(prometheus.Labels{"limit": limit}).Inc()
+	httpRespW.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	errorResponse(err, http.StatusTooManyRequests, httpRespW, httpReq)
+	log.Printf("throttled: %v", err)
+}
+
+// SetTrustedProxies sets the addresses, given as IPs or CIDRs, of the proxies whose X-Forwarded-For and X-Real-IP headers
+// tell the address of the client. The headers of other clients are ignored, since any client can set them.
+func (service *Service) SetTrustedProxies(proxies []string) error {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		trusted = append(trusted, network)
+	}
+	service.trustedProxies = trusted
+	return nil
+}
+
+// trustedProxy reports whether address is one of the trusted proxies.
+func (service *Service) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range service.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress gives the address of the client of a request. If the request comes from a trusted proxy, it is the
+// address the proxies forwarded the request for, which is the last address in X-Forwarded-For that is not a trusted proxy.
+func (service *Service) clientAddress(httpReq *http.Request) string {
+	address, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		address = httpReq.RemoteAddr
+	}
+	if !service.trustedProxy(address) {
+		return address
+	}
+
+	if forwardedFor := httpReq.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			address = hop
+			if !service.trustedProxy(hop) {
+				break
+			}
+		}
+		return address
+	}
+	if realIP := strings.TrimSpace(httpReq.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return address
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimitersTake(t *testing.T) {
+	limiters := newRateLimiters()
+	now := time.Now()
+	limit := RateLimit{Rate: 1, Burst: 2}
+
+	if wait, _ := limiters.take("a", limit, 2, now); wait != 0 {
+		t.Errorf("Expected the burst to be allowed; Got wait %v", wait)
+	}
+	if wait, _ := limiters.take("a", limit, 1, now); wait <= 0 || wait > time.Second {
+		t.Errorf("Expected to wait at most a second; Got %v", wait)
+	}
+	if wait, _ := limiters.take("b", limit, 1, now); wait != 0 {
+		t.Errorf("Expected another name to have its own bucket; Got wait %v", wait)
+	}
+	if wait, _ := limiters.take("a", limit, 1, now.Add(time.Second)); wait != 0 {
+		t.Errorf("Expected the bucket to be refilled after a second; Got wait %v", wait)
+	}
+	if _, err := limiters.take("c", limit, 10, now); err == nil {
+		t.Errorf("Expected more tokens than the burst to fail")
+	}
+	if wait, _ := limiters.take("c", limit, 2, now); wait != 0 {
+		t.Errorf("Expected a failed take to leave the bucket full; Got wait %v", wait)
+	}
+	if wait, _ := limiters.take("a", RateLimit{}, 100, now); wait != 0 {
+		t.Errorf("Expected no limit with a zero rate; Got wait %v", wait)
+	}
+
+	limiters.take("b", limit, 1, now.Add(2*rateLimiterIdle))
+	if _, ok := limiters.buckets["a"]; ok {
+		t.Errorf("Expected idle buckets to be removed")
+	}
+}
+
+func postTestBody(service *Service, path, apiKey, remoteAddr, body string) *httptest.ResponseRecorder {
+	httpReq := httptest.NewRequest("POST", path, strings.NewReader(body))
+	httpReq.Header.Set("Api-Key", apiKey)
+	if remoteAddr != "" {
+		httpReq.RemoteAddr = remoteAddr
+	}
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+	return httpRespW
+}
+
+func TestPostEventKeyRateLimit(t *testing.T) {
+	service := newScopedTestService(t)
+	service.SetLimits(Limits{KeyRate: 0.001, KeyBurst: 2})
+	event := `{"Product": "a", "ProductionHub": "` + productionHubName + `"}`
+
+	for i := 0; i < 2; i++ {
+		if resp := postTestBody(service, "/api/v1/events", testAPIKey, "", event); resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202 Accepted within the burst; Got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	resp := postTestBody(service, "/api/v1/events", testAPIKey, "", event)
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 Too Many Requests with Retry-After; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := postTestBody(service, "/api/v1/events", testScopedAPIKey, "", event); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected another key to have its own limit; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if count := testutil.ToFloat64(service.throttled.WithLabelValues("key")); count != 1 {
+		t.Errorf("Expected 1 throttled post; Got %v", count)
+	}
+
+	// A key with its own rate limit is not limited by the default.
+	if _, err := SetApiKeyRateLimit(service.stateDB, testAPIKey, &RateLimit{}); err != nil {
+		t.Fatalf("failed to set rate limit: %s", err)
+	}
+	if resp := postTestBody(service, "/api/v1/events", testAPIKey, "", event); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected the key's own rate limit to be used; Got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestPostEventsBatchKeyRateLimit(t *testing.T) {
+	service := newScopedTestService(t)
+	service.SetLimits(Limits{KeyRate: 0.001, KeyBurst: 3})
+	event := `{"Product": "a", "ProductionHub": "` + productionHubName + `"}` + "\n"
+
+	if resp := postTestBody(service, "/api/v1/events:batch", testAPIKey, "", strings.Repeat(event, 2)); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 Accepted within the burst; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := postTestBody(service, "/api/v1/events:batch", testAPIKey, "", strings.Repeat(event, 2)); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 Too Many Requests when the batch is larger than the tokens left; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := postTestBody(service, "/api/v1/events", testAPIKey, "", event); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected the rejected batch to take no tokens; Got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// A batch larger than the burst could never be posted, so it is rejected without waiting for the bucket to fill.
+	service.SetLimits(Limits{KeyRate: 1000, KeyBurst: 3})
+	if resp := postTestBody(service, "/api/v1/events:batch", testAPIKey, "", strings.Repeat(event, 4)); resp.Code != http.StatusRequestEntityTooLarge ||
+		resp.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected 413 Request Entity Too Large for a batch larger than the burst; Got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestPostEventIPRateLimit(t *testing.T) {
+	service := newScopedTestService(t)
+	service.SetLimits(Limits{IPRate: 0.001, IPBurst: 1})
+	event := `{"Product": "a", "ProductionHub": "` + productionHubName + `"}`
+
+	if resp := postTestBody(service, "/api/v1/events", testAPIKey, "192.0.2.1:1234", event); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 Accepted within the burst; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	resp := postTestBody(service, "/api/v1/events", testScopedAPIKey, "192.0.2.1:5678", event)
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 Too Many Requests with Retry-After from the same address; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := postTestBody(service, "/api/v1/events", testAPIKey, "192.0.2.2:1234", event); resp.Code != http.StatusAccepted {
+		t.Errorf("Expected another address to have its own limit; Got %d: %s", resp.Code, resp.Body.String())
+	}
+	if count := testutil.ToFloat64(service.throttled.WithLabelValues("ip")); count != 1 {
+		t.Errorf("Expected 1 throttled post; Got %v", count)
+	}
+	// Throttled posts are also recorded in the audit trail.
+	entries, err := ReadAudit(service.stateDB, AuditFilter{Outcome: AuditRejected})
+	if err != nil || len(entries) != 1 || entries[0].Status != http.StatusTooManyRequests || entries[0].ClientAddress != "192.0.2.1" ||
+		entries[0].Count != 1 || entries[0].Error == "" {
+		t.Errorf("Expected the throttled post in the audit trail; Got %+v, %v", entries, err)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	service := newScopedTestService(t)
+	if err := service.SetTrustedProxies([]string{"proxy"}); err == nil {
+		t.Errorf("Expected an invalid trusted proxy to fail")
+	}
+	if err := service.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"}); err != nil {
+		t.Fatalf("failed to set trusted proxies: %s", err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		expected     string
+	}{
+		{"198.51.100.1:1234", "", "", "198.51.100.1"},
+		// Anyone can set the headers, so they are ignored unless the request comes from a trusted proxy.
+		{"198.51.100.1:1234", "203.0.113.7", "203.0.113.8", "198.51.100.1"},
+		{"192.0.2.10:1234", "203.0.113.7", "", "203.0.113.7"},
+		{"192.0.2.10:1234", "", "203.0.113.8", "203.0.113.8"},
+		// The client may also set X-Forwarded-For, so the address is the last one not added by a trusted proxy.
+		{"10.1.2.3:1234", "203.0.113.99, 203.0.113.7, 10.0.0.1", "", "203.0.113.7"},
+		{"10.1.2.3:1234", "10.0.0.2, 10.0.0.1", "", "10.0.0.2"},
+		{"10.1.2.3:1234", "not-an-ip", "", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		httpReq := httptest.NewRequest("POST", "/api/v1/events", nil)
+		httpReq.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			httpReq.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if test.realIP != "" {
+			httpReq.Header.Set("X-Real-IP", test.realIP)
+		}
+		if address := service.clientAddress(httpReq); address != test.expected {
+			t.Errorf("Expected %s for %+v; Got %s", test.expected, test, address)
+		}
+	}
+}
+
+func TestPostEventIPRateLimitSpoofed(t *testing.T) {
+	service := newScopedTestService(t)
+	service.SetLimits(Limits{IPRate: 0.001, IPBurst: 1})
+	event := `{"Product": "a", "ProductionHub": "` + productionHubName + `"}`
+
+	for i, forwardedFor := range []string{"203.0.113.1", "203.0.113.2"} {
+		httpReq := httptest.NewRequest("POST", "/api/v1/events", strings.NewReader(event))
+		httpReq.Header.Set("Api-Key", testAPIKey)
+		httpReq.Header.Set("X-Forwarded-For", forwardedFor)
+		httpReq.RemoteAddr = "198.51.100.1:1234"
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+		if expected := []int{http.StatusAccepted, http.StatusTooManyRequests}[i]; httpRespW.Code != expected {
+			t.Errorf("Expected %d for post %d with a changed X-Forwarded-For; Got %d", expected, i+1, httpRespW.Code)
+		}
+	}
+}
+
+func TestPostEventBodyLimit(t *testing.T) {
+	service := newScopedTestService(t)
+	service.SetLimits(Limits{MaxBodyBytes: 64})
+	large := `{"Product": "` + strings.Repeat("a", 64) + `", "ProductionHub": "` + productionHubName + `"}`
+
+	if resp := postTestBody(service, "/api/v1/events", testAPIKey, "", large); resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 Request Entity Too Large; Got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// Without a Content-Length, the body is cut off while it is read.
+	httpReq := httptest.NewRequest("POST", "/api/v1/events:batch", strings.NewReader(large))
+	httpReq.ContentLength = -1
+	httpReq.Header.Set("Api-Key", testAPIKey)
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+	if httpRespW.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 Request Entity Too Large; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+
+	if count := testutil.ToFloat64(service.throttled.WithLabelValues("size")); count != 2 {
+		t.Errorf("Expected 2 posts too large; Got %v", count)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// retentionBatchSize is the number of events deleted at a time when pruning, so the events db is not locked for long.
+const retentionBatchSize = 500
+
+// RetentionRule decides how long the events of the products and production hubs it matches are kept.
+// The patterns are matched like event filters, where * also matches /, and an empty pattern matches everything.
+// Limits of 0 are not applied.
+type RetentionRule struct {
+	Product       string
+	ProductionHub string
+	MaxAge        time.Duration // Events received longer ago are deleted.
+	MaxCount      int           // Only the newest events of each product of a hub are kept.
+	KeepRefTimes  int           // Events of the latest reference times of each product of a hub are always kept.
+}
+
+// ParseRetentionRule parses a rule given as space separated kind=value, where kind is product, hub, max-age, max-count or
+// keep-reftimes, e.g. "product=nowcast_* max-age=2h keep-reftimes=1". The max age may also be given in days, such as 30d.
+func ParseRetentionRule(s string) (RetentionRule, error) {
+	rule := RetentionRule{}
+	for _, part := range strings.Fields(s) {
+		kind, value, found := strings.Cut(part, "=")
+		if !found || value == "" {
+			return RetentionRule{}, fmt.Errorf("invalid retention rule %q, use product=, hub=, max-age=, max-count= or keep-reftimes=", s)
+		}
+
+		var err error
+		switch kind {
+		case "product":
+			rule.Product = value
+		case "hub":
+			rule.ProductionHub = value
+		case "max-age":
+			rule.MaxAge, err = mms.ParseDuration(value)
+		case "max-count":
+			rule.MaxCount, err = parseRetentionCount(value)
+		case "keep-reftimes":
+			rule.KeepRefTimes, err = parseRetentionCount(value)
+		default:
+			return RetentionRule{}, fmt.Errorf("unknown %q in retention rule %q, use product=, hub=, max-age=, max-count= or keep-reftimes=", kind, s)
+		}
+		if err != nil {
+			return RetentionRule{}, fmt.Errorf("invalid %s in retention rule %q: %v", kind, s, err)
+		}
+	}
+
+	for _, pattern := range []string{rule.Product, rule.ProductionHub} {
+		if _, err := mms.MatchGlob(pattern, ""); err != nil {
+			return RetentionRule{}, fmt.Errorf("invalid pattern %q in retention rule %q", pattern, s)
+		}
+	}
+	if rule.MaxAge == 0 && rule.MaxCount == 0 {
+		return RetentionRule{}, fmt.Errorf("retention rule %q needs max-age or max-count", s)
+	}
+	return rule, nil
+}
+
+func parseRetentionCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("not a number of events")
+	}
+	return n, nil
+}
+
+// String gives the rule in the form parsed by ParseRetentionRule.
+func (rule RetentionRule) String() string {
+	var parts []string
+	for _, p := range []struct {
+		kind  string
+		value string
+		set   bool
+	}{
+		{"product", rule.Product, rule.Product != ""},
+		{"hub", rule.ProductionHub, rule.ProductionHub != ""},
+		{"max-age", formatRetentionAge(rule.MaxAge), rule.MaxAge > 0},
+		{"max-count", strconv.Itoa(rule.MaxCount), rule.MaxCount > 0},
+		{"keep-reftimes", strconv.Itoa(rule.KeepRefTimes), rule.KeepRefTimes > 0},
+	} {
+		if p.set {
+			parts = append(parts, p.kind+"="+p.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatRetentionAge formats whole days as days, such as 30d, and other ages without zero units, such as 2h or 1h30m.
+func formatRetentionAge(age time.Duration) string {
+	if age%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", age/(24*time.Hour))
+	}
+	s := age.String()
+	for _, zero := range []string{"0s", "0m"} {
+		if strings.HasSuffix(s, "m"+zero) || strings.HasSuffix(s, "h"+zero) {
+			s = strings.TrimSuffix(s, zero)
+		}
+	}
+	return s
+}
+
+// matches reports whether the rule applies to the events of product from productionHub.
+func (rule RetentionRule) matches(product string, productionHub string) bool {
+	for _, m := range []struct {
+		pattern string
+		value   string
+	}{{rule.Product, product}, {rule.ProductionHub, productionHub}} {
+		if m.pattern == "" {
+			continue
+		}
+		if ok, _ := mms.MatchGlob(m.pattern, m.value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// retentionRule gives the index of the first rule matching the events of key, or -1 when they are kept by no rule.
+func retentionRule(rules []RetentionRule, key ProductKey) int {
+	for i, rule := range rules {
+		if rule.matches(key.Product, key.ProductionHub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// retentionVictims gives the ids of the events of one product from one production hub that rule deletes at now.
+// The events are in the order they were stored, so the newest are last.
+func retentionVictims(rule RetentionRule, events []EventSummary, now time.Time) []int64 {
+	kept := map[time.Time]bool{}
+	if rule.KeepRefTimes > 0 {
+		var refTimes []time.Time
+		for _, event := range events {
+			if !kept[event.RefTime] {
+				kept[event.RefTime] = true
+				refTimes = append(refTimes, event.RefTime)
+			}
+		}
+		sort.Slice(refTimes, func(i, j int) bool { return refTimes[i].After(refTimes[j]) })
+		for i := rule.KeepRefTimes; i < len(refTimes); i++ {
+			delete(kept, refTimes[i])
+		}
+	}
+
+	var victims []int64
+	for i, event := range events {
+		if kept[event.RefTime] {
+			continue
+		}
+		tooOld := rule.MaxAge > 0 && event.ReceivedAt.Before(now.Add(-rule.MaxAge))
+		tooMany := rule.MaxCount > 0 && len(events)-i > rule.MaxCount
+		if tooOld || tooMany {
+			victims = append(victims, event.ID)
+		}
+	}
+	return victims
+}
+
+// SetRetention sets the rules deciding which events are deleted by PruneEvents.
+func (service *Service) SetRetention(rules []RetentionRule) {
+	service.retention = rules
+	for _, rule := range rules {
+		service.retentionDeleted.WithLabelValues(rule.String())
+	}
+}
+
+// PruneEvents deletes the events the retention rules do not keep at now, and gives the number of deleted events.
+// The events of one product of a hub are loaded at a time, and deleted a batch at a time. Events not yet published
+// are kept by the event store, so they still count towards the max count of their product.
+func (service *Service) PruneEvents(ctx context.Context, now time.Time) (int64, error) {
+	if len(service.retention) == 0 {
+		return 0, nil
+	}
+	keys, err := service.events.EventProducts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	deleted := make([]int64, len(service.retention))
+	logDeleted := func() {
+		for i, rule := range service.retention {
+			log.Printf("retention rule %q deleted %d events", rule.String(), deleted[i])
+		}
+	}
+	for _, key := range keys {
+		i := retentionRule(service.retention, key)
+		if i < 0 {
+			continue
+		}
+		summaries, err := service.events.EventSummaries(ctx, key)
+		if err != nil {
+			logDeleted()
+			return total, err
+		}
+
+		ids := retentionVictims(service.retention[i], summaries, now)
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > retentionBatchSize {
+				batch = batch[:retentionBatchSize]
+			}
+			ids = ids[len(batch):]
+
+			n, err := service.events.DeleteEvents(ctx, batch)
+			deleted[i] += n
+			total += n
+			service.retentionDeleted.WithLabelValues(service.retention[i].String()).Add(float64(n))
+			if err != nil {
+				logDeleted()
+				return total, err
+			}
+		}
+	}
+	logDeleted()
+	return total, nil
+}
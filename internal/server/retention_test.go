@@ -0,0 +1,162 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	for value, expected := range map[string]string{
+		"product=nowcast_* max-age=2h keep-reftimes=1": "product=nowcast_* max-age=2h keep-reftimes=1",
+		"hub=ppi*  max-age=30d":                        "hub=ppi* max-age=30d",
+		"max-age=1d12h max-count=100":                  "max-age=36h max-count=100",
+		"product=meps max-count=10":                    "product=meps max-count=10",
+		"max-age=90m":                                  "max-age=1h30m",
+	} {
+		rule, err := ParseRetentionRule(value)
+		if err != nil || rule.String() != expected {
+			t.Errorf("Expected %q for %q; Got %q, %v", expected, value, rule.String(), err)
+		}
+	}
+
+	for _, invalid := range []string{"", "product=meps", "max-age=-2h", "max-age=2y", "max-count=x", "keep-reftimes=1", "size=10 max-age=2h", "product=[a max-age=2h", "max-age"} {
+		if _, err := ParseRetentionRule(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestRetentionVictims(t *testing.T) {
+	now := time.Date(2022, 7, 5, 12, 0, 0, 0, time.UTC)
+	refTime := now.Truncate(24 * time.Hour)
+	// Events of nowcast, received 1 to 4 hours ago, with a reference time per event,
+	// of climate, received 1 to 40 days ago with the same reference time, and of meps from another hub.
+	var summaries []EventSummary
+	for i := 4; i > 0; i-- {
+		summaries = append(summaries, EventSummary{ID: int64(len(summaries) + 1), Product: "nowcast_precip", ProductionHub: "ppi",
+			RefTime: refTime.Add(time.Duration(-i) * time.Hour), ReceivedAt: now.Add(time.Duration(-i) * time.Hour)})
+	}
+	for _, days := range []int{40, 20, 1} {
+		summaries = append(summaries, EventSummary{ID: int64(len(summaries) + 1), Product: "climate_daily", ProductionHub: "ppi",
+			RefTime: refTime.AddDate(0, 0, -40), ReceivedAt: now.AddDate(0, 0, -days)})
+	}
+	summaries = append(summaries, EventSummary{ID: 8, Product: "meps", ProductionHub: "other", ReceivedAt: now.AddDate(0, 0, -1)})
+
+	tests := []struct {
+		rules    []string
+		expected [][]int64
+	}{
+		{[]string{"product=nowcast_* max-age=2h", "product=climate_* max-age=30d"}, [][]int64{{1, 2}, {5}}},
+		// The first matching rule decides, and events matched by no rule are kept.
+		{[]string{"hub=ppi max-age=2h", "max-age=30d"}, [][]int64{{1, 2, 5, 6, 7}, nil}},
+		{[]string{"product=nowcast_* max-count=1", "max-age=12h"}, [][]int64{{1, 2, 3}, {5, 6, 7, 8}}},
+		// The events of the latest reference times are always kept.
+		{[]string{"product=nowcast_* max-age=2h keep-reftimes=3", "product=climate_* max-age=1h keep-reftimes=1"}, [][]int64{{1}, nil}},
+		{[]string{"product=nowcast_* max-count=1 keep-reftimes=2"}, [][]int64{{1, 2}}},
+	}
+	for _, test := range tests {
+		var rules []RetentionRule
+		for _, s := range test.rules {
+			rule, err := ParseRetentionRule(s)
+			if err != nil {
+				t.Fatalf("failed to parse rule: %s", err)
+			}
+			rules = append(rules, rule)
+		}
+		// Each product of a hub is pruned on its own, by the first rule matching it.
+		victims := make([][]int64, len(rules))
+		for _, key := range []ProductKey{{"ppi", "nowcast_precip"}, {"ppi", "climate_daily"}, {"other", "meps"}} {
+			i := retentionRule(rules, key)
+			if i < 0 {
+				continue
+			}
+			var events []EventSummary
+			for _, summary := range summaries {
+				if summary.ProductionHub == key.ProductionHub && summary.Product == key.Product {
+					events = append(events, summary)
+				}
+			}
+			victims[i] = append(victims[i], retentionVictims(rules[i], events, now)...)
+		}
+		if !reflect.DeepEqual(victims, test.expected) {
+			t.Errorf("Expected %v deleted by %q; Got %v", test.expected, test.rules, victims)
+		}
+	}
+}
+
+func TestPruneEvents(t *testing.T) {
+	store, _ := NewMemoryEventStore(2 * retentionBatchSize)
+	service := NewService(CreateTemplates(), store, nil, "", nil, Version{}, true)
+
+	var events []*mms.ProductEvent
+	for i := 0; i < retentionBatchSize+10; i++ {
+		events = append(events, &mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName, EventID: fmt.Sprintf("arome%d", i)})
+	}
+	events = append(events, &mms.ProductEvent{Product: "meps", ProductionHub: productionHubName})
+	ids, _, err := store.SaveEvents(context.Background(), events, "mms", "")
+	if err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	for _, id := range ids {
+		if err := store.MarkDelivered(context.Background(), id, time.Now()); err != nil {
+			t.Fatalf("failed to mark event delivered: %s", err)
+		}
+	}
+
+	if deleted, err := service.PruneEvents(context.Background(), time.Now()); err != nil || deleted != 0 {
+		t.Errorf("Expected no events to be deleted without rules; Got %d, %v", deleted, err)
+	}
+
+	arome := RetentionRule{Product: "arome_*", MaxCount: 5}
+	service.SetRetention([]RetentionRule{arome, {MaxAge: time.Hour}})
+	deleted, err := service.PruneEvents(context.Background(), time.Now())
+	if err != nil || deleted != retentionBatchSize+5 {
+		t.Errorf("Expected %d deleted events; Got %d, %v", retentionBatchSize+5, deleted, err)
+	}
+	stored, _, _ := service.QueryEvents(context.Background(), mms.EventFilter{})
+	if len(stored) != 6 || stored[0].EventID != fmt.Sprintf("arome%d", retentionBatchSize+5) || stored[5].Product != "meps" {
+		t.Errorf("Expected the 5 newest arome_arctic events and the meps event to be kept; Got %d events", len(stored))
+	}
+	if count := testutil.ToFloat64(service.retentionDeleted.WithLabelValues(arome.String())); count != float64(retentionBatchSize+5) {
+		t.Errorf("Expected the deleted events to be counted for %q; Got %v", arome, count)
+	}
+
+	// Events not yet published are kept, but still count towards the max count.
+	pending := []*mms.ProductEvent{
+		{Product: "arome_arctic", ProductionHub: productionHubName, EventID: "pending1"},
+		{Product: "arome_arctic", ProductionHub: productionHubName, EventID: "pending2"},
+	}
+	if _, _, err := store.SaveEvents(context.Background(), pending, "mms", ""); err != nil {
+		t.Fatalf("failed to save events: %s", err)
+	}
+	service.SetRetention([]RetentionRule{{Product: "arome_*", MaxCount: 1}})
+	if deleted, err := service.PruneEvents(context.Background(), time.Now()); err != nil || deleted != 5 {
+		t.Errorf("Expected the 5 published arome_arctic events to be deleted; Got %d, %v", deleted, err)
+	}
+	stored, _, _ = service.QueryEvents(context.Background(), mms.EventFilter{})
+	if len(stored) != 3 || stored[1].EventID != "pending1" || stored[2].EventID != "pending2" {
+		t.Errorf("Expected the meps event and the pending arome_arctic events to be kept; Got %d events", len(stored))
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+// KeyRole is what an API key may be used for. Reading events and product status needs no key, so there is no read role.
+type KeyRole string
+
+const (
+	// KeyRoleWrite allows posting events.
+	KeyRoleWrite KeyRole = "write"
+	// KeyRoleAdmin allows managing API keys, as well as posting.
+	KeyRoleAdmin KeyRole = "admin"
+)
+
+// KeyScope restricts what an API key may be used for. The patterns are matched with mms.MatchGlob, as the patterns
+// of event filters, so '*' matches any characters, including '/'.
+// An empty list of patterns allows everything.
+type KeyScope struct {
+	Roles      []KeyRole `json:"roles"`
+	QueueNames []string  `json:"queueNames,omitempty"` // Queue names the key may post to.
+	Hubs       []string  `json:"hubs,omitempty"`       // Production hubs the key may post events from.
+	Products   []string  `json:"products,omitempty"`   // Products the key may post events about.
+}
+
+// DefaultKeyScope is the scope of keys that are not given one, which may post any event.
+var DefaultKeyScope = KeyScope{Roles: []KeyRole{KeyRoleWrite}}
+
+// ParseKeyScope parses scopes given as kind=value, where kind is role, queue, hub or product, e.g. role=write or product=arome_*.
+// Several values of a kind are all allowed. Without a role, the key gets the write role.
+func ParseKeyScope(scopes []string) (KeyScope, error) {
+	scope := KeyScope{}
+	for _, s := range scopes {
+		kind, value, found := strings.Cut(s, "=")
+		value = strings.TrimSpace(value)
+		if !found || value == "" {
+			return KeyScope{}, fmt.Errorf("invalid scope %q, use role=, queue=, hub= or product=", s)
+		}
+
+		switch strings.TrimSpace(kind) {
+		case "role":
+			scope.Roles = append(scope.Roles, KeyRole(value))
+		case "queue":
+			scope.QueueNames = append(scope.QueueNames, value)
+		case "hub":
+			scope.Hubs = append(scope.Hubs, value)
+		case "product":
+			scope.Products = append(scope.Products, value)
+		default:
+			return KeyScope{}, fmt.Errorf("unknown scope %q, use role=, queue=, hub= or product=", kind)
+		}
+	}
+
+	return scope.withDefaults()
+}
+
+// withDefaults checks the roles and patterns of the scope, and gives the scope the write role if it has none.
+func (scope KeyScope) withDefaults() (KeyScope, error) {
+	for _, role := range scope.Roles {
+		if role != KeyRoleWrite && role != KeyRoleAdmin {
+			return KeyScope{}, fmt.Errorf("unknown role %q, use write or admin", role)
+		}
+	}
+	for _, patterns := range [][]string{scope.QueueNames, scope.Hubs, scope.Products} {
+		for _, pattern := range patterns {
+			if _, err := mms.MatchGlob(pattern, ""); err != nil || pattern == "" {
+				return KeyScope{}, fmt.Errorf("invalid pattern %q in scope", pattern)
+			}
+		}
+	}
+
+	if len(scope.Roles) == 0 {
+		scope.Roles = DefaultKeyScope.Roles
+	}
+	return scope, nil
+}
+
+// String gives the scope in the form parsed by ParseKeyScope.
+func (scope KeyScope) String() string {
+	var parts []string
+	for _, role := range scope.Roles {
+		parts = append(parts, "role="+string(role))
+	}
+	for _, p := range []struct {
+		kind     string
+		patterns []string
+	}{{"queue", scope.QueueNames}, {"hub", scope.Hubs}, {"product", scope.Products}} {
+		for _, pattern := range p.patterns {
+			parts = append(parts, p.kind+"="+pattern)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasRole reports whether the scope has role. The admin role has all roles.
+func (scope KeyScope) HasRole(role KeyRole) bool {
+	for _, r := range scope.Roles {
+		if r == role || r == KeyRoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsQueueName reports whether events may be posted to queueName.
+func (scope KeyScope) AllowsQueueName(queueName string) bool {
+	return matchAny(scope.QueueNames, queueName)
+}
+
+// AllowsEvent tells why pEvent may not be posted, or returns nil if it may.
+func (scope KeyScope) AllowsEvent(pEvent *mms.ProductEvent) error {
+	if !matchAny(scope.Hubs, pEvent.ProductionHub) {
+		return fmt.Errorf("API key may not post events from production hub %q", pEvent.ProductionHub)
+	}
+	if !matchAny(scope.Products, pEvent.Product) {
+		return fmt.Errorf("API key may not post events about product %q", pEvent.Product)
+	}
+	return nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, err := mms.MatchGlob(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+const testScopedAPIKey = "c2NvcGVkLWtleS1mb3ItdGVzdGluZy0wMTIzNDU2Nzg="
+
+func TestParseKeyScope(t *testing.T) {
+	scope, err := ParseKeyScope([]string{"queue=mms", "hub=ppi*", "product=arome_*", "product=meps"})
+	if err != nil {
+		t.Fatalf("Expected a valid scope; Got %v", err)
+	}
+	if s := scope.String(); s != "role=write queue=mms hub=ppi* product=arome_* product=meps" {
+		t.Errorf("Expected the write role and the patterns; Got %q", s)
+	}
+	if !scope.HasRole(KeyRoleWrite) || scope.HasRole(KeyRoleAdmin) {
+		t.Errorf("Expected only the write role; Got %v", scope.Roles)
+	}
+
+	admin, _ := ParseKeyScope([]string{"role=admin"})
+	if !admin.HasRole(KeyRoleAdmin) || !admin.HasRole(KeyRoleWrite) {
+		t.Errorf("Expected the admin role to have all roles")
+	}
+
+	for _, invalid := range []string{"queue", "queue=", "role=owner", "role=read", "group=a", "product=[a"} {
+		if _, err := ParseKeyScope([]string{invalid}); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestKeyScopeAllows(t *testing.T) {
+	scope, _ := ParseKeyScope([]string{"queue=mms.*", "hub=ppi", "product=arome_*"})
+
+	if !scope.AllowsQueueName("mms.test") || scope.AllowsQueueName("mms") {
+		t.Errorf("Expected only queue names matching mms.* to be allowed")
+	}
+	for _, tc := range []struct {
+		hub, product string
+		allowed      bool
+	}{
+		{"ppi", "arome_arctic", true},
+		{"ppi", "meps", false},
+		{"other", "arome_arctic", false},
+		// '*' also matches '/', as in event filters.
+		{"ppi", "arome_arctic/sfx", true},
+	} {
+		err := scope.AllowsEvent(&mms.ProductEvent{ProductionHub: tc.hub, Product: tc.product})
+		if (err == nil) != tc.allowed {
+			t.Errorf("Expected %s from %s allowed to be %v; Got %v", tc.product, tc.hub, tc.allowed, err)
+		}
+	}
+
+	if err := DefaultKeyScope.AllowsEvent(&mms.ProductEvent{ProductionHub: "any", Product: "any"}); err != nil {
+		t.Errorf("Expected the default scope to allow any event; Got %v", err)
+	}
+}
+
+func newScopedTestService(t *testing.T, scopes ...string) *Service {
+	service := newOutboxTestService(t, "nats://127.0.0.1:1")
+	if err := AddNewApiKey(service.stateDB, testScopedAPIKey, "scoped"); err != nil {
+		t.Fatalf("failed to add api key: %s", err)
+	}
+	scope, err := ParseKeyScope(scopes)
+	if err != nil {
+		t.Fatalf("invalid scope: %s", err)
+	}
+	if _, err := SetApiKeyScope(service.stateDB, testScopedAPIKey, scope); err != nil {
+		t.Fatalf("failed to set scope: %s", err)
+	}
+	return service
+}
+
+func TestPostEventScope(t *testing.T) {
+	service := newScopedTestService(t, "queue=mms", "hub="+productionHubName, "product=arome_*")
+
+	for _, tc := range []struct {
+		queueName string
+		pEvent    mms.ProductEvent
+		status    int
+	}{
+		{"mms", mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName}, http.StatusAccepted},
+		{"", mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName}, http.StatusAccepted},
+		{"other", mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName}, http.StatusForbidden},
+		{"mms", mms.ProductEvent{Product: "arome_arctic", ProductionHub: "other-hub"}, http.StatusForbidden},
+		{"mms", mms.ProductEvent{Product: "meps", ProductionHub: productionHubName}, http.StatusForbidden},
+	} {
+		payload, _ := json.Marshal(tc.pEvent)
+		httpReq := httptest.NewRequest("POST", "/api/v1/events", bytes.NewReader(payload))
+		httpReq.Header.Set("Api-Key", testScopedAPIKey)
+		if tc.queueName != "" {
+			httpReq.Header.Set("Queue-Name", tc.queueName)
+		}
+		httpRespW := httptest.NewRecorder()
+		service.Router.ServeHTTP(httpRespW, httpReq)
+
+		if httpRespW.Code != tc.status {
+			t.Errorf("Expected %d posting %s from %s to %q; Got %d: %s", tc.status, tc.pEvent.Product, tc.pEvent.ProductionHub, tc.queueName,
+				httpRespW.Code, httpRespW.Body.String())
+		}
+	}
+}
+
+func TestPostEventsBatchScope(t *testing.T) {
+	service := newScopedTestService(t, "product=a*")
+
+	httpReq := httptest.NewRequest("POST", "/api/v1/events:batch", strings.NewReader(`{"Product": "arome", "ProductionHub": "`+productionHubName+`"}
+{"Product": "meps", "ProductionHub": "`+productionHubName+`"}
+`))
+	httpReq.Header.Set("Api-Key", testScopedAPIKey)
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+
+	var resp postBatchResponse
+	json.Unmarshal(httpRespW.Body.Bytes(), &resp)
+	if httpRespW.Code != http.StatusForbidden || len(resp.Results) != 2 || resp.Results[0].Error != "" || resp.Results[1].Error == "" {
+		t.Errorf("Expected 403 with the second event rejected; Got %d: %s", httpRespW.Code, httpRespW.Body.String())
+	}
+}
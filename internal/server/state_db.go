@@ -17,13 +17,35 @@ limitations under the License.
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 )
 
+// apiKeyIDLength is the number of hex digits in the public id of an API key.
+const apiKeyIDLength = 8
+
+const createApiKeysTable = `CREATE TABLE IF NOT EXISTS "api_keys" (
+		"keyId" TEXT UNIQUE,
+		"salt" TEXT,
+		"keyHash" TEXT,
+		"createdDate" TEXT,
+		"lastUsed" TEXT,
+		"expires" TEXT,
+		"createMsg" TEXT,
+		"scope" TEXT,
+		"rateLimit" REAL,
+		"rateBurst" INTEGER,
+		PRIMARY KEY("keyId")
+	);`
+
 // NewStateDB returns an sql database object, initialised with necessary tables.
 func NewStateDB(filePath string) (*sql.DB, error) {
 	if filePath == "" {
@@ -32,7 +54,30 @@ func NewStateDB(filePath string) (*sql.DB, error) {
 	return createStateDB(filePath)
 }
 
-// AddNewApiKey adds a given key and message to the keys table. Invalid keys are rejected.
+// ApiKeyID gives the public id of a key, which identifies it in the keys table without giving away the secret.
+// Generated keys start with their id and a '.'. Keys without an id prefix get the start of their SHA-256 hash as id.
+func ApiKeyID(apiKey string) string {
+	if keyID, _, found := strings.Cut(apiKey, "."); found {
+		return keyID
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:apiKeyIDLength]
+}
+
+// GenerateApiKey generates a new random key with an id prefix, and adds it with the message to the keys table.
+func GenerateApiKey(db *sql.DB, keyMsg string) (string, error) {
+	apiKey, err := newApiKey()
+	if err != nil {
+		return "", err
+	}
+	if err := AddNewApiKey(db, apiKey, keyMsg); err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+// AddNewApiKey adds a given key and message to the keys table. Only the id and a salted hash of the key are stored.
+// Invalid keys, and keys with the same id as a key in the table, are rejected.
 func AddNewApiKey(db *sql.DB, apiKey string, keyMsg string) error {
 	err := checkKeyFormat(apiKey)
 	if err != nil {
@@ -40,9 +85,7 @@ func AddNewApiKey(db *sql.DB, apiKey string, keyMsg string) error {
 	}
 
 	// Insert it into the database. Duplicate entries will be rejected.
-	insertSQL := `INSERT INTO api_keys (apiKey, createdDate, createMsg) VALUES (?, ?, ?)`
-	statement, err := db.Prepare(insertSQL)
-	_, err = statement.Exec(apiKey, time.Now().Format(time.RFC3339), keyMsg)
+	err = insertApiKey(db, apiKey, time.Now().Format(time.RFC3339), sql.NullString{}, keyMsg, sql.NullString{})
 	if err != nil {
 		return fmt.Errorf("failed to add api key to db: %s", err)
 	}
@@ -50,17 +93,70 @@ func AddNewApiKey(db *sql.DB, apiKey string, keyMsg string) error {
 	return nil
 }
 
-// RemoveApiKey removes a given key from the keys table. Invalid keys are rejected.
-func RemoveApiKey(db *sql.DB, apiKey string) (bool, error) {
+// GenerateScopedApiKey generates a new random key, and adds it with the message, scope, expiry and rate limit to the keys table.
+func GenerateScopedApiKey(db *sql.DB, keyMsg string, scope KeyScope, expires time.Time, limit *RateLimit) (string, error) {
+	apiKey, err := newApiKey()
+	if err != nil {
+		return "", err
+	}
+	if err := AddScopedApiKey(db, apiKey, keyMsg, scope, expires, limit); err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+// AddScopedApiKey adds a given key with the message, scope, expiry and rate limit to the keys table in one transaction,
+// so the key is never usable with the default scope or without its expiry. A zero expires and a nil limit are not stored.
+func AddScopedApiKey(db *sql.DB, apiKey string, keyMsg string, scope KeyScope, expires time.Time, limit *RateLimit) error {
 	err := checkKeyFormat(apiKey)
+	if err != nil {
+		return fmt.Errorf("api key rejected: %s", err)
+	}
+	scopeJSON, err := json.Marshal(scope)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key scope: %s", err)
+	}
+	var rateLimit sql.NullFloat64
+	var rateBurst sql.NullInt64
+	if limit != nil {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("negative rate limit")
+		}
+		rateLimit = sql.NullFloat64{Float64: limit.Rate, Valid: true}
+		rateBurst = sql.NullInt64{Int64: int64(limit.Burst), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	err = insertApiKey(tx, apiKey, time.Now().Format(time.RFC3339), sql.NullString{}, keyMsg, sql.NullString{String: string(scopeJSON), Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to add api key to db: %s", err)
+	}
+	_, err = tx.Exec(`UPDATE api_keys SET expires = ?, rateLimit = ?, rateBurst = ? WHERE keyId = ?`,
+		expiresColumn(expires), rateLimit, rateBurst, ApiKeyID(apiKey))
+	if err != nil {
+		return fmt.Errorf("failed to add api key to db: %s", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to add api key to db: %s", err)
+	}
+	return nil
+}
+
+// RemoveApiKey removes a key, given by itself or by its id, from the keys table. Invalid keys are rejected.
+func RemoveApiKey(db *sql.DB, key string) (bool, error) {
+	keyID, err := keyIDOf(key)
 	if err != nil {
 		return false, fmt.Errorf("api key rejected: %s", err)
 	}
 
 	// Delete the key from the database
-	deleteSQL := `DELETE FROM api_keys WHERE apiKey = ?`
-	statement, err := db.Prepare(deleteSQL)
-	result, err := statement.Exec(apiKey)
+	result, err := db.Exec(`DELETE FROM api_keys WHERE keyId = ?`, keyID)
 	if err != nil {
 		return false, fmt.Errorf("failed to remove api key from db: %s", err)
 	}
@@ -69,53 +165,335 @@ func RemoveApiKey(db *sql.DB, apiKey string) (bool, error) {
 	return nRows == 1, err
 }
 
-// ValidateApiKey checks a given key against the keys table. Invalid keys are rejected.
+// ValidateApiKey checks a given key against the keys table. Invalid and expired keys are rejected.
 func ValidateApiKey(db *sql.DB, apiKey string) (bool, error) {
 	err := checkKeyFormat(apiKey)
 	if err != nil {
 		return false, fmt.Errorf("api key rejected: %s", err)
 	}
 
-	checkSQL := `UPDATE api_keys SET lastUsed = ? WHERE apiKey = ?`
-	statement, err := db.Prepare(checkSQL)
-	result, err := statement.Exec(time.Now().Format(time.RFC3339), apiKey)
+	keyID := ApiKeyID(apiKey)
+	var salt, keyHash string
+	var expires sql.NullString
+	err = db.QueryRow(`SELECT salt, keyHash, expires FROM api_keys WHERE keyId = ?`, keyID).Scan(&salt, &keyHash, &expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read api key record from db: %s", err)
+	}
+
+	saltBytes, err := hex.DecodeString(salt)
+	if err != nil {
+		return false, fmt.Errorf("invalid salt of api key %s in db: %s", keyID, err)
+	}
+	if !hmac.Equal([]byte(hashApiKey(saltBytes, apiKey)), []byte(keyHash)) {
+		return false, nil
+	}
+	if expires.Valid {
+		expiresAt, err := time.Parse(time.RFC3339, expires.String)
+		if err != nil {
+			return false, fmt.Errorf("invalid expiry of api key %s in db: %s", keyID, err)
+		}
+		if !time.Now().Before(expiresAt) {
+			return false, fmt.Errorf("api key %s expired at %s", keyID, expires.String)
+		}
+	}
+
+	_, err = db.Exec(`UPDATE api_keys SET lastUsed = ? WHERE keyId = ?`, time.Now().Format(time.RFC3339), keyID)
 	if err != nil {
 		return false, fmt.Errorf("failed to update api key record in db: %s", err)
 	}
+
+	return true, nil
+}
+
+// SetApiKeyExpiry sets when a key, given by itself or by its id, stops working. A zero expires makes the key work until it is removed.
+// It returns false if the key is not found.
+func SetApiKeyExpiry(db *sql.DB, key string, expires time.Time) (bool, error) {
+	keyID, err := keyIDOf(key)
+	if err != nil {
+		return false, fmt.Errorf("api key rejected: %s", err)
+	}
+
+	result, err := db.Exec(`UPDATE api_keys SET expires = ? WHERE keyId = ?`, expiresColumn(expires), keyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update api key expiry in db: %s", err)
+	}
 	nRows, err := result.RowsAffected()
 
 	return nRows == 1, err
 }
 
-// ListApiKeys lists all keys in the keys table
-func ListApiKeys(db *sql.DB) error {
-	result, err := db.Query("SELECT apiKey, createdDate, lastUsed, createMsg FROM api_keys ORDER BY createdDate ASC")
+// RotateApiKey generates a new key with the message and scope of a key, given by itself or by its id,
+// and makes the old key expire after the grace period, unless it expires before that. It returns the new key.
+func RotateApiKey(db *sql.DB, key string, grace time.Duration) (string, error) {
+	keyID, err := keyIDOf(key)
+	if err != nil {
+		return "", fmt.Errorf("api key rejected: %s", err)
+	}
+	newKey, err := newApiKey()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	var createMsg string
+	var expires, scopeJSON sql.NullString
+	var rateLimit sql.NullFloat64
+	var rateBurst sql.NullInt64
+	err = tx.QueryRow(`SELECT createMsg, expires, scope, rateLimit, rateBurst FROM api_keys WHERE keyId = ?`, keyID).Scan(
+		&createMsg, &expires, &scopeJSON, &rateLimit, &rateBurst)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("api key %s not found", keyID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read api key record from db: %s", err)
+	}
+
+	if err := insertApiKey(tx, newKey, time.Now().Format(time.RFC3339), sql.NullString{}, createMsg, scopeJSON); err != nil {
+		return "", fmt.Errorf("failed to add api key to db: %s", err)
+	}
+	if _, err := tx.Exec(`UPDATE api_keys SET rateLimit = ?, rateBurst = ? WHERE keyId = ?`, rateLimit, rateBurst, ApiKeyID(newKey)); err != nil {
+		return "", fmt.Errorf("failed to update api key rate limit in db: %s", err)
+	}
+
+	graceEnd := time.Now().Add(grace)
+	if expiresAt, err := time.Parse(time.RFC3339, expires.String); !expires.Valid || err != nil || graceEnd.Before(expiresAt) {
+		if _, err := tx.Exec(`UPDATE api_keys SET expires = ? WHERE keyId = ?`, expiresColumn(graceEnd), keyID); err != nil {
+			return "", fmt.Errorf("failed to update api key expiry in db: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to rotate api key: %s", err)
+	}
+	return newKey, nil
+}
+
+// SetApiKeyScope restricts what a key, given by itself or by its id, may be used for. It returns false if the key is not found.
+func SetApiKeyScope(db *sql.DB, key string, scope KeyScope) (bool, error) {
+	keyID, err := keyIDOf(key)
+	if err != nil {
+		return false, fmt.Errorf("api key rejected: %s", err)
+	}
+
+	scopeJSON, err := json.Marshal(scope)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal key scope: %s", err)
+	}
+	result, err := db.Exec(`UPDATE api_keys SET scope = ? WHERE keyId = ?`, string(scopeJSON), keyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update api key scope in db: %s", err)
+	}
+	nRows, err := result.RowsAffected()
+
+	return nRows == 1, err
+}
+
+// SetApiKeyRateLimit overrides the rate limit of the keys in the configuration for a key, given by itself or by its id.
+// A nil limit removes the override. It returns false if the key is not found.
+func SetApiKeyRateLimit(db *sql.DB, key string, limit *RateLimit) (bool, error) {
+	keyID, err := keyIDOf(key)
+	if err != nil {
+		return false, fmt.Errorf("api key rejected: %s", err)
+	}
+
+	var rateLimit sql.NullFloat64
+	var rateBurst sql.NullInt64
+	if limit != nil {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return false, fmt.Errorf("negative rate limit")
+		}
+		rateLimit = sql.NullFloat64{Float64: limit.Rate, Valid: true}
+		rateBurst = sql.NullInt64{Int64: int64(limit.Burst), Valid: true}
+	}
+	result, err := db.Exec(`UPDATE api_keys SET rateLimit = ?, rateBurst = ? WHERE keyId = ?`, rateLimit, rateBurst, keyID)
 	if err != nil {
-		return fmt.Errorf("failed to list api keys from db: %s", err)
+		return false, fmt.Errorf("failed to update api key rate limit in db: %s", err)
+	}
+	nRows, err := result.RowsAffected()
+
+	return nRows == 1, err
+}
+
+// ApiKeyScope gives what the key with the given id may be used for. Keys without a scope get DefaultKeyScope.
+func ApiKeyScope(db *sql.DB, keyID string) (KeyScope, error) {
+	var scopeJSON sql.NullString
+	err := db.QueryRow(`SELECT scope FROM api_keys WHERE keyId = ?`, keyID).Scan(&scopeJSON)
+	if err != nil {
+		return KeyScope{}, fmt.Errorf("failed to read api key scope from db: %s", err)
+	}
+	return parseScopeColumn(scopeJSON)
+}
+
+// ApiKeyInfo is what is stored about a key in the keys table, without the key itself.
+type ApiKeyInfo struct {
+	ID          string     `json:"id"`
+	CreatedDate string     `json:"createdDate"`
+	LastUsed    string     `json:"lastUsed,omitempty"`
+	Expires     string     `json:"expires,omitempty"`
+	Message     string     `json:"message"`
+	Scope       KeyScope   `json:"scope"`
+	RateLimit   *RateLimit `json:"rateLimit,omitempty"` // Overrides the rate limit of the keys in the configuration.
+}
+
+// ReadApiKeys gives all keys in the keys table, oldest first.
+func ReadApiKeys(db *sql.DB) ([]ApiKeyInfo, error) {
+	return readApiKeys(db, "")
+}
+
+// ReadApiKey gives a key, given by itself or by its id, from the keys table. It returns nil if the key is not found.
+func ReadApiKey(db *sql.DB, key string) (*ApiKeyInfo, error) {
+	keyID, err := keyIDOf(key)
+	if err != nil {
+		return nil, fmt.Errorf("api key rejected: %s", err)
+	}
+	keys, err := readApiKeys(db, "WHERE keyId = ?", keyID)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return &keys[0], nil
+}
+
+func readApiKeys(db *sql.DB, where string, args ...interface{}) ([]ApiKeyInfo, error) {
+	result, err := db.Query("SELECT keyId, createdDate, lastUsed, expires, createMsg, scope, rateLimit, rateBurst FROM api_keys "+where+" ORDER BY createdDate ASC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys from db: %s", err)
 	}
 	defer result.Close()
 
-	fmt.Printf("%-44s  %-25s  %-25s  %s\n", "API Key", "Created On", "Last Used", "Message")
+	keys := []ApiKeyInfo{}
 	for result.Next() {
-		var apiKey string
-		var createdDate string
-		var lastUsedNull sql.NullString
-		var lastUsed string
-		var createMsg string
-		result.Scan(&apiKey, &createdDate, &lastUsedNull, &createMsg)
-		if lastUsedNull.Valid {
-			lastUsed = lastUsedNull.String
-		} else {
+		var key ApiKeyInfo
+		var lastUsed, expires, scopeJSON sql.NullString
+		var rateLimit sql.NullFloat64
+		var rateBurst sql.NullInt64
+		if err := result.Scan(&key.ID, &key.CreatedDate, &lastUsed, &expires, &key.Message, &scopeJSON, &rateLimit, &rateBurst); err != nil {
+			return nil, fmt.Errorf("failed to list api keys from db: %s", err)
+		}
+		if rateLimit.Valid {
+			key.RateLimit = &RateLimit{Rate: rateLimit.Float64, Burst: int(rateBurst.Int64)}
+		}
+		key.LastUsed = lastUsed.String
+		key.Expires = expires.String
+		key.Scope, err = parseScopeColumn(scopeJSON)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, result.Err()
+}
+
+// ListApiKeys lists all keys in the keys table by their id. The keys themselves are not stored, and can not be listed.
+func ListApiKeys(db *sql.DB) error {
+	keys, err := ReadApiKeys(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-8s  %-25s  %-25s  %-25s  %-20s  %-30s  %s\n", "Key ID", "Created On", "Last Used", "Expires", "Rate Limit", "Message", "Scope")
+	for _, key := range keys {
+		lastUsed := key.LastUsed
+		if lastUsed == "" {
 			lastUsed = "Never Used"
 		}
-		fmt.Printf("%-44s  %-25s  %-25s  %s\n", apiKey, createdDate, lastUsed, createMsg)
+		expires := key.Expires
+		if expires == "" {
+			expires = "Never"
+		}
+		rateLimit := "Default"
+		if key.RateLimit != nil {
+			rateLimit = key.RateLimit.String()
+		}
+		fmt.Printf("%-8s  %-25s  %-25s  %-25s  %-20s  %-30s  %s\n", key.ID, key.CreatedDate, lastUsed, expires, rateLimit, key.Message, key.Scope)
 	}
 
 	return nil
 }
 
-// Check that the key is a base64 encoded 32 byte string
+func parseScopeColumn(scopeJSON sql.NullString) (KeyScope, error) {
+	if !scopeJSON.Valid {
+		return DefaultKeyScope, nil
+	}
+	scope := KeyScope{}
+	if err := json.Unmarshal([]byte(scopeJSON.String), &scope); err != nil {
+		return KeyScope{}, fmt.Errorf("invalid api key scope in db: %s", err)
+	}
+	return scope, nil
+}
+
+func expiresColumn(expires time.Time) sql.NullString {
+	if expires.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: expires.UTC().Format(time.RFC3339), Valid: true}
+}
+
+// newApiKey gives a random key, prefixed by a random id.
+func newApiKey() (string, error) {
+	random := make([]byte, apiKeyIDLength/2+32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate api key: %s", err)
+	}
+	return hex.EncodeToString(random[:apiKeyIDLength/2]) + "." + base64.StdEncoding.EncodeToString(random[apiKeyIDLength/2:]), nil
+}
+
+// hashApiKey gives the salted hash of a key. The keys are 256 bit random strings, so a fast hash is sufficient.
+func hashApiKey(salt []byte, apiKey string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(apiKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertApiKey(db sqlExecer, apiKey string, createdDate string, lastUsed sql.NullString, keyMsg string, scopeJSON sql.NullString) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %s", err)
+	}
+	keyID := ApiKeyID(apiKey)
+	_, err := db.Exec(`INSERT INTO api_keys (keyId, salt, keyHash, createdDate, lastUsed, createMsg, scope) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		keyID, hex.EncodeToString(salt), hashApiKey(salt, apiKey), createdDate, lastUsed, keyMsg, scopeJSON)
+	return err
+}
+
+// keyIDOf gives the id of a key, or the id itself if an id is given.
+func keyIDOf(key string) (string, error) {
+	if isApiKeyID(key) {
+		return key, nil
+	}
+	if err := checkKeyFormat(key); err != nil {
+		return "", err
+	}
+	return ApiKeyID(key), nil
+}
+
+func isApiKeyID(keyID string) bool {
+	if len(keyID) != apiKeyIDLength {
+		return false
+	}
+	_, err := hex.DecodeString(keyID)
+	return err == nil && strings.ToLower(keyID) == keyID
+}
+
+// Check that the key is a base64 encoded 32 byte string, optionally prefixed by a key id and a '.'
 func checkKeyFormat(apiKey string) error {
+	if keyID, secret, found := strings.Cut(apiKey, "."); found {
+		if !isApiKeyID(keyID) {
+			return fmt.Errorf("the key id is not %d lowercase hex digits", apiKeyIDLength)
+		}
+		apiKey = secret
+	}
 	rawKey, err := base64.StdEncoding.DecodeString(apiKey)
 	if err != nil {
 		return fmt.Errorf("the key could not be base64 decoded: %s", err)
@@ -127,30 +505,125 @@ func checkKeyFormat(apiKey string) error {
 }
 
 func createStateDB(dbFilePath string) (*sql.DB, error) {
-	// Create database file if it does not exist.
-	file, err := os.OpenFile(dbFilePath, os.O_CREATE, 0660)
+	db, err := OpenDB(dbFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create db file: %s", err)
+		return nil, err
+	}
+	if _, err := MigrateStateDB(db, false); err != nil {
+		db.Close()
+		return nil, err
 	}
-	file.Close()
+	return db, nil
+}
+
+// stateMigrations upgrade state databases. Version 0 is a database from before the schema had a version.
+var stateMigrations = []migration{
+	{1, "create the api_keys table, with keys from older databases hashed", func(tx *sql.Tx) error {
+		if err := hashPlaintextApiKeys(tx); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(createApiKeysTable); err != nil {
+			return fmt.Errorf("failed to create api_keys table: %s", err)
+		}
+		return nil
+	}},
+	{2, "add the rateLimit and rateBurst columns to api_keys", addApiKeysRateLimitColumns},
+	{3, "create the post_audit table", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createAuditTable); err != nil {
+			return fmt.Errorf("failed to create post_audit table: %s", err)
+		}
+		return nil
+	}},
+	{4, "add the count column to post_audit, for throttled posts counted in one entry", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`ALTER TABLE post_audit ADD COLUMN "count" INTEGER NOT NULL DEFAULT 1`); err != nil {
+			return fmt.Errorf("failed to add column count to post_audit table: %s", err)
+		}
+		return nil
+	}},
+	{5, "create the admin_audit table", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createAdminAuditTable); err != nil {
+			return fmt.Errorf("failed to create admin_audit table: %s", err)
+		}
+		return nil
+	}},
+}
+
+// MigrateStateDB upgrades a state database to the latest schema, and gives the migrations that were applied.
+// With dryRun, nothing is changed, and it gives the migrations that would be applied.
+func MigrateStateDB(db *sql.DB, dryRun bool) ([]Migration, error) {
+	return runMigrations(db, stateMigrations, dryRun)
+}
 
-	// Create db with necessary tables if it does not exist.
-	db, err := sql.Open("sqlite3", dbFilePath)
+// addApiKeysRateLimitColumns adds the rate limit columns to state databases created before keys had rate limits.
+func addApiKeysRateLimitColumns(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "api_keys")
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to sqlite database: %s", err)
+		return err
+	}
+
+	for _, c := range []struct{ column, columnType string }{
+		{"rateLimit", "REAL"},
+		{"rateBurst", "INTEGER"},
+	} {
+		if columns[c.column] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE api_keys ADD COLUMN "%s" %s`, c.column, c.columnType)); err != nil {
+			return fmt.Errorf("failed to add column %s to api_keys table: %s", c.column, err)
+		}
+	}
+	return nil
+}
+
+// hashPlaintextApiKeys replaces the keys table of state databases created before keys were hashed, which stored the keys
+// themselves, with a table of the key ids and hashes. The keys keep working.
+func hashPlaintextApiKeys(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "api_keys")
+	if err != nil {
+		return err
+	}
+	if !columns["apiKey"] {
+		return nil
 	}
-	createTable := `CREATE TABLE IF NOT EXISTS "api_keys" (
-		"apiKey" TEXT UNIQUE,
-		"createdDate" TEXT,
-		"lastUsed" TEXT,
-		"createMsg" TEXT,
-		PRIMARY KEY("apiKey")
-	);
-	CREATE INDEX IF NOT EXISTS "api_keys_idx" ON "api_keys" (
-		"apiKey"
-	);`
 
-	_, err = db.Exec(createTable)
+	// Keys were scoped before they were hashed in some databases.
+	scopeColumn := "NULL"
+	if columns["scope"] {
+		scopeColumn = "scope"
+	}
+	alterSQL := `ALTER TABLE api_keys RENAME TO api_keys_plaintext;
+		DROP INDEX IF EXISTS api_keys_idx;` + createApiKeysTable
+	if _, err := tx.Exec(alterSQL); err != nil {
+		return fmt.Errorf("failed to replace api_keys table: %s", err)
+	}
+
+	// The old columns may be NULL in keys added by hand, and are then stored as empty.
+	type plaintextKey struct {
+		apiKey                                      string
+		createdDate, createMsg, lastUsed, scopeJSON sql.NullString
+	}
+	var keys []plaintextKey
+	rows, err := tx.Query(`SELECT apiKey, createdDate, lastUsed, createMsg, ` + scopeColumn + ` FROM api_keys_plaintext`)
+	if err != nil {
+		return fmt.Errorf("failed to read plaintext api keys: %s", err)
+	}
+	for rows.Next() {
+		var key plaintextKey
+		if err := rows.Scan(&key.apiKey, &key.createdDate, &key.lastUsed, &key.createMsg, &key.scopeJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read plaintext api keys: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
 
-	return db, err
+	for _, key := range keys {
+		if err := insertApiKey(tx, key.apiKey, key.createdDate.String, key.lastUsed, key.createMsg.String, key.scopeJSON); err != nil {
+			return fmt.Errorf("failed to hash api key %s: %s", ApiKeyID(key.apiKey), err)
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE api_keys_plaintext`); err != nil {
+		return fmt.Errorf("failed to drop plaintext api keys: %s", err)
+	}
+	return nil
 }
@@ -0,0 +1,231 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStateDB(t *testing.T) *sql.DB {
+	stateTestFile := fmt.Sprintf("/tmp/mmsdteststate%d.db", rand.Int())
+	t.Cleanup(func() { os.Remove(stateTestFile) })
+	stateDB, err := NewStateDB(stateTestFile)
+	if err != nil {
+		t.Fatalf("failed to create state db: %s", err)
+	}
+	t.Cleanup(func() { stateDB.Close() })
+	return stateDB
+}
+
+// storedKeyColumns gives everything stored about the keys, to check that the keys themselves are not stored.
+func storedKeyColumns(t *testing.T, db *sql.DB) string {
+	rows, err := db.Query(`SELECT keyId, salt, keyHash, createdDate, lastUsed, expires, createMsg, scope FROM api_keys`)
+	if err != nil {
+		t.Fatalf("failed to read keys: %s", err)
+	}
+	defer rows.Close()
+	var stored []string
+	for rows.Next() {
+		values := make([]sql.NullString, 8)
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		rows.Scan(pointers...)
+		for _, value := range values {
+			stored = append(stored, value.String)
+		}
+	}
+	return strings.Join(stored, " ")
+}
+
+func TestGenerateApiKey(t *testing.T) {
+	stateDB := newTestStateDB(t)
+
+	apiKey, err := GenerateApiKey(stateDB, "test")
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	keyID := ApiKeyID(apiKey)
+	if !strings.HasPrefix(apiKey, keyID+".") || len(keyID) != apiKeyIDLength || checkKeyFormat(apiKey) != nil {
+		t.Errorf("Expected a key prefixed by its id; Got %q with id %q", apiKey, keyID)
+	}
+	if secret := strings.TrimPrefix(apiKey, keyID+"."); strings.Contains(storedKeyColumns(t, stateDB), secret) {
+		t.Errorf("Expected the key not to be stored")
+	}
+
+	if ok, err := ValidateApiKey(stateDB, apiKey); !ok || err != nil {
+		t.Errorf("Expected the key to be valid; Got %v, %v", ok, err)
+	}
+	otherKey, _ := newApiKey()
+	if ok, _ := ValidateApiKey(stateDB, keyID+otherKey[apiKeyIDLength:]); ok {
+		t.Errorf("Expected a key with the same id and another secret to be invalid")
+	}
+	if err := AddNewApiKey(stateDB, keyID+otherKey[apiKeyIDLength:], "same id"); err == nil {
+		t.Errorf("Expected a key with the same id to be rejected")
+	}
+
+	if ok, err := RemoveApiKey(stateDB, keyID); !ok || err != nil {
+		t.Errorf("Expected the key to be removed by its id; Got %v, %v", ok, err)
+	}
+	if ok, _ := ValidateApiKey(stateDB, apiKey); ok {
+		t.Errorf("Expected a removed key to be invalid")
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	stateDB := newTestStateDB(t)
+	apiKey, _ := GenerateApiKey(stateDB, "test")
+
+	if ok, err := SetApiKeyExpiry(stateDB, apiKey, time.Now().Add(-time.Minute)); !ok || err != nil {
+		t.Fatalf("Expected the expiry to be set; Got %v, %v", ok, err)
+	}
+	if ok, err := ValidateApiKey(stateDB, apiKey); ok || err == nil {
+		t.Errorf("Expected an expired key to be invalid; Got %v, %v", ok, err)
+	}
+
+	if ok, err := SetApiKeyExpiry(stateDB, ApiKeyID(apiKey), time.Time{}); !ok || err != nil {
+		t.Fatalf("Expected the expiry to be removed; Got %v, %v", ok, err)
+	}
+	if ok, err := ValidateApiKey(stateDB, apiKey); !ok || err != nil {
+		t.Errorf("Expected the key to be valid again; Got %v, %v", ok, err)
+	}
+}
+
+func TestAddScopedApiKey(t *testing.T) {
+	stateDB := newTestStateDB(t)
+	scope, _ := ParseKeyScope([]string{"product=meps"})
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	apiKey, err := GenerateScopedApiKey(stateDB, "scoped", scope, expires, &RateLimit{Rate: 2, Burst: 4})
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	info, err := ReadApiKey(stateDB, apiKey)
+	if err != nil || info == nil {
+		t.Fatalf("Expected the key to be added; Got %v, %v", info, err)
+	}
+	if info.Scope.String() != scope.String() {
+		t.Errorf("Expected scope %s; Got %s", scope, info.Scope)
+	}
+	if info.Expires != expires.UTC().Format(time.RFC3339) {
+		t.Errorf("Expected expiry %s; Got %s", expires.UTC().Format(time.RFC3339), info.Expires)
+	}
+	if info.RateLimit == nil || *info.RateLimit != (RateLimit{Rate: 2, Burst: 4}) {
+		t.Errorf("Expected rate limit 2/4; Got %v", info.RateLimit)
+	}
+
+	// Nothing is added if any part of the key is invalid.
+	otherKey, _ := newApiKey()
+	if err := AddScopedApiKey(stateDB, otherKey, "invalid", scope, time.Time{}, &RateLimit{Rate: -1}); err == nil {
+		t.Errorf("Expected a negative rate limit to be rejected")
+	}
+	if info, _ := ReadApiKey(stateDB, otherKey); info != nil {
+		t.Errorf("Expected a rejected key not to be added; Got %v", info)
+	}
+}
+
+func TestRotateApiKey(t *testing.T) {
+	stateDB := newTestStateDB(t)
+	oldKey, _ := GenerateApiKey(stateDB, "rotated")
+	scope, _ := ParseKeyScope([]string{"product=meps"})
+	SetApiKeyScope(stateDB, oldKey, scope)
+
+	newKey, err := RotateApiKey(stateDB, ApiKeyID(oldKey), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to rotate key: %s", err)
+	}
+	for _, apiKey := range []string{oldKey, newKey} {
+		if ok, err := ValidateApiKey(stateDB, apiKey); !ok || err != nil {
+			t.Errorf("Expected %s to be valid during the grace period; Got %v, %v", ApiKeyID(apiKey), ok, err)
+		}
+	}
+	if got, err := ApiKeyScope(stateDB, ApiKeyID(newKey)); err != nil || got.String() != scope.String() {
+		t.Errorf("Expected the new key to get the scope of the old key; Got %v, %v", got, err)
+	}
+
+	// A grace period does not extend the life of a key that expires before it ends.
+	newerKey, _ := RotateApiKey(stateDB, newKey, 0)
+	if ok, _ := ValidateApiKey(stateDB, newKey); ok {
+		t.Errorf("Expected the key to stop working without a grace period")
+	}
+	RotateApiKey(stateDB, newerKey, time.Hour)
+	var expires string
+	stateDB.QueryRow(`SELECT expires FROM api_keys WHERE keyId = ?`, ApiKeyID(newKey)).Scan(&expires)
+	if expiresAt, err := time.Parse(time.RFC3339, expires); err != nil || expiresAt.After(time.Now()) {
+		t.Errorf("Expected the expiry of an expired key to be kept; Got %q", expires)
+	}
+
+	if _, err := RotateApiKey(stateDB, "00000000", time.Hour); err == nil {
+		t.Errorf("Expected rotating an unknown key to fail")
+	}
+}
+
+func TestHashPlaintextApiKeys(t *testing.T) {
+	for _, withScope := range []bool{false, true} {
+		// A state database created before keys were hashed, with or without scopes.
+		stateTestFile := fmt.Sprintf("/tmp/mmsdteststate%d.db", rand.Int())
+		defer os.Remove(stateTestFile)
+		oldDB, err := sql.Open("sqlite3", stateTestFile)
+		if err != nil {
+			t.Fatalf("failed to open db: %s", err)
+		}
+		createSQL := `CREATE TABLE api_keys (apiKey TEXT UNIQUE, createdDate TEXT, lastUsed TEXT, createMsg TEXT, PRIMARY KEY(apiKey));
+			CREATE INDEX api_keys_idx ON api_keys (apiKey);
+			INSERT INTO api_keys (apiKey, createdDate, createMsg) VALUES ('` + testAPIKey + `', '2021-01-01T00:00:00Z', 'old key');
+			INSERT INTO api_keys (apiKey, createdDate, createMsg) VALUES ('` + testScopedAPIKey + `', NULL, NULL);`
+		if withScope {
+			createSQL += `ALTER TABLE api_keys ADD COLUMN scope TEXT;
+				UPDATE api_keys SET scope = '{"roles":["admin"]}';`
+		}
+		_, err = oldDB.Exec(createSQL)
+		oldDB.Close()
+		if err != nil {
+			t.Fatalf("failed to create old state db: %s", err)
+		}
+
+		stateDB, err := NewStateDB(stateTestFile)
+		if err != nil {
+			t.Fatalf("failed to open old state db: %s", err)
+		}
+		defer stateDB.Close()
+
+		if ok, err := ValidateApiKey(stateDB, testAPIKey); !ok || err != nil {
+			t.Errorf("Expected the old key to keep working; Got %v, %v", ok, err)
+		}
+		if strings.Contains(storedKeyColumns(t, stateDB), testAPIKey) {
+			t.Errorf("Expected the old key not to be stored")
+		}
+		scope, err := ApiKeyScope(stateDB, ApiKeyID(testAPIKey))
+		if expected := map[bool]string{false: "role=write", true: "role=admin"}[withScope]; err != nil || scope.String() != expected {
+			t.Errorf("Expected the scope %s; Got %v, %v", expected, scope, err)
+		}
+		// A key added by hand without a date or message is kept too.
+		if ok, err := ValidateApiKey(stateDB, testScopedAPIKey); !ok || err != nil {
+			t.Errorf("Expected the key without a date or message to keep working; Got %v, %v", ok, err)
+		}
+		if keys, err := ReadApiKeys(stateDB); err != nil || len(keys) != 2 {
+			t.Errorf("Expected 2 keys; Got %+v, %v", keys, err)
+		}
+	}
+}
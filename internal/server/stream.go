@@ -0,0 +1,294 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/metno/go-mms/pkg/mms"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	streamKeepAliveInterval = 15 * time.Second
+	streamWriteTimeout      = 10 * time.Second
+	streamBufferSize        = 256
+	streamReplayBatchSize   = 500
+)
+
+// eventStream is a connection to a client receiving events, either over SSE or WebSocket.
+type eventStream interface {
+	// Resume tells the client the id to resume from if the connection breaks before any event is sent.
+	Resume(id int64) error
+	Send(se StoredEvent) error
+	KeepAlive() error
+	Done() <-chan struct{}
+	Close() error
+}
+
+// eventBroker fans out accepted product events to all connected stream clients.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	clients     prometheus.Gauge
+}
+
+type streamSubscriber struct {
+	filter   mms.EventFilter
+	events   chan StoredEvent
+	overflow chan struct{} // Closed if the subscriber could not keep up and was dropped.
+}
+
+func newEventBroker(m *metrics) *eventBroker {
+	broker := &eventBroker{
+		subscribers: make(map[*streamSubscriber]struct{}),
+		clients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "mmsd",
+			Name:      "stream_clients",
+			Help:      "The number of clients connected to the events stream.",
+		}),
+	}
+	m.MustRegister(broker.clients)
+
+	return broker
+}
+
+func (b *eventBroker) subscribe(filter mms.EventFilter) *streamSubscriber {
+	sub := &streamSubscriber{
+		filter:   filter,
+		events:   make(chan StoredEvent, streamBufferSize),
+		overflow: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[sub] = struct{}{}
+	b.clients.Inc()
+
+	return sub
+}
+
+func (b *eventBroker) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		b.clients.Dec()
+	}
+}
+
+// publish hands an event to every matching subscriber without blocking.
+// Subscribers with a full buffer are dropped; their clients can resume with Last-Event-ID.
+func (b *eventBroker) publish(se StoredEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if !sub.filter.Matches(se.Event) {
+			continue
+		}
+		select {
+		case sub.events <- se:
+		default:
+			delete(b.subscribers, sub)
+			b.clients.Dec()
+			close(sub.overflow)
+		}
+	}
+}
+
+// streamEventsHandler pushes accepted product events to the client as Server-Sent Events,
+// or over a WebSocket if the client asks for an upgrade.
+func (service *Service) streamEventsHandler(httpRespW http.ResponseWriter, httpReq *http.Request) {
+	filter, err := mms.ParseEventFilter(httpReq.URL.Query())
+	if err != nil {
+		errorResponse(err, http.StatusBadRequest, httpRespW, httpReq)
+		return
+	}
+
+	// Browsers can not set headers on WebSocket requests, so the query parameter is accepted too.
+	var lastID int64
+	lastEventID := httpReq.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = httpReq.URL.Query().Get("lastEventId")
+	}
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			errorResponse(fmt.Errorf("invalid Last-Event-ID: %s", lastEventID), http.StatusBadRequest, httpRespW, httpReq)
+			return
+		}
+	}
+
+	var stream eventStream
+	if isWebSocketUpgrade(httpReq) {
+		stream, err = acceptWebSocket(httpRespW, httpReq)
+	} else {
+		stream, err = newSSEStream(httpRespW, httpReq)
+	}
+	if err != nil {
+		log.Printf("failed to open event stream: %s", err)
+		return
+	}
+	defer stream.Close()
+
+	// Subscribe before replaying, so no events are missed between the replay and going live.
+	sub := service.streams.subscribe(filter)
+	defer service.streams.unsubscribe(sub)
+
+	// A new client is told the id of the newest event, so it does not miss any events if it reconnects before the first
+	// one arrives.
+	if lastEventID == "" {
+		stats, err := service.events.Stats(httpReq.Context())
+		if err != nil {
+			log.Printf("failed to get the newest event id for stream: %s", err)
+			return
+		}
+		lastID = stats.LastID
+		if err := stream.Resume(lastID); err != nil {
+			return
+		}
+	} else {
+		for {
+			events, err := service.events.EventsAfter(httpReq.Context(), lastID, filter, streamReplayBatchSize)
+			if err != nil {
+				log.Printf("failed to replay events for stream: %s", err)
+				return
+			}
+			for _, se := range events {
+				if err := stream.Send(se); err != nil {
+					return
+				}
+				lastID = se.ID
+			}
+			if len(events) < streamReplayBatchSize {
+				break
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case <-sub.overflow:
+			log.Printf("dropped slow event stream client %s", httpReq.RemoteAddr)
+			return
+		case se := <-sub.events:
+			if se.ID <= lastID {
+				continue
+			}
+			if err := stream.Send(se); err != nil {
+				return
+			}
+			lastID = se.ID
+		case <-keepAlive.C:
+			if err := stream.KeepAlive(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sseStream writes events as text/event-stream.
+type sseStream struct {
+	httpRespW http.ResponseWriter
+	rc        *http.ResponseController
+	done      <-chan struct{}
+}
+
+func newSSEStream(httpRespW http.ResponseWriter, httpReq *http.Request) (*sseStream, error) {
+	stream := &sseStream{
+		httpRespW: httpRespW,
+		rc:        http.NewResponseController(httpRespW),
+		done:      httpReq.Context().Done(),
+	}
+
+	httpRespW.Header().Set("Content-Type", "text/event-stream")
+	httpRespW.Header().Set("Cache-Control", "no-cache")
+	httpRespW.Header().Set("Connection", "keep-alive")
+	httpRespW.Header().Set("X-Accel-Buffering", "no")
+	if err := stream.setWriteDeadline(); err != nil {
+		return nil, err
+	}
+	httpRespW.WriteHeader(http.StatusOK)
+
+	// Tell the client how long to wait before reconnecting.
+	if _, err := fmt.Fprintf(httpRespW, "retry: %d\n\n", (5 * time.Second).Milliseconds()); err != nil {
+		return nil, err
+	}
+	if err := stream.rc.Flush(); err != nil {
+		return nil, fmt.Errorf("streaming not supported: %s", err)
+	}
+
+	return stream, nil
+}
+
+// setWriteDeadline extends the write deadline of the connection, overriding the server's WriteTimeout.
+func (stream *sseStream) setWriteDeadline() error {
+	err := stream.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (stream *sseStream) write(msg string) error {
+	if err := stream.setWriteDeadline(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(stream.httpRespW, msg); err != nil {
+		return err
+	}
+	return stream.rc.Flush()
+}
+
+// Send writes the event in the same form as WebSocket messages, {"id": 1, "event": {...}}, with the id also as the SSE event id.
+func (stream *sseStream) Send(se StoredEvent) error {
+	payload, err := json.Marshal(se)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %s", err)
+	}
+	return stream.write(fmt.Sprintf("id: %d\nevent: product\ndata: %s\n\n", se.ID, payload))
+}
+
+// Resume sends an SSE event with only an id, which sets the last event id of the client without giving it an event.
+func (stream *sseStream) Resume(id int64) error {
+	return stream.write(fmt.Sprintf("id: %d\n\n", id))
+}
+
+func (stream *sseStream) KeepAlive() error {
+	return stream.write(": keep-alive\n\n")
+}
+
+func (stream *sseStream) Done() <-chan struct{} {
+	return stream.done
+}
+
+func (stream *sseStream) Close() error {
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/metno/go-mms/pkg/mms"
+)
+
+func newStreamTestService(t *testing.T) *Service {
+	dbTestFile := fmt.Sprintf("/tmp/mmsdtestsqlite%d.db", rand.Int())
+	t.Cleanup(func() { os.Remove(dbTestFile) })
+	eventsDB, err := NewEventsDB(dbTestFile)
+	if err != nil {
+		t.Fatalf("failed to create db: %s", err)
+	}
+	return NewService(CreateTemplates(), NewSQLiteEventStore(eventsDB), nil, "", nil, Version{}, true)
+}
+
+// waitForStreamClients waits until n clients are connected to the stream broker.
+func waitForStreamClients(t *testing.T, service *Service, n int) {
+	for i := 0; i < 100; i++ {
+		service.streams.mu.Lock()
+		connected := len(service.streams.subscribers)
+		service.streams.mu.Unlock()
+		if connected == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d stream clients before timeout", n)
+}
+
+func TestStreamEventsSSE(t *testing.T) {
+	service := newStreamTestService(t)
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	stored := &mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName}
+	storedID, err := insertProductEvent(testEventsDB(service), stored)
+	if err != nil {
+		t.Fatalf("failed to save event: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpReq, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/events/stream?product=arome*", nil)
+	httpReq.Header.Set("Last-Event-ID", "0")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("failed to open stream: %s", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream; Got %s", httpResp.Header.Get("Content-Type"))
+	}
+
+	waitForStreamClients(t, service, 1)
+	service.streams.publish(StoredEvent{ID: storedID + 1, Event: &mms.ProductEvent{Product: "meps"}})
+	service.streams.publish(StoredEvent{ID: storedID + 2, Event: &mms.ProductEvent{Product: "arome_arctic_sfx"}})
+
+	reader := bufio.NewReader(httpResp.Body)
+	var ids, products []string
+	for len(products) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read stream: %s", err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var se StoredEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &se); err != nil {
+				t.Fatalf("failed to decode streamed event: %s", err)
+			}
+			if fmt.Sprint(se.ID) != ids[len(ids)-1] {
+				t.Errorf("Expected the id %s in the data; Got %d", ids[len(ids)-1], se.ID)
+			}
+			products = append(products, se.Event.Product)
+		}
+	}
+
+	expectedIDs := fmt.Sprintf("%d,%d", storedID, storedID+2)
+	if strings.Join(ids, ",") != expectedIDs || strings.Join(products, ",") != "arome_arctic,arome_arctic_sfx" {
+		t.Errorf("Expected replayed and live arome events with ids %s; Got %v %v", expectedIDs, ids, products)
+	}
+}
+
+func TestStreamEventsSSEResume(t *testing.T) {
+	service := newStreamTestService(t)
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	storedID, err := insertProductEvent(testEventsDB(service), &mms.ProductEvent{Product: "arome_arctic", ProductionHub: productionHubName})
+	if err != nil {
+		t.Fatalf("failed to save event: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpReq, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/events/stream", nil)
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("failed to open stream: %s", err)
+	}
+	defer httpResp.Body.Close()
+
+	// Without a Last-Event-ID, the stored event is not sent, but its id is, to resume from.
+	reader := bufio.NewReader(httpResp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read stream: %s", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			t.Fatalf("Expected no events; Got %s", line)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			if id := strings.TrimSpace(strings.TrimPrefix(line, "id: ")); id != fmt.Sprint(storedID) {
+				t.Errorf("Expected to resume from %d; Got %s", storedID, id)
+			}
+			break
+		}
+	}
+}
+
+func TestStreamEventsWebSocket(t *testing.T) {
+	service := newStreamTestService(t)
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	conn, httpResp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/v1/events/stream", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	if httpResp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols; Got %s", httpResp.Status)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The first message gives the id to resume from, with no event in the empty store.
+	var se StoredEvent
+	if err := conn.ReadJSON(&se); err != nil || se.ID != 0 || se.Event != nil {
+		t.Fatalf("Expected a message to resume from 0; Got %+v, %v", se, err)
+	}
+
+	waitForStreamClients(t, service, 1)
+	service.streams.publish(StoredEvent{ID: 7, Event: &mms.ProductEvent{Product: "test"}})
+
+	if err := conn.ReadJSON(&se); err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if se.ID != 7 || se.Event.Product != "test" {
+		t.Errorf("Expected event 7 for product test; Got %+v", se)
+	}
+}
+
+func TestStreamEventsWebSocketOrigin(t *testing.T) {
+	service := newStreamTestService(t)
+	ts := httptest.NewServer(service.Router)
+	defer ts.Close()
+
+	// Browsers on other web sites may not stream the events.
+	header := http.Header{"Origin": []string{"https://example.com"}}
+	_, httpResp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/v1/events/stream", header)
+	if err == nil || httpResp == nil || httpResp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin WebSocket to be forbidden; Got %v", err)
+	}
+}
+
+func TestStreamEventsInvalidLastEventID(t *testing.T) {
+	service := newStreamTestService(t)
+
+	httpReq := httptest.NewRequest("GET", "/api/v1/events/stream", nil)
+	httpReq.Header.Set("Last-Event-ID", "abc")
+	httpRespW := httptest.NewRecorder()
+	service.Router.ServeHTTP(httpRespW, httpReq)
+
+	if httpRespW.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400; Got %d", httpRespW.Code)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMaxClientMessage is the largest message accepted from a client. Clients are not expected to send anything but
+// pings and closes.
+const wsMaxClientMessage = 1 << 16
+
+// websocketUpgrader upgrades event stream requests to WebSockets. Requests from browsers must come from the same origin
+// as the production hub, so other web sites can not stream events with the credentials of their visitors.
+var websocketUpgrader = websocket.Upgrader{
+	HandshakeTimeout: streamWriteTimeout,
+}
+
+// wsStream sends events as JSON text messages on a WebSocket connection.
+type wsStream struct {
+	conn      *websocket.Conn
+	mu        sync.Mutex // Serialises writes.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func isWebSocketUpgrade(httpReq *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(httpReq)
+}
+
+// acceptWebSocket performs the opening handshake and takes over the connection.
+func acceptWebSocket(httpRespW http.ResponseWriter, httpReq *http.Request) (*wsStream, error) {
+	// On failure, the upgrader has already answered the client.
+	conn, err := websocketUpgrader.Upgrade(httpRespW, httpReq, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade to websocket: %s", err)
+	}
+	conn.SetReadLimit(wsMaxClientMessage)
+
+	stream := &wsStream{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go stream.readLoop()
+
+	return stream, nil
+}
+
+// readLoop reads from the client until the connection ends, which lets the connection answer pings and closes.
+// Other messages are ignored.
+func (stream *wsStream) readLoop() {
+	defer stream.closeDone()
+
+	for {
+		if _, _, err := stream.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (stream *wsStream) Send(se StoredEvent) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	stream.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return stream.conn.WriteJSON(se)
+}
+
+// Resume sends a message with the id and a null event.
+func (stream *wsStream) Resume(id int64) error {
+	return stream.Send(StoredEvent{ID: id})
+}
+
+func (stream *wsStream) KeepAlive() error {
+	return stream.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+}
+
+func (stream *wsStream) Done() <-chan struct{} {
+	return stream.done
+}
+
+func (stream *wsStream) closeDone() {
+	stream.closeOnce.Do(func() { close(stream.done) })
+}
+
+// Close sends a normal closure message and closes the connection.
+func (stream *wsStream) Close() error {
+	stream.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(streamWriteTimeout))
+	stream.closeDone()
+	return stream.conn.Close()
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// APIKey describes an API key of a production hub, as given by GET /api/v1/admin/keys.
+// The key itself is only given when it is generated or rotated.
+type APIKey struct {
+	ID          string           `json:"id"`
+	CreatedDate string           `json:"createdDate"`
+	LastUsed    string           `json:"lastUsed,omitempty"`
+	Expires     string           `json:"expires,omitempty"`
+	Message     string           `json:"message"`
+	Scope       APIKeyScope      `json:"scope"`
+	RateLimit   *APIKeyRateLimit `json:"rateLimit,omitempty"` // Without a rate limit, the key has the default of the production hub.
+	Key         string           `json:"key,omitempty"`
+}
+
+// APIKeyRateLimit limits how many events per second may be posted with an API key, and how many at once above that rate.
+// A zero Rate is unlimited.
+type APIKeyRateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// APIKeyScope restricts what an API key may be used for. The roles are write and admin.
+// The patterns may contain '*', and an empty list of patterns allows everything.
+type APIKeyScope struct {
+	Roles      []string `json:"roles"`
+	QueueNames []string `json:"queueNames,omitempty"`
+	Hubs       []string `json:"hubs,omitempty"`
+	Products   []string `json:"products,omitempty"`
+}
+
+// NewAPIKey describes an API key to add to a production hub.
+type NewAPIKey struct {
+	Key     string       `json:"key,omitempty"` // The key to add. The production hub generates a key if not given.
+	Message string       `json:"message"`
+	Scope   *APIKeyScope `json:"scope,omitempty"`   // Without a scope, the key may post any event.
+	Expires string       `json:"expires,omitempty"` // When the key stops working, as an RFC 3339 time, a date or a relative time such as now+90d.
+	// Rate limit of the key instead of the default of the production hub.
+	RateLimit *APIKeyRateLimit `json:"rateLimit,omitempty"`
+}
+
+// ListAPIKeys lists the API keys of the production hub. The client needs an API key with the admin role.
+func (client *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+	if _, err := client.do(ctx, apiRequest{method: "GET", path: "/api/v1/admin/keys", retry: true}, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// AddAPIKey adds an API key to the production hub, generating the key unless it is given. The client needs an API key with the admin role.
+func (client *Client) AddAPIKey(ctx context.Context, newKey NewAPIKey) (*APIKey, error) {
+	body, err := json.Marshal(newKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal API key: %v", err)
+	}
+	key := APIKey{}
+	if _, err := client.do(ctx, apiRequest{method: "POST", path: "/api/v1/admin/keys", body: body}, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey removes the API key with the given id from the production hub. The client needs an API key with the admin role.
+func (client *Client) RevokeAPIKey(ctx context.Context, keyID string) error {
+	_, err := client.do(ctx, apiRequest{method: "DELETE", path: "/api/v1/admin/keys/" + url.PathEscape(keyID)}, nil)
+	return err
+}
+
+// RotateAPIKey generates a new API key with the message and scope of the key with the given id, and makes the old key
+// stop working after the grace period. The client needs an API key with the admin role.
+func (client *Client) RotateAPIKey(ctx context.Context, keyID string, grace time.Duration) (*APIKey, error) {
+	query := url.Values{}
+	query.Set("grace", grace.String())
+	key := APIKey{}
+	if _, err := client.do(ctx, apiRequest{method: "POST", path: "/api/v1/admin/keys/" + url.PathEscape(keyID) + ":rotate", query: query}, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,440 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultClientTimeout is the timeout of each request made by a Client, unless another is configured.
+	DefaultClientTimeout = 30 * time.Second
+	// DefaultClientRetryWait is the wait before a Client retries a failed request the first time.
+	DefaultClientRetryWait = time.Second
+	// MaxBatchEvents is the largest number of events mmsd accepts in one batch.
+	MaxBatchEvents = 1000
+)
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	APIKey    string        // Sent as Api-Key with requests that need it, such as posting events.
+	CAFile    string        // PEM file with the certificates of CAs to trust besides the system ones.
+	Insecure  bool          // Skip verification of the server certificate.
+	Timeout   time.Duration // Timeout of each request, DefaultClientTimeout if zero.
+	Retries   int           // Number of times a request is retried after failing with a network error or a temporary status.
+	RetryWait time.Duration // Wait before the first retry, doubled for each retry and randomly shortened by up to half. DefaultClientRetryWait if zero.
+}
+
+// Client is a client of the mmsd REST API of a production hub. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	config     ClientConfig
+	httpClient *http.Client
+}
+
+// APIError is returned by a Client when mmsd answers with an error status.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string        // The error of the HTTPServerError response, or the response body if it is not one.
+	RetryAfter time.Duration // From the Retry-After header, zero if not given.
+
+	body []byte
+}
+
+func (apiErr *APIError) Error() string {
+	return fmt.Sprintf("%s %s failed with status: %s: %s", apiErr.Method, apiErr.URL, apiErr.Status, apiErr.Message)
+}
+
+// PostResult is the answer of mmsd to a posted event.
+type PostResult struct {
+	ID        int64  `json:"id"`                  // Id of the event in the events DB of the production hub.
+	EventID   string `json:"eventId"`             // Id of the published event.
+	Duplicate bool   `json:"duplicate,omitempty"` // The event was posted before, and is not published again.
+	Error     string `json:"error,omitempty"`     // Why an event of a rejected batch is not valid.
+}
+
+// About describes a production hub, as given by GET /api/v1/about.
+type About struct {
+	Name           string        `json:"name"`
+	Description    string        `json:"description"`
+	TermsOfService string        `json:"termsOfService"`
+	Documentation  string        `json:"documentation"`
+	Provider       AboutProvider `json:"provider"`
+}
+
+// AboutProvider is the organization running a production hub.
+type AboutProvider struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// Healthz is the health of a production hub, as given by GET /api/v1/healthz.
+type Healthz struct {
+	Status      string             `json:"status"` // healthy, unhealthy or critical.
+	Description string             `json:"description"`
+	Components  []HealthzComponent `json:"components,omitempty"`
+}
+
+// HealthzComponent is the health of one dependency of a production hub, such as its NATS server.
+type HealthzComponent struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Description string `json:"description"`
+}
+
+// Healthy reports whether the production hub and all its components are healthy.
+func (healthz *Healthz) Healthy() bool {
+	return healthz.Status == "healthy"
+}
+
+// sharedHTTPClient and sharedInsecureHTTPClient are used by PostProductEvent, so posts of single events reuse the
+// connections to the production hub. The insecure one skips verification of the server certificate.
+var (
+	sharedHTTPClient         = &http.Client{Transport: newTransport(&tls.Config{}), Timeout: DefaultClientTimeout}
+	sharedInsecureHTTPClient = &http.Client{Transport: newTransport(&tls.Config{InsecureSkipVerify: true}), Timeout: DefaultClientTimeout}
+)
+
+// NewClient creates a client of the mmsd REST API at baseURL, the URL of the production hub such as https://hub.example.com.
+func NewClient(baseURL string, config ClientConfig) (*Client, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultClientTimeout
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		tlsConfig.RootCAs, err = x509.SystemCertPool()
+		if err != nil || tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+	}
+
+	return newClient(baseURL, config, &http.Client{Transport: newTransport(tlsConfig), Timeout: config.Timeout})
+}
+
+// newClient creates a client of the mmsd REST API at baseURL that sends its requests with httpClient.
+func newClient(baseURL string, config ClientConfig, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid production hub URL %q, use http(s)://host[:port]", baseURL)
+	}
+	if config.RetryWait <= 0 {
+		config.RetryWait = DefaultClientRetryWait
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		config:     config,
+		httpClient: httpClient,
+	}, nil
+}
+
+// newTransport gives a transport with the defaults of http.DefaultTransport and the given TLS configuration.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+// ListProductEventsPage gives the events matching filter. If there are more events to fetch,
+// the cursor for the next page is returned as well.
+func (client *Client) ListProductEventsPage(ctx context.Context, filter EventFilter) ([]*ProductEvent, string, error) {
+	events := []*ProductEvent{}
+	header, err := client.do(ctx, apiRequest{method: "GET", path: "/api/v1/events", query: filter.QueryValues(), retry: true}, &events)
+	if err != nil {
+		return nil, "", err
+	}
+	return events, header.Get("Next-Cursor"), nil
+}
+
+// ListProductEvents gives all events matching filter, fetching one page of filter.Limit events at a time.
+func (client *Client) ListProductEvents(ctx context.Context, filter EventFilter) ([]*ProductEvent, error) {
+	var events []*ProductEvent
+	for {
+		page, cursor, err := client.ListProductEventsPage(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+		if cursor == "" || len(page) == 0 {
+			return events, nil
+		}
+		filter.Cursor = cursor
+	}
+}
+
+// PostProductEvent posts pEvent to the production hub, which publishes it on its subject below queueName.
+// A post is only retried when pEvent has an EventID, which mmsd uses to store and publish the event just once.
+func (client *Client) PostProductEvent(ctx context.Context, queueName string, pEvent *ProductEvent) (*PostResult, error) {
+	payload, err := json.Marshal(pEvent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ProductEvent: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Queue-Name", queueName)
+	header.Set("Content-Type", "application/json")
+	if pEvent.EventID != "" {
+		header.Set("Idempotency-Key", pEvent.EventID)
+	}
+
+	result := PostResult{}
+	_, err = client.do(ctx, apiRequest{method: "POST", path: "/api/v1/events", header: header, body: payload, retry: pEvent.EventID != ""}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PostProductEvents posts a batch of at most MaxBatchEvents events to the production hub, which stores all of them
+// or none, and publishes them on their subjects below queueName. It returns the result of each event.
+// If any of the events is invalid, or may not be posted with the API key, it returns an *APIError together with the results
+// telling which events are rejected.
+// A batch is only retried when all events have an EventID.
+func (client *Client) PostProductEvents(ctx context.Context, queueName string, events []*ProductEvent) ([]PostResult, error) {
+	if len(events) > MaxBatchEvents {
+		return nil, fmt.Errorf("%d events in batch, at most %d are allowed", len(events), MaxBatchEvents)
+	}
+
+	var payload bytes.Buffer
+	retry := true
+	for _, pEvent := range events {
+		line, err := json.Marshal(pEvent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ProductEvent: %v", err)
+		}
+		payload.Write(line)
+		payload.WriteByte('\n')
+		retry = retry && pEvent.EventID != ""
+	}
+
+	header := http.Header{}
+	header.Set("Queue-Name", queueName)
+	header.Set("Content-Type", "application/x-ndjson")
+
+	response := struct {
+		Results []PostResult `json:"results"`
+	}{}
+	_, err := client.do(ctx, apiRequest{method: "POST", path: "/api/v1/events:batch", header: header, body: payload.Bytes(), retry: retry}, &response)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusForbidden) {
+		// The results tell which events are rejected.
+		json.Unmarshal(apiErr.body, &response)
+		return response.Results, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
+
+// ListProductStatus gives the status of all products known to the production hub.
+// If state is not empty, only products in that state are listed.
+func (client *Client) ListProductStatus(ctx context.Context, state ProductState) ([]ProductStatus, error) {
+	query := url.Values{}
+	if state != "" {
+		query.Set("state", string(state))
+	}
+
+	statuses := []ProductStatus{}
+	if _, err := client.do(ctx, apiRequest{method: "GET", path: "/api/v1/productstatus", query: query, retry: true}, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// GetProductStatus gives the status of a single product from a production hub,
+// which may be left empty if the product only comes from one.
+func (client *Client) GetProductStatus(ctx context.Context, productionHub string, product string) (*ProductStatus, error) {
+	query := url.Values{}
+	if productionHub != "" {
+		query.Set("productionHub", productionHub)
+	}
+
+	status := ProductStatus{}
+	request := apiRequest{method: "GET", path: "/api/v1/productstatus/" + url.PathEscape(product), query: query, retry: true}
+	if _, err := client.do(ctx, request, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// About describes the production hub.
+func (client *Client) About(ctx context.Context) (*About, error) {
+	about := About{}
+	if _, err := client.do(ctx, apiRequest{method: "GET", path: "/api/v1/about", retry: true}, &about); err != nil {
+		return nil, err
+	}
+	return &about, nil
+}
+
+// Healthz gives the health of the production hub. An unhealthy hub is not an error, see Healthz.Healthy.
+func (client *Client) Healthz(ctx context.Context) (*Healthz, error) {
+	healthz := Healthz{}
+	if _, err := client.do(ctx, apiRequest{method: "GET", path: "/api/v1/healthz", accept: []int{http.StatusServiceUnavailable}}, &healthz); err != nil {
+		return nil, err
+	}
+	return &healthz, nil
+}
+
+// apiRequest is a request made by Client.do.
+type apiRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	retry  bool  // The request may be sent again if it fails.
+	accept []int // Error statuses whose responses are decoded like successful ones.
+}
+
+// do sends req, retrying it as configured, and decodes the JSON response into v.
+// It returns the headers of the response.
+func (client *Client) do(ctx context.Context, req apiRequest, v interface{}) (http.Header, error) {
+	apiURL := client.baseURL + req.path
+	if query := req.query.Encode(); query != "" {
+		apiURL = apiURL + "?" + query
+	}
+
+	wait := client.config.RetryWait
+	for attempt := 0; ; attempt++ {
+		header, err := client.send(ctx, apiURL, req, v)
+		if err == nil || !req.retry || attempt >= client.config.Retries || !temporaryError(err) || ctx.Err() != nil {
+			return header, err
+		}
+
+		// Random jitter, so clients that failed together do not retry together.
+		retryWait := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if apiErr, ok := err.(*APIError); ok && apiErr.RetryAfter > retryWait {
+			retryWait = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(retryWait):
+		}
+		wait *= 2
+	}
+}
+
+func (client *Client) send(ctx context.Context, apiURL string, req apiRequest, v interface{}) (http.Header, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, apiURL, bytes.NewReader(req.body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if client.config.APIKey != "" {
+		httpReq.Header.Set("Api-Key", client.config.APIKey)
+	}
+
+	httpResp, err := client.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response to %s %s: %w", req.method, apiURL, err)
+	}
+
+	if !statusOK(httpResp.StatusCode, req.accept) {
+		return nil, newAPIError(req.method, apiURL, httpResp, body)
+	}
+
+	if v != nil && len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, v); err != nil {
+			return nil, fmt.Errorf("failed to decode response to %s %s: %v", req.method, apiURL, err)
+		}
+	}
+	return httpResp.Header, nil
+}
+
+func statusOK(statusCode int, accept []int) bool {
+	if statusCode >= 200 && statusCode < 300 {
+		return true
+	}
+	for _, accepted := range accept {
+		if statusCode == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+func newAPIError(method string, apiURL string, httpResp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		Method:     method,
+		URL:        apiURL,
+		StatusCode: httpResp.StatusCode,
+		Status:     httpResp.Status,
+		Message:    strings.TrimSpace(string(body)),
+		body:       body,
+	}
+
+	serverErr := struct {
+		ErrMsg string `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &serverErr); err == nil && serverErr.ErrMsg != "" {
+		apiErr.Message = serverErr.ErrMsg
+	}
+
+	if seconds, err := strconv.Atoi(httpResp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// temporaryError reports whether a request failing with err may succeed if it is sent again.
+func temporaryError(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// Errors sending the request or reading the response, such as a refused connection or a timeout.
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc, config ClientConfig) *Client {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	client, err := NewClient(ts.URL, config)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return client
+}
+
+func TestNewClientInvalidURL(t *testing.T) {
+	for _, baseURL := range []string{"", "localhost:8080", "nats://localhost:4222", "http://"} {
+		if _, err := NewClient(baseURL, ClientConfig{}); err == nil {
+			t.Errorf("Expected an error for %q", baseURL)
+		}
+	}
+}
+
+func TestClientListProductEvents(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/events" || r.URL.Query().Get("product") != "arome_*" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("cursor") == "" {
+			w.Header().Set("Next-Cursor", "next")
+			json.NewEncoder(w).Encode([]*ProductEvent{{Product: "arome_arctic"}})
+			return
+		}
+		json.NewEncoder(w).Encode([]*ProductEvent{{Product: "arome_norway"}})
+	}, ClientConfig{})
+
+	events, err := client.ListProductEvents(context.Background(), EventFilter{Product: "arome_*", Limit: 1})
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	if len(events) != 2 || events[0].Product != "arome_arctic" || events[1].Product != "arome_norway" {
+		t.Errorf("Expected the events of both pages; Got %v", events)
+	}
+}
+
+func TestClientPostProductEvent(t *testing.T) {
+	var header http.Header
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"id": 42, "eventId": "test-id"}`))
+	}, ClientConfig{APIKey: "test-key"})
+
+	result, err := client.PostProductEvent(context.Background(), "mms", &ProductEvent{ProductionHub: "test-hub", Product: "test", EventID: "test-id"})
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	if result.ID != 42 || result.EventID != "test-id" || result.Duplicate {
+		t.Errorf("Expected event 42 to be accepted; Got %+v", result)
+	}
+	if header.Get("Api-Key") != "test-key" || header.Get("Queue-Name") != "mms" || header.Get("Idempotency-Key") != "test-id" {
+		t.Errorf("Expected the api key, queue name and idempotency key in the request; Got %v", header)
+	}
+}
+
+func TestClientAPIError(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "Unauthorized API key submitted"}`))
+	}, ClientConfig{Retries: 2, RetryWait: time.Millisecond})
+
+	_, err := client.PostProductEvent(context.Background(), "mms", &ProductEvent{ProductionHub: "test-hub", EventID: "test-id"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected an APIError; Got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "Unauthorized API key submitted" {
+		t.Errorf("Expected 401 with the error of the server; Got %+v", apiErr)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	requests := 0
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, ClientConfig{Retries: 2, RetryWait: time.Millisecond})
+
+	if _, err := client.ListProductStatus(context.Background(), ""); err != nil || requests != 3 {
+		t.Errorf("Expected success after 2 retries; Got %d requests, %v", requests, err)
+	}
+
+	// Posting without an event id is not retried, as the event could be stored twice.
+	requests = 0
+	if _, err := client.PostProductEvent(context.Background(), "mms", &ProductEvent{ProductionHub: "test-hub"}); err == nil || requests != 1 {
+		t.Errorf("Expected a single failed post; Got %d requests, %v", requests, err)
+	}
+
+	requests = 0
+	if _, err := client.PostProductEvent(context.Background(), "mms", &ProductEvent{ProductionHub: "test-hub", EventID: "test-id"}); err != nil || requests != 3 {
+		t.Errorf("Expected the post with an event id to succeed after 2 retries; Got %d requests, %v", requests, err)
+	}
+}
+
+func TestClientHealthz(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status": "critical", "description": "Components not ok: nats.", "components": [{"name": "nats", "status": "critical"}]}`))
+	}, ClientConfig{})
+
+	healthz, err := client.Healthz(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors for an unhealthy hub; Got %s", err)
+	}
+	if healthz.Healthy() || healthz.Status != "critical" || len(healthz.Components) != 1 {
+		t.Errorf("Expected a critical hub; Got %+v", healthz)
+	}
+}
+
+func TestClientCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "MMSd REST API"}`))
+	}))
+	defer ts.Close()
+
+	if client, _ := NewClient(ts.URL, ClientConfig{}); client != nil {
+		if _, err := client.About(context.Background()); err == nil {
+			t.Errorf("Expected an error for an unknown CA")
+		}
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err)
+	}
+	client, err := NewClient(ts.URL, ClientConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	about, err := client.About(context.Background())
+	if err != nil || about.Name != "MMSd REST API" {
+		t.Errorf("Expected the about of the hub; Got %+v, %v", about, err)
+	}
+}
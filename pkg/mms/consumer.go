@@ -0,0 +1,395 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	jsnats "github.com/cloudevents/sdk-go/protocol/nats_jetstream/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/nats-io/nats.go"
+)
+
+// StartPolicy tells where a new JetStream consumer starts reading the stream of events.
+type StartPolicy string
+
+const (
+	// StartAll delivers every event kept in the stream.
+	StartAll StartPolicy = "all"
+	// StartNew only delivers events published after the consumer was created.
+	StartNew StartPolicy = "new"
+	// StartAtTime delivers the events published at or after ConsumerConfig.StartTime.
+	StartAtTime StartPolicy = "time"
+	// StartAtSequence delivers the events from stream sequence number ConsumerConfig.StartSequence.
+	StartAtSequence StartPolicy = "sequence"
+	// StartLastPerSubject delivers the last event of each subject, then the new ones.
+	StartLastPerSubject StartPolicy = "last-per-subject"
+)
+
+// DefaultReplayPeriod is how far back a consumer without a start policy begins.
+const DefaultReplayPeriod = 12 * time.Hour
+
+// DefaultMaxDeliver is how many times an event is delivered to a failing callback before it is dead-lettered.
+const DefaultMaxDeliver = 5
+
+// DefaultDeadLetterSubject is where events are republished when the callback has failed DefaultMaxDeliver times.
+const DefaultDeadLetterSubject = "mms-dlq"
+
+// DefaultBackoff is the time to wait before delivering an event again after the callback failed, for each failed delivery.
+// The last one is used for any later deliveries.
+var DefaultBackoff = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+const (
+	consumerFetchBatch   = 10
+	consumerFetchTimeout = 5 * time.Second
+	// consumerInactiveThreshold is how long the server keeps an ephemeral consumer after its subscriber is gone.
+	consumerInactiveThreshold = 5 * time.Minute
+	// consumerDefaultAckWait is the AckWait of consumers created without one, as set by the server.
+	consumerDefaultAckWait = 30 * time.Second
+)
+
+// ConsumerConfig configures how events are consumed from the JetStream stream of a production hub.
+type ConsumerConfig struct {
+	// Durable is the name of a durable consumer. The server remembers which events it has acknowledged,
+	// so a restarted subscriber continues where it stopped. If empty, the consumer ends with the subscription.
+	Durable string
+	// Start is where a new consumer starts reading. Existing durable consumers always continue where they are.
+	// If empty, the consumer starts DefaultReplayPeriod ago.
+	Start         StartPolicy
+	StartTime     time.Time
+	StartSequence uint64
+	// AckWait is how long the server waits for an event to be acknowledged before delivering it again.
+	// Events are kept in progress while the callback handles them, so it only limits how long a stuck subscriber holds them.
+	AckWait time.Duration
+	// MaxDeliver is how many times an event is delivered before it is republished to DeadLetterSubject.
+	// Zero means DefaultMaxDeliver, and -1 redelivers forever.
+	MaxDeliver int
+	// DeadLetterSubject is the subject for events the callback failed to handle. Empty means DefaultDeadLetterSubject.
+	DeadLetterSubject string
+	// Backoff is the delay before each redelivery after a failed callback. Nil means DefaultBackoff.
+	Backoff []time.Duration
+}
+
+func (config ConsumerConfig) maxDeliver() int {
+	if config.MaxDeliver == 0 {
+		return DefaultMaxDeliver
+	}
+	return config.MaxDeliver
+}
+
+func (config ConsumerConfig) deadLetterSubject() string {
+	if config.DeadLetterSubject == "" {
+		return DefaultDeadLetterSubject
+	}
+	return config.DeadLetterSubject
+}
+
+// backoff gives the delay before the next delivery after the given number of failed deliveries.
+func (config ConsumerConfig) backoff(deliveries int) time.Duration {
+	backoff := config.Backoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+	if len(backoff) == 0 {
+		return 0
+	}
+	if deliveries > len(backoff) {
+		deliveries = len(backoff)
+	}
+	if deliveries < 1 {
+		deliveries = 1
+	}
+	return backoff[deliveries-1]
+}
+
+// SetStart sets the start policy of config from a string: all, new, last-per-subject,
+// a stream sequence number, an RFC3339 time, or a duration back in time such as 12h.
+func (config *ConsumerConfig) SetStart(value string) error {
+	switch value {
+	case "":
+		config.Start = ""
+	case string(StartAll), string(StartNew), string(StartLastPerSubject):
+		config.Start = StartPolicy(value)
+	default:
+		if seq, err := strconv.ParseUint(value, 10, 64); err == nil {
+			config.Start = StartAtSequence
+			config.StartSequence = seq
+		} else if t, err := ParseTime(value); err == nil {
+			config.Start = StartAtTime
+			config.StartTime = t
+		} else if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			config.Start = StartAtTime
+			config.StartTime = time.Now().Add(-d)
+		} else {
+			return fmt.Errorf("invalid start %q, use all, new, last-per-subject, a sequence number, an RFC3339 time or a duration", value)
+		}
+	}
+	return nil
+}
+
+// subscribeOptions translates the config to options for a new consumer on the stream.
+func (config ConsumerConfig) subscribeOptions() ([]nats.SubOpt, error) {
+	opts := []nats.SubOpt{
+		nats.BindStream(ProductStream),
+		nats.AckExplicit(),
+		nats.MaxDeliver(config.maxDeliver()),
+	}
+	if config.AckWait > 0 {
+		opts = append(opts, nats.AckWait(config.AckWait))
+	}
+	if config.Durable == "" {
+		opts = append(opts, nats.InactiveThreshold(consumerInactiveThreshold))
+	}
+
+	switch config.Start {
+	case "":
+		opts = append(opts, nats.StartTime(time.Now().Add(-DefaultReplayPeriod)))
+	case StartAll:
+		opts = append(opts, nats.DeliverAll())
+	case StartNew:
+		opts = append(opts, nats.DeliverNew())
+	case StartAtTime:
+		opts = append(opts, nats.StartTime(config.StartTime))
+	case StartAtSequence:
+		opts = append(opts, nats.StartSequence(config.StartSequence))
+	case StartLastPerSubject:
+		opts = append(opts, nats.DeliverLastPerSubject())
+	default:
+		return nil, fmt.Errorf("unknown start policy %q", config.Start)
+	}
+
+	return opts, nil
+}
+
+// jetStreamConsumer pulls events from a JetStream consumer and acknowledges each of them once it is handled.
+type jetStreamConsumer struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	sub    *nats.Subscription
+	config ConsumerConfig
+	// progressInterval is how often the server is told that fetched events are still being handled, half the AckWait.
+	progressInterval time.Duration
+}
+
+// newJetStreamConsumer connects to natsURL and subscribes to queueName in the ProductStream stream.
+// An existing durable consumer is resumed as it is, otherwise a new consumer is created from config.
+func newJetStreamConsumer(natsURL string, natsCredentials nats.Option, queueName string, config ConsumerConfig) (*jetStreamConsumer, error) {
+	conn, err := nats.Connect(natsURL, natsCredentials, nats.Name("mms-consumer"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get JetStream context: %v", err)
+	}
+
+	sub, err := pullSubscribe(js, queueName, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s in stream %s: %v", queueName, ProductStream, err)
+	}
+
+	// A resumed durable consumer keeps the AckWait it was created with.
+	ackWait := config.AckWait
+	if info, err := sub.ConsumerInfo(); err == nil && info.Config.AckWait > 0 {
+		ackWait = info.Config.AckWait
+	}
+	if ackWait <= 0 {
+		ackWait = consumerDefaultAckWait
+	}
+
+	return &jetStreamConsumer{conn: conn, js: js, sub: sub, config: config, progressInterval: ackWait / 2}, nil
+}
+
+func pullSubscribe(js nats.JetStreamContext, queueName string, config ConsumerConfig) (*nats.Subscription, error) {
+	if config.Durable != "" {
+		_, err := js.ConsumerInfo(ProductStream, config.Durable)
+		if err == nil {
+			return js.PullSubscribe(queueName, config.Durable, nats.Bind(ProductStream, config.Durable))
+		}
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return nil, fmt.Errorf("failed to look up consumer %s: %v", config.Durable, err)
+		}
+	}
+
+	opts, err := config.subscribeOptions()
+	if err != nil {
+		return nil, err
+	}
+	return js.PullSubscribe(queueName, config.Durable, opts...)
+}
+
+// receive calls callback for every product event until ctx is cancelled or the connection is closed.
+// Events are acknowledged when callback succeeds; otherwise they are delivered again after a backoff,
+// until they are dead-lettered.
+func (c *jetStreamConsumer) receive(ctx context.Context, callback ProductEventCallback) error {
+	receiver := productReceiver(callback)
+
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, consumerFetchTimeout)
+		msgs, err := c.sub.Fetch(consumerFetchBatch, nats.Context(fetchCtx))
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, nats.ErrTimeout) {
+			if c.conn.IsClosed() {
+				return fmt.Errorf("failed to fetch events: %v", err)
+			}
+			// Probably reconnecting, the consumer is still there when the connection is back.
+			log.Printf("failed to fetch events, retrying: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if !c.handleBatch(ctx, msgs, receiver) {
+			return nil
+		}
+	}
+}
+
+// handleBatch handles fetched events in order, and gives false if ctx is cancelled before they are all handled.
+// Until then, the events not handled yet are kept in progress, so a slow callback does not get them delivered again.
+func (c *jetStreamConsumer) handleBatch(ctx context.Context, msgs []*nats.Msg, receiver func(context.Context, cloudevents.Event) error) bool {
+	var next int32
+	stop := c.keepInProgress(msgs, &next)
+	defer stop()
+
+	for i, msg := range msgs {
+		atomic.StoreInt32(&next, int32(i))
+		// Events not handled yet are delivered again to the next subscriber.
+		if ctx.Err() != nil {
+			return false
+		}
+		event, err := binding.ToEvent(ctx, jsnats.NewMessage(msg))
+		if err != nil {
+			// It will never decode, so do not get it again.
+			log.Printf("failed to decode event, dropping it: %v", err)
+			msg.Term()
+			continue
+		}
+
+		if err := receiver(ctx, *event); err != nil {
+			c.retryOrDeadLetter(msg, event.ID(), err)
+			continue
+		}
+		if err := msg.AckSync(); err != nil {
+			log.Printf("failed to acknowledge event %s: %v", event.ID(), err)
+		}
+	}
+	return true
+}
+
+// keepInProgress tells the server every progressInterval that msgs from index next on are still being handled,
+// which resets their AckWait, until stop is called.
+func (c *jetStreamConsumer) keepInProgress(msgs []*nats.Msg, next *int32) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(c.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for _, msg := range msgs[atomic.LoadInt32(next):] {
+				// Events handled in the meantime are already acknowledged, and refuse it.
+				msg.InProgress()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// retryOrDeadLetter asks for the event to be delivered again after a backoff,
+// or republishes it to the dead-letter subject if it has been delivered MaxDeliver times.
+func (c *jetStreamConsumer) retryOrDeadLetter(msg *nats.Msg, eventID string, cause error) {
+	deliveries := 1
+	meta, err := msg.Metadata()
+	if err == nil {
+		deliveries = int(meta.NumDelivered)
+	}
+
+	maxDeliver := c.config.maxDeliver()
+	if maxDeliver < 0 || deliveries < maxDeliver {
+		delay := c.config.backoff(deliveries)
+		log.Printf("failed to handle event %s in delivery %d, delivering it again in %s: %v", eventID, deliveries, delay, cause)
+		if err := msg.NakWithDelay(delay); err != nil {
+			log.Printf("failed to nak event %s: %v", eventID, err)
+		}
+		return
+	}
+
+	if err := c.deadLetter(msg, meta, deliveries, cause); err != nil {
+		// The server does not deliver it again either, so this is the last trace of it.
+		log.Printf("failed to handle event %s in delivery %d, and failed to dead-letter it: %v: %v", eventID, deliveries, cause, err)
+		return
+	}
+	log.Printf("failed to handle event %s in delivery %d, moved it to %s: %v", eventID, deliveries, c.config.deadLetterSubject(), cause)
+	if err := msg.Term(); err != nil {
+		log.Printf("failed to terminate event %s: %v", eventID, err)
+	}
+}
+
+// deadLetter republishes msg to the dead-letter subject, with the reason it failed in the headers.
+func (c *jetStreamConsumer) deadLetter(msg *nats.Msg, meta *nats.MsgMetadata, deliveries int, cause error) error {
+	dlqMsg := nats.NewMsg(c.config.deadLetterSubject())
+	dlqMsg.Data = msg.Data
+	for key, values := range msg.Header {
+		dlqMsg.Header[key] = values
+	}
+	// The dead letter is a new message, and must not be deduplicated against the original.
+	dlqMsg.Header.Del(nats.MsgIdHdr)
+
+	dlqMsg.Header.Set(DeadLetterErrorHeader, cause.Error())
+	dlqMsg.Header.Set(DeadLetterSubjectHeader, msg.Subject)
+	dlqMsg.Header.Set(DeadLetterDeliveriesHeader, strconv.Itoa(deliveries))
+	if meta != nil {
+		dlqMsg.Header.Set(DeadLetterConsumerHeader, meta.Consumer)
+		dlqMsg.Header.Set(DeadLetterSequenceHeader, strconv.FormatUint(meta.Sequence.Stream, 10))
+	}
+
+	if _, err := c.js.PublishMsg(dlqMsg); err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", dlqMsg.Subject, err)
+	}
+	return nil
+}
+
+// Close closes the NATS connection. Durable consumers are kept on the server.
+func (c *jetStreamConsumer) Close(ctx context.Context) error {
+	c.conn.Close()
+	return nil
+}
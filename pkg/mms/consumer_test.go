@@ -0,0 +1,249 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestConsumerConfigSetStart(t *testing.T) {
+	startTime := time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC)
+
+	for value, expected := range map[string]ConsumerConfig{
+		"":                     {},
+		"all":                  {Start: StartAll},
+		"new":                  {Start: StartNew},
+		"last-per-subject":     {Start: StartLastPerSubject},
+		"42":                   {Start: StartAtSequence, StartSequence: 42},
+		"2021-03-01T06:00:00Z": {Start: StartAtTime, StartTime: startTime},
+	} {
+		config := ConsumerConfig{}
+		if err := config.SetStart(value); err != nil {
+			t.Errorf("Expected no errors for %q; Got %s", value, err)
+		}
+		if !config.StartTime.Equal(expected.StartTime) || config.Start != expected.Start || config.StartSequence != expected.StartSequence {
+			t.Errorf("Expected %+v for %q; Got %+v", expected, value, config)
+		}
+	}
+
+	config := ConsumerConfig{}
+	if err := config.SetStart("2h"); err != nil || config.Start != StartAtTime || time.Since(config.StartTime) < 2*time.Hour {
+		t.Errorf("Expected a start time two hours ago; Got %+v, %v", config, err)
+	}
+	if err := config.SetStart("yesterday"); err == nil {
+		t.Errorf("Expected an error for an invalid start")
+	}
+}
+
+// runTestStream creates the product stream on a test server and returns a function publishing test events to it.
+func runTestStream(t *testing.T) (*natsserver.Server, func(product string)) {
+	natsServer := runTestNatsServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	t.Cleanup(conn.Close)
+	js, _ := conn.JetStream()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: ProductStream, Subjects: []string{"mms.>", DefaultDeadLetterSubject}}); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, ProductStream, nil)
+	if err != nil {
+		t.Fatalf("failed to create publisher: %s", err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+
+	return natsServer, func(product string) {
+		if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: product}, "mms"); err != nil {
+			t.Fatalf("failed to publish: %s", err)
+		}
+	}
+}
+
+// receiveProducts subscribes with config until n events are received, then closes the subscription.
+func receiveProducts(t *testing.T, natsURL string, config ConsumerConfig, n int, callback ProductEventCallback) []string {
+	eClient, err := NewNatsConsumerClient(natsURL, nil, "mms.>", true, config)
+	if err != nil {
+		t.Fatalf("failed to create consumer: %s", err)
+	}
+
+	received := make(chan string, 10)
+	sub, err := eClient.Subscribe(context.Background(), func(e *ProductEvent) error {
+		if callback != nil {
+			if err := callback(e); err != nil {
+				return err
+			}
+		}
+		received <- e.Product
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	// Drain, so the last event is acknowledged before the connection is closed.
+	defer sub.Drain(context.Background())
+
+	var products []string
+	for len(products) < n {
+		select {
+		case product := <-received:
+			products = append(products, product)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d events; Got %v", n, products)
+		}
+	}
+	return products
+}
+
+func TestDurableConsumer(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+	publish("b")
+
+	config := ConsumerConfig{Durable: "test-durable", Start: StartAll}
+	if products := receiveProducts(t, natsServer.ClientURL(), config, 2, nil); fmt.Sprint(products) != "[a b]" {
+		t.Errorf("Expected [a b]; Got %v", products)
+	}
+
+	// A restarted durable consumer continues after the acknowledged events.
+	publish("c")
+	if products := receiveProducts(t, natsServer.ClientURL(), config, 1, nil); fmt.Sprint(products) != "[c]" {
+		t.Errorf("Expected [c]; Got %v", products)
+	}
+}
+
+func TestConsumerStartPolicies(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+	publish("b")
+
+	if products := receiveProducts(t, natsServer.ClientURL(), ConsumerConfig{Start: StartAtSequence, StartSequence: 2}, 1, nil); products[0] != "b" {
+		t.Errorf("Expected b from sequence 2; Got %v", products)
+	}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		publish("c")
+	}()
+	if products := receiveProducts(t, natsServer.ClientURL(), ConsumerConfig{Start: StartNew}, 1, nil); products[0] != "c" {
+		t.Errorf("Expected only the new event c; Got %v", products)
+	}
+}
+
+func TestConsumerRedeliversFailedEvents(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+
+	failures := 0
+	failOnce := func(e *ProductEvent) error {
+		if failures == 0 {
+			failures++
+			return fmt.Errorf("failed to handle %s", e.Product)
+		}
+		return nil
+	}
+	config := ConsumerConfig{Start: StartAll, Backoff: []time.Duration{100 * time.Millisecond}}
+	if products := receiveProducts(t, natsServer.ClientURL(), config, 1, failOnce); products[0] != "a" || failures != 1 {
+		t.Errorf("Expected a to be delivered again after failing once; Got %v after %d failures", products, failures)
+	}
+}
+
+func TestConsumerKeepsSlowEventsInProgress(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+	publish("b")
+
+	// Another subscriber of the durable consumer would get a, and b fetched with it, when handling a takes longer than the AckWait.
+	config := ConsumerConfig{Durable: "test-slow", Start: StartAll, AckWait: time.Second}
+	slow := func(e *ProductEvent) error {
+		if e.Product == "a" {
+			time.Sleep(2500 * time.Millisecond)
+		}
+		return nil
+	}
+	done := make(chan []string)
+	go func() {
+		done <- receiveProducts(t, natsServer.ClientURL(), config, 2, slow)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	other, err := NewNatsConsumerClient(natsServer.ClientURL(), nil, "mms.>", true, config)
+	if err != nil {
+		t.Fatalf("failed to create consumer: %s", err)
+	}
+	redelivered := make(chan string, 10)
+	sub, err := other.Subscribe(context.Background(), func(e *ProductEvent) error {
+		redelivered <- e.Product
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer sub.Drain(context.Background())
+
+	if products := <-done; fmt.Sprint(products) != "[a b]" {
+		t.Errorf("Expected [a b]; Got %v", products)
+	}
+	select {
+	case product := <-redelivered:
+		t.Errorf("Expected no events to be delivered again while in progress; Got %s", product)
+	default:
+	}
+}
+
+func TestConsumerFiltersOnSubject(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+	publish("b")
+	publish("a")
+
+	eClient, err := NewNatsConsumerClient(natsServer.ClientURL(), nil, SubscriptionSubject("mms", "test-hub", "b"), true, ConsumerConfig{Start: StartAll})
+	if err != nil {
+		t.Fatalf("failed to create consumer: %s", err)
+	}
+	received := make(chan string, 10)
+	sub, err := eClient.Subscribe(context.Background(), func(e *ProductEvent) error {
+		received <- e.Product
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer sub.Drain(context.Background())
+
+	select {
+	case product := <-received:
+		if product != "b" {
+			t.Errorf("Expected only b; Got %s", product)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected b")
+	}
+	select {
+	case product := <-received:
+		t.Errorf("Expected only b; Got %s as well", product)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
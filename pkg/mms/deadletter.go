@@ -0,0 +1,188 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	jsnats "github.com/cloudevents/sdk-go/protocol/nats_jetstream/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/nats-io/nats.go"
+)
+
+// Headers added to events republished to the dead-letter subject.
+const (
+	DeadLetterErrorHeader      = "Mms-Dlq-Error"      // Error returned by the last failed callback.
+	DeadLetterSubjectHeader    = "Mms-Dlq-Subject"    // Subject the event was originally published on.
+	DeadLetterDeliveriesHeader = "Mms-Dlq-Deliveries" // Number of times the event was delivered.
+	DeadLetterConsumerHeader   = "Mms-Dlq-Consumer"   // Consumer that failed to handle the event.
+	DeadLetterSequenceHeader   = "Mms-Dlq-Sequence"   // Stream sequence number of the original event.
+)
+
+const deadLetterFetchWait = time.Second
+
+// DeadLetter is an event that could not be handled by a subscriber and was moved to the dead-letter subject.
+type DeadLetter struct {
+	Sequence   uint64 // Stream sequence number of the dead letter, used to replay it.
+	Time       time.Time
+	Subject    string // Subject the event was originally published on.
+	Consumer   string
+	Deliveries int
+	Error      string
+	Event      *ProductEvent // Nil if the event is not a product event.
+
+	msg *nats.Msg
+}
+
+// ListDeadLetters returns the dead letters kept in the ProductStream stream on the NATS server at natsURL.
+// If deadLetterSubject is empty, DefaultDeadLetterSubject is used.
+func ListDeadLetters(natsURL string, natsCredentials nats.Option, deadLetterSubject string) ([]*DeadLetter, error) {
+	if deadLetterSubject == "" {
+		deadLetterSubject = DefaultDeadLetterSubject
+	}
+
+	conn, err := nats.Connect(natsURL, natsCredentials, nats.Name("mms-dlq"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %v", err)
+	}
+
+	return fetchDeadLetters(js, deadLetterSubject)
+}
+
+// ReplayDeadLetters republishes dead letters to the subjects they were originally published on,
+// so subscribers get them again. Only the dead letters with the given sequence numbers are replayed, or all if there are none.
+// The dead letters stay in the dead-letter subject until the stream removes them. It returns the replayed dead letters.
+func ReplayDeadLetters(natsURL string, natsCredentials nats.Option, deadLetterSubject string, sequences []uint64) ([]*DeadLetter, error) {
+	if deadLetterSubject == "" {
+		deadLetterSubject = DefaultDeadLetterSubject
+	}
+
+	conn, err := nats.Connect(natsURL, natsCredentials, nats.Name("mms-dlq"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %v", err)
+	}
+
+	deadLetters, err := fetchDeadLetters(js, deadLetterSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[uint64]bool{}
+	for _, seq := range sequences {
+		wanted[seq] = true
+	}
+
+	var replayed []*DeadLetter
+	for _, dl := range deadLetters {
+		if len(wanted) > 0 && !wanted[dl.Sequence] {
+			continue
+		}
+		if dl.Subject == "" {
+			return replayed, fmt.Errorf("dead letter %d has no original subject", dl.Sequence)
+		}
+
+		msg := nats.NewMsg(dl.Subject)
+		msg.Data = dl.msg.Data
+		for key, values := range dl.msg.Header {
+			if !strings.HasPrefix(key, "Mms-Dlq-") {
+				msg.Header[key] = values
+			}
+		}
+		if _, err := js.PublishMsg(msg); err != nil {
+			return replayed, fmt.Errorf("failed to replay dead letter %d to %s: %v", dl.Sequence, dl.Subject, err)
+		}
+		replayed = append(replayed, dl)
+	}
+
+	return replayed, nil
+}
+
+// fetchDeadLetters reads all messages on the dead-letter subject with a temporary consumer.
+func fetchDeadLetters(js nats.JetStreamContext, deadLetterSubject string) ([]*DeadLetter, error) {
+	sub, err := js.PullSubscribe(deadLetterSubject, "",
+		nats.BindStream(ProductStream),
+		nats.DeliverAll(),
+		nats.AckNone(),
+		nats.InactiveThreshold(consumerInactiveThreshold),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s in stream %s: %v", deadLetterSubject, ProductStream, err)
+	}
+	defer sub.Unsubscribe()
+
+	var deadLetters []*DeadLetter
+	for {
+		msgs, err := sub.Fetch(consumerFetchBatch, nats.MaxWait(deadLetterFetchWait))
+		if errors.Is(err, nats.ErrTimeout) {
+			return deadLetters, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch dead letters: %v", err)
+		}
+
+		var pending uint64
+		for _, msg := range msgs {
+			dl := newDeadLetter(msg)
+			if meta, err := msg.Metadata(); err == nil {
+				dl.Sequence = meta.Sequence.Stream
+				dl.Time = meta.Timestamp
+				pending = meta.NumPending
+			}
+			deadLetters = append(deadLetters, dl)
+		}
+		if pending == 0 {
+			return deadLetters, nil
+		}
+	}
+}
+
+func newDeadLetter(msg *nats.Msg) *DeadLetter {
+	dl := &DeadLetter{
+		Subject:  msg.Header.Get(DeadLetterSubjectHeader),
+		Consumer: msg.Header.Get(DeadLetterConsumerHeader),
+		Error:    msg.Header.Get(DeadLetterErrorHeader),
+		msg:      msg,
+	}
+	dl.Deliveries, _ = strconv.Atoi(msg.Header.Get(DeadLetterDeliveriesHeader))
+
+	event, err := binding.ToEvent(context.Background(), jsnats.NewMessage(msg))
+	if err == nil && isProductEventType(event.Type()) {
+		pEvent := ProductEvent{}
+		if err := event.DataAs(&pEvent); err == nil {
+			dl.Event = &pEvent
+		}
+	}
+
+	return dl
+}
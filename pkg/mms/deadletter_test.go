@@ -0,0 +1,103 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestConsumerBackoff(t *testing.T) {
+	config := ConsumerConfig{}
+	for deliveries, expected := range map[int]time.Duration{
+		0:  5 * time.Second,
+		1:  5 * time.Second,
+		2:  30 * time.Second,
+		4:  10 * time.Minute,
+		10: 10 * time.Minute,
+	} {
+		if backoff := config.backoff(deliveries); backoff != expected {
+			t.Errorf("Expected backoff %s after %d deliveries; Got %s", expected, deliveries, backoff)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	natsServer, publish := runTestStream(t)
+	publish("a")
+
+	eClient, err := NewNatsConsumerClient(natsServer.ClientURL(), nil, "mms.>", true,
+		ConsumerConfig{Start: StartAll, MaxDeliver: 2, Backoff: []time.Duration{10 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("failed to create consumer: %s", err)
+	}
+	failures := make(chan string, 10)
+	sub, err := eClient.Subscribe(context.Background(), func(e *ProductEvent) error {
+		failures <- e.Product
+		return fmt.Errorf("failed to handle %s", e.Product)
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-failures:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 deliveries; Got %d", i)
+		}
+	}
+
+	var deadLetters []*DeadLetter
+	for start := time.Now(); len(deadLetters) == 0 && time.Since(start) < 5*time.Second; {
+		deadLetters, err = ListDeadLetters(natsServer.ClientURL(), nil, "")
+		if err != nil {
+			t.Fatalf("failed to list dead letters: %s", err)
+		}
+	}
+	sub.Drain(context.Background())
+	if len(deadLetters) != 1 {
+		t.Fatalf("Expected 1 dead letter; Got %d", len(deadLetters))
+	}
+	dl := deadLetters[0]
+	if dl.Subject != "mms.test-hub.a" || dl.Deliveries != 2 || dl.Error != "failed to handle a" || dl.Event == nil || dl.Event.Product != "a" {
+		t.Errorf("Expected the dead letter of a after 2 deliveries; Got %+v", dl)
+	}
+	select {
+	case product := <-failures:
+		t.Errorf("Expected no more deliveries after max deliver; Got %s", product)
+	default:
+	}
+
+	replayed, err := ReplayDeadLetters(natsServer.ClientURL(), nil, "", []uint64{dl.Sequence})
+	if err != nil || len(replayed) != 1 {
+		t.Fatalf("Expected 1 replayed dead letter; Got %v, %v", replayed, err)
+	}
+	if products := receiveProducts(t, natsServer.ClientURL(), ConsumerConfig{Start: StartAtSequence, StartSequence: dl.Sequence + 1}, 1, nil); products[0] != "a" {
+		t.Errorf("Expected a to be replayed on mms.test-hub.a; Got %v", products)
+	}
+
+	conn, _ := nats.Connect(natsServer.ClientURL())
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	if info, err := js.StreamInfo(ProductStream); err != nil || info.State.Msgs != 3 {
+		t.Errorf("Expected the event, its dead letter and the replay in the stream; Got %v, %v", info, err)
+	}
+}
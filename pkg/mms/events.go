@@ -17,39 +17,46 @@ limitations under the License.
 package mms
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/user"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	cenats "github.com/cloudevents/sdk-go/protocol/nats/v2"
 	jsnats "github.com/cloudevents/sdk-go/protocol/nats_jetstream/v2"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 )
 
-// convert the time to UTC and Format to a default time format
-
+// PEventTime is a time that is formatted in UTC with FormatTime and parsed with ParseTime.
 type PEventTime time.Time
 
 const DefaultTimeFormat = "2006-01-02T15:04:05Z"
 
 func (pt PEventTime) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf("\"%s\"", time.Time(pt).UTC().Format(DefaultTimeFormat))), nil
+	return []byte(fmt.Sprintf("\"%s\"", FormatTime(time.Time(pt)))), nil
+}
+
+// MarshalEnvironmentValue formats the time like MarshalJSON for environment variables.
+func (pt PEventTime) MarshalEnvironmentValue() (string, error) {
+	return FormatTime(time.Time(pt)), nil
 }
 
 func (pt *PEventTime) UnmarshalJSON(b []byte) error {
 	timeString := strings.Trim(string(b), `"`)
-	t, err := time.Parse(DefaultTimeFormat, timeString)
+	t, err := ParseTime(timeString)
 
 	if err != nil {
 		return fmt.Errorf("invalid date format: %s", timeString)
@@ -74,7 +81,102 @@ type ProductEvent struct {
 	RefTime         PEventTime `env:"MMS_PRODUCT_EVENT_REF_TIME"`      // Reference time
 	CreatedAt       PEventTime `env:"MMS_PRODUCT_EVENT_CREATED_AT"`    // timestamp of the produced file (object)
 	NextEventAt     PEventTime `env:"MMS_PRODUCT_EVENT_NEXT_EVENT_AT"` // timestamp of the next event
+	// Unique id of the event. Events with the same id are only stored and delivered once.
+	// If empty, mmsd gives the event a random id. See DeterministicID for an id that is the same when an event is posted again.
+	EventID string `json:",omitempty" env:"MMS_PRODUCT_EVENT_ID"`
+
+	// Optional fields, sent as ProductEventTypeV2 events when any of them is set.
+	Checksum  string    `json:",omitempty" env:"MMS_PRODUCT_EVENT_CHECKSUM"`   // <algorithm>:<hex digest>, e.g. sha256:9f86d0...
+	Size      int64     `json:",omitempty" env:"MMS_PRODUCT_EVENT_SIZE"`       // Size of the product in bytes
+	MediaType string    `json:",omitempty" env:"MMS_PRODUCT_EVENT_MEDIA_TYPE"` // e.g. application/x-netcdf
+	Coverage  *Coverage `json:",omitempty"`
+	// Free-form key/values, given to commands as MMS_PRODUCT_EVENT_ATTRIBUTE_<KEY> and as JSON in MMS_PRODUCT_EVENT_ATTRIBUTES.
+	Attributes map[string]string `json:",omitempty"`
+}
+
+// Coverage is the geographic and time extent of the data in a product.
+type Coverage struct {
+	BoundingBox *BoundingBox `json:",omitempty" env:"MMS_PRODUCT_EVENT_COVERAGE_BBOX"`
+	Start       *PEventTime  `json:",omitempty" env:"MMS_PRODUCT_EVENT_COVERAGE_START"`
+	End         *PEventTime  `json:",omitempty" env:"MMS_PRODUCT_EVENT_COVERAGE_END"`
+}
+
+// BoundingBox is a geographic area in degrees, with longitudes east and latitudes north.
+type BoundingBox struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+// ParseBoundingBox parses a bounding box given as west,south,east,north.
+func ParseBoundingBox(value string) (*BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bounding box %q, use west,south,east,north", value)
+	}
+	var coords [4]float64
+	for i, part := range parts {
+		coord, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounding box %q: %v", value, err)
+		}
+		coords[i] = coord
+	}
+
+	bbox := &BoundingBox{West: coords[0], South: coords[1], East: coords[2], North: coords[3]}
+	if bbox.South < -90 || bbox.North > 90 || bbox.South > bbox.North {
+		return nil, fmt.Errorf("invalid bounding box %q, latitudes must be within -90 and 90 with south before north", value)
+	}
+	if bbox.West < -180 || bbox.West > 180 || bbox.East < -180 || bbox.East > 180 {
+		return nil, fmt.Errorf("invalid bounding box %q, longitudes must be within -180 and 180", value)
+	}
+	return bbox, nil
+}
+
+// String formats the bounding box as west,south,east,north, as read by ParseBoundingBox.
+func (bbox BoundingBox) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", bbox.West, bbox.South, bbox.East, bbox.North)
+}
 
+// MarshalEnvironmentValue formats the bounding box as west,south,east,north for environment variables.
+func (bbox BoundingBox) MarshalEnvironmentValue() (string, error) {
+	return bbox.String(), nil
+}
+
+// Cloudevent types of product events. Consumers accept both.
+const (
+	ProductEventTypeV1 = "no.met.mms.product.v1"
+	ProductEventTypeV2 = "no.met.mms.product.v2" // Has at least one of the optional fields of ProductEvent.
+)
+
+// eventType gives the cloudevent type of pEvent. Events without the optional fields stay v1, for older consumers.
+func (pEvent *ProductEvent) eventType() string {
+	if pEvent.Checksum != "" || pEvent.Size != 0 || pEvent.MediaType != "" || pEvent.Coverage != nil || len(pEvent.Attributes) > 0 {
+		return ProductEventTypeV2
+	}
+	return ProductEventTypeV1
+}
+
+// isProductEventType reports whether a cloudevent of eventType carries a ProductEvent, of any version.
+func isProductEventType(eventType string) bool {
+	return strings.HasPrefix(eventType, "no.met.mms.product.")
+}
+
+// eventIDNamespace is the UUID namespace of deterministic event ids.
+var eventIDNamespace = uuid.MustParse("6f3c1f8e-5a0d-4b8e-9a43-2c1d7e0b9f52")
+
+// DeterministicID gives an event id derived from the production hub, product, reference time, counter and product location,
+// so an event posted again, e.g. when a job is retried, gets the same id and is dropped as a duplicate.
+func (pEvent *ProductEvent) DeterministicID() string {
+	name := strings.Join([]string{
+		pEvent.ProductionHub,
+		pEvent.Product,
+		time.Time(pEvent.RefTime).UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(pEvent.Counter),
+		pEvent.ProductLocation,
+	}, "\x00")
+	return uuid.NewSHA1(eventIDNamespace, []byte(name)).String()
 }
 
 type HeartBeatEvent struct {
@@ -83,6 +185,9 @@ type HeartBeatEvent struct {
 	NextEventAt   time.Time // timestamp of the next event
 }
 
+// ProductStream is the name of the JetStream stream that stores the events published by mmsd.
+const ProductStream = "PRODUCTDATA"
+
 // ProductEventCallback specifies the function signature for receiving ProductEvent events.
 type ProductEventCallback func(e *ProductEvent) error
 
@@ -91,6 +196,12 @@ type EventClient struct {
 	ceClient     cloudevents.Client
 	cenatsSender cenats.Sender
 	jsnatsSender jsnats.Sender
+
+	// consumer and conn are only set for clients created by NewNatsConsumerClient.
+	consumer protocol.Closer
+	conn     *nats.Conn
+	// jsConsumer is set instead of ceClient for clients consuming from JetStream.
+	jsConsumer *jetStreamConsumer
 }
 
 // Generate a hub indetifier
@@ -112,27 +223,38 @@ func MakeHubIdentifier() (string, error) {
 }
 
 // NewNatsConsumerClient creates a cloudevent client for consuming MMS events from NATS.
-func NewNatsConsumerClient(natsURL string, natsCredentials nats.Option, queueName string, natsLocal bool) (*EventClient, error) {
-	if natsLocal {
-		eClient, err := newNATSConsumer(natsURL, natsCredentials, queueName)
-		if err != nil {
-			return nil, fmt.Errorf("failed to subscribe to events: %v", err)
-		}
-
-		return &EventClient{
-			ceClient: eClient,
-		}, nil
-	} else {
-		eClient, err := newNATSJsConsumer(natsURL, natsCredentials, queueName)
+// queueName is the subject to receive events on, which may contain wildcards, see SubscriptionSubject.
+// With natsLocal, events are received with core NATS unless a consumerConfig is given.
+// Otherwise they are consumed from the JetStream stream of the production hub, with the first consumerConfig if any,
+// and each event is acknowledged once the callback has handled it without error.
+func NewNatsConsumerClient(natsURL string, natsCredentials nats.Option, queueName string, natsLocal bool, consumerConfig ...ConsumerConfig) (*EventClient, error) {
+	if natsLocal && len(consumerConfig) == 0 {
+		eClient, consumer, err := newNATSConsumer(natsURL, natsCredentials, queueName)
 		if err != nil {
 			return nil, fmt.Errorf("failed to subscribe to events: %v", err)
 		}
 
 		return &EventClient{
 			ceClient: eClient,
+			consumer: consumer,
+			conn:     consumer.Conn,
 		}, nil
+	}
 
+	config := ConsumerConfig{}
+	if len(consumerConfig) > 0 {
+		config = consumerConfig[0]
+	}
+	consumer, err := newJetStreamConsumer(natsURL, natsCredentials, queueName, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %v", err)
 	}
+
+	return &EventClient{
+		consumer:   consumer,
+		conn:       consumer.conn,
+		jsConsumer: consumer,
+	}, nil
 }
 
 // NewNatsSenderClient creates a cloudevent client for sending MMS events to NATS.
@@ -161,18 +283,30 @@ func NewNatsSenderClient(natsURL string, natsCredentials nats.Option, queueName
 }
 
 // WatchProductEvents will call your callback function on each incoming event from the MMS Nats server.
+// It never returns.
+//
+// Deprecated: Use Subscribe, which can be stopped and reports terminal errors.
 func (eClient *EventClient) WatchProductEvents(callback ProductEventCallback) {
 	for {
+		if eClient.jsConsumer != nil {
+			if err := eClient.jsConsumer.receive(context.Background(), callback); err != nil {
+				log.Printf("failed to receive events, %s", err.Error())
+			}
+			continue
+		}
 		if err := eClient.ceClient.StartReceiver(context.Background(), productReceiver(callback)); err != nil {
 			log.Printf("failed to start nats receiver, %s", err.Error())
 		}
 	}
 }
 
+// defaultHTTPClient is used by the functions getting from the REST API without a Client.
+var defaultHTTPClient = &http.Client{Timeout: DefaultClientTimeout}
+
 // ListProductEvents will give all available events from the specified events cache.
 func ListProductEvents(apiURL string) ([]*ProductEvent, error) {
 
-	resp, err := http.Get(apiURL)
+	resp, err := defaultHTTPClient.Get(apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("Could not get events from local http server:%v", err)
 	}
@@ -187,10 +321,82 @@ func ListProductEvents(apiURL string) ([]*ProductEvent, error) {
 	return events, nil
 }
 
-// MakeProductEvent prepares and sends the product event
+// ListProductEventsPage gives the events from the specified events cache matching filter.
+// If there are more events to fetch, the cursor for the next page is returned as well.
+func ListProductEventsPage(apiURL string, filter EventFilter) ([]*ProductEvent, string, error) {
+	if query := filter.QueryValues().Encode(); query != "" {
+		apiURL = apiURL + "?" + query
+	}
+
+	resp, err := defaultHTTPClient.Get(apiURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not get events from local http server:%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, "", fmt.Errorf("GET %s failed with status: %s . Response body: %s", apiURL, resp.Status, string(b))
+	}
+
+	events := []*ProductEvent{}
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode event: %v", err)
+	}
+
+	return events, resp.Header.Get("Next-Cursor"), nil
+}
+
+// ReadProductEvents reads events given as a JSON array, or as newline delimited JSON.
+func ReadProductEvents(r io.Reader) ([]*ProductEvent, error) {
+	reader := bufio.NewReader(r)
+	first, err := firstNonSpace(reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %v", err)
+	}
+
+	events := []*ProductEvent{}
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		if err := decoder.Decode(&events); err != nil {
+			return nil, fmt.Errorf("invalid JSON array of events: %v", err)
+		}
+		return events, nil
+	}
+	for {
+		pEvent := ProductEvent{}
+		err := decoder.Decode(&pEvent)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %v", len(events)+1, err)
+		}
+		events = append(events, &pEvent)
+	}
+}
+
+// firstNonSpace peeks at the first byte of reader that is not white space.
+func firstNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			return b, reader.UnreadByte()
+		}
+	}
+}
+
+// MakeProductEvent prepares and sends the product event on its subject below queueName, see ProductSubject.
 func MakeProductEvent(natsURL string, natsCredentials nats.Option, pEvent *ProductEvent, queueName string, natsLocal bool) error {
 
-	mmsClient, err := NewNatsSenderClient(natsURL, natsCredentials, queueName, natsLocal)
+	mmsClient, err := NewNatsSenderClient(natsURL, natsCredentials, ProductSubject(queueName, pEvent.ProductionHub, pEvent.Product), natsLocal)
 	if err != nil {
 		return fmt.Errorf("failed to create messaging service: %v", err)
 	}
@@ -208,49 +414,32 @@ func MakeProductEvent(natsURL string, natsCredentials nats.Option, pEvent *Produ
 	return nil
 }
 
-func PostProductEvent(mmsdURL string, apiKey string, queueName string, pe *ProductEvent, insecure bool) error {
-	var err error
-
-	url := mmsdURL + "/api/v1/events"
+// DefaultPostRetries is the number of times PostProductEvent retries a post that failed with a network error or a temporary status.
+const DefaultPostRetries = 5
 
-	jsonStr, err := json.Marshal(&pe)
-	if err != nil {
-		return fmt.Errorf("failed to marshal ProductEvent: %v", err)
-	}
-
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %v", err)
-	}
-
-	httpReq.Header.Set("Api-Key", apiKey)
-	httpReq.Header.Set("Queue-Name", queueName)
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	var tr *http.Transport
+// PostProductEvent posts pe to the production hub at mmsdURL, which publishes it on its subject below queueName.
+// Failed posts are retried with exponential backoff, see ClientConfig. An event without an EventID is posted with a random one,
+// so the retries do not publish it twice, while pe is left as it is, so it may be posted again as a new event. The posts share one HTTP client, so they reuse the connections to the production hub.
+// Use a Client for other settings, and a Spool to keep undelivered events.
+func PostProductEvent(mmsdURL string, apiKey string, queueName string, pe *ProductEvent, insecure bool) error {
+	httpClient := sharedHTTPClient
 	if insecure {
-		tr = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-	} else {
-		tr = &http.Transport{}
+		httpClient = sharedInsecureHTTPClient
 	}
-
-	httpClient := &http.Client{Transport: tr}
-	httpResp, err := httpClient.Do(httpReq)
-
+	config := ClientConfig{APIKey: apiKey, Insecure: insecure, Timeout: DefaultClientTimeout, Retries: DefaultPostRetries}
+	client, err := newClient(mmsdURL, config, httpClient)
 	if err != nil {
-		return fmt.Errorf("failed to create http client: %v", err)
+		return err
 	}
 
-	defer httpResp.Body.Close()
-
-	statusOK := httpResp.StatusCode >= 200 && httpResp.StatusCode < 300
-	if !statusOK {
-		b, _ := ioutil.ReadAll(httpResp.Body)
-		return fmt.Errorf("POST to %s failed with status: %s . Response body: %s", url, httpResp.Status, string(b))
+	if pe.EventID == "" {
+		withID := *pe
+		withID.EventID = uuid.New().String()
+		pe = &withID
 	}
-	return nil
+
+	_, err = client.PostProductEvent(context.Background(), queueName, pe)
+	return err
 }
 
 // MakeProductEvent prepares and sends the product event
@@ -273,18 +462,15 @@ func MakeHeartBeatEvent(natsURL string, natsCredentials nats.Option, hEvent *Hea
 
 // EmitProductEventMessage generates an event and sends it to the specified messaging service.
 func (eClient *EventClient) EmitProductEventMessage(pEvent *ProductEvent) error {
-	event := cloudevents.NewEvent()
-	event.SetID(uuid.New().String())
-	event.SetType("no.met.mms.product.v1")
-	event.SetTime(time.Now())
-	event.SetSource(pEvent.ProductionHub)
-	event.SetSubject(pEvent.Product)
-
-	err := event.SetData("application/json", pEvent)
+	event, err := newProductCloudEvent(pEvent)
 	if err != nil {
-		return fmt.Errorf("failed to properly encode event data for product event: %v", err)
+		return err
 	}
 
+	if eClient.jsnatsSender.Jsm != nil {
+		// Publish with the event id as message id, so JetStream drops duplicates.
+		return publishToStream(context.Background(), eClient.jsnatsSender.Jsm, eClient.jsnatsSender.Subject, event, event.ID())
+	}
 	if result := eClient.ceClient.Send(context.Background(), event); cloudevents.IsUndelivered(result) {
 		return fmt.Errorf("failed to send: %v", result.Error())
 	}
@@ -294,6 +480,41 @@ func (eClient *EventClient) EmitProductEventMessage(pEvent *ProductEvent) error
 
 // EmitHeartBeatMessage generates an event and sends it to the specified messaging service.
 func (eClient *EventClient) EmitHeartBeatMessage(hEvent *HeartBeatEvent) error {
+	event, err := newHeartBeatCloudEvent(hEvent)
+	if err != nil {
+		return err
+	}
+
+	if result := eClient.ceClient.Send(context.Background(), event); cloudevents.IsUndelivered(result) {
+		return fmt.Errorf("failed to send: %v", result.Error())
+	}
+
+	return nil
+}
+
+// newProductCloudEvent wraps a product event in a cloudevent.
+func newProductCloudEvent(pEvent *ProductEvent) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	if pEvent.EventID != "" {
+		event.SetID(pEvent.EventID)
+	} else {
+		event.SetID(uuid.New().String())
+	}
+	event.SetType(pEvent.eventType())
+	event.SetTime(time.Now())
+	event.SetSource(pEvent.ProductionHub)
+	event.SetSubject(pEvent.Product)
+
+	err := event.SetData("application/json", pEvent)
+	if err != nil {
+		return event, fmt.Errorf("failed to properly encode event data for product event: %v", err)
+	}
+
+	return event, nil
+}
+
+// newHeartBeatCloudEvent wraps a heartbeat event in a cloudevent.
+func newHeartBeatCloudEvent(hEvent *HeartBeatEvent) (cloudevents.Event, error) {
 	event := cloudevents.NewEvent()
 	event.SetID(uuid.New().String())
 	event.SetType("no.met.mms.heartbeat.v1")
@@ -303,14 +524,10 @@ func (eClient *EventClient) EmitHeartBeatMessage(hEvent *HeartBeatEvent) error {
 
 	err := event.SetData("application/json", hEvent)
 	if err != nil {
-		return fmt.Errorf("failed to properly encode event data for heartbeat event: %v", err)
-	}
-
-	if result := eClient.ceClient.Send(context.Background(), event); cloudevents.IsUndelivered(result) {
-		return fmt.Errorf("failed to send: %v", result.Error())
+		return event, fmt.Errorf("failed to properly encode event data for heartbeat event: %v", err)
 	}
 
-	return nil
+	return event, nil
 }
 
 func newNATSSender(natsURL string, natsCredentials nats.Option, queueName string) (cloudevents.Client, cenats.Sender, error) {
@@ -328,7 +545,7 @@ func newNATSSender(natsURL string, natsCredentials nats.Option, queueName string
 }
 
 func newNATSJsSender(natsURL string, natsCredentials nats.Option, queueName string) (cloudevents.Client, jsnats.Sender, error) {
-	pEvent, err := jsnats.NewSender(natsURL, "PRODUCTDATA", queueName, cenats.NatsOptions(natsCredentials), nil)
+	pEvent, err := jsnats.NewSender(natsURL, ProductStream, queueName, cenats.NatsOptions(natsCredentials), nil)
 	if err != nil {
 		return nil, jsnats.Sender{}, fmt.Errorf("failed to create nats protocol: %v", err)
 	}
@@ -341,47 +558,27 @@ func newNATSJsSender(natsURL string, natsCredentials nats.Option, queueName stri
 	return eClient, *pEvent, nil
 }
 
-func newNATSConsumer(natsURL string, natsCredentials nats.Option, queueName string) (cloudevents.Client, error) {
+func newNATSConsumer(natsURL string, natsCredentials nats.Option, queueName string) (cloudevents.Client, *cenats.Consumer, error) {
 
 	pEvent, err := cenats.NewConsumer(natsURL, queueName, cenats.NatsOptions(natsCredentials))
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create nats protocol, %v", err)
-	}
-
-	eClient, err := cloudevents.NewClient(pEvent)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create client, %v", err)
-	}
-
-	return eClient, nil
-}
-
-func newNATSJsConsumer(natsURL string, natsCredentials nats.Option, queueName string) (cloudevents.Client, error) {
-	since := time.Now().UTC().Add(time.Hour * time.Duration(-12))
-
-	subscribeOptions := []nats.SubOpt{
-		nats.DeliverAll(),
-		nats.StartTime(since),
-	}
-	pEvent, err := jsnats.NewConsumer(natsURL, "PRODUCTDATA", queueName, cenats.NatsOptions(natsCredentials), nil, subscribeOptions)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to create nats protocol, %v", err)
+		return nil, nil, fmt.Errorf("failed to create nats protocol, %v", err)
 	}
 
 	eClient, err := cloudevents.NewClient(pEvent)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client, %v", err)
+		pEvent.Conn.Close()
+		return nil, nil, fmt.Errorf("failed to create client, %v", err)
 	}
 
-	return eClient, nil
+	return eClient, pEvent, nil
 }
 
 func productReceiver(callback ProductEventCallback) func(context.Context, cloudevents.Event) error {
 	return func(ctx context.Context, event cloudevents.Event) error {
-		// Silently ignore non product events.
-		if !strings.HasPrefix(event.Type(), "no.met.mms.product") {
+		// Silently ignore non product events. v1 events decode into ProductEvent without the optional fields.
+		if !isProductEventType(event.Type()) {
 			return nil
 		}
 
@@ -21,8 +21,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -86,9 +89,17 @@ func TestListProductEvents(t *testing.T) {
 }
 
 func TestPostProductEvent(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var newConns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusCreated)
 	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
 
 	productEvent := ProductEvent{
 		JobName:         "test-job",
@@ -102,10 +113,70 @@ func TestPostProductEvent(t *testing.T) {
 		NextEventAt:     PEventTime(time.Now().Add(time.Second * time.Duration(3600))),
 	}
 
-	err := PostProductEvent(ts.URL, "no-api-key", "mms", &productEvent, false)
-	if err != nil {
+	for i := 0; i < 2; i++ {
+		err := PostProductEvent(ts.URL, "no-api-key", "mms", &productEvent, false)
+		if err != nil {
+			t.Errorf("Expected no errors; Got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&newConns); n != 1 {
+		t.Errorf("Expected the posts to share a connection; Got %d connections", n)
+	}
+}
+
+func TestDeterministicID(t *testing.T) {
+	productEvent := ProductEvent{
+		Product:         "test-product",
+		ProductLocation: "/lustre/test.nc",
+		ProductionHub:   "test-hub",
+		Counter:         1,
+		RefTime:         PEventTime(time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC)),
+		CreatedAt:       PEventTime(time.Now()),
+	}
+	id := productEvent.DeterministicID()
+
+	// Retrying a job creates the event again at another time.
+	retried := productEvent
+	retried.CreatedAt = PEventTime(time.Now().Add(time.Minute))
+	retried.RefTime = PEventTime(time.Date(2021, 3, 1, 7, 0, 0, 0, time.FixedZone("CET", 3600)))
+	if retried.DeterministicID() != id {
+		t.Errorf("Expected the same id for the same product instance; Got %s and %s", id, retried.DeterministicID())
+	}
+
+	next := productEvent
+	next.Counter = 2
+	if next.DeterministicID() == id {
+		t.Errorf("Expected another id for the next counter; Got %s", id)
+	}
+}
+
+func TestPostProductEventIdempotencyKey(t *testing.T) {
+	var idempotencyKey string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	productEvent := ProductEvent{ProductionHub: "test-hub", Product: "test-product", EventID: "test-id"}
+	if err := PostProductEvent(ts.URL, "no-api-key", "mms", &productEvent, false); err != nil {
 		t.Errorf("Expected no errors; Got %v", err)
 	}
+	if idempotencyKey != "test-id" {
+		t.Errorf("Expected the event id as Idempotency-Key; Got %q", idempotencyKey)
+	}
+
+	// An event without an id is posted with a new random one each time, and is not changed.
+	template := ProductEvent{ProductionHub: "test-hub", Product: "test-product"}
+	var keys []string
+	for i := 0; i < 2; i++ {
+		if err := PostProductEvent(ts.URL, "no-api-key", "mms", &template, false); err != nil {
+			t.Errorf("Expected no errors; Got %v", err)
+		}
+		keys = append(keys, idempotencyKey)
+	}
+	if keys[0] == "" || keys[0] == keys[1] || template.EventID != "" {
+		t.Errorf("Expected a new Idempotency-Key for each post, and the event to be left without an id; Got %q and %+v", keys, template)
+	}
 }
 
 func TestPostProductEventNotSuccessful(t *testing.T) {
@@ -142,6 +213,83 @@ func TestEmitProductEventMessage(t *testing.T) {
 	}
 }
 
+func TestProductEventVersions(t *testing.T) {
+	start := PEventTime(time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC))
+	v2Event := ProductEvent{
+		ProductionHub: "test-hub",
+		Product:       "test",
+		Checksum:      "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Size:          1024,
+		MediaType:     "application/x-netcdf",
+		Coverage:      &Coverage{BoundingBox: &BoundingBox{West: -10, South: 50, East: 40, North: 85}, Start: &start},
+		Attributes:    map[string]string{"model": "arome"},
+	}
+
+	for _, pEvent := range []ProductEvent{{ProductionHub: "test-hub", Product: "test"}, v2Event} {
+		event, err := newProductCloudEvent(&pEvent)
+		if err != nil {
+			t.Fatalf("Expected no errors; Got %s", err)
+		}
+		expectedType := ProductEventTypeV1
+		if pEvent.Attributes != nil {
+			expectedType = ProductEventTypeV2
+		}
+		if event.Type() != expectedType {
+			t.Errorf("Expected type %s; Got %s", expectedType, event.Type())
+		}
+
+		var received *ProductEvent
+		err = productReceiver(func(e *ProductEvent) error {
+			received = e
+			return nil
+		})(context.Background(), event)
+		if err != nil || received == nil {
+			t.Fatalf("Expected %s event to be received; Got %v", event.Type(), err)
+		}
+		if received.Checksum != pEvent.Checksum || received.Size != pEvent.Size || received.MediaType != pEvent.MediaType ||
+			fmt.Sprint(received.Attributes) != fmt.Sprint(pEvent.Attributes) || (received.Coverage == nil) != (pEvent.Coverage == nil) {
+			t.Errorf("Expected %+v; Got %+v", pEvent, received)
+		}
+		if received.Coverage != nil && (*received.Coverage.BoundingBox != *pEvent.Coverage.BoundingBox || !time.Time(*received.Coverage.Start).Equal(time.Time(start))) {
+			t.Errorf("Expected coverage %+v; Got %+v", pEvent.Coverage, received.Coverage)
+		}
+	}
+
+	// Events without an id are encoded without the field, as by older versions.
+	if data, _ := json.Marshal(&ProductEvent{ProductionHub: "test-hub", Product: "test"}); strings.Contains(string(data), "EventID") {
+		t.Errorf("Expected no EventID in an event without an id; Got %s", data)
+	}
+
+	// v1 events without the new fields, as sent by older versions, are still accepted.
+	v1Event := cloudevents.NewEvent()
+	v1Event.SetID("1")
+	v1Event.SetSource("test-hub")
+	v1Event.SetType(ProductEventTypeV1)
+	v1Event.SetData("application/json", map[string]interface{}{"Product": "test", "ProductionHub": "test-hub"})
+	err := productReceiver(func(e *ProductEvent) error {
+		if e.Product != "test" || e.Coverage != nil || e.Attributes != nil {
+			t.Errorf("Expected a v1 product event; Got %+v", e)
+		}
+		return nil
+	})(context.Background(), v1Event)
+	if err != nil {
+		t.Errorf("Expected no errors; Got %s", err)
+	}
+}
+
+func TestParseBoundingBox(t *testing.T) {
+	bbox, err := ParseBoundingBox("-10.5, 50,40,85")
+	if err != nil || *bbox != (BoundingBox{West: -10.5, South: 50, East: 40, North: 85}) || bbox.String() != "-10.5,50,40,85" {
+		t.Errorf("Expected the bounding box -10.5,50,40,85; Got %v, %v", bbox, err)
+	}
+
+	for _, value := range []string{"", "1,2,3", "a,b,c,d", "0,80,10,70", "0,-91,10,10", "-181,0,10,10"} {
+		if _, err := ParseBoundingBox(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
 // EventClient that sends and receives events on an internal go channel.
 func newMockCloudeventsClient() *EventClient {
 	cEvent, err := cloudevents.NewClient(gochan.New())
@@ -163,3 +311,24 @@ func newMockCloudeventsClient() *EventClient {
 		ceClient: cEvent,
 	}
 }
+
+func TestReadProductEvents(t *testing.T) {
+	for input, expected := range map[string]int{
+		`[{"Product": "a"}, {"Product": "b"}]`:           2,
+		"{\"Product\": \"a\"}\n\n{\"Product\": \"b\"}\n": 2,
+		`  {"Product": "a"}`:                             1,
+		"":                                               0,
+		"\n  \n":                                         0,
+	} {
+		events, err := ReadProductEvents(strings.NewReader(input))
+		if err != nil || len(events) != expected {
+			t.Errorf("Expected %d events from %q; Got %v, %v", expected, input, events, err)
+		}
+	}
+
+	for _, input := range []string{`[{"Product": "a"}`, "{\"Product\": \"a\"}\nnot json\n", `{"RefTime": "yesterday"}`} {
+		if _, err := ReadProductEvents(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
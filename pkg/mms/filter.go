@@ -0,0 +1,254 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxEventsLimit is the largest page size accepted by the events API.
+const MaxEventsLimit = 10000
+
+// EventFilter selects a subset of the stored product events, as accepted by GET /api/v1/events.
+// Zero values mean "no restriction". Product, ProductionHub and JobName may contain wildcards, as in MatchGlob.
+type EventFilter struct {
+	Product       string
+	ProductionHub string
+	JobName       string
+	Since         time.Time // CreatedAt >= Since
+	Until         time.Time // CreatedAt < Until
+	RefTimeSince  time.Time // RefTime >= RefTimeSince
+	RefTimeUntil  time.Time // RefTime < RefTimeUntil
+	Limit         int       // Maximum number of events in one page, 0 for all
+	Descending    bool      // Newest events first
+	Cursor        string    // Opaque cursor returned with the previous page
+}
+
+// QueryValues encodes the filter as URL query parameters.
+func (f EventFilter) QueryValues() url.Values {
+	values := url.Values{}
+	setString := func(key string, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	setTime := func(key string, value time.Time) {
+		if !value.IsZero() {
+			values.Set(key, value.UTC().Format(time.RFC3339Nano))
+		}
+	}
+
+	setString("product", f.Product)
+	setString("productionHub", f.ProductionHub)
+	setString("jobName", f.JobName)
+	setTime("since", f.Since)
+	setTime("until", f.Until)
+	setTime("refTimeSince", f.RefTimeSince)
+	setTime("refTimeUntil", f.RefTimeUntil)
+	if f.Limit > 0 {
+		values.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if f.Descending {
+		values.Set("order", "desc")
+	}
+	setString("cursor", f.Cursor)
+
+	return values
+}
+
+// Matches reports whether a product event is selected by the filter. Limit, Descending and Cursor are ignored.
+func (f EventFilter) Matches(e *ProductEvent) bool {
+	if !globMatch(f.Product, e.Product) || !globMatch(f.ProductionHub, e.ProductionHub) || !globMatch(f.JobName, e.JobName) {
+		return false
+	}
+
+	createdAt := time.Time(e.CreatedAt)
+	if !f.Since.IsZero() && createdAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !createdAt.Before(f.Until) {
+		return false
+	}
+
+	refTime := time.Time(e.RefTime)
+	if !f.RefTimeSince.IsZero() && refTime.Before(f.RefTimeSince) {
+		return false
+	}
+	if !f.RefTimeUntil.IsZero() && !refTime.Before(f.RefTimeUntil) {
+		return false
+	}
+
+	return true
+}
+
+// ErrBadGlob is returned by MatchGlob for a pattern with a '[' that is not closed.
+var ErrBadGlob = errors.New("syntax error in pattern")
+
+// globMatch matches value against a pattern as MatchGlob does. An empty pattern matches everything.
+func globMatch(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := MatchGlob(pattern, value)
+	return err == nil && matched
+}
+
+// MatchGlob reports whether value matches pattern the way the GLOB operator of the events database does:
+// '*' matches any characters, including '/', '?' matches one character, and '[...]' matches one character in the set,
+// which may contain ranges such as a-z, or one character not in it if the set starts with '^'. The match is case sensitive.
+// The pattern is matched the same way by the server and by clients filtering events themselves.
+func MatchGlob(pattern string, value string) (bool, error) {
+	patternRunes := []rune(pattern)
+	for i := 0; i < len(patternRunes); i++ {
+		if patternRunes[i] == '[' {
+			n, _ := matchGlobSet(patternRunes[i:], 0)
+			if n == 0 {
+				return false, ErrBadGlob
+			}
+			i += n - 1
+		}
+	}
+	return matchGlob(patternRunes, []rune(value)), nil
+}
+
+// matchGlob matches a valid pattern. A failed match backtracks to the last '*' only, as the earlier ones can match anything.
+func matchGlob(pattern []rune, value []rune) bool {
+	p, v := 0, 0
+	starP, starV := -1, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starV = p, v
+				p++
+				continue
+			case '?':
+				p++
+				v++
+				continue
+			case '[':
+				if n, ok := matchGlobSet(pattern[p:], value[v]); ok {
+					p += n
+					v++
+					continue
+				}
+			default:
+				if pattern[p] == value[v] {
+					p++
+					v++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starV++
+		p, v = starP+1, starV
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchGlobSet matches r against the set at the start of pattern, and gives the length of the set.
+// A ']' first in the set is part of it. The length is 0 if the set is not closed.
+func matchGlobSet(pattern []rune, r rune) (int, bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern) && (first || pattern[i] != ']'); first = false {
+		lo, hi := pattern[i], pattern[i]
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 3
+		} else {
+			i++
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+	if i >= len(pattern) {
+		return 0, false
+	}
+	return i + 1, matched != negate
+}
+
+// ParseEventFilter decodes URL query parameters into an EventFilter.
+func ParseEventFilter(values url.Values) (EventFilter, error) {
+	var err error
+	f := EventFilter{
+		Product:       values.Get("product"),
+		ProductionHub: values.Get("productionHub"),
+		JobName:       values.Get("jobName"),
+		Cursor:        values.Get("cursor"),
+	}
+
+	for key, pattern := range map[string]string{
+		"product":       f.Product,
+		"productionHub": f.ProductionHub,
+		"jobName":       f.JobName,
+	} {
+		if _, err := MatchGlob(pattern, ""); err != nil {
+			return f, fmt.Errorf("invalid pattern in %s: %s", key, pattern)
+		}
+	}
+
+	for key, dst := range map[string]*time.Time{
+		"since":        &f.Since,
+		"until":        &f.Until,
+		"refTimeSince": &f.RefTimeSince,
+		"refTimeUntil": &f.RefTimeUntil,
+	} {
+		value := values.Get(key)
+		if value == "" {
+			continue
+		}
+		if *dst, err = ParseRelativeTime(value, time.Now()); err != nil {
+			return f, fmt.Errorf("invalid time in %s: %s", key, value)
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		f.Limit, err = strconv.Atoi(limit)
+		if err != nil || f.Limit < 1 || f.Limit > MaxEventsLimit {
+			return f, fmt.Errorf("limit must be a number between 1 and %d", MaxEventsLimit)
+		}
+	}
+
+	switch strings.ToLower(values.Get("order")) {
+	case "", "asc":
+		f.Descending = false
+	case "desc":
+		f.Descending = true
+	default:
+		return f, fmt.Errorf("order must be asc or desc")
+	}
+
+	return f, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEventFilterRoundTrip(t *testing.T) {
+	filter := EventFilter{
+		Product:       "arome_*",
+		ProductionHub: "ecflow.modellprod",
+		Since:         time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC),
+		RefTimeUntil:  time.Date(2022, 7, 6, 0, 0, 0, 0, time.UTC),
+		Limit:         100,
+		Descending:    true,
+		Cursor:        "abc",
+	}
+
+	parsed, err := ParseEventFilter(filter.QueryValues())
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	if parsed != filter {
+		t.Errorf("Expected %+v; Got %+v", filter, parsed)
+	}
+}
+
+func TestParseEventFilterInvalid(t *testing.T) {
+	for _, query := range []string{
+		"since=someday",
+		"limit=0",
+		"limit=abc",
+		"order=sideways",
+		"product=arome_[",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseEventFilter(values); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		value   string
+		matched bool
+	}{
+		{"arome_*", "arome_arctic", true},
+		{"arome_*", "meps", false},
+		{"*", "a/b", true},
+		{"hub/*", "hub/a/b", true},
+		{"*_arctic", "arome_met_arctic", true},
+		{"a*b*c", "abxbc", true},
+		{"a*b*c", "abxbd", false},
+		{"?", "å", true},
+		{"?", "ab", false},
+		{"[a-c]x", "bx", true},
+		{"[^a-c]x", "bx", false},
+		{"[]]", "]", true},
+		{"[*]", "*", true},
+		{"[*]", "a", false},
+		{"Meps", "meps", false},
+		{`a\*`, `a\b`, true},
+	} {
+		matched, err := MatchGlob(test.pattern, test.value)
+		if err != nil || matched != test.matched {
+			t.Errorf("Expected %s to match %s: %v; Got %v, %v", test.pattern, test.value, test.matched, matched, err)
+		}
+	}
+
+	if _, err := MatchGlob("arome_[", "arome_"); err != ErrBadGlob {
+		t.Errorf("Expected an unclosed set to be rejected; Got %v", err)
+	}
+}
+
+func TestParseEventFilterRelativeTime(t *testing.T) {
+	values, _ := url.ParseQuery("refTimeSince=today-1d&until=2022-07-05")
+	filter, err := ParseEventFilter(values)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	yesterday := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if !filter.RefTimeSince.Equal(yesterday) || !filter.Until.Equal(time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected reftime-since %s and until 2022-07-05; Got %+v", yesterday, filter)
+	}
+}
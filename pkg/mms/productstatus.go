@@ -0,0 +1,97 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProductState tells whether a product has arrived when expected.
+type ProductState string
+
+const (
+	// ProductStateOnTime means the next event is not yet due.
+	ProductStateOnTime ProductState = "on-time"
+	// ProductStateLate means the next event is due, but less than one event interval ago.
+	ProductStateLate ProductState = "late"
+	// ProductStateOverdue means the next event is due by more than one event interval, so at least one event is missing.
+	ProductStateOverdue ProductState = "overdue"
+	// ProductStateUnknown means the last event did not say when to expect the next one.
+	ProductStateUnknown ProductState = "unknown"
+)
+
+// ProductStatus is the status of one product from a production hub as reported by GET /api/v1/productstatus.
+type ProductStatus struct {
+	Product              string        `json:"product"`
+	ProductionHub        string        `json:"productionHub"`
+	State                ProductState  `json:"state"`
+	LastEvent            *ProductEvent `json:"lastEvent"`
+	NextInstanceExpected *time.Time    `json:"nextInstanceExpected,omitempty"`
+	DelaySeconds         float64       `json:"delaySeconds"` // Negative while the next event is not yet due.
+}
+
+// ListProductStatus gives the status of all products known to the production hub at apiURL, i.e. <production hub>/api/v1/productstatus.
+// If state is not empty, only products in that state are listed.
+func ListProductStatus(apiURL string, state ProductState) ([]ProductStatus, error) {
+	if state != "" {
+		apiURL = apiURL + "?" + url.Values{"state": []string{string(state)}}.Encode()
+	}
+
+	statuses := []ProductStatus{}
+	if err := getJSON(apiURL, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// GetProductStatus gives the status of a single product from the production hub at apiURL, i.e. <production hub>/api/v1/productstatus.
+// The production hub the product comes from may be left empty if the product only comes from one.
+func GetProductStatus(apiURL string, productionHub string, product string) (*ProductStatus, error) {
+	apiURL = apiURL + "/" + url.PathEscape(product)
+	if productionHub != "" {
+		apiURL = apiURL + "?" + url.Values{"productionHub": []string{productionHub}}.Encode()
+	}
+
+	status := ProductStatus{}
+	if err := getJSON(apiURL, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func getJSON(apiURL string, v interface{}) error {
+	resp, err := defaultHTTPClient.Get(apiURL)
+	if err != nil {
+		return fmt.Errorf("Could not get %s: %v", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s failed with status: %s . Response body: %s", apiURL, resp.Status, string(b))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
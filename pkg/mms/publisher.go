@@ -0,0 +1,288 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	cenats "github.com/cloudevents/sdk-go/protocol/nats/v2"
+	jsnats "github.com/cloudevents/sdk-go/protocol/nats_jetstream/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Publisher keeps one long-lived NATS connection and reuses it for every event it sends.
+// The connection reconnects automatically, and a Publisher is safe for concurrent use.
+type Publisher struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext // Nil when publishing with core NATS.
+	metrics *PublisherMetrics
+
+	mu             sync.Mutex
+	closed         bool
+	legacySubjects bool
+}
+
+// MaxQueueLabels is the number of queue names that get their own series in the publisher metrics.
+// The queue names are given by the posting clients, so later ones share the series labeled OtherQueueLabel.
+const MaxQueueLabels = 20
+
+// OtherQueueLabel labels the publisher metrics of the queue names seen after the first MaxQueueLabels.
+const OtherQueueLabel = "other"
+
+// PublisherMetrics holds the Prometheus metrics for one or more publishers.
+// Register it once with a Prometheus registry; it can be shared between publishers.
+type PublisherMetrics struct {
+	latency  *prometheus.HistogramVec
+	failures *prometheus.CounterVec
+
+	mu     sync.Mutex
+	queues map[string]bool // The queue names with their own series.
+}
+
+// NewPublisherMetrics creates the publish latency and failure metrics.
+func NewPublisherMetrics() *PublisherMetrics {
+	return &PublisherMetrics{
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "mms",
+				Name:      "publish_duration_seconds",
+				Help:      "A histogram of latencies for publishing events to NATS.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"queue"},
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "mms",
+				Name:      "publish_failures_total",
+				Help:      "The total number of events that could not be published to NATS.",
+			},
+			[]string{"queue"},
+		),
+		queues: make(map[string]bool),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *PublisherMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.latency.Describe(ch)
+	m.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *PublisherMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.latency.Collect(ch)
+	m.failures.Collect(ch)
+}
+
+func (m *PublisherMetrics) observe(queueName string, start time.Time, err error) {
+	label := m.queueLabel(queueName)
+	m.latency.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.failures.WithLabelValues(label).Inc()
+	}
+}
+
+// queueLabel gives the queue label of the metrics of queueName, which is the queue name itself
+// for the first MaxQueueLabels queue names, and OtherQueueLabel for the rest.
+func (m *PublisherMetrics) queueLabel(queueName string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.queues[queueName] {
+		if len(m.queues) >= MaxQueueLabels {
+			return OtherQueueLabel
+		}
+		m.queues[queueName] = true
+	}
+	return queueName
+}
+
+// NewPublisher connects to NATS and returns a Publisher using that connection.
+// If the server is not reachable yet, the connection is retried in the background.
+// Events are published to the JetStream stream, e.g. ProductStream, and acknowledged by the server.
+// The stream drops events with an id it has already stored within its duplicate window.
+// If stream is empty, they are published with core NATS instead.
+// Metrics may be nil, in which case the publisher gets its own unregistered metrics.
+func NewPublisher(natsURL string, natsCredentials nats.Option, stream string, metrics *PublisherMetrics) (*Publisher, error) {
+	conn, err := nats.Connect(natsURL,
+		natsCredentials,
+		nats.Name("mms-publisher"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	var js nats.JetStreamContext
+	if stream != "" {
+		js, err = conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to get JetStream context: %v", err)
+		}
+	}
+
+	if metrics == nil {
+		metrics = NewPublisherMetrics()
+	}
+
+	return &Publisher{
+		conn:    conn,
+		js:      js,
+		metrics: metrics,
+	}, nil
+}
+
+// Metrics returns the metrics updated by this publisher.
+func (p *Publisher) Metrics() *PublisherMetrics {
+	return p.metrics
+}
+
+// Conn returns the underlying NATS connection.
+func (p *Publisher) Conn() *nats.Conn {
+	return p.conn
+}
+
+// SetLegacySubjects makes the publisher also send product events on the queue name itself, the subject they were
+// published on before ProductSubject, for subscribers that have not moved to the subjects of production hub and product.
+func (p *Publisher) SetLegacySubjects(legacySubjects bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.legacySubjects = legacySubjects
+}
+
+// PublishProductEvent sends a product event on the subject of its production hub and product below the given queue name,
+// see ProductSubject, and with SetLegacySubjects also on the queue name. Sending on the queue name is best effort:
+// a failure is only logged and counted in the metrics, since retrying the event would send it again on its own subject.
+func (p *Publisher) PublishProductEvent(ctx context.Context, pEvent *ProductEvent, queueName string) error {
+	event, err := newProductCloudEvent(pEvent)
+	if err != nil {
+		return err
+	}
+	if err := p.publish(ctx, event, queueName, ProductSubject(queueName, pEvent.ProductionHub, pEvent.Product), event.ID()); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	legacySubjects := p.legacySubjects
+	p.mu.Unlock()
+	if !legacySubjects {
+		return nil
+	}
+	// The copy needs its own message id, or the stream drops it as a duplicate.
+	if err := p.publish(ctx, event, queueName, queueName, event.ID()+"."+queueName); err != nil {
+		log.Printf("failed to publish event %s on the legacy subject %s: %v", event.ID(), queueName, err)
+	}
+	return nil
+}
+
+// PublishHeartBeatEvent sends a heartbeat event on the given queue name.
+func (p *Publisher) PublishHeartBeatEvent(ctx context.Context, hEvent *HeartBeatEvent, queueName string) error {
+	event, err := newHeartBeatCloudEvent(hEvent)
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, event, queueName, queueName, event.ID())
+}
+
+// Close flushes pending events and closes the NATS connection.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	return p.conn.Drain()
+}
+
+// publish sends event on subject, with msgID as its message id in the stream. The metrics are labeled with the queue name
+// rather than the subject, to keep the number of series small.
+func (p *Publisher) publish(ctx context.Context, event cloudevents.Event, queueName string, subject string, msgID string) error {
+	start := time.Now()
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+
+	var err error
+	switch {
+	case closed:
+		err = fmt.Errorf("publisher is closed")
+	case p.js != nil:
+		err = publishToStream(ctx, p.js, subject, event, msgID)
+	default:
+		err = publishToConn(ctx, p.conn, subject, event)
+	}
+
+	p.metrics.observe(queueName, start, err)
+	return err
+}
+
+// publishToConn sends event on subject with core NATS. The event is encoded the way a cloudevents client
+// sending on the subject would, without keeping a client for each subject.
+func publishToConn(ctx context.Context, conn *nats.Conn, subject string, event cloudevents.Event) error {
+	if err := event.Validate(); err != nil {
+		return fmt.Errorf("invalid event: %v", err)
+	}
+
+	var data bytes.Buffer
+	if err := cenats.WriteMsg(ctx, binding.ToMessage(&event), &data); err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	if err := conn.Publish(subject, data.Bytes()); err != nil {
+		return fmt.Errorf("failed to send: %v", err)
+	}
+	return nil
+}
+
+// publishToStream sends event on subject to JetStream, with msgID, usually the event id, as the Nats-Msg-Id header,
+// so the stream drops the event if it has already stored one with the same id within its duplicate window.
+func publishToStream(ctx context.Context, js nats.JetStreamContext, subject string, event cloudevents.Event, msgID string) error {
+	if err := event.Validate(); err != nil {
+		return fmt.Errorf("invalid event: %v", err)
+	}
+
+	var data bytes.Buffer
+	if err := jsnats.WriteMsg(ctx, binding.ToMessage(&event), &data); err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data.Bytes()
+	msg.Header.Set(nats.MsgIdHdr, msgID)
+
+	// Without a deadline, the default timeout of the JetStream context is used.
+	var opts []nats.PubOpt
+	if _, ok := ctx.Deadline(); ok {
+		opts = append(opts, nats.Context(ctx))
+	}
+	if _, err := js.PublishMsg(msg, opts...); err != nil {
+		return fmt.Errorf("failed to send: %v", err)
+	}
+	return nil
+}
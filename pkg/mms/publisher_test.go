@@ -0,0 +1,266 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// runTestNatsServer starts an embedded NATS server on a random port.
+func runTestNatsServer(t *testing.T) *natsserver.Server {
+	natsServer, err := natsserver.NewServer(&natsserver.Options{
+		ServerName: "mms-nats-server-test",
+		Host:       "127.0.0.1",
+		Port:       -1,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %s", err)
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready for connections")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	return natsServer
+}
+
+func TestPublisher(t *testing.T) {
+	natsServer := runTestNatsServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	defer conn.Close()
+	msgs := make(chan *nats.Msg, 10)
+	if _, err := conn.ChanSubscribe("mms.test-hub.test", msgs); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	conn.Flush()
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, "", nil)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	defer publisher.Close()
+
+	// Publish concurrently to make sure the shared connection is safe to use.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test"}, "mms")
+			if err != nil {
+				t.Errorf("Expected no errors; Got %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-msgs:
+			event := cloudevents.NewEvent()
+			if err := json.Unmarshal(msg.Data, &event); err != nil {
+				t.Fatalf("failed to decode cloudevent: %s", err)
+			}
+			pEvent := ProductEvent{}
+			if err := event.DataAs(&pEvent); err != nil {
+				t.Fatalf("failed to decode product event: %s", err)
+			}
+			if pEvent.Product != "test" {
+				t.Errorf("Expected Product test; Got %s", pEvent.Product)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 5 messages; Got %d", i)
+		}
+	}
+
+	if n := testutil.CollectAndCount(publisher.Metrics(), "mms_publish_duration_seconds"); n != 1 {
+		t.Errorf("Expected 1 latency series; Got %d", n)
+	}
+	if n := testutil.CollectAndCount(publisher.Metrics(), "mms_publish_failures_total"); n != 0 {
+		t.Errorf("Expected no failure series; Got %d", n)
+	}
+}
+
+func TestPublisherClosed(t *testing.T) {
+	natsServer := runTestNatsServer(t)
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, "", nil)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	publisher.Close()
+
+	err = publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test"}, "mms")
+	if err == nil {
+		t.Errorf("Expected an error when publishing on a closed publisher")
+	}
+	if n := testutil.CollectAndCount(publisher.Metrics(), "mms_publish_failures_total"); n != 1 {
+		t.Errorf("Expected 1 failure series; Got %d", n)
+	}
+}
+
+func TestPublisherMetricsQueueLabels(t *testing.T) {
+	metrics := NewPublisherMetrics()
+	for i := 0; i < MaxQueueLabels+5; i++ {
+		metrics.observe(fmt.Sprintf("queue%d", i), time.Now(), nil)
+	}
+	metrics.observe("queue0", time.Now(), nil)
+
+	if n := testutil.CollectAndCount(metrics, "mms_publish_duration_seconds"); n != MaxQueueLabels+1 {
+		t.Errorf("Expected %d latency series; Got %d", MaxQueueLabels+1, n)
+	}
+	if label := metrics.queueLabel("queue0"); label != "queue0" {
+		t.Errorf("Expected queue0 to keep its own series; Got %s", label)
+	}
+	if label := metrics.queueLabel("new"); label != OtherQueueLabel {
+		t.Errorf("Expected a new queue to share the %s series; Got %s", OtherQueueLabel, label)
+	}
+}
+
+func TestPublisherJetStream(t *testing.T) {
+	natsServer := runTestNatsServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: ProductStream, Subjects: []string{"mms.>"}}); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, ProductStream, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	defer publisher.Close()
+
+	if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test"}, "mms"); err != nil {
+		t.Errorf("Expected no errors; Got %s", err)
+	}
+	if info, err := js.StreamInfo(ProductStream); err != nil || info.State.Msgs != 1 {
+		t.Errorf("Expected 1 event in the stream; Got %v, %v", info, err)
+	}
+
+	// An event with an id is only stored once.
+	for i := 0; i < 2; i++ {
+		if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test", EventID: "test-id"}, "mms"); err != nil {
+			t.Errorf("Expected no errors; Got %s", err)
+		}
+	}
+	if info, err := js.StreamInfo(ProductStream); err != nil || info.State.Msgs != 2 {
+		t.Errorf("Expected the duplicate event to be dropped; Got %v, %v", info, err)
+	}
+
+	// Nothing acknowledges events outside the subjects of the stream.
+	if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test"}, "other"); err == nil {
+		t.Errorf("Expected an error when publishing outside the stream")
+	}
+}
+
+func TestPublisherLegacySubjects(t *testing.T) {
+	natsServer := runTestNatsServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: ProductStream, Subjects: []string{"mms", "mms.>"}}); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, ProductStream, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	defer publisher.Close()
+	publisher.SetLegacySubjects(true)
+
+	for i := 0; i < 2; i++ {
+		if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test", EventID: "test-id"}, "mms"); err != nil {
+			t.Errorf("Expected no errors; Got %s", err)
+		}
+	}
+	// The event is stored once on each subject, with the same event id.
+	for _, subject := range []string{"mms", "mms.test-hub.test"} {
+		msg, err := js.GetLastMsg(ProductStream, subject)
+		if err != nil {
+			t.Errorf("Expected the event on %s; Got %s", subject, err)
+			continue
+		}
+		if !strings.Contains(string(msg.Data), `"id":"test-id"`) {
+			t.Errorf("Expected the event id test-id on %s; Got %s", subject, msg.Data)
+		}
+	}
+	if info, err := js.StreamInfo(ProductStream); err != nil || info.State.Msgs != 2 {
+		t.Errorf("Expected 2 events in the stream; Got %v, %v", info, err)
+	}
+}
+
+func TestPublisherLegacySubjectFails(t *testing.T) {
+	natsServer := runTestNatsServer(t)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %s", err)
+	}
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: ProductStream, Subjects: []string{"mms.>"}}); err != nil {
+		t.Fatalf("failed to create stream: %s", err)
+	}
+
+	publisher, err := NewPublisher(natsServer.ClientURL(), nil, ProductStream, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+	defer publisher.Close()
+	publisher.SetLegacySubjects(true)
+
+	// The stream does not take the legacy subject, but the event is published on its own subject, and is not
+	// sent again there by a retry.
+	if err := publisher.PublishProductEvent(context.Background(), &ProductEvent{ProductionHub: "test-hub", Product: "test", EventID: "test-id"}, "mms"); err != nil {
+		t.Errorf("Expected a failure on the legacy subject to be ignored; Got %s", err)
+	}
+	if info, err := js.StreamInfo(ProductStream); err != nil || info.State.Msgs != 1 {
+		t.Errorf("Expected the event in the stream; Got %v, %v", info, err)
+	}
+	if failed := testutil.ToFloat64(publisher.Metrics().failures.WithLabelValues("mms")); failed != 1 {
+		t.Errorf("Expected the failure to be counted; Got %v", failed)
+	}
+}
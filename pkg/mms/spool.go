@@ -0,0 +1,291 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// spoolRejectedDir is the directory below the spool directory where events the production hub rejects are moved.
+const spoolRejectedDir = "rejected"
+
+// Spool is a directory keeping events that could not be posted to a production hub, one JSON file per event,
+// so they can be posted later in the order they were spooled.
+type Spool struct {
+	dir string
+}
+
+// SpooledEvent is an event waiting in a Spool.
+type SpooledEvent struct {
+	QueueName string        `json:"queueName"`
+	Event     *ProductEvent `json:"event"`
+	SpooledAt time.Time     `json:"spooledAt"`
+	Error     string        `json:"error"` // Why the event could not be posted.
+
+	file string
+}
+
+// NewSpool opens the spool in dir, creating the directory if needed.
+func NewSpool(dir string) (*Spool, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("empty spool directory")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, spoolRejectedDir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Dir gives the directory of the spool.
+func (spool *Spool) Dir() string {
+	return spool.dir
+}
+
+// Post posts pEvent with client, and spools it if the production hub can not be reached or is temporarily failing.
+// It returns whether the event was spooled. Events the production hub rejects, e.g. with an invalid API key, are not spooled.
+// The events already in the spool are posted first, and while they can not be, pEvent is spooled behind them.
+// An event without an EventID gets a random one, so it is only published once however often it is posted.
+func (spool *Spool) Post(ctx context.Context, client *Client, queueName string, pEvent *ProductEvent) (bool, error) {
+	if pEvent.EventID == "" {
+		pEvent.EventID = uuid.New().String()
+	}
+
+	if _, flushErr := spool.Flush(ctx, client); flushErr != nil {
+		if err := spool.Add(queueName, pEvent, flushErr); err != nil {
+			return false, fmt.Errorf("%v, and failed to spool the event: %v", flushErr, err)
+		}
+		return true, spooledBehindError(flushErr)
+	}
+
+	_, postErr := client.PostProductEvent(ctx, queueName, pEvent)
+	if postErr == nil || !temporaryError(postErr) {
+		return false, postErr
+	}
+
+	if err := spool.Add(queueName, pEvent, postErr); err != nil {
+		return false, fmt.Errorf("%v, and failed to spool the event: %v", postErr, err)
+	}
+	return true, nil
+}
+
+// PostBatch posts events with client in batches of MaxBatchEvents, see Client.PostProductEvents. If a batch can not be posted
+// because the production hub can not be reached or is temporarily failing, the events of that batch and the following batches
+// are spooled in order. As with Post, the events already in the spool are posted first, or the events are spooled behind them.
+// It returns the number of spooled events. Events without an EventID get a random one.
+func (spool *Spool) PostBatch(ctx context.Context, client *Client, queueName string, events []*ProductEvent) (int, error) {
+	for _, pEvent := range events {
+		if pEvent.EventID == "" {
+			pEvent.EventID = uuid.New().String()
+		}
+	}
+
+	if _, flushErr := spool.Flush(ctx, client); flushErr != nil {
+		for i, pEvent := range events {
+			if err := spool.Add(queueName, pEvent, flushErr); err != nil {
+				return i, fmt.Errorf("%v, and failed to spool the events: %v", flushErr, err)
+			}
+		}
+		return len(events), spooledBehindError(flushErr)
+	}
+
+	for start := 0; start < len(events); start += MaxBatchEvents {
+		end := start + MaxBatchEvents
+		if end > len(events) {
+			end = len(events)
+		}
+
+		_, postErr := client.PostProductEvents(ctx, queueName, events[start:end])
+		if postErr == nil {
+			continue
+		}
+		if !temporaryError(postErr) {
+			return 0, postErr
+		}
+
+		for i, pEvent := range events[start:] {
+			if err := spool.Add(queueName, pEvent, postErr); err != nil {
+				return i, fmt.Errorf("%v, and failed to spool the events: %v", postErr, err)
+			}
+		}
+		return len(events) - start, nil
+	}
+	return 0, nil
+}
+
+// spooledBehindError gives the error of events spooled behind events that could not be flushed. Only the production hub
+// being unreachable or temporarily failing is expected, anything else needs to be looked into.
+func spooledBehindError(flushErr error) error {
+	if temporaryError(flushErr) {
+		return nil
+	}
+	return fmt.Errorf("spooled behind events that can not be posted: %v", flushErr)
+}
+
+// Add writes pEvent to the spool. postErr tells why it could not be posted.
+func (spool *Spool) Add(queueName string, pEvent *ProductEvent, postErr error) error {
+	spooled := SpooledEvent{QueueName: queueName, Event: pEvent, SpooledAt: time.Now().UTC()}
+	if postErr != nil {
+		spooled.Error = postErr.Error()
+	}
+	payload, err := json.Marshal(spooled)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spooled event: %v", err)
+	}
+
+	// The names sort in the order the events are spooled. The random suffix keeps concurrent jobs from overwriting each other.
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write to a temporary file first, so a flush never reads a half written event.
+	tmpFile, err := os.CreateTemp(spool.dir, ".spool-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(payload); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(spool.dir, name)); err != nil {
+		return fmt.Errorf("failed to add event to spool: %v", err)
+	}
+	return nil
+}
+
+// List gives the spooled events, oldest first.
+func (spool *Spool) List() ([]*SpooledEvent, error) {
+	entries, err := os.ReadDir(spool.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var spooled []*SpooledEvent
+	for _, name := range names {
+		file := filepath.Join(spool.dir, name)
+		payload, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			// Flushed by someone else in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spooled event: %v", err)
+		}
+
+		spooledEvent := SpooledEvent{file: file}
+		if err := json.Unmarshal(payload, &spooledEvent); err != nil || spooledEvent.Event == nil {
+			log.Printf("moving invalid spool file %s to %s", name, spoolRejectedDir)
+			spool.reject(file)
+			continue
+		}
+		spooled = append(spooled, &spooledEvent)
+	}
+	return spooled, nil
+}
+
+// Flush posts the spooled events with client in the order they were spooled, and removes them from the spool once posted.
+// It stops at the first event that still can not be posted, so the events are not delivered out of order.
+// Events the production hub rejects as invalid are moved to the rejected directory of the spool. Any other error, such as
+// an API key that is not authorized, stops the flush and keeps the event. It returns the number of posted events.
+func (spool *Spool) Flush(ctx context.Context, client *Client) (int, error) {
+	spooled, err := spool.List()
+	if err != nil {
+		return 0, err
+	}
+
+	posted := 0
+	for _, spooledEvent := range spooled {
+		_, err := client.PostProductEvent(ctx, spooledEvent.QueueName, spooledEvent.Event)
+		if err != nil && invalidEventError(err) {
+			log.Printf("production hub rejected spooled event %s, moving it to %s: %v", spooledEvent.Event.EventID, spoolRejectedDir, err)
+			spool.reject(spooledEvent.file)
+			continue
+		}
+		if err != nil {
+			return posted, fmt.Errorf("failed to post spooled event %s: %w", spooledEvent.Event.EventID, err)
+		}
+
+		if err := os.Remove(spooledEvent.file); err != nil && !os.IsNotExist(err) {
+			return posted, fmt.Errorf("failed to remove posted event from spool: %v", err)
+		}
+		posted++
+	}
+	return posted, nil
+}
+
+// Run flushes the spool every interval until ctx is done.
+func (spool *Spool) Run(ctx context.Context, client *Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		posted, err := spool.Flush(ctx, client)
+		if posted > 0 {
+			log.Printf("posted %d spooled events", posted)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to flush spool, trying again in %s: %v", interval, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// invalidEventError reports whether err is the production hub rejecting an event as invalid, which posting it again will not change.
+func invalidEventError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest
+}
+
+func (spool *Spool) reject(file string) {
+	if err := os.Rename(file, filepath.Join(spool.dir, spoolRejectedDir, filepath.Base(file))); err != nil {
+		log.Printf("failed to move %s to %s: %v", file, spoolRejectedDir, err)
+	}
+}
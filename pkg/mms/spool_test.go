@@ -0,0 +1,173 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHub is a production hub that can be taken down, and records the products of the events posted to it.
+type testHub struct {
+	mu       sync.Mutex
+	status   int
+	products []string
+}
+
+func (hub *testHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	pEvent := ProductEvent{}
+	json.NewDecoder(r.Body).Decode(&pEvent)
+	if pEvent.Product == "rejected" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if hub.status != 0 {
+		w.WriteHeader(hub.status)
+		return
+	}
+	hub.products = append(hub.products, pEvent.Product)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (hub *testHub) setStatus(status int) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.status = status
+}
+
+func newTestSpool(t *testing.T) (*Spool, *testHub, *Client) {
+	spool, err := NewSpool(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatalf("failed to create spool: %s", err)
+	}
+	hub := &testHub{}
+	ts := httptest.NewServer(hub)
+	t.Cleanup(ts.Close)
+	client, err := NewClient(ts.URL, ClientConfig{Retries: 1, RetryWait: time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return spool, hub, client
+}
+
+func TestSpoolPost(t *testing.T) {
+	spool, hub, client := newTestSpool(t)
+
+	hub.setStatus(http.StatusServiceUnavailable)
+	for _, product := range []string{"rejected", "a", "b"} {
+		pEvent := ProductEvent{ProductionHub: "test-hub", Product: product}
+		spooled, err := spool.Post(context.Background(), client, "mms", &pEvent)
+		if product == "rejected" {
+			if err == nil || spooled {
+				t.Errorf("Expected a rejected event not to be spooled; Got %v, %v", spooled, err)
+			}
+			continue
+		}
+		if err != nil || !spooled || pEvent.EventID == "" {
+			t.Errorf("Expected %s to be spooled with an event id; Got %v, %v, %q", product, spooled, err, pEvent.EventID)
+		}
+	}
+
+	spooledEvents, err := spool.List()
+	if err != nil || len(spooledEvents) != 2 {
+		t.Fatalf("Expected 2 spooled events; Got %v, %v", spooledEvents, err)
+	}
+	if spooledEvents[0].Event.Product != "a" || spooledEvents[1].Event.Product != "b" || spooledEvents[0].QueueName != "mms" || spooledEvents[0].Error == "" {
+		t.Errorf("Expected a and b in order, with the error; Got %+v and %+v", spooledEvents[0], spooledEvents[1])
+	}
+
+	hub.setStatus(0)
+	pEvent := ProductEvent{ProductionHub: "test-hub", Product: "c"}
+	if spooled, err := spool.Post(context.Background(), client, "mms", &pEvent); err != nil || spooled {
+		t.Errorf("Expected c to be posted; Got %v, %v", spooled, err)
+	}
+	// The spooled events are posted before c, so they arrive in order.
+	if fmt.Sprint(hub.products) != "[a b c]" {
+		t.Errorf("Expected a, b and c to be posted in order; Got %v", hub.products)
+	}
+}
+
+func TestSpoolPostBehindSpooled(t *testing.T) {
+	spool, hub, client := newTestSpool(t)
+	if err := spool.Add("mms", &ProductEvent{ProductionHub: "test-hub", Product: "a", EventID: "a"}, nil); err != nil {
+		t.Fatalf("failed to spool a: %s", err)
+	}
+
+	// While the hub is down, the batch waits behind a, even if the hub comes back before it would have been posted.
+	hub.setStatus(http.StatusServiceUnavailable)
+	events := []*ProductEvent{{ProductionHub: "test-hub", Product: "b"}, {ProductionHub: "test-hub", Product: "c"}}
+	if spooled, err := spool.PostBatch(context.Background(), client, "mms", events); err != nil || spooled != 2 {
+		t.Errorf("Expected b and c to be spooled; Got %d, %v", spooled, err)
+	}
+
+	hub.setStatus(0)
+	pEvent := ProductEvent{ProductionHub: "test-hub", Product: "d"}
+	if spooled, err := spool.Post(context.Background(), client, "mms", &pEvent); err != nil || spooled {
+		t.Errorf("Expected d to be posted; Got %v, %v", spooled, err)
+	}
+	if fmt.Sprint(hub.products) != "[a b c d]" {
+		t.Errorf("Expected a, b, c and d to be posted in order; Got %v", hub.products)
+	}
+}
+
+func TestSpoolFlush(t *testing.T) {
+	spool, hub, client := newTestSpool(t)
+	for i, product := range []string{"a", "rejected", "b", "c"} {
+		if err := spool.Add("mms", &ProductEvent{ProductionHub: "test-hub", Product: product, EventID: fmt.Sprint(i)}, nil); err != nil {
+			t.Fatalf("failed to spool %s: %s", product, err)
+		}
+	}
+
+	// Nothing is posted while the hub is down.
+	hub.setStatus(http.StatusServiceUnavailable)
+	if posted, err := spool.Flush(context.Background(), client); err == nil || posted != 0 {
+		t.Errorf("Expected the flush to fail; Got %d posted, %v", posted, err)
+	}
+
+	// Nor with an API key that is not authorized, which may be fixed, so the events are kept.
+	hub.setStatus(http.StatusUnauthorized)
+	if posted, err := spool.Flush(context.Background(), client); err == nil || posted != 0 {
+		t.Errorf("Expected the flush to fail; Got %d posted, %v", posted, err)
+	}
+	if spooledEvents, err := spool.List(); err != nil || len(spooledEvents) != 4 {
+		t.Errorf("Expected the events to be kept; Got %v, %v", spooledEvents, err)
+	}
+
+	hub.setStatus(0)
+	posted, err := spool.Flush(context.Background(), client)
+	if err != nil || posted != 3 || fmt.Sprint(hub.products) != "[a b c]" {
+		t.Errorf("Expected a, b and c to be posted in order; Got %d posted, %v, %v", posted, hub.products, err)
+	}
+
+	if spooledEvents, err := spool.List(); err != nil || len(spooledEvents) != 0 {
+		t.Errorf("Expected an empty spool; Got %v, %v", spooledEvents, err)
+	}
+	if rejected, _ := os.ReadDir(filepath.Join(spool.Dir(), spoolRejectedDir)); len(rejected) != 1 {
+		t.Errorf("Expected the rejected event to be moved aside; Got %v", rejected)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StreamReconnectWait is the time to wait before reconnecting to a broken event stream.
+var StreamReconnectWait = 5 * time.Second
+
+// StreamProductEvents receives events from the Server-Sent Events stream of mmsd at streamURL,
+// i.e. <production hub>/api/v1/events/stream, and calls callback for each of them.
+// Only the Product, ProductionHub and JobName parts of filter are used.
+// Broken connections are resumed from the last received event id, which mmsd sends when the stream is opened, so no events
+// are missed even if the connection breaks before the first one. It returns when ctx is cancelled.
+func StreamProductEvents(ctx context.Context, streamURL string, filter EventFilter, callback ProductEventCallback) error {
+	query := EventFilter{
+		Product:       filter.Product,
+		ProductionHub: filter.ProductionHub,
+		JobName:       filter.JobName,
+	}.QueryValues().Encode()
+	if query != "" {
+		streamURL = streamURL + "?" + query
+	}
+
+	lastEventID := ""
+	for {
+		err := readEventStream(ctx, streamURL, &lastEventID, callback)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("event stream failed, reconnecting in %s: %s", StreamReconnectWait, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(StreamReconnectWait):
+		}
+	}
+}
+
+// readEventStream reads one connection of the event stream until it breaks, updating lastEventID as it goes.
+func readEventStream(ctx context.Context, streamURL string, lastEventID *string, callback ProductEventCallback) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+	if *lastEventID != "" {
+		httpReq.Header.Set("Last-Event-ID", *lastEventID)
+	}
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(httpResp.Body)
+		return fmt.Errorf("GET %s failed with status: %s . Response body: %s", streamURL, httpResp.Status, string(b))
+	}
+
+	var id, eventType string
+	var data []string
+	scanner := bufio.NewScanner(httpResp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// End of one event.
+			if len(data) > 0 && (eventType == "" || eventType == "product") {
+				if pEvent, err := decodeStreamedEvent([]byte(strings.Join(data, "\n"))); err != nil {
+					log.Printf("failed to decode streamed event: %v", err)
+				} else if err := callback(pEvent); err != nil {
+					log.Printf("failed to handle streamed event: %v", err)
+				}
+			}
+			if id != "" {
+				*lastEventID = id
+			}
+			id, eventType, data = "", "", nil
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event stream: %v", err)
+	}
+	return fmt.Errorf("event stream closed by server")
+}
+
+// decodeStreamedEvent decodes the data of a streamed event, {"id": 1, "event": {...}}, or the bare event sent by older
+// versions of mmsd.
+func decodeStreamedEvent(data []byte) (*ProductEvent, error) {
+	var streamed struct {
+		Event *ProductEvent `json:"event"`
+	}
+	if err := json.Unmarshal(data, &streamed); err != nil {
+		return nil, err
+	}
+	if streamed.Event != nil {
+		return streamed.Event, nil
+	}
+
+	pEvent := ProductEvent{}
+	if err := json.Unmarshal(data, &pEvent); err != nil {
+		return nil, err
+	}
+	return &pEvent, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamProductEvents(t *testing.T) {
+	StreamReconnectWait = 10 * time.Millisecond
+
+	// The server first only tells the client the id to resume from, and then sends one event per connection and closes it,
+	// so the client has to resume.
+	lastEventIDs := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("product") != "arome*" {
+			t.Errorf("Expected product filter arome*; Got %s", r.URL.RawQuery)
+		}
+		lastEventID := r.Header.Get("Last-Event-ID")
+		lastEventIDs <- lastEventID
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, ": keep-alive\n\n")
+		if lastEventID == "" {
+			fmt.Fprintf(w, "id: 3\n\n")
+			return
+		}
+		id := 0
+		fmt.Sscanf(lastEventID, "%d", &id)
+		id++
+		data := fmt.Sprintf(`{"id": %d, "event": {"Product": "arome_%d"}}`, id, id)
+		if id == 5 {
+			// Older versions of mmsd send the bare event.
+			data = fmt.Sprintf(`{"Product": "arome_%d"}`, id)
+		}
+		fmt.Fprintf(w, "id: %d\nevent: product\ndata: %s\n\n", id, data)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- StreamProductEvents(ctx, ts.URL, EventFilter{Product: "arome*"}, func(e *ProductEvent) error {
+			received <- e.Product
+			return nil
+		})
+	}()
+
+	for _, expected := range []string{"arome_4", "arome_5"} {
+		select {
+		case product := <-received:
+			if product != expected {
+				t.Errorf("Expected %s; Got %s", expected, product)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s before timeout", expected)
+		}
+	}
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected no errors after cancel; Got %s", err)
+	}
+	if first, second, third := <-lastEventIDs, <-lastEventIDs, <-lastEventIDs; first != "" || second != "3" || third != "4" {
+		t.Errorf("Expected the connections to resume from 3 and 4; Got %q, %q and %q", first, second, third)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import "strings"
+
+// DefaultSubjectPrefix is the first token of the subjects product events are published on,
+// used when no queue name is given.
+const DefaultSubjectPrefix = "mms"
+
+// ProductSubject gives the NATS subject a product event is published on: <prefix>.<hub>.<product>,
+// so subscribers can let the NATS server filter on production hub and product.
+// Characters that are not allowed in subject tokens are replaced, see SubjectToken.
+func ProductSubject(prefix string, productionHub string, product string) string {
+	if prefix == "" {
+		prefix = DefaultSubjectPrefix
+	}
+	return prefix + "." + SubjectToken(productionHub) + "." + SubjectToken(product)
+}
+
+// SubscriptionSubject gives the NATS subject to subscribe to for events from productionHub about product.
+// Both may contain wildcards as in EventFilter. An empty pattern, or one that is not a whole subject token
+// such as arome_*, becomes the * wildcard, and the events must be filtered further with EventFilter.Matches.
+func SubscriptionSubject(prefix string, productionHub string, product string) string {
+	if prefix == "" {
+		prefix = DefaultSubjectPrefix
+	}
+	return prefix + "." + subscriptionToken(productionHub) + "." + subscriptionToken(product)
+}
+
+// SubjectToken replaces the characters of name that are not letters, digits, - or _ with _,
+// which makes it usable as a single token of a NATS subject. Different names may give the same token.
+func SubjectToken(name string) string {
+	if name == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func subscriptionToken(pattern string) string {
+	if pattern == "" || strings.ContainsAny(pattern, "*?[") {
+		return "*"
+	}
+	return SubjectToken(pattern)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import "testing"
+
+func TestProductSubject(t *testing.T) {
+	for _, test := range []struct {
+		prefix, hub, product, expected string
+	}{
+		{"mms", "ppi", "arome_arctic", "mms.ppi.arome_arctic"},
+		{"", "ppi", "arome_arctic", "mms.ppi.arome_arctic"},
+		{"mms", "met.no", "arome arctic/full", "mms.met_no.arome_arctic_full"},
+		{"mms", "ppi", "a*>b", "mms.ppi.a__b"},
+		{"mms", "ppi", "", "mms.ppi._"},
+		{"test.mms", "ppi", "æøå", "test.mms.ppi.___"},
+	} {
+		if subject := ProductSubject(test.prefix, test.hub, test.product); subject != test.expected {
+			t.Errorf("Expected %s for %q, %q, %q; Got %s", test.expected, test.prefix, test.hub, test.product, subject)
+		}
+	}
+}
+
+func TestSubscriptionSubject(t *testing.T) {
+	for _, test := range []struct {
+		hub, product, expected string
+	}{
+		{"", "", "mms.*.*"},
+		{"ppi", "", "mms.ppi.*"},
+		{"", "arome_arctic", "mms.*.arome_arctic"},
+		{"ppi", "arome_*", "mms.ppi.*"},
+		{"*", "arome.arctic", "mms.*.arome_arctic"},
+	} {
+		if subject := SubscriptionSubject("mms", test.hub, test.product); subject != test.expected {
+			t.Errorf("Expected %s for %q, %q; Got %s", test.expected, test.hub, test.product, subject)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Subscription is a handle to a running event receiver started by EventClient.Subscribe.
+type Subscription struct {
+	eClient *EventClient
+	cancel  context.CancelFunc
+	done    chan struct{}
+	errs    chan error
+
+	mu        sync.Mutex
+	err       error
+	stopping  bool
+	closeOnce sync.Once
+}
+
+// Subscribe starts receiving events in the background and calls callback for each incoming product event.
+// The subscription ends when ctx is cancelled, when Close or Drain is called, or when the underlying
+// NATS connection is closed for good. Errors that end the subscription are sent on Errors().
+func (eClient *EventClient) Subscribe(ctx context.Context, callback ProductEventCallback) (*Subscription, error) {
+	if eClient.ceClient == nil && eClient.jsConsumer == nil {
+		return nil, fmt.Errorf("event client is not initialised")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		eClient: eClient,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		errs:    make(chan error, 1),
+	}
+
+	if eClient.conn != nil {
+		eClient.conn.SetClosedHandler(func(conn *nats.Conn) {
+			if sub.isStopping() {
+				return
+			}
+			if err := conn.LastError(); err != nil {
+				sub.fail(fmt.Errorf("nats connection closed: %v", err))
+			} else {
+				sub.fail(fmt.Errorf("nats connection closed"))
+			}
+			cancel()
+		})
+	}
+
+	go func() {
+		defer close(sub.done)
+		defer close(sub.errs)
+		defer cancel()
+
+		var err error
+		if eClient.jsConsumer != nil {
+			err = eClient.jsConsumer.receive(ctx, callback)
+		} else {
+			err = eClient.ceClient.StartReceiver(ctx, productReceiver(callback))
+		}
+		if err != nil {
+			sub.fail(fmt.Errorf("event receiver stopped: %v", err))
+		}
+
+		// The receiver has returned, so closing the connection from here on is expected.
+		sub.stop()
+		if err := sub.closeConsumer(); err != nil {
+			sub.fail(err)
+		}
+
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if sub.err != nil {
+			sub.errs <- sub.err
+		}
+	}()
+
+	return sub, nil
+}
+
+// fail records the first terminal error of the subscription.
+func (sub *Subscription) fail(err error) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.err != nil {
+		return
+	}
+	sub.err = err
+}
+
+// Errors returns a channel that receives at most one terminal error and is closed when the subscription ends.
+func (sub *Subscription) Errors() <-chan error {
+	return sub.errs
+}
+
+// Done returns a channel that is closed when the subscription has ended.
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Err returns the terminal error of the subscription, or nil if it was stopped on purpose or is still running.
+func (sub *Subscription) Err() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.err
+}
+
+// Wait blocks until the subscription has ended and returns its terminal error, if any.
+func (sub *Subscription) Wait() error {
+	<-sub.done
+	return sub.Err()
+}
+
+// Close stops the subscription at once and closes the NATS connection, without waiting for running callbacks.
+func (sub *Subscription) Close() error {
+	sub.stop()
+	sub.cancel()
+	return sub.closeConsumer()
+}
+
+// Drain stops receiving new events, waits for running callbacks to finish and then closes the NATS connection.
+// If ctx expires before the callbacks are done, the connection is closed anyway and the context error is returned.
+func (sub *Subscription) Drain(ctx context.Context) error {
+	sub.stop()
+	sub.cancel()
+
+	var err error
+	select {
+	case <-sub.done:
+	case <-ctx.Done():
+		err = fmt.Errorf("failed to drain subscription: %v", ctx.Err())
+	}
+
+	if cerr := sub.closeConsumer(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sub *Subscription) stop() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.stopping = true
+}
+
+func (sub *Subscription) isStopping() bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.stopping
+}
+
+func (sub *Subscription) closeConsumer() error {
+	var err error
+	sub.closeOnce.Do(func() {
+		if sub.eClient.consumer == nil {
+			return
+		}
+		if cerr := sub.eClient.consumer.Close(context.Background()); cerr != nil {
+			err = fmt.Errorf("failed to close nats consumer: %v", cerr)
+		}
+	})
+	return err
+}
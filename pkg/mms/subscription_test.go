@@ -0,0 +1,95 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol/gochan"
+)
+
+func TestSubscribe(t *testing.T) {
+	ceClient, err := cloudevents.NewClient(gochan.New())
+	if err != nil {
+		t.Fatalf("failed to create gochan cloudevents client: %s", err)
+	}
+	eClient := &EventClient{ceClient: ceClient}
+
+	received := make(chan *ProductEvent, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := eClient.Subscribe(ctx, func(e *ProductEvent) error {
+		received <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+
+	if err := eClient.EmitProductEventMessage(&ProductEvent{ProductionHub: "test-hub", Product: "test"}); err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+
+	select {
+	case e := <-received:
+		if e.Product != "test" {
+			t.Errorf("Expected Product test; Got %s", e.Product)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an event to be received before timeout")
+	}
+
+	cancel()
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the subscription to end after the context was cancelled")
+	}
+
+	if err := sub.Wait(); err != nil {
+		t.Errorf("Expected no terminal error after cancel; Got %s", err)
+	}
+	if _, ok := <-sub.Errors(); ok {
+		t.Errorf("Expected the errors channel to be closed without errors")
+	}
+}
+
+func TestSubscriptionDrain(t *testing.T) {
+	ceClient, err := cloudevents.NewClient(gochan.New())
+	if err != nil {
+		t.Fatalf("failed to create gochan cloudevents client: %s", err)
+	}
+	eClient := &EventClient{ceClient: ceClient}
+
+	sub, err := eClient.Subscribe(context.Background(), func(e *ProductEvent) error { return nil })
+	if err != nil {
+		t.Fatalf("Expected no errors; Got %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sub.Drain(ctx); err != nil {
+		t.Errorf("Expected no errors from Drain; Got %s", err)
+	}
+
+	// Closing an already drained subscription is a no-op.
+	if err := sub.Close(); err != nil {
+		t.Errorf("Expected no errors from Close; Got %s", err)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the RFC 3339 and ISO 8601 forms accepted by ParseTime, tried in order.
+// Fractional seconds are accepted after the seconds of any of them.
+var timeLayouts = []string{
+	time.RFC3339Nano,            // 2006-01-02T15:04:05.999999999Z07:00
+	"2006-01-02T15:04:05Z0700",  // ISO 8601 offset without colon
+	"2006-01-02T15:04:05Z07",    // ISO 8601 offset in hours
+	"2006-01-02T15:04:05",       // No offset, UTC
+	"2006-01-02 15:04:05Z07:00", // RFC 3339 allows a space instead of T
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04Z07:00", // Without seconds
+	"2006-01-02T15:04",
+	"20060102T150405Z0700", // ISO 8601 basic format
+	"20060102T150405",
+	"2006-01-02", // Date only, midnight UTC
+	"20060102",
+}
+
+// ParseTime parses a time in RFC 3339 or ISO 8601 format, with or without offset, fractional seconds or seconds,
+// or just a date. Times without offset are UTC. The returned time is in UTC.
+func ParseTime(value string) (time.Time, error) {
+	// RFC 3339 allows a lower case t and z.
+	value = strings.ToUpper(strings.TrimSpace(value))
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 such as 2006-01-02T15:04:05Z or 2006-01-02T15:04:05+01:00, or a date such as 2006-01-02", value)
+}
+
+// ParseRelativeTime parses a time like ParseTime, or relative to now: now, today, yesterday or tomorrow,
+// where the last three are midnight UTC. They may be followed by an offset such as today+06h, now-30m or today-1d.
+// The offset is a duration as in time.ParseDuration, which may also start with a number of days.
+func ParseRelativeTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	today := now.UTC().Truncate(24 * time.Hour)
+	for _, ref := range []struct {
+		name string
+		time time.Time
+	}{
+		{"now", now.UTC()},
+		{"today", today},
+		{"yesterday", today.AddDate(0, 0, -1)},
+		{"tomorrow", today.AddDate(0, 0, 1)},
+	} {
+		if !strings.HasPrefix(strings.ToLower(value), ref.name) {
+			continue
+		}
+		offset, err := parseTimeOffset(value[len(ref.name):])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q: %v", value, err)
+		}
+		return ref.time.Add(offset), nil
+	}
+	return ParseTime(value)
+}
+
+// parseTimeOffset parses an offset such as +06h, -1d12h or the empty string.
+func parseTimeOffset(offset string) (time.Duration, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	sign := time.Duration(1)
+	switch offset[0] {
+	case '+':
+	case '-':
+		sign = -1
+	default:
+		return 0, fmt.Errorf("offset must start with + or -")
+	}
+	duration := offset[1:]
+	if duration == "" {
+		return 0, fmt.Errorf("missing duration after %c", offset[0])
+	}
+	d, err := ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset, use a duration such as 06h or 1d12h")
+	}
+	return sign * d, nil
+}
+
+// ParseDuration parses a duration as in time.ParseDuration, which may also start with a number of days, such as 30d or 1d12h.
+// Negative durations are not accepted.
+func ParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var days time.Duration
+	if i := strings.IndexByte(value, 'd'); i > 0 {
+		n, err := strconv.Atoi(value[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days in duration %q", value)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		value = value[i+1:]
+	}
+	if value == "" {
+		return days, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, use a duration such as 06h or 1d12h", value)
+	}
+	return days + d, nil
+}
+
+// FormatTime formats t in UTC with the DefaultTimeFormat, in whole seconds, as product event times always have been.
+// Fractional seconds are dropped, so subscribers that only parse whole seconds keep working.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(DefaultTimeFormat)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020–2021 MET Norway
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRoundTrip(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"2021-03-01T06:00:00Z":                time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01t06:00:00z":                time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T07:00:00+01:00":           time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T01:30:00-04:30":           time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00:00.123456789Z":      time.Date(2021, 3, 1, 6, 0, 0, 123456789, time.UTC),
+		"2021-03-01T08:00:00.5+02:00":         time.Date(2021, 3, 1, 6, 0, 0, 500000000, time.UTC),
+		"2021-03-01T07:00:00+0100":            time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T07:00:00+01":              time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00:00":                 time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01 07:00:00+01:00":           time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01 06:00:00":                 time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00Z":                   time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00":                    time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"20210301T070000+0100":                time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"20210301T060000":                     time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01":                          time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		"20210301":                            time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		" 2021-03-01T06:00:00Z ":              time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00:00.000000001+00:00": time.Date(2021, 3, 1, 6, 0, 0, 1, time.UTC),
+	} {
+		parsed, err := ParseTime(value)
+		if err != nil {
+			t.Errorf("Expected no errors for %q; Got %s", value, err)
+			continue
+		}
+		if !parsed.Equal(expected) || parsed.Location() != time.UTC {
+			t.Errorf("Expected %s for %q; Got %s", expected, value, parsed)
+		}
+
+		// Times are formatted in whole seconds.
+		formatted := FormatTime(parsed)
+		reparsed, err := ParseTime(formatted)
+		if err != nil || !reparsed.Equal(expected.Truncate(time.Second)) {
+			t.Errorf("Expected %q formatted as %q to parse as %s; Got %s, %v", value, formatted, expected.Truncate(time.Second), reparsed, err)
+		}
+	}
+}
+
+func TestParseTimeInvalid(t *testing.T) {
+	for _, value := range []string{"", "now", "2021-13-01", "2021-03-01T25:00:00Z", "2021-03-01T06:00:00+25:00", "01.03.2021"} {
+		if _, err := ParseTime(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseRelativeTime(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 34, 56, 0, time.FixedZone("CET", 3600))
+	for value, expected := range map[string]time.Time{
+		"now":                  time.Date(2021, 3, 1, 11, 34, 56, 0, time.UTC),
+		"NOW-30m":              time.Date(2021, 3, 1, 11, 4, 56, 0, time.UTC),
+		"today":                time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		"today+06h":            time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+		"today-1d":             time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC),
+		"today+1d12h":          time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC),
+		"yesterday+18h":        time.Date(2021, 2, 28, 18, 0, 0, 0, time.UTC),
+		"tomorrow":             time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+		"2021-03-01T06:00:00Z": time.Date(2021, 3, 1, 6, 0, 0, 0, time.UTC),
+	} {
+		parsed, err := ParseRelativeTime(value, now)
+		if err != nil {
+			t.Errorf("Expected no errors for %q; Got %s", value, err)
+			continue
+		}
+		if !parsed.Equal(expected) || parsed.Location() != time.UTC {
+			t.Errorf("Expected %s for %q; Got %s", expected, value, parsed)
+		}
+	}
+
+	for _, value := range []string{"today06h", "today+", "today+-6h", "today+xd", "now+1y", "someday"} {
+		if _, err := ParseRelativeTime(value, now); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"2h":    2 * time.Hour,
+		"30d":   30 * 24 * time.Hour,
+		"1d12h": 36 * time.Hour,
+	} {
+		if d, err := ParseDuration(value); err != nil || d != expected {
+			t.Errorf("Expected %s for %q; Got %s, %v", expected, value, d, err)
+		}
+	}
+
+	for _, value := range []string{"", "-2h", "xd", "-1d", "1y"} {
+		if _, err := ParseDuration(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestPEventTimeJSON(t *testing.T) {
+	for value, expected := range map[string]string{
+		`"2021-03-01T06:00:00Z"`:              `"2021-03-01T06:00:00Z"`,
+		`"2021-03-01T07:00:00+01:00"`:         `"2021-03-01T06:00:00Z"`,
+		`"2021-03-01T08:00:00.25+02:00"`:      `"2021-03-01T06:00:00Z"`,
+		`"2021-03-01T06:00:00.123456789Z"`:    `"2021-03-01T06:00:00Z"`,
+		`"2021-03-01"`:                        `"2021-03-01T00:00:00Z"`,
+		`"2021-03-01T06:00:00.000000000Z"`:    `"2021-03-01T06:00:00Z"`,
+		`"2020-08-26T12:18:48.281847242Z"`:    `"2020-08-26T12:18:48Z"`,
+		`"2020-08-26T12:18:48.28184724-0230"`: `"2020-08-26T14:48:48Z"`,
+	} {
+		var pt PEventTime
+		if err := json.Unmarshal([]byte(value), &pt); err != nil {
+			t.Errorf("Expected no errors for %s; Got %s", value, err)
+			continue
+		}
+		marshalled, err := json.Marshal(pt)
+		if err != nil || string(marshalled) != expected {
+			t.Errorf("Expected %s for %s; Got %s, %v", expected, value, marshalled, err)
+		}
+
+		// Fractional seconds are dropped.
+		var reparsed PEventTime
+		if err := json.Unmarshal(marshalled, &reparsed); err != nil || !time.Time(reparsed).Equal(time.Time(pt).Truncate(time.Second)) {
+			t.Errorf("Expected %s to round trip; Got %s, %v", marshalled, time.Time(reparsed), err)
+		}
+	}
+
+	var pt PEventTime
+	if err := json.Unmarshal([]byte(`"yesterday"`), &pt); err == nil {
+		t.Errorf("Expected relative times to be invalid in events")
+	}
+}